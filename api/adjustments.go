@@ -0,0 +1,200 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tamir-liebermann/gobank/db"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func adjustmentErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, db.ErrAdjustmentNotFound), errors.Is(err, db.ErrAccountNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, db.ErrAdjustmentClosed), errors.Is(err, db.ErrAdjustmentOverdraw), errors.Is(err, db.ErrAccountErased):
+		return http.StatusConflict
+	case errors.Is(err, db.ErrAdjustmentSelfReview):
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
+
+// @Summary Propose a balance adjustment
+// @Description Propose a manual credit or debit with a reason. It is only posted once a different admin approves it (admin only)
+// @ID create-adjustment
+// @Accept json
+// @Produce json
+// @Param adjustment body CreateAdjustmentRequest true "Adjustment"
+// @Success 201 {object} db.Adjustment
+// @Failure 400 {object} ErrorResponse "Invalid adjustment"
+// @Failure 404 {object} ErrorResponse "Account not found"
+// @Router /admin/adjustments [post]
+// @Security BearerAuth
+func (api *ApiManager) handleCreateAdjustment(ctx *gin.Context) {
+	makerID, err := currentUserID(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	var req CreateAdjustmentRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Bad request"})
+		return
+	}
+
+	accountID, err := api.accMgr.ResolveAccountRef(req.Account)
+	if err != nil {
+		ctx.JSON(accountRefStatus(err), ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	adjustment, err := api.accMgr.CreateAdjustment(db.Adjustment{
+		AccountID:   accountID,
+		Direction:   req.Direction,
+		Amount:      req.Amount,
+		Reason:      req.Reason,
+		RequestedBy: makerID,
+	})
+	if err != nil {
+		status := adjustmentErrorStatus(err)
+		if status == http.StatusInternalServerError {
+			status = http.StatusBadRequest
+		}
+		ctx.JSON(status, ErrorResponse{Message: err.Error()})
+		return
+	}
+	api.audit(ctx, "adjustment.propose", adjustment.ID.Hex(), map[string]string{
+		"account":   accountID.Hex(),
+		"direction": adjustment.Direction,
+		"amount":    formatAmount(adjustment.Amount),
+		"reason":    adjustment.Reason,
+	})
+
+	ctx.JSON(http.StatusCreated, adjustment)
+}
+
+// @Summary List balance adjustments
+// @Description Adjustments waiting for approval by default (admin only)
+// @ID get-adjustments
+// @Produce json
+// @Param status query string false "pending, approved or rejected; 'all' for everything"
+// @Param account query string false "Only adjustments of this account (ID or account number)"
+// @Success 200 {object} AdjustmentsRes
+// @Router /admin/adjustments [get]
+// @Security BearerAuth
+func (api *ApiManager) handleGetAdjustments(ctx *gin.Context) {
+	status := ctx.DefaultQuery("status", db.AdjustmentPending)
+	if status == "all" {
+		status = ""
+	}
+
+	accountID := primitive.NilObjectID
+	if account := ctx.Query("account"); account != "" {
+		var err error
+		if accountID, err = api.accMgr.ResolveAccountRef(account); err != nil {
+			ctx.JSON(accountRefStatus(err), ErrorResponse{Message: err.Error()})
+			return
+		}
+	}
+
+	adjustments, err := api.accMgr.GetAdjustments(status, accountID)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Internal server error"})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, AdjustmentsRes{Adjustments: adjustments})
+}
+
+// @Summary Approve a balance adjustment
+// @Description Post a pending adjustment. The approver must not be the admin who proposed it (admin only)
+// @ID approve-adjustment
+// @Accept json
+// @Produce json
+// @Param adjustment_id path string true "Adjustment ID"
+// @Param review body ReviewAdjustmentRequest false "Review note"
+// @Success 200 {object} db.Adjustment
+// @Failure 403 {object} ErrorResponse "Proposed by the same admin"
+// @Failure 404 {object} ErrorResponse "Adjustment not found"
+// @Failure 409 {object} ErrorResponse "Already reviewed, or the debit would overdraw the account"
+// @Router /admin/adjustments/{adjustment_id}/approve [post]
+// @Security BearerAuth
+func (api *ApiManager) handleApproveAdjustment(ctx *gin.Context) {
+	api.handleReviewAdjustment(ctx, true)
+}
+
+// @Summary Reject a balance adjustment
+// @Description Close a pending adjustment without posting it. The reviewer must not be the admin who proposed it (admin only)
+// @ID reject-adjustment
+// @Accept json
+// @Produce json
+// @Param adjustment_id path string true "Adjustment ID"
+// @Param review body ReviewAdjustmentRequest false "Review note"
+// @Success 200 {object} db.Adjustment
+// @Failure 403 {object} ErrorResponse "Proposed by the same admin"
+// @Failure 404 {object} ErrorResponse "Adjustment not found"
+// @Failure 409 {object} ErrorResponse "Already reviewed"
+// @Router /admin/adjustments/{adjustment_id}/reject [post]
+// @Security BearerAuth
+func (api *ApiManager) handleRejectAdjustment(ctx *gin.Context) {
+	api.handleReviewAdjustment(ctx, false)
+}
+
+func (api *ApiManager) handleReviewAdjustment(ctx *gin.Context, approve bool) {
+	checkerID, err := currentUserID(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	adjustmentID, err := primitive.ObjectIDFromHex(ctx.Param("adjustment_id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Invalid ID format"})
+		return
+	}
+
+	// The note is optional, so an empty body is fine
+	var req ReviewAdjustmentRequest
+	if ctx.Request.ContentLength > 0 {
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Bad request"})
+			return
+		}
+	}
+
+	if !approve {
+		adjustment, err := api.accMgr.RejectAdjustment(adjustmentID, checkerID, req.Note)
+		if err != nil {
+			ctx.JSON(adjustmentErrorStatus(err), ErrorResponse{Message: err.Error()})
+			return
+		}
+		api.audit(ctx, "adjustment.reject", adjustment.ID.Hex(), map[string]string{"note": adjustment.ReviewNote})
+		ctx.JSON(http.StatusOK, adjustment)
+		return
+	}
+
+	adjustment, transaction, err := api.accMgr.ApproveAdjustment(adjustmentID, checkerID, req.Note)
+	if err != nil {
+		ctx.JSON(adjustmentErrorStatus(err), ErrorResponse{Message: err.Error()})
+		return
+	}
+	api.audit(ctx, "adjustment.approve", adjustment.ID.Hex(), map[string]string{
+		"account":     adjustment.AccountID.Hex(),
+		"direction":   adjustment.Direction,
+		"amount":      formatAmount(adjustment.Amount),
+		"transaction": transaction.ID.Hex(),
+		"note":        adjustment.ReviewNote,
+	})
+
+	verb := "credited to"
+	if adjustment.Direction == db.AdjustmentDebit {
+		verb = "debited from"
+	}
+	go api.notifyAccount(adjustment.AccountID, fmt.Sprintf("%.2f was %s your account: %s", adjustment.Amount, verb, adjustment.Reason))
+
+	ctx.JSON(http.StatusOK, adjustment)
+}
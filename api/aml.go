@@ -0,0 +1,274 @@
+package api
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tamir-liebermann/gobank/db"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// screenAML runs after every deposit and transfer and files any suspicious
+// activity into a case for the compliance team.
+func (api *ApiManager) screenAML(accountID primitive.ObjectID) {
+	cases, err := api.accMgr.ScreenAML(accountID)
+	if err != nil {
+		log.Printf("Error running AML screening for %s: %v", accountID.Hex(), err)
+		return
+	}
+	for _, amlCase := range cases {
+		log.Printf("AML case %s (%s, %s) updated for account %s", amlCase.ID.Hex(), amlCase.Kind, amlCase.Window, accountID.Hex())
+	}
+}
+
+// amlCaseFile gathers a case with its account and underlying transactions.
+func (api *ApiManager) amlCaseFile(caseID primitive.ObjectID) (*AMLCaseFileRes, error) {
+	amlCase, err := api.accMgr.GetAMLCaseById(caseID)
+	if err != nil {
+		return nil, err
+	}
+
+	account, err := api.accMgr.SearchAccountById(amlCase.AccountID)
+	if err != nil {
+		return nil, err
+	}
+	if account == nil {
+		return nil, errors.New("account not found")
+	}
+
+	transactions, err := api.accMgr.GetTransactionsByIds(amlCase.TransactionIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AMLCaseFileRes{
+		Case: *amlCase,
+		Account: AMLAccountRes{
+			ID:            account.ID.Hex(),
+			AccountHolder: account.AccountHolder,
+			PhoneNumber:   account.PhoneNumber,
+			CreatedAt:     account.CreatedAt,
+		},
+		Transactions: transactions,
+		GeneratedAt:  time.Now(),
+	}, nil
+}
+
+func writeAMLCaseCSV(ctx *gin.Context, file *AMLCaseFileRes) error {
+	ctx.Header("Content-Type", "text/csv; charset=utf-8")
+	ctx.Header("Content-Disposition", fmt.Sprintf("attachment; filename=aml-case-%s.csv", file.Case.ID.Hex()))
+
+	money := func(amount float64) string { return strconv.FormatFloat(amount, 'f', 2, 64) }
+
+	w := csv.NewWriter(ctx.Writer)
+	rows := [][]string{
+		{"case_id", "account_id", "account_holder", "phone_number", "kind", "window", "total", "limit", "status", "resolution", "generated_at"},
+		{file.Case.ID.Hex(), file.Account.ID, file.Account.AccountHolder, file.Account.PhoneNumber, file.Case.Kind, file.Case.Window,
+			money(file.Case.Total), money(file.Case.Limit), file.Case.Status, file.Case.Resolution, file.GeneratedAt.Format(time.RFC3339)},
+		{},
+		{"transaction_id", "timestamp", "type", "from_account", "to_account", "amount"},
+	}
+	for _, transaction := range file.Transactions {
+		transactionType := transaction.Type
+		if transactionType == "" {
+			transactionType = db.TransactionTransfer
+		}
+		rows = append(rows, []string{transaction.ID.Hex(), transaction.Timestamp.Format(time.RFC3339), transactionType,
+			transaction.FromAccount.Hex(), transaction.ToAccount.Hex(), money(transaction.Amount)})
+	}
+	rows = append(rows, []string{}, []string{"note_author", "note_time", "note"})
+	for _, note := range file.Case.Notes {
+		rows = append(rows, []string{note.AuthorID.Hex(), note.CreatedAt.Format(time.RFC3339), note.Text})
+	}
+
+	if err := w.WriteAll(rows); err != nil {
+		return err
+	}
+	return w.Error()
+}
+
+func amlCaseErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, db.ErrAMLCaseNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, db.ErrAMLCaseClosed):
+		return http.StatusConflict
+	}
+	return http.StatusBadRequest
+}
+
+// @Summary Get AML volumes of an account
+// @Description Cumulative cash-in and transfer volumes over each rolling window (admin only)
+// @ID get-aml-volumes
+// @Produce json
+// @Param id path string true "Account ID or account number"
+// @Success 200 {object} AMLVolumesRes
+// @Failure 400 {object} ErrorResponse "Invalid ID format"
+// @Router /admin/aml/accounts/{id}/volumes [get]
+// @Security BearerAuth
+func (api *ApiManager) handleGetAMLVolumes(ctx *gin.Context) {
+	accountID, err := api.accMgr.ResolveAccountRef(ctx.Param("id"))
+	if err != nil {
+		ctx.JSON(accountRefStatus(err), ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	volumes, err := api.accMgr.GetAMLVolumes(accountID)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Internal server error"})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, AMLVolumesRes{AccountID: accountID.Hex(), Volumes: volumes})
+}
+
+// @Summary List AML cases
+// @Description List suspicious-activity cases, open ones by default (admin only)
+// @ID get-aml-cases
+// @Produce json
+// @Param status query string false "open, closed or all"
+// @Param account_id query string false "Only cases of this account"
+// @Success 200 {object} AMLCasesRes
+// @Router /admin/aml/cases [get]
+// @Security BearerAuth
+func (api *ApiManager) handleGetAMLCases(ctx *gin.Context) {
+	status := ctx.DefaultQuery("status", db.AMLCaseOpen)
+	if status == "all" {
+		status = ""
+	}
+
+	accountID, err := parseOptionalID(ctx.Query("account_id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Invalid ID format"})
+		return
+	}
+
+	cases, err := api.accMgr.GetAMLCases(status, accountID)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Internal server error"})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, AMLCasesRes{Cases: cases})
+}
+
+// @Summary Get an AML case file
+// @Description A case with its account and underlying transactions, as JSON or as a CSV download (admin only)
+// @ID get-aml-case
+// @Produce json
+// @Produce text/csv
+// @Param case_id path string true "Case ID"
+// @Param format query string false "json (default) or csv"
+// @Success 200 {object} AMLCaseFileRes
+// @Failure 404 {object} ErrorResponse "Case not found"
+// @Router /admin/aml/cases/{case_id} [get]
+// @Security BearerAuth
+func (api *ApiManager) handleGetAMLCase(ctx *gin.Context) {
+	caseID, err := primitive.ObjectIDFromHex(ctx.Param("case_id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Invalid ID format"})
+		return
+	}
+
+	file, err := api.amlCaseFile(caseID)
+	if err != nil {
+		ctx.JSON(amlCaseErrorStatus(err), ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	if ctx.Query("format") == "csv" {
+		if err := writeAMLCaseCSV(ctx, file); err != nil {
+			log.Printf("Error writing AML case %s as CSV: %v", caseID.Hex(), err)
+		}
+		return
+	}
+
+	ctx.Header("Content-Disposition", fmt.Sprintf("attachment; filename=aml-case-%s.json", caseID.Hex()))
+	ctx.JSON(http.StatusOK, file)
+}
+
+// @Summary Annotate an AML case
+// @Description Add a note to a case (admin only)
+// @ID annotate-aml-case
+// @Accept json
+// @Produce json
+// @Param case_id path string true "Case ID"
+// @Param note body AMLCaseNoteRequest true "Note"
+// @Success 200 {object} db.AMLCase
+// @Failure 404 {object} ErrorResponse "Case not found"
+// @Router /admin/aml/cases/{case_id}/notes [post]
+// @Security BearerAuth
+func (api *ApiManager) handleAddAMLCaseNote(ctx *gin.Context) {
+	authorID, err := currentUserID(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	caseID, err := primitive.ObjectIDFromHex(ctx.Param("case_id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Invalid ID format"})
+		return
+	}
+
+	var req AMLCaseNoteRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Bad request"})
+		return
+	}
+
+	amlCase, err := api.accMgr.AddAMLCaseNote(caseID, authorID, req.Text)
+	if err != nil {
+		ctx.JSON(amlCaseErrorStatus(err), ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, amlCase)
+}
+
+// @Summary Close an AML case
+// @Description Close a case with a resolution, e.g. "reported" or "no action" (admin only)
+// @ID close-aml-case
+// @Accept json
+// @Produce json
+// @Param case_id path string true "Case ID"
+// @Param resolution body CloseAMLCaseRequest true "Resolution"
+// @Success 200 {object} db.AMLCase
+// @Failure 404 {object} ErrorResponse "Case not found"
+// @Failure 409 {object} ErrorResponse "Case already closed"
+// @Router /admin/aml/cases/{case_id}/close [post]
+// @Security BearerAuth
+func (api *ApiManager) handleCloseAMLCase(ctx *gin.Context) {
+	adminID, err := currentUserID(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	caseID, err := primitive.ObjectIDFromHex(ctx.Param("case_id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Invalid ID format"})
+		return
+	}
+
+	var req CloseAMLCaseRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Bad request"})
+		return
+	}
+
+	amlCase, err := api.accMgr.CloseAMLCase(caseID, adminID, req.Resolution)
+	if err != nil {
+		ctx.JSON(amlCaseErrorStatus(err), ErrorResponse{Message: err.Error()})
+		return
+	}
+	api.audit(ctx, "aml.case.close", caseID.Hex(), map[string]string{"resolution": amlCase.Resolution})
+
+	ctx.JSON(http.StatusOK, amlCase)
+}
@@ -0,0 +1,203 @@
+package api
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tamir-liebermann/gobank/db"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// apiKeyHeader carries the API key of service-to-service requests.
+const apiKeyHeader = "X-API-Key"
+
+var errAPIKeyRoute = errors.New("this API key can't use this endpoint")
+
+// apiKeyRoutes are the only routes API keys can reach, with the scope each
+// one needs. Everything else, like chat, sessions and staff tools, needs a
+// person to log in.
+var apiKeyRoutes = map[string]string{
+	"GET /account/:id":                        db.ScopeAccountsRead,
+	"GET /account/transactions/:id":           db.ScopeAccountsRead,
+	"GET /account/balance":                    db.ScopeAccountsRead,
+	"GET /admin/accounts":                     db.ScopeAccountsRead,
+	"GET /admin/accounts/search":              db.ScopeAccountsRead,
+	"GET /admin/accounts/:id/overview":        db.ScopeAccountsRead,
+	"POST /account/transfer":                  db.ScopeTransfersCreate,
+	"POST /account/batches":                   db.ScopeTransfersCreate,
+	"GET /account/batches":                    db.ScopeTransfersCreate,
+	"GET /account/batches/:batch_id":          db.ScopeTransfersCreate,
+	"POST /account/batches/:batch_id/confirm": db.ScopeTransfersCreate,
+	"POST /account/batches/:batch_id/cancel":  db.ScopeTransfersCreate,
+	"GET /account/batches/:batch_id/report":   db.ScopeTransfersCreate,
+}
+
+func apiKeyErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, db.ErrAPIKeyNotFound), errors.Is(err, db.ErrAccountNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, db.ErrUnknownScope), errors.Is(err, db.ErrInvalidAllowedIP):
+		return http.StatusBadRequest
+	case errors.Is(err, db.ErrAPIKeyRevoked):
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// currentAPIKey returns the API key the request was made with, if any.
+func currentAPIKey(ctx *gin.Context) (*db.APIKey, bool) {
+	key, ok := ctx.Value(apiKeyKey).(*db.APIKey)
+	return key, ok
+}
+
+// apiKeyAuthenticate lets a service act as the account its API key belongs
+// to, on the routes the key's scopes cover. Every request is logged with
+// the key, and audit entries name it.
+func (api *ApiManager) apiKeyAuthenticate(ctx *gin.Context) {
+	key, err := api.accMgr.AuthenticateAPIKey(strings.TrimSpace(ctx.GetHeader(apiKeyHeader)), ctx.ClientIP())
+	if errors.Is(err, db.ErrAPIKeyIPNotAllowed) {
+		api.audit(ctx, "api_key.denied", key.ID.Hex(), map[string]string{"ip": ctx.ClientIP(), "reason": "ip"})
+	}
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "Not authorized"})
+		return
+	}
+
+	account, err := api.accMgr.SearchAccountById(key.AccountID)
+	if err != nil || account == nil || account.ErasedAt != nil {
+		ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "Not authorized"})
+		return
+	}
+
+	ctx.Set("userId", key.AccountID.Hex())
+	ctx.Set(authSourceKey, db.AuditSourceAPIKey)
+	ctx.Set(apiKeyKey, key)
+	log.Printf("API key %s (%s) as %s: %s %s [%s]", key.ID.Hex(), key.Name, key.AccountID.Hex(),
+		ctx.Request.Method, ctx.Request.URL.Path, ctx.GetString(requestIDKey))
+
+	scope, ok := apiKeyRoutes[ctx.Request.Method+" "+ctx.FullPath()]
+	if !ok || !key.HasScope(scope) {
+		api.audit(ctx, "access.denied", "", map[string]string{
+			"method": ctx.Request.Method,
+			"route":  ctx.FullPath(),
+		})
+		ctx.AbortWithStatusJSON(http.StatusForbidden, ErrorResponse{Message: errAPIKeyRoute.Error()})
+		return
+	}
+
+	ctx.Next()
+}
+
+// @Summary Create an API key
+// @Description Create a key a service uses to act as an account without logging in, sent in the X-API-Key header. Scopes are accounts:read and transfers:create; the key never has more rights than its account's role. The key is only shown in this response (needs api_keys:manage)
+// @ID create-api-key
+// @Accept json
+// @Produce json
+// @Param key body CreateAPIKeyRequest true "Key settings"
+// @Success 201 {object} CreateAPIKeyRes
+// @Failure 400 {object} ErrorResponse "Unknown scope or invalid IP"
+// @Failure 404 {object} ErrorResponse "Account not found"
+// @Router /admin/api-keys [post]
+// @Security BearerAuth
+func (api *ApiManager) handleCreateAPIKey(ctx *gin.Context) {
+	var req CreateAPIKeyRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Bad request"})
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Scopes) == 0 {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "name and at least one scope are required"})
+		return
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "expires_at must be in the future"})
+		return
+	}
+
+	creatorID, err := currentUserID(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, ErrorResponse{Message: err.Error()})
+		return
+	}
+	accountID, err := api.accMgr.ResolveAccountRef(req.Account)
+	if err != nil {
+		ctx.JSON(accountRefStatus(err), ErrorResponse{Message: err.Error()})
+		return
+	}
+	account, err := api.accMgr.SearchAccountById(accountID)
+	if err != nil || account == nil || account.ErasedAt != nil {
+		ctx.JSON(http.StatusNotFound, ErrorResponse{Message: db.ErrAccountNotFound.Error()})
+		return
+	}
+
+	key, raw, err := api.accMgr.CreateAPIKey(req.Name, accountID, req.Scopes, req.AllowedIPs, req.ExpiresAt, creatorID)
+	if err != nil {
+		ctx.JSON(apiKeyErrorStatus(err), ErrorResponse{Message: err.Error()})
+		return
+	}
+	api.audit(ctx, "api_key.create", key.ID.Hex(), map[string]string{
+		"name":    key.Name,
+		"account": accountID.Hex(),
+		"scopes":  strings.Join(key.Scopes, ","),
+	})
+
+	ctx.JSON(http.StatusCreated, CreateAPIKeyRes{APIKey: key, Key: raw})
+}
+
+// @Summary List API keys
+// @Description API keys with their scopes, allowlists, expiry and when and where they were last used (needs api_keys:manage)
+// @ID get-api-keys
+// @Produce json
+// @Param account query string false "Only keys of this account ID or account number"
+// @Success 200 {object} APIKeysRes
+// @Router /admin/api-keys [get]
+// @Security BearerAuth
+func (api *ApiManager) handleGetAPIKeys(ctx *gin.Context) {
+	accountID := primitive.NilObjectID
+	if ref := ctx.Query("account"); ref != "" {
+		var err error
+		if accountID, err = api.accMgr.ResolveAccountRef(ref); err != nil {
+			ctx.JSON(accountRefStatus(err), ErrorResponse{Message: err.Error()})
+			return
+		}
+	}
+
+	keys, err := api.accMgr.GetAPIKeys(accountID)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Could not load API keys"})
+		return
+	}
+	ctx.JSON(http.StatusOK, APIKeysRes{Keys: keys})
+}
+
+// @Summary Revoke an API key
+// @Description Stop an API key from working right away (needs api_keys:manage)
+// @ID revoke-api-key
+// @Produce json
+// @Param key_id path string true "API key ID"
+// @Success 200 {object} db.APIKey
+// @Failure 404 {object} ErrorResponse "API key not found"
+// @Failure 409 {object} ErrorResponse "Already revoked"
+// @Router /admin/api-keys/{key_id} [delete]
+// @Security BearerAuth
+func (api *ApiManager) handleRevokeAPIKey(ctx *gin.Context) {
+	keyID, err := primitive.ObjectIDFromHex(ctx.Param("key_id"))
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, ErrorResponse{Message: db.ErrAPIKeyNotFound.Error()})
+		return
+	}
+
+	key, err := api.accMgr.RevokeAPIKey(keyID)
+	if err != nil {
+		ctx.JSON(apiKeyErrorStatus(err), ErrorResponse{Message: err.Error()})
+		return
+	}
+	api.audit(ctx, "api_key.revoke", key.ID.Hex(), map[string]string{"name": key.Name})
+
+	ctx.JSON(http.StatusOK, key)
+}
@@ -0,0 +1,144 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tamir-liebermann/gobank/db"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Context keys set by the request ID and auth middlewares.
+const (
+	requestIDKey      = "requestId"
+	authSourceKey     = "authSource"
+	sessionIDKey      = "sessionId"
+	tokenIDKey        = "tokenId"
+	tokenExpiresAtKey = "tokenExpiresAt"
+	apiKeyKey         = "apiKey"
+)
+
+var requestIDRegexp = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// requestID tags every request with an ID, reusing a well-formed
+// X-Request-ID from the caller, and echoes it back in the response.
+func requestID(ctx *gin.Context) {
+	id := ctx.GetHeader("X-Request-ID")
+	if !requestIDRegexp.MatchString(id) {
+		id = primitive.NewObjectID().Hex()
+	}
+	ctx.Set(requestIDKey, id)
+	ctx.Header("X-Request-ID", id)
+	ctx.Next()
+}
+
+// audit appends an entry for the current request to the audit log. The
+// actor is the authenticated account, if any. Failing to audit is logged but
+// never fails the request.
+func (api *ApiManager) audit(ctx *gin.Context, action, target string, details map[string]string) {
+	entry := db.AuditEntry{
+		Action:  action,
+		Target:  target,
+		Source:  db.AuditSourceSystem,
+		Details: details,
+	}
+	if ctx != nil {
+		if actorID, err := currentUserID(ctx); err == nil {
+			entry.ActorID = actorID
+		}
+		entry.RequestID = ctx.GetString(requestIDKey)
+		if source := ctx.GetString(authSourceKey); source != "" {
+			entry.Source = source
+		}
+		// Actions taken with an API key name the key as well as its account
+		if key, ok := currentAPIKey(ctx); ok {
+			details := map[string]string{"api_key": key.ID.Hex()}
+			for k, v := range entry.Details {
+				details[k] = v
+			}
+			entry.Details = details
+		}
+	}
+
+	if _, err := api.accMgr.AppendAudit(entry); err != nil {
+		log.Printf("Error writing audit entry %s on %s: %v", action, target, err)
+	}
+}
+
+func formatAmount(amount float64) string {
+	return strconv.FormatFloat(amount, 'f', 2, 64)
+}
+
+// @Summary Query the audit log
+// @Description Newest entries first, filtered by actor, action, target, source, request ID or time range (admin only)
+// @ID get-audit-log
+// @Produce json
+// @Param actor query string false "Actor account ID"
+// @Param action query string false "Action, e.g. transfer or account.login"
+// @Param target query string false "Target, usually an ID"
+// @Param source query string false "jwt, twilio, chat or system"
+// @Param request_id query string false "Request ID"
+// @Param from query string false "RFC3339 start time"
+// @Param to query string false "RFC3339 end time"
+// @Param limit query int false "At most this many entries (default 100, max 1000)"
+// @Success 200 {object} AuditLogRes
+// @Failure 400 {object} ErrorResponse "Invalid filter"
+// @Router /admin/audit [get]
+// @Security BearerAuth
+func (api *ApiManager) handleGetAuditLog(ctx *gin.Context) {
+	filter := db.AuditFilter{
+		Action:    ctx.Query("action"),
+		Target:    ctx.Query("target"),
+		Source:    ctx.Query("source"),
+		RequestID: ctx.Query("request_id"),
+	}
+
+	var err error
+	if filter.ActorID, err = parseOptionalID(ctx.Query("actor")); err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Invalid actor ID"})
+		return
+	}
+	for param, t := range map[string]*time.Time{"from": &filter.From, "to": &filter.To} {
+		if value := ctx.Query(param); value != "" {
+			if *t, err = time.Parse(time.RFC3339, value); err != nil {
+				ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Invalid " + param + " time, use RFC3339"})
+				return
+			}
+		}
+	}
+	if value := ctx.Query("limit"); value != "" {
+		if filter.Limit, err = strconv.ParseInt(value, 10, 64); err != nil {
+			ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Invalid limit"})
+			return
+		}
+	}
+
+	entries, err := api.accMgr.GetAuditEntries(filter)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Internal server error"})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, AuditLogRes{Entries: entries})
+}
+
+// @Summary Verify the audit log
+// @Description Walk the hash chain and report the first tampered entry, if any (admin only)
+// @ID verify-audit-log
+// @Produce json
+// @Success 200 {object} db.AuditVerification
+// @Router /admin/audit/verify [get]
+// @Security BearerAuth
+func (api *ApiManager) handleVerifyAuditLog(ctx *gin.Context) {
+	result, err := api.accMgr.VerifyAuditChain()
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Internal server error"})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, result)
+}
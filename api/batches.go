@@ -0,0 +1,582 @@
+package api
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tamir-liebermann/gobank/db"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	maxBatchUploadSize = 2 << 20
+	maxBatchMemoLength = 140
+)
+
+func batchErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, db.ErrBatchNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, db.ErrBatchNotPreview), errors.Is(err, db.ErrBatchInvalid):
+		return http.StatusConflict
+	}
+	return http.StatusBadRequest
+}
+
+// readBatchUpload reads the rows of a batch from a JSON body, a CSV body or
+// a CSV file sent as multipart form data.
+func readBatchUpload(ctx *gin.Context) (string, []BatchRowRequest, error) {
+	ctx.Request.Body = http.MaxBytesReader(ctx.Writer, ctx.Request.Body, maxBatchUploadSize)
+	mode := ctx.Query("mode")
+
+	contentType, _, _ := mime.ParseMediaType(ctx.GetHeader("Content-Type"))
+	switch contentType {
+	case "application/json":
+		var req BatchRequest
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			return "", nil, errors.New("invalid JSON body")
+		}
+		if req.Mode != "" {
+			mode = req.Mode
+		}
+		return mode, req.Rows, nil
+
+	case "multipart/form-data":
+		header, err := ctx.FormFile("file")
+		if err != nil {
+			return "", nil, errors.New("a CSV file is required")
+		}
+		file, err := header.Open()
+		if err != nil {
+			return "", nil, errors.New("could not read the file")
+		}
+		defer file.Close()
+		if formMode := ctx.PostForm("mode"); formMode != "" {
+			mode = formMode
+		}
+		rows, err := parseBatchCSV(file)
+		return mode, rows, err
+
+	case "text/csv":
+		rows, err := parseBatchCSV(ctx.Request.Body)
+		return mode, rows, err
+	}
+	return "", nil, errors.New("send the batch as application/json, text/csv or a multipart CSV file")
+}
+
+// parseBatchCSV reads rows under a recipient,amount,memo header. The memo
+// column is optional and the columns may come in any order. Amounts that
+// aren't numbers are kept as NaN so the row shows up as invalid in the
+// preview instead of failing the whole upload.
+func parseBatchCSV(r io.Reader) ([]BatchRowRequest, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, errors.New("the CSV is empty")
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	recipientCol, okRecipient := columns["recipient"]
+	amountCol, okAmount := columns["amount"]
+	memoCol, okMemo := columns["memo"]
+	if !okRecipient || !okAmount {
+		return nil, errors.New("the CSV header must have recipient and amount columns")
+	}
+
+	field := func(record []string, i int) string {
+		if i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	var rows []BatchRowRequest
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("invalid CSV: %v", err)
+		}
+		row := BatchRowRequest{Recipient: field(record, recipientCol), Amount: math.NaN()}
+		if amount, err := strconv.ParseFloat(field(record, amountCol), 64); err == nil {
+			row.Amount = amount
+		}
+		if okMemo {
+			row.Memo = field(record, memoCol)
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// validateBatchRow checks one row without moving any money and fills in the
+// recipient and the fee for the preview.
+func (api *ApiManager) validateBatchRow(ownerID primitive.ObjectID, line int, req BatchRowRequest) db.BatchRow {
+	row := db.BatchRow{
+		Line:      line,
+		Recipient: strings.TrimSpace(req.Recipient),
+		Amount:    req.Amount,
+		Memo:      strings.TrimSpace(req.Memo),
+		Status:    db.BatchRowInvalid,
+	}
+
+	switch {
+	case math.IsNaN(req.Amount) || math.IsInf(req.Amount, 0):
+		row.Amount = 0
+		row.Error = "amount is not a number"
+		return row
+	case req.Amount <= 0:
+		row.Error = "amount must be greater than zero"
+		return row
+	case math.Round(req.Amount*100)/100 != req.Amount:
+		row.Error = "amount can have at most two decimals"
+		return row
+	case len(row.Memo) > maxBatchMemoLength:
+		row.Error = fmt.Sprintf("memo can be at most %d characters", maxBatchMemoLength)
+		return row
+	}
+
+	recipientID, err := api.resolveRecipient(ownerID, row.Recipient)
+	if err != nil {
+		row.Error = err.Error()
+		return row
+	}
+	if recipientID == ownerID {
+		row.Error = "cannot transfer to the same account"
+		return row
+	}
+	recipient, err := api.accMgr.SearchAccountById(recipientID)
+	if err != nil || recipient == nil || recipient.ErasedAt != nil {
+		row.Error = "recipient account not found"
+		return row
+	}
+
+	fee, err := api.accMgr.QuoteFee(db.FeeOperationTransfer, ownerID, row.Amount)
+	if err != nil {
+		row.Error = "could not quote the fee"
+		return row
+	}
+
+	row.RecipientID = recipientID
+	row.RecipientName = recipient.AccountHolder
+	row.Fee = fee
+	row.Status = db.BatchRowValid
+	return row
+}
+
+// batchWarnings points out things that are valid but probably not intended.
+func batchWarnings(batch *db.Batch, balance float64) []string {
+	var warnings []string
+	if need := batch.Total + batch.TotalFees; need > balance {
+		warnings = append(warnings, fmt.Sprintf("the batch needs %.2f including fees but the balance is %.2f", need, balance))
+	}
+
+	seen := map[string]int{}
+	for _, row := range batch.Rows {
+		if row.Status != db.BatchRowValid {
+			continue
+		}
+		key := fmt.Sprintf("%s/%.2f", row.RecipientID.Hex(), row.Amount)
+		if first, ok := seen[key]; ok {
+			warnings = append(warnings, fmt.Sprintf("line %d pays the same recipient the same amount as line %d", row.Line, first))
+			continue
+		}
+		seen[key] = row.Line
+	}
+	return warnings
+}
+
+// runBatch executes a confirmed batch. It runs in the background, so ctx must
+// be a copy of the request context.
+func (api *ApiManager) runBatch(ctx *gin.Context, batch *db.Batch) {
+	var batchErr error
+	if batch.Mode == db.BatchAllOrNothing {
+		batchErr = api.runBatchAtomically(ctx, batch)
+	} else {
+		api.runBatchBestEffort(ctx, batch)
+	}
+
+	if err := api.accMgr.FinishBatch(batch, batchErr); err != nil {
+		log.Printf("Error finishing batch %s: %v", batch.ID.Hex(), err)
+		return
+	}
+	api.audit(ctx, "batch.complete", batch.ID.Hex(), map[string]string{
+		"status":    batch.Status,
+		"completed": strconv.Itoa(batch.CompletedCount),
+		"rows":      strconv.Itoa(batch.RowCount),
+	})
+
+	go api.notifyAccount(batch.OwnerID, fmt.Sprintf("Your batch of %d transfers is %s: %d of %d went through.",
+		batch.RowCount, strings.ReplaceAll(batch.Status, "_", " "), batch.CompletedCount, batch.RowCount))
+}
+
+func (api *ApiManager) runBatchAtomically(ctx *gin.Context, batch *db.Batch) error {
+	transfers := make([]db.BatchTransfer, len(batch.Rows))
+	for i, row := range batch.Rows {
+		transfers[i] = db.BatchTransfer{
+			To:     row.RecipientID,
+			Amount: row.Amount,
+			Opts:   db.TransferOptions{Memo: row.Memo, IdempotencyKey: db.BatchRowKey(batch.ID, row.Line)},
+		}
+	}
+
+	transactions, err := api.accMgr.TransferBatch(batch.OwnerID, transfers)
+	if err != nil {
+		failedIndex := -1
+		var rowErr *db.BatchRowError
+		if errors.As(err, &rowErr) {
+			failedIndex = rowErr.Index
+		}
+		for i := range batch.Rows {
+			if i == failedIndex {
+				batch.Rows[i].Status = db.BatchRowFailed
+				batch.Rows[i].Error = rowErr.Err.Error()
+				continue
+			}
+			batch.Rows[i].Status = db.BatchRowSkipped
+			batch.Rows[i].Error = "not sent, the batch was rolled back"
+		}
+		return err
+	}
+
+	for i, transaction := range transactions {
+		batch.Rows[i].Status = db.BatchRowCompleted
+		batch.Rows[i].Fee = transaction.Fee
+		batch.Rows[i].TransactionID = transaction.ID
+		api.transferCompleted(ctx, transaction)
+	}
+	return nil
+}
+
+func (api *ApiManager) runBatchBestEffort(ctx *gin.Context, batch *db.Batch) {
+	for i := range batch.Rows {
+		row := &batch.Rows[i]
+		if row.Status == db.BatchRowInvalid {
+			row.Status = db.BatchRowSkipped
+		} else {
+			api.runBatchRow(ctx, batch, row)
+		}
+
+		if err := api.accMgr.UpdateBatchRow(batch.ID, i, *row); err != nil {
+			log.Printf("Error saving row %d of batch %s: %v", row.Line, batch.ID.Hex(), err)
+		}
+	}
+}
+
+func (api *ApiManager) runBatchRow(ctx *gin.Context, batch *db.Batch, row *db.BatchRow) {
+	key := db.BatchRowKey(batch.ID, row.Line)
+
+	// A retried row that already went through keeps its first transaction
+	existing, err := api.accMgr.GetTransactionByIdempotencyKey(key)
+	if err != nil {
+		row.Status = db.BatchRowFailed
+		row.Error = err.Error()
+		return
+	}
+	if existing != nil {
+		row.Status = db.BatchRowCompleted
+		row.Fee = existing.Fee
+		row.TransactionID = existing.ID
+		return
+	}
+
+	transaction, err := api.performTransfer(ctx, batch.OwnerID, row.RecipientID, row.Amount, db.TransferOptions{
+		Memo:           row.Memo,
+		IdempotencyKey: key,
+		BatchID:        batch.ID,
+		BatchLine:      row.Line,
+	})
+	var held *db.TransferHeldError
+	if errors.As(err, &held) {
+		row.Status = db.BatchRowHeld
+		row.Error = "held for review (hold " + held.Held.ID.Hex() + ")"
+		return
+	} else if err != nil {
+		row.Status = db.BatchRowFailed
+		row.Error = err.Error()
+		return
+	}
+
+	row.Status = db.BatchRowCompleted
+	row.Fee = transaction.Fee
+	row.TransactionID = transaction.ID
+}
+
+func writeBatchReportCSV(ctx *gin.Context, batch *db.Batch) error {
+	ctx.Header("Content-Type", "text/csv; charset=utf-8")
+	ctx.Header("Content-Disposition", fmt.Sprintf("attachment; filename=batch-%s.csv", batch.ID.Hex()))
+
+	w := csv.NewWriter(ctx.Writer)
+	rows := [][]string{{"line", "recipient", "recipient_account", "recipient_name", "amount", "fee", "memo", "status", "error", "transaction_id"}}
+	for _, row := range batch.Rows {
+		recipientAccount, transactionID := "", ""
+		if !row.RecipientID.IsZero() {
+			recipientAccount = row.RecipientID.Hex()
+		}
+		if !row.TransactionID.IsZero() {
+			transactionID = row.TransactionID.Hex()
+		}
+		rows = append(rows, []string{strconv.Itoa(row.Line), row.Recipient, recipientAccount, row.RecipientName,
+			formatAmount(row.Amount), formatAmount(row.Fee), row.Memo, row.Status, row.Error, transactionID})
+	}
+
+	if err := w.WriteAll(rows); err != nil {
+		return err
+	}
+	return w.Error()
+}
+
+// @Summary Upload a batch of transfers
+// @Description Validate a batch of (recipient, amount, memo) rows sent as JSON, as a text/csv body or as a multipart CSV file, and return a preview. Nothing is sent until the batch is confirmed. An Idempotency-Key header makes re-uploads return the first batch
+// @ID create-batch
+// @Accept json
+// @Accept text/csv
+// @Accept multipart/form-data
+// @Produce json
+// @Param Idempotency-Key header string false "Key that identifies this upload"
+// @Param mode query string false "all_or_nothing (default) or best_effort"
+// @Param batch body BatchRequest false "Batch as JSON"
+// @Success 201 {object} db.Batch
+// @Success 200 {object} db.Batch "Batch already uploaded under this key"
+// @Failure 400 {object} ErrorResponse "Invalid upload"
+// @Router /account/batches [post]
+// @Security BearerAuth
+// @Security ApiKeyAuth
+func (api *ApiManager) handleCreateBatch(ctx *gin.Context) {
+	ownerID, err := currentUserID(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	mode, requests, err := readBatchUpload(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: err.Error()})
+		return
+	}
+	if mode == "" {
+		mode = db.BatchAllOrNothing
+	}
+	if mode != db.BatchAllOrNothing && mode != db.BatchBestEffort {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "mode must be all_or_nothing or best_effort"})
+		return
+	}
+	if len(requests) == 0 {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "The batch has no rows"})
+		return
+	}
+	if len(requests) > db.MaxBatchRows {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: fmt.Sprintf("A batch can have at most %d rows", db.MaxBatchRows)})
+		return
+	}
+
+	owner, err := api.accMgr.SearchAccountById(ownerID)
+	if err != nil || owner == nil {
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Could not find account"})
+		return
+	}
+
+	batch := db.Batch{
+		OwnerID:        ownerID,
+		Mode:           mode,
+		IdempotencyKey: strings.TrimSpace(ctx.GetHeader("Idempotency-Key")),
+	}
+	for i, req := range requests {
+		batch.Rows = append(batch.Rows, api.validateBatchRow(ownerID, i+1, req))
+	}
+
+	created, isNew, err := api.accMgr.CreateBatch(batch)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Could not save the batch"})
+		return
+	}
+	if !isNew {
+		ctx.JSON(http.StatusOK, created)
+		return
+	}
+	// Warnings depend on the totals CreateBatch worked out, so they aren't stored
+	created.Warnings = batchWarnings(created, owner.Balance)
+	api.audit(ctx, "batch.create", created.ID.Hex(), map[string]string{
+		"mode":  created.Mode,
+		"rows":  strconv.Itoa(created.RowCount),
+		"total": formatAmount(created.Total),
+	})
+
+	ctx.JSON(http.StatusCreated, created)
+}
+
+// @Summary List batches
+// @Description Your batches, newest first, without their rows
+// @ID get-batches
+// @Produce json
+// @Success 200 {object} BatchesRes
+// @Router /account/batches [get]
+// @Security BearerAuth
+// @Security ApiKeyAuth
+func (api *ApiManager) handleGetBatches(ctx *gin.Context) {
+	ownerID, err := currentUserID(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	batches, err := api.accMgr.GetBatches(ownerID)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Internal server error"})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, BatchesRes{Batches: batches})
+}
+
+// @Summary Get a batch
+// @Description A batch with the status of every row
+// @ID get-batch
+// @Produce json
+// @Param batch_id path string true "Batch ID"
+// @Success 200 {object} db.Batch
+// @Failure 404 {object} ErrorResponse "Batch not found"
+// @Router /account/batches/{batch_id} [get]
+// @Security BearerAuth
+// @Security ApiKeyAuth
+func (api *ApiManager) handleGetBatch(ctx *gin.Context) {
+	batch, ok := api.batchFromRequest(ctx)
+	if !ok {
+		return
+	}
+
+	ctx.JSON(http.StatusOK, batch)
+}
+
+// @Summary Download a batch report
+// @Description The per-row result of a batch as CSV
+// @ID get-batch-report
+// @Produce text/csv
+// @Param batch_id path string true "Batch ID"
+// @Success 200 {string} string "CSV report"
+// @Failure 404 {object} ErrorResponse "Batch not found"
+// @Router /account/batches/{batch_id}/report [get]
+// @Security BearerAuth
+// @Security ApiKeyAuth
+func (api *ApiManager) handleGetBatchReport(ctx *gin.Context) {
+	batch, ok := api.batchFromRequest(ctx)
+	if !ok {
+		return
+	}
+
+	if err := writeBatchReportCSV(ctx, batch); err != nil {
+		log.Printf("Error writing report of batch %s: %v", batch.ID.Hex(), err)
+	}
+}
+
+func (api *ApiManager) batchFromRequest(ctx *gin.Context) (*db.Batch, bool) {
+	ownerID, err := currentUserID(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, ErrorResponse{Message: err.Error()})
+		return nil, false
+	}
+
+	batchID, err := primitive.ObjectIDFromHex(ctx.Param("batch_id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Invalid ID format"})
+		return nil, false
+	}
+
+	batch, err := api.accMgr.GetBatchById(ownerID, batchID)
+	if err != nil {
+		ctx.JSON(batchErrorStatus(err), ErrorResponse{Message: err.Error()})
+		return nil, false
+	}
+	return batch, true
+}
+
+// @Summary Confirm a batch
+// @Description Start sending a previewed batch. It runs in the background; poll the batch for per-row status. With two-factor on, large batches need a fresh second factor
+// @ID confirm-batch
+// @Produce json
+// @Param batch_id path string true "Batch ID"
+// @Success 202 {object} db.Batch
+// @Failure 403 {object} ErrorResponse "Second factor needed"
+// @Failure 409 {object} ErrorResponse "Already confirmed, cancelled or has invalid rows"
+// @Router /account/batches/{batch_id}/confirm [post]
+// @Security BearerAuth
+// @Security ApiKeyAuth
+func (api *ApiManager) handleConfirmBatch(ctx *gin.Context) {
+	ownerID, err := currentUserID(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	batchID, err := primitive.ObjectIDFromHex(ctx.Param("batch_id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Invalid ID format"})
+		return
+	}
+
+	preview, err := api.accMgr.GetBatchById(ownerID, batchID)
+	if err != nil {
+		ctx.JSON(batchErrorStatus(err), ErrorResponse{Message: err.Error()})
+		return
+	}
+	if preview.Total >= api.stepUpTransferAmount && !api.requireSecondFactor(ctx, ownerID) {
+		return
+	}
+
+	batch, err := api.accMgr.ConfirmBatch(ownerID, batchID)
+	if err != nil {
+		ctx.JSON(batchErrorStatus(err), ErrorResponse{Message: err.Error()})
+		return
+	}
+	api.audit(ctx, "batch.confirm", batch.ID.Hex(), nil)
+
+	go api.runBatch(ctx.Copy(), batch)
+	ctx.JSON(http.StatusAccepted, batch)
+}
+
+// @Summary Cancel a batch
+// @Description Drop a batch that hasn't been confirmed yet
+// @ID cancel-batch
+// @Produce json
+// @Param batch_id path string true "Batch ID"
+// @Success 200 {object} db.Batch
+// @Failure 409 {object} ErrorResponse "Already confirmed or cancelled"
+// @Router /account/batches/{batch_id}/cancel [post]
+// @Security BearerAuth
+// @Security ApiKeyAuth
+func (api *ApiManager) handleCancelBatch(ctx *gin.Context) {
+	ownerID, err := currentUserID(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	batchID, err := primitive.ObjectIDFromHex(ctx.Param("batch_id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Invalid ID format"})
+		return
+	}
+
+	batch, err := api.accMgr.CancelBatch(ownerID, batchID)
+	if err != nil {
+		ctx.JSON(batchErrorStatus(err), ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, batch)
+}
@@ -0,0 +1,301 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tamir-liebermann/gobank/db"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// evaluateBudgets runs after every completed transfer and sends a WhatsApp
+// alert for each budget threshold the transfer pushed the sender past.
+func (api *ApiManager) evaluateBudgets(transaction *db.Transaction) {
+	budgets, err := api.accMgr.GetBudgets(transaction.FromAccount)
+	if err != nil {
+		log.Printf("Error loading budgets of %s: %v", transaction.FromAccount.Hex(), err)
+		return
+	}
+
+	for i := range budgets {
+		budget := &budgets[i]
+		if !budget.Matches(transaction) {
+			continue
+		}
+
+		spent, err := api.accMgr.GetBudgetSpending(budget)
+		if err != nil {
+			log.Printf("Error computing spending for budget %s: %v", budget.ID.Hex(), err)
+			continue
+		}
+		percent := spent / budget.MonthlyLimit * 100
+
+		// Only the highest newly crossed threshold is worth a message, but
+		// every crossed threshold is marked so it is not reported later.
+		alert := 0.0
+		for _, threshold := range budget.Thresholds {
+			if percent < threshold {
+				break
+			}
+			marked, err := api.accMgr.MarkBudgetAlert(budget.ID, threshold)
+			if err != nil {
+				log.Printf("Error recording alert for budget %s: %v", budget.ID.Hex(), err)
+				continue
+			}
+			if marked {
+				alert = threshold
+			}
+		}
+
+		if alert > 0 {
+			api.notifyAccount(budget.AccountID, budgetAlertMessage(budget, spent, alert))
+		}
+	}
+}
+
+func budgetAlertMessage(budget *db.Budget, spent, threshold float64) string {
+	if threshold >= 100 {
+		return fmt.Sprintf("Budget alert: you've spent %.2f this month on %s, which is over your %.2f budget.",
+			spent, budget.Name, budget.MonthlyLimit)
+	}
+	return fmt.Sprintf("Budget alert: you've used %.0f%% of your %s budget this month (%.2f of %.2f).",
+		threshold, budget.Name, spent, budget.MonthlyLimit)
+}
+
+func (api *ApiManager) budgetStatus(accountID primitive.ObjectID) ([]BudgetStatusRes, error) {
+	budgets, err := api.accMgr.GetBudgets(accountID)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := []BudgetStatusRes{}
+	for i := range budgets {
+		spent, err := api.accMgr.GetBudgetSpending(&budgets[i])
+		if err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, BudgetStatusRes{
+			Budget:    budgets[i],
+			Spent:     spent,
+			Remaining: math.Max(0, budgets[i].MonthlyLimit-spent),
+			Percent:   math.Round(spent/budgets[i].MonthlyLimit*1000) / 10,
+		})
+	}
+	return statuses, nil
+}
+
+// budgetFromRequest builds a Budget, resolving the counterparty (phone,
+// account ID or payee nickname) to an account.
+func (api *ApiManager) budgetFromRequest(accountID primitive.ObjectID, req BudgetRequest) (db.Budget, error) {
+	budget := db.Budget{
+		AccountID:    accountID,
+		Name:         req.Name,
+		Category:     req.Category,
+		MonthlyLimit: req.MonthlyLimit,
+		Thresholds:   req.Thresholds,
+	}
+
+	if strings.TrimSpace(req.Counterparty) != "" {
+		counterparty, err := api.resolveRecipient(accountID, req.Counterparty)
+		if err != nil {
+			return budget, err
+		}
+		budget.Counterparty = counterparty
+		if budget.Name == "" {
+			budget.Name = req.Counterparty
+		}
+	}
+	return budget, nil
+}
+
+// @Summary List budgets
+// @Description List the caller's monthly budgets with this month's spending
+// @ID get-budgets
+// @Produce json
+// @Success 200 {object} BudgetsRes
+// @Failure 500 {object} ErrorResponse "Internal server error"
+// @Router /account/budgets [get]
+// @Security BearerAuth
+func (api *ApiManager) handleGetBudgets(ctx *gin.Context) {
+	accountID, err := currentUserID(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	statuses, err := api.budgetStatus(accountID)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Internal server error"})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, BudgetsRes{Budgets: statuses})
+}
+
+// @Summary Create a budget
+// @Description Create a monthly budget for a category or a counterparty with alert thresholds
+// @ID create-budget
+// @Accept json
+// @Produce json
+// @Param budget body BudgetRequest true "Budget"
+// @Success 201 {object} db.Budget
+// @Failure 400 {object} ErrorResponse "Bad request"
+// @Router /account/budgets [post]
+// @Security BearerAuth
+func (api *ApiManager) handleCreateBudget(ctx *gin.Context) {
+	accountID, err := currentUserID(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	var req BudgetRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Bad request"})
+		return
+	}
+
+	budget, err := api.budgetFromRequest(accountID, req)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	created, err := api.accMgr.CreateBudget(budget)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusCreated, created)
+}
+
+// @Summary Update a budget
+// @Description Change a budget's limit, thresholds, category or counterparty
+// @ID update-budget
+// @Accept json
+// @Produce json
+// @Param budget_id path string true "Budget ID"
+// @Param budget body BudgetRequest true "Budget"
+// @Success 200 {object} db.Budget
+// @Failure 400 {object} ErrorResponse "Bad request"
+// @Failure 404 {object} ErrorResponse "Budget not found"
+// @Router /account/budgets/{budget_id} [put]
+// @Security BearerAuth
+func (api *ApiManager) handleUpdateBudget(ctx *gin.Context) {
+	accountID, err := currentUserID(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	budgetID, err := primitive.ObjectIDFromHex(ctx.Param("budget_id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Invalid ID format"})
+		return
+	}
+
+	var req BudgetRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Bad request"})
+		return
+	}
+
+	budget, err := api.budgetFromRequest(accountID, req)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: err.Error()})
+		return
+	}
+	budget.ID = budgetID
+
+	updated, err := api.accMgr.UpdateBudget(budget)
+	if errors.Is(err, db.ErrBudgetNotFound) {
+		ctx.JSON(http.StatusNotFound, ErrorResponse{Message: err.Error()})
+		return
+	} else if err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, updated)
+}
+
+// @Summary Delete a budget
+// @Description Delete one of the caller's budgets
+// @ID delete-budget
+// @Produce json
+// @Param budget_id path string true "Budget ID"
+// @Success 200 {object} string "Budget deleted"
+// @Failure 404 {object} ErrorResponse "Budget not found"
+// @Router /account/budgets/{budget_id} [delete]
+// @Security BearerAuth
+func (api *ApiManager) handleDeleteBudget(ctx *gin.Context) {
+	accountID, err := currentUserID(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	budgetID, err := primitive.ObjectIDFromHex(ctx.Param("budget_id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Invalid ID format"})
+		return
+	}
+
+	err = api.accMgr.DeleteBudget(accountID, budgetID)
+	if errors.Is(err, db.ErrBudgetNotFound) {
+		ctx.JSON(http.StatusNotFound, ErrorResponse{Message: err.Error()})
+		return
+	} else if err != nil {
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Internal server error"})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"message": "Budget deleted"})
+}
+
+func (api *ApiManager) handleSetBudgetIntent(ctx *gin.Context, req BudgetRequest) (*db.Budget, error) {
+	accountID, err := currentUserID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	budget, err := api.budgetFromRequest(accountID, req)
+	if err != nil {
+		return nil, err
+	}
+	return api.accMgr.CreateBudget(budget)
+}
+
+func (api *ApiManager) handleBudgetStatusIntent(ctx *gin.Context) (string, error) {
+	accountID, err := currentUserID(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	statuses, err := api.budgetStatus(accountID)
+	if err != nil {
+		return "", err
+	}
+	if len(statuses) == 0 {
+		return "You have no budgets yet. Try \"set a 1000 budget for groceries\".", nil
+	}
+
+	var sb strings.Builder
+	sb.WriteString("Your budgets this month:\n")
+	for _, status := range statuses {
+		line := fmt.Sprintf("- %s: %.2f of %.2f spent (%.0f%%)", status.Budget.Name, status.Spent, status.Budget.MonthlyLimit, status.Percent)
+		if status.Spent > status.Budget.MonthlyLimit {
+			line += fmt.Sprintf(", %.2f over", status.Spent-status.Budget.MonthlyLimit)
+		} else {
+			line += fmt.Sprintf(", %.2f left", status.Remaining)
+		}
+		sb.WriteString(line + "\n")
+	}
+	return sb.String(), nil
+}
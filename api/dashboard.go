@@ -0,0 +1,279 @@
+package api
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tamir-liebermann/gobank/db"
+)
+
+const (
+	defaultStatsWindow   = 30 * 24 * time.Hour
+	maxStatsWindow       = 366 * 24 * time.Hour
+	defaultTopCount      = 10
+	maxTopCount          = 100
+	overviewTransactions = 20
+)
+
+// parseTimeParam accepts RFC3339 times and plain YYYY-MM-DD dates, which are
+// read as midnight UTC.
+func parseTimeParam(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
+// statsRange reads the from/to query parameters of the statistics endpoints.
+// It defaults to the last 30 days and refuses ranges over a year.
+func statsRange(ctx *gin.Context) (time.Time, time.Time, error) {
+	to := time.Now()
+	if value := ctx.Query("to"); value != "" {
+		t, err := parseTimeParam(value)
+		if err != nil {
+			return time.Time{}, time.Time{}, errors.New("invalid to, use RFC3339 or YYYY-MM-DD")
+		}
+		to = t
+	}
+	from := to.Add(-defaultStatsWindow)
+	if value := ctx.Query("from"); value != "" {
+		t, err := parseTimeParam(value)
+		if err != nil {
+			return time.Time{}, time.Time{}, errors.New("invalid from, use RFC3339 or YYYY-MM-DD")
+		}
+		from = t
+	}
+
+	if !from.Before(to) {
+		return time.Time{}, time.Time{}, errors.New("from must be before to")
+	}
+	if to.Sub(from) > maxStatsWindow {
+		return time.Time{}, time.Time{}, errors.New("the range can be at most a year")
+	}
+	return from, to, nil
+}
+
+// @Summary Account statistics
+// @Description Account counts by role, status and KYC status, and the deposits held for customers (admin only)
+// @ID get-account-stats
+// @Produce json
+// @Success 200 {object} db.AccountStats
+// @Router /admin/stats/accounts [get]
+// @Security BearerAuth
+func (api *ApiManager) handleGetAccountStats(ctx *gin.Context) {
+	stats, err := api.accMgr.GetAccountStats()
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Internal server error"})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, stats)
+}
+
+// @Summary Transfer volume per day
+// @Description Number, volume and fees of transfers per UTC day, the last 30 days by default (admin only)
+// @ID get-transfer-stats
+// @Produce json
+// @Param from query string false "Start, RFC3339 or YYYY-MM-DD"
+// @Param to query string false "End (exclusive), RFC3339 or YYYY-MM-DD"
+// @Success 200 {object} TransferVolumeRes
+// @Failure 400 {object} ErrorResponse "Invalid range"
+// @Router /admin/stats/transfers [get]
+// @Security BearerAuth
+func (api *ApiManager) handleGetTransferStats(ctx *gin.Context) {
+	from, to, err := statsRange(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	days, err := api.accMgr.GetTransferVolumeByDay(from, to)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Internal server error"})
+		return
+	}
+
+	res := TransferVolumeRes{From: from, To: to, Days: days}
+	for _, day := range days {
+		res.Count += day.Count
+		res.Volume += day.Volume
+		res.Fees += day.Fees
+	}
+	res.Volume = math.Round(res.Volume*100) / 100
+	res.Fees = math.Round(res.Fees*100) / 100
+	ctx.JSON(http.StatusOK, res)
+}
+
+// @Summary Top counterparties
+// @Description Accounts with the highest transfer volume, sent plus received, the last 30 days by default (admin only)
+// @ID get-top-counterparties
+// @Produce json
+// @Param from query string false "Start, RFC3339 or YYYY-MM-DD"
+// @Param to query string false "End (exclusive), RFC3339 or YYYY-MM-DD"
+// @Param limit query int false "Number of accounts (default 10, at most 100)"
+// @Success 200 {object} CounterpartiesRes
+// @Failure 400 {object} ErrorResponse "Invalid range"
+// @Router /admin/stats/counterparties [get]
+// @Security BearerAuth
+func (api *ApiManager) handleGetTopCounterparties(ctx *gin.Context) {
+	from, to, err := statsRange(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	limit := int64(defaultTopCount)
+	if value := ctx.Query("limit"); value != "" {
+		if limit, err = strconv.ParseInt(value, 10, 64); err != nil || limit < 1 || limit > maxTopCount {
+			ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "limit must be between 1 and 100"})
+			return
+		}
+	}
+
+	counterparties, err := api.accMgr.GetTopCounterparties(from, to, limit)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Internal server error"})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, CounterpartiesRes{From: from, To: to, Counterparties: counterparties})
+}
+
+// @Summary Search accounts
+// @Description Paginated account search, newest first (admin only)
+// @ID search-accounts
+// @Produce json
+// @Param name query string false "Part of the account holder's name, case-insensitive"
+// @Param phone query string false "Part of the phone number"
+// @Param role query string false "Role"
+// @Param status query string false "active or erased"
+// @Param min_balance query number false "Lowest balance"
+// @Param max_balance query number false "Highest balance"
+// @Param created_from query string false "Created at or after, RFC3339 or YYYY-MM-DD"
+// @Param created_to query string false "Created before, RFC3339 or YYYY-MM-DD"
+// @Param page query int false "Page, from 1"
+// @Param page_size query int false "Accounts per page (default 50, at most 200)"
+// @Success 200 {object} AccountSearchRes
+// @Failure 400 {object} ErrorResponse "Invalid filter"
+// @Router /admin/accounts/search [get]
+// @Security BearerAuth
+// @Security ApiKeyAuth
+func (api *ApiManager) handleSearchAccounts(ctx *gin.Context) {
+	search := db.AccountSearch{
+		Name:   ctx.Query("name"),
+		Phone:  ctx.Query("phone"),
+		Role:   ctx.Query("role"),
+		Status: ctx.Query("status"),
+	}
+	if search.Status != "" && search.Status != db.AccountStatusActive && search.Status != db.AccountStatusErased {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "status must be active or erased"})
+		return
+	}
+
+	for param, bound := range map[string]**float64{"min_balance": &search.MinBalance, "max_balance": &search.MaxBalance} {
+		if value := ctx.Query(param); value != "" {
+			amount, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Invalid " + param})
+				return
+			}
+			*bound = &amount
+		}
+	}
+	for param, t := range map[string]*time.Time{"created_from": &search.CreatedFrom, "created_to": &search.CreatedTo} {
+		if value := ctx.Query(param); value != "" {
+			parsed, err := parseTimeParam(value)
+			if err != nil {
+				ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Invalid " + param + ", use RFC3339 or YYYY-MM-DD"})
+				return
+			}
+			*t = parsed
+		}
+	}
+	for param, n := range map[string]*int64{"page": &search.Page, "page_size": &search.PageSize} {
+		if value := ctx.Query(param); value != "" {
+			parsed, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || parsed < 1 {
+				ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Invalid " + param})
+				return
+			}
+			*n = parsed
+		}
+	}
+
+	accounts, total, err := api.accMgr.SearchAccounts(search)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Internal server error"})
+		return
+	}
+	api.audit(ctx, "admin.search_accounts", "", map[string]string{"results": strconv.Itoa(len(accounts))})
+
+	res := AccountSearchRes{Accounts: accounts, Total: total, Page: search.Page, PageSize: search.PageSize}
+	if res.Page < 1 {
+		res.Page = 1
+	}
+	if res.PageSize < 1 {
+		res.PageSize = db.DefaultAccountPageSize
+	} else if res.PageSize > db.MaxAccountPageSize {
+		res.PageSize = db.MaxAccountPageSize
+	}
+	ctx.JSON(http.StatusOK, res)
+}
+
+// @Summary Account drill-down
+// @Description Profile, balances, pockets, open AML cases and recent transactions of one account (admin only)
+// @ID get-account-overview
+// @Produce json
+// @Param id path string true "Account ID or account number"
+// @Success 200 {object} AccountOverviewRes
+// @Failure 404 {object} ErrorResponse "Account not found"
+// @Router /admin/accounts/{id}/overview [get]
+// @Security BearerAuth
+// @Security ApiKeyAuth
+func (api *ApiManager) handleGetAccountOverview(ctx *gin.Context) {
+	accountID, err := api.accMgr.ResolveAccountRef(ctx.Param("id"))
+	if err != nil {
+		ctx.JSON(accountRefStatus(err), ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	account, err := api.accMgr.SearchAccountById(accountID)
+	if err != nil || account == nil {
+		ctx.JSON(http.StatusNotFound, ErrorResponse{Message: "Account not found"})
+		return
+	}
+
+	pockets, err := api.accMgr.GetPockets(accountID)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Internal server error"})
+		return
+	}
+	cases, err := api.accMgr.GetAMLCases(db.AMLCaseOpen, accountID)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Internal server error"})
+		return
+	}
+	transactions, err := api.accMgr.GetRecentTransactions(accountID, overviewTransactions)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Internal server error"})
+		return
+	}
+	api.audit(ctx, "admin.view_account", accountID.Hex(), nil)
+
+	res := AccountOverviewRes{
+		Account:            *account,
+		Balance:            account.Balance,
+		Pockets:            pockets,
+		OpenAMLCases:       cases,
+		RecentTransactions: transactions,
+	}
+	for _, pocket := range pockets {
+		res.PocketBalance += pocket.Balance
+	}
+	res.PocketBalance = math.Round(res.PocketBalance*100) / 100
+	ctx.JSON(http.StatusOK, res)
+}
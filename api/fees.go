@@ -0,0 +1,151 @@
+package api
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tamir-liebermann/gobank/db"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// maintenanceFeeInterval is how often the maintenance fee job looks for
+// accounts that haven't been charged this month.
+const maintenanceFeeInterval = time.Hour
+
+// runMaintenanceFees charges monthly maintenance fees in the background.
+// Charging is idempotent per account and month, so running hourly is safe.
+func (api *ApiManager) runMaintenanceFees() {
+	ticker := time.NewTicker(maintenanceFeeInterval)
+	defer ticker.Stop()
+
+	for ; ; <-ticker.C {
+		charged, err := api.accMgr.ChargeMaintenanceFees()
+		if err != nil {
+			log.Printf("Error charging maintenance fees: %v", err)
+			continue
+		}
+		if charged > 0 {
+			log.Printf("Charged maintenance fees to %d accounts", charged)
+		}
+	}
+}
+
+// @Summary List the fee schedule
+// @Description List every fee rule (admin only)
+// @ID get-fee-rules
+// @Produce json
+// @Success 200 {object} FeeRulesRes
+// @Failure 403 {object} ErrorResponse "Not an admin"
+// @Router /admin/fees [get]
+// @Security BearerAuth
+func (api *ApiManager) handleGetFeeRules(ctx *gin.Context) {
+	rules, err := api.accMgr.GetFeeRules()
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Internal server error"})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, FeeRulesRes{Fees: rules})
+}
+
+// @Summary Add a fee rule
+// @Description Add a rule to the fee schedule (admin only)
+// @ID create-fee-rule
+// @Accept json
+// @Produce json
+// @Param fee body FeeRuleRequest true "Fee rule"
+// @Success 201 {object} db.FeeRule
+// @Failure 400 {object} ErrorResponse "Bad request"
+// @Failure 403 {object} ErrorResponse "Not an admin"
+// @Router /admin/fees [post]
+// @Security BearerAuth
+func (api *ApiManager) handleCreateFeeRule(ctx *gin.Context) {
+	var req FeeRuleRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Bad request"})
+		return
+	}
+
+	rule, err := api.accMgr.CreateFeeRule(db.FeeRule{
+		Name:      req.Name,
+		Operation: req.Operation,
+		Role:      req.Role,
+		MinAmount: req.MinAmount,
+		Flat:      req.Flat,
+		Percent:   req.Percent,
+		MaxFee:    req.MaxFee,
+	})
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: err.Error()})
+		return
+	}
+	api.audit(ctx, "fee.rule.create", rule.ID.Hex(), map[string]string{"name": rule.Name, "operation": rule.Operation})
+
+	ctx.JSON(http.StatusCreated, rule)
+}
+
+// @Summary Delete a fee rule
+// @Description Remove a rule from the fee schedule (admin only)
+// @ID delete-fee-rule
+// @Produce json
+// @Param fee_id path string true "Fee rule ID"
+// @Success 200 {object} string "Fee rule deleted"
+// @Failure 404 {object} ErrorResponse "Fee rule not found"
+// @Router /admin/fees/{fee_id} [delete]
+// @Security BearerAuth
+func (api *ApiManager) handleDeleteFeeRule(ctx *gin.Context) {
+	feeID, err := primitive.ObjectIDFromHex(ctx.Param("fee_id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Invalid ID format"})
+		return
+	}
+
+	err = api.accMgr.DeleteFeeRule(feeID)
+	if errors.Is(err, db.ErrFeeRuleNotFound) {
+		ctx.JSON(http.StatusNotFound, ErrorResponse{Message: err.Error()})
+		return
+	} else if err != nil {
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Internal server error"})
+		return
+	}
+	api.audit(ctx, "fee.rule.delete", feeID.Hex(), nil)
+
+	ctx.JSON(http.StatusOK, gin.H{"message": "Fee rule deleted"})
+}
+
+// @Summary Quote a fee
+// @Description Show the fee the caller would pay for a transfer or deposit of the given amount
+// @ID quote-fee
+// @Produce json
+// @Param operation query string true "transfer or deposit"
+// @Param amount query number true "Amount"
+// @Success 200 {object} FeeQuoteRes
+// @Failure 400 {object} ErrorResponse "Bad request"
+// @Router /account/fees/quote [get]
+// @Security BearerAuth
+func (api *ApiManager) handleQuoteFee(ctx *gin.Context) {
+	accountID, err := currentUserID(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	operation := ctx.DefaultQuery("operation", db.FeeOperationTransfer)
+	amount, err := strconv.ParseFloat(ctx.Query("amount"), 64)
+	if err != nil || amount <= 0 {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Amount must be greater than zero"})
+		return
+	}
+
+	fee, err := api.accMgr.QuoteFee(operation, accountID, amount)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Internal server error"})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, FeeQuoteRes{Operation: operation, Amount: amount, Fee: fee})
+}
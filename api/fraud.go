@@ -0,0 +1,271 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tamir-liebermann/gobank/db"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func heldTransferMessage(held *db.HeldTransfer) string {
+	return fmt.Sprintf("Your transfer of %.2f is on hold while our team reviews it for your security. "+
+		"This usually takes a few hours; we'll message you as soon as it's done.", held.Amount)
+}
+
+// transferStoppedReply turns a transfer stopped by screening, by a missing
+// step-up or by the KYC tier limits into the chat reply explaining it.
+func transferStoppedReply(err error) (string, bool) {
+	var kycLimit *db.KYCLimitError
+	if errors.As(err, &kycLimit) {
+		return "Sorry, " + kycLimit.Error() + ".", true
+	}
+	var held *db.TransferHeldError
+	if errors.As(err, &held) {
+		return heldTransferMessage(held.Held), true
+	}
+	if errors.Is(err, db.ErrConfirmLocked) || errors.Is(err, errSecondFactorRequired) || errors.Is(err, errStepUpUnavailable) {
+		return "Sorry, " + err.Error() + ".", true
+	}
+	var blocked *db.TransferBlockedError
+	if errors.As(err, &blocked) {
+		return "This transfer can't be made. Please contact support if you think this is a mistake.", true
+	}
+	return "", false
+}
+
+// transferStoppedStatus is the REST status for a transfer stopped by
+// screening or by the KYC tier limits: accepted while it is held for review,
+// forbidden when it was refused.
+func transferStoppedStatus(err error) (int, bool) {
+	var held *db.TransferHeldError
+	var blocked *db.TransferBlockedError
+	var kycLimit *db.KYCLimitError
+	switch {
+	case errors.As(err, &held):
+		return http.StatusAccepted, true
+	case errors.As(err, &blocked), errors.As(err, &kycLimit):
+		return http.StatusForbidden, true
+	}
+	return 0, false
+}
+
+// reviewHeldTransfer approves or rejects a held transfer. Approved transfers
+// go through the normal transfer path without being screened again.
+func (api *ApiManager) reviewHeldTransfer(ctx *gin.Context, reviewerID, heldID primitive.ObjectID, approve bool, note string) (*db.HeldTransfer, error) {
+	held, err := api.accMgr.ReviewHeldTransfer(heldID, reviewerID, approve, note)
+	if err != nil {
+		return nil, err
+	}
+	api.audit(ctx, "fraud.hold.review", heldID.Hex(), map[string]string{"approve": strconv.FormatBool(approve), "note": note})
+
+	if !approve {
+		go api.notifyAccount(held.FromAccount, fmt.Sprintf("Your transfer of %.2f to %s was declined after review.",
+			held.Amount, api.accountLabel(held.ToAccount)))
+		return held, nil
+	}
+
+	transaction, transferErr := api.performTransfer(ctx, held.FromAccount, held.ToAccount, held.Amount, db.TransferOptions{
+		Category:       held.Category,
+		Memo:           held.Memo,
+		SkipScreening:  true,
+		IdempotencyKey: held.IdempotencyKey,
+	})
+	if err := api.accMgr.CompleteHeldTransfer(held, transaction, transferErr); err != nil {
+		return nil, err
+	}
+
+	if transferErr != nil {
+		go api.notifyAccount(held.FromAccount, fmt.Sprintf("Your transfer of %.2f to %s was approved but could not be completed: %v",
+			held.Amount, api.accountLabel(held.ToAccount), transferErr))
+		return held, nil
+	}
+	go api.notifyAccount(held.FromAccount, fmt.Sprintf("Your transfer of %.2f to %s was approved and sent.",
+		held.Amount, api.accountLabel(held.ToAccount)))
+	if !held.MoneyRequestID.IsZero() {
+		go api.notifyAccount(held.ToAccount, fmt.Sprintf("%s paid your request for %.2f.", api.accountLabel(held.FromAccount), held.Amount))
+	}
+	return held, nil
+}
+
+func heldTransferErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, db.ErrHeldTransferNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, db.ErrHeldTransferClosed):
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// @Summary List fraud rules
+// @Description List the rules every outgoing transfer is screened against (admin only)
+// @ID get-fraud-rules
+// @Produce json
+// @Success 200 {object} FraudRulesRes
+// @Failure 403 {object} ErrorResponse "Not an admin"
+// @Router /admin/fraud/rules [get]
+// @Security BearerAuth
+func (api *ApiManager) handleGetFraudRules(ctx *gin.Context) {
+	rules, err := api.accMgr.GetFraudRules()
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Internal server error"})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, FraudRulesRes{Rules: rules})
+}
+
+// @Summary Add a fraud rule
+// @Description Add a screening rule: new_payee, velocity or new_account_drain, with a hold or block outcome (admin only)
+// @ID create-fraud-rule
+// @Accept json
+// @Produce json
+// @Param rule body FraudRuleRequest true "Fraud rule"
+// @Success 201 {object} db.FraudRule
+// @Failure 400 {object} ErrorResponse "Bad request"
+// @Router /admin/fraud/rules [post]
+// @Security BearerAuth
+func (api *ApiManager) handleCreateFraudRule(ctx *gin.Context) {
+	var req FraudRuleRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Bad request"})
+		return
+	}
+
+	rule, err := api.accMgr.CreateFraudRule(db.FraudRule{
+		Name:           req.Name,
+		Kind:           req.Kind,
+		Outcome:        req.Outcome,
+		Amount:         req.Amount,
+		Count:          req.Count,
+		WindowMinutes:  req.WindowMinutes,
+		AccountAgeDays: req.AccountAgeDays,
+		BalancePercent: req.BalancePercent,
+	})
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: err.Error()})
+		return
+	}
+	api.audit(ctx, "fraud.rule.create", rule.ID.Hex(), map[string]string{"name": rule.Name, "kind": rule.Kind, "outcome": rule.Outcome})
+
+	ctx.JSON(http.StatusCreated, rule)
+}
+
+// @Summary Delete a fraud rule
+// @Description Remove a screening rule (admin only)
+// @ID delete-fraud-rule
+// @Produce json
+// @Param rule_id path string true "Rule ID"
+// @Success 200 {object} string "Fraud rule deleted"
+// @Failure 404 {object} ErrorResponse "Fraud rule not found"
+// @Router /admin/fraud/rules/{rule_id} [delete]
+// @Security BearerAuth
+func (api *ApiManager) handleDeleteFraudRule(ctx *gin.Context) {
+	ruleID, err := primitive.ObjectIDFromHex(ctx.Param("rule_id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Invalid ID format"})
+		return
+	}
+
+	err = api.accMgr.DeleteFraudRule(ruleID)
+	if errors.Is(err, db.ErrFraudRuleNotFound) {
+		ctx.JSON(http.StatusNotFound, ErrorResponse{Message: err.Error()})
+		return
+	} else if err != nil {
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Internal server error"})
+		return
+	}
+	api.audit(ctx, "fraud.rule.delete", ruleID.Hex(), nil)
+
+	ctx.JSON(http.StatusOK, gin.H{"message": "Fraud rule deleted"})
+}
+
+// @Summary List held transfers
+// @Description The fraud review queue. Defaults to transfers still pending review (admin only)
+// @ID get-held-transfers
+// @Produce json
+// @Param status query string false "pending, approved, rejected, failed or blocked; 'all' for everything"
+// @Success 200 {object} HeldTransfersRes
+// @Router /admin/fraud/holds [get]
+// @Security BearerAuth
+func (api *ApiManager) handleGetHeldTransfers(ctx *gin.Context) {
+	status := ctx.DefaultQuery("status", db.HeldTransferPending)
+	if status == "all" {
+		status = ""
+	}
+
+	held, err := api.accMgr.GetHeldTransfers(status)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Internal server error"})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, HeldTransfersRes{Transfers: held})
+}
+
+// @Summary Approve a held transfer
+// @Description Release a held transfer; it is made without being screened again (admin only)
+// @ID approve-held-transfer
+// @Accept json
+// @Produce json
+// @Param hold_id path string true "Held transfer ID"
+// @Param review body ReviewHeldTransferRequest false "Review note"
+// @Success 200 {object} db.HeldTransfer
+// @Failure 404 {object} ErrorResponse "Held transfer not found"
+// @Failure 409 {object} ErrorResponse "Already reviewed"
+// @Router /admin/fraud/holds/{hold_id}/approve [post]
+// @Security BearerAuth
+func (api *ApiManager) handleApproveHeldTransfer(ctx *gin.Context) {
+	api.handleReviewHeldTransfer(ctx, true)
+}
+
+// @Summary Reject a held transfer
+// @Description Decline a held transfer; no money moves (admin only)
+// @ID reject-held-transfer
+// @Accept json
+// @Produce json
+// @Param hold_id path string true "Held transfer ID"
+// @Param review body ReviewHeldTransferRequest false "Review note"
+// @Success 200 {object} db.HeldTransfer
+// @Failure 404 {object} ErrorResponse "Held transfer not found"
+// @Failure 409 {object} ErrorResponse "Already reviewed"
+// @Router /admin/fraud/holds/{hold_id}/reject [post]
+// @Security BearerAuth
+func (api *ApiManager) handleRejectHeldTransfer(ctx *gin.Context) {
+	api.handleReviewHeldTransfer(ctx, false)
+}
+
+func (api *ApiManager) handleReviewHeldTransfer(ctx *gin.Context, approve bool) {
+	reviewerID, err := currentUserID(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	heldID, err := primitive.ObjectIDFromHex(ctx.Param("hold_id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Invalid ID format"})
+		return
+	}
+
+	// The note is optional, so an empty body is fine
+	var req ReviewHeldTransferRequest
+	if ctx.Request.ContentLength > 0 {
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Bad request"})
+			return
+		}
+	}
+
+	held, err := api.reviewHeldTransfer(ctx, reviewerID, heldID, approve, req.Note)
+	if err != nil {
+		ctx.JSON(heldTransferErrorStatus(err), ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, held)
+}
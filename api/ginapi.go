@@ -3,8 +3,12 @@ package api
 import (
 	// "log"
 
+	"errors"
+	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
       
 
 	"github.com/gin-gonic/gin"
@@ -13,13 +17,30 @@ import (
 	ginSwagger "github.com/swaggo/gin-swagger"
 	"github.com/tamir-liebermann/gobank/db"
 	"github.com/tamir-liebermann/gobank/env"
+	"github.com/tamir-liebermann/gobank/storage"
 	"github.com/tamir-liebermann/gobank/utils"
 	"github.com/twilio/twilio-go"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 type ApiManager struct {
 	accMgr       *db.AccManager
 	twilioClient *twilio.RestClient
+	blobs        storage.BlobStore
+
+	// Transfers of at least this much need a fresh second factor
+	stepUpTransferAmount float64
+
+	// Chat actions of these kinds, for at least confirmAmount, need a
+	// one-time code or the transaction PIN to confirm
+	confirmActions map[string]bool
+	confirmAmount  float64
+
+	passwordPolicy *utils.PasswordPolicy
+
+	// Proxies whose X-Forwarded-For is believed for the client IP; with
+	// none, the client IP is the connection's address
+	trustedProxies []string
 }
 
 func NewApiManager(mgr *db.AccManager) *ApiManager {
@@ -30,33 +51,191 @@ func NewApiManager(mgr *db.AccManager) *ApiManager {
 		Password: spec.TwilioAuth,
 	})
 
+	stepUpTransferAmount, err := strconv.ParseFloat(spec.StepUpTransferAmount, 64)
+	if err != nil || stepUpTransferAmount <= 0 {
+		log.Fatalf("STEP_UP_TRANSFER_AMOUNT %q must be a positive amount", spec.StepUpTransferAmount)
+	}
+
+	confirmActions := map[string]bool{}
+	for _, kind := range strings.Split(spec.ChatConfirmActions, ",") {
+		kind = strings.TrimSpace(kind)
+		switch kind {
+		case "":
+		case db.PendingActionTransfer, db.PendingActionPayRequest, db.PendingActionErasure:
+			confirmActions[kind] = true
+		default:
+			log.Fatalf("CHAT_CONFIRM_ACTIONS has unknown action %q", kind)
+		}
+	}
+	confirmAmount, err := strconv.ParseFloat(spec.ChatConfirmAmount, 64)
+	if err != nil || confirmAmount < 0 {
+		log.Fatalf("CHAT_CONFIRM_AMOUNT %q must be an amount of at least 0", spec.ChatConfirmAmount)
+	}
+
+	minLength, err := strconv.Atoi(spec.PasswordMinLength)
+	if err != nil || minLength < 8 {
+		log.Fatalf("PASSWORD_MIN_LENGTH %q must be a number of at least 8", spec.PasswordMinLength)
+	}
+	passwordPolicy, err := utils.NewPasswordPolicy(minLength, spec.PasswordBreachedList)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf("Breached password list %s not found, only checking password length", spec.PasswordBreachedList)
+		passwordPolicy, err = utils.NewPasswordPolicy(minLength, "")
+	}
+	if err != nil {
+		log.Fatalf("Error loading breached password list %s: %v", spec.PasswordBreachedList, err)
+	}
+
+	var trustedProxies []string
+	for _, proxy := range strings.Split(spec.TrustedProxies, ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			trustedProxies = append(trustedProxies, proxy)
+		}
+	}
+
+	// Access tokens are checked against logouts and revoked sessions
+	utils.SetTokenRevocationCheck(mgr.TokenRevoked)
+
 	return &ApiManager{
 		accMgr:       mgr,
 		twilioClient: twilioClient,
+		blobs:        storage.NewLocalDiskStore(spec.KycStorageDir),
+
+		stepUpTransferAmount: stepUpTransferAmount,
+		confirmActions:       confirmActions,
+		confirmAmount:        confirmAmount,
+		passwordPolicy:       passwordPolicy,
+		trustedProxies:       trustedProxies,
 	}
 }
 
 
 func (api *ApiManager) RegisterRoutes(server *gin.Engine) {
+	// ClientIP feeds API key allowlists and login throttling, so it must not
+	// come from a header any caller can set
+	if err := server.SetTrustedProxies(api.trustedProxies); err != nil {
+		log.Fatalf("TRUSTED_PROXIES %v", err)
+	}
+	server.Use(requestID)
 	server.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerfiles.Handler))
 	server.POST("/create", api.handleCreateAccount)
 	server.POST("/login", api.handleLogin)
+	server.POST("/login/2fa", api.handleLoginTwoFactor)
+	server.POST("/token/refresh", api.handleRefreshToken)
+	server.GET("/.well-known/jwks.json", api.handleGetJWKS)
+	server.POST("/password/reset/request", api.handleRequestPasswordReset)
+	server.POST("/password/reset", api.handleResetPassword)
 
 	accounts := server.Group("/account")
 	accounts.Use(api.authWithTwilioOrJwt)
 
-	accounts.GET("/transactions/:id", api.handleGetTransactionsHistory)
-	accounts.GET("/:id", api.handleGetById)
+	accounts.GET("/transactions/:id", api.requireAccountAccess(db.PermAccountsRead), api.handleGetTransactionsHistory)
+	accounts.GET("/:id", api.requireAccountAccess(db.PermAccountsRead), api.handleGetById)
 	accounts.GET("/balance", api.handleCheckBalance)
 	accounts.GET("/name/:account_holder", api.handleGetByNameOrPhone)
-	accounts.DELETE("/:id", api.handleDeleteById)
+	accounts.DELETE("/:id", api.requireAccountAccess(db.PermAccountsDelete), api.handleDeleteById)
 	accounts.POST("/transfer", api.handleTransfer)
 	accounts.POST("/chatgpt", api.handleChatGPTRequest)
 	accounts.POST("/deposit", api.handleDeposit)
-
+	accounts.GET("/payees", api.handleGetPayees)
+	accounts.POST("/payees", api.handleCreatePayee)
+	accounts.PUT("/payees/:payee_id", api.handleRenamePayee)
+	accounts.DELETE("/payees/:payee_id", api.handleDeletePayee)
+	accounts.GET("/requests", api.handleGetMoneyRequests)
+	accounts.POST("/requests", api.handleCreateMoneyRequest)
+	accounts.POST("/requests/:request_id/pay", api.handlePayMoneyRequest)
+	accounts.POST("/requests/:request_id/decline", api.handleDeclineMoneyRequest)
+	accounts.POST("/requests/:request_id/cancel", api.handleCancelMoneyRequest)
+	accounts.GET("/splits", api.handleGetSplits)
+	accounts.POST("/splits", api.handleCreateSplit)
+	accounts.GET("/splits/:split_id", api.handleGetSplit)
+	accounts.GET("/pockets", api.handleGetPockets)
+	accounts.POST("/pockets", api.handleCreatePocket)
+	accounts.GET("/pockets/:pocket_id", api.handleGetPocket)
+	accounts.PUT("/pockets/:pocket_id", api.handleUpdatePocketGoal)
+	accounts.DELETE("/pockets/:pocket_id", api.handleDeletePocket)
+	accounts.POST("/pockets/:pocket_id/move", api.handleMovePocketFunds)
+	accounts.GET("/budgets", api.handleGetBudgets)
+	accounts.POST("/budgets", api.handleCreateBudget)
+	accounts.PUT("/budgets/:budget_id", api.handleUpdateBudget)
+	accounts.DELETE("/budgets/:budget_id", api.handleDeleteBudget)
+	accounts.GET("/fees/quote", api.handleQuoteFee)
+	accounts.GET("/kyc", api.handleGetKYC)
+	accounts.PUT("/kyc", api.handleUpdateKYC)
+	accounts.POST("/kyc/documents", api.handleUploadKYCDocument)
+	accounts.POST("/kyc/submit", api.handleSubmitKYC)
+	accounts.POST("/privacy/export", api.handleRequestDataExport)
+	accounts.POST("/privacy/erasure", api.handleRequestDataErasure)
+	accounts.GET("/privacy/requests", api.handleGetDataRequests)
+	accounts.GET("/privacy/requests/:request_id/download", api.handleDownloadDataExport)
+	accounts.POST("/batches", api.handleCreateBatch)
+	accounts.GET("/batches", api.handleGetBatches)
+	accounts.GET("/batches/:batch_id", api.handleGetBatch)
+	accounts.POST("/batches/:batch_id/confirm", api.handleConfirmBatch)
+	accounts.POST("/batches/:batch_id/cancel", api.handleCancelBatch)
+	accounts.GET("/batches/:batch_id/report", api.handleGetBatchReport)
+	accounts.POST("/logout", api.handleLogout)
+	accounts.GET("/sessions", api.handleGetSessions)
+	accounts.DELETE("/sessions/:session_id", api.handleRevokeSession)
+	accounts.GET("/2fa", api.handleGetTwoFactor)
+	accounts.POST("/2fa/enroll", api.handleEnrollTwoFactor)
+	accounts.POST("/2fa/verify", api.handleVerifyTwoFactor)
+	accounts.POST("/2fa/step-up", api.handleStepUp)
+	accounts.POST("/2fa/recovery-codes", api.handleRegenerateRecoveryCodes)
+	accounts.POST("/2fa/disable", api.handleDisableTwoFactor)
+	accounts.PUT("/phone", api.handleChangePhoneNumber)
+	accounts.PUT("/pin", api.handleSetTransactionPIN)
+	accounts.PUT("/password", api.handleChangePassword)
+
+	// Staff routes; each one needs a permission the caller's role grants
 	admin := server.Group("/admin")
 	admin.Use(api.authWithTwilioOrJwt)
-	admin.GET("/accounts", api.handleGetAccounts)
+	admin.GET("/accounts", api.requirePermission(db.PermAccountsRead), api.handleGetAccounts)
+	admin.POST("/accounts/import", api.requirePermission(db.PermAccountsImport), api.handleImportAccounts)
+	admin.GET("/accounts/search", api.requirePermission(db.PermAccountsRead), api.handleSearchAccounts)
+	admin.GET("/accounts/:id/overview", api.requirePermission(db.PermAccountsRead), api.handleGetAccountOverview)
+	admin.PUT("/accounts/:id/role", api.requirePermission(db.PermRolesManage), api.handleGrantRole)
+	admin.DELETE("/accounts/:id/role", api.requirePermission(db.PermRolesManage), api.handleRevokeRole)
+	admin.GET("/accounts/:id/sessions", api.requirePermission(db.PermAccountsRead), api.handleGetAccountSessions)
+	admin.POST("/accounts/:id/sessions/revoke", api.requirePermission(db.PermSessionsRevoke), api.handleRevokeAccountSessions)
+	admin.POST("/accounts/:id/2fa/reset", api.requirePermission(db.PermTwoFactorReset), api.handleResetTwoFactor)
+	admin.POST("/accounts/:id/unlock", api.requirePermission(db.PermLoginsUnlock), api.handleUnlockAccountLogin)
+	admin.GET("/login-lockouts", api.requirePermission(db.PermAccountsRead), api.handleGetLoginLockouts)
+	admin.DELETE("/login-lockouts/:lockout_id", api.requirePermission(db.PermLoginsUnlock), api.handleDeleteLoginLockout)
+	admin.GET("/roles", api.requirePermission(db.PermRolesManage), api.handleGetRoles)
+	admin.POST("/api-keys", api.requirePermission(db.PermAPIKeysManage), api.handleCreateAPIKey)
+	admin.GET("/api-keys", api.requirePermission(db.PermAPIKeysManage), api.handleGetAPIKeys)
+	admin.DELETE("/api-keys/:key_id", api.requirePermission(db.PermAPIKeysManage), api.handleRevokeAPIKey)
+	admin.GET("/stats/accounts", api.requirePermission(db.PermStatsRead), api.handleGetAccountStats)
+	admin.GET("/stats/transfers", api.requirePermission(db.PermStatsRead), api.handleGetTransferStats)
+	admin.GET("/stats/counterparties", api.requirePermission(db.PermStatsRead), api.handleGetTopCounterparties)
+	admin.GET("/fees", api.requirePermission(db.PermFeesRead), api.handleGetFeeRules)
+	admin.POST("/fees", api.requirePermission(db.PermFeesManage), api.handleCreateFeeRule)
+	admin.DELETE("/fees/:fee_id", api.requirePermission(db.PermFeesManage), api.handleDeleteFeeRule)
+	admin.GET("/fraud/rules", api.requirePermission(db.PermFraudRead), api.handleGetFraudRules)
+	admin.POST("/fraud/rules", api.requirePermission(db.PermFraudManage), api.handleCreateFraudRule)
+	admin.DELETE("/fraud/rules/:rule_id", api.requirePermission(db.PermFraudManage), api.handleDeleteFraudRule)
+	admin.GET("/fraud/holds", api.requirePermission(db.PermFraudRead), api.handleGetHeldTransfers)
+	admin.POST("/fraud/holds/:hold_id/approve", api.requirePermission(db.PermFraudReview), api.handleApproveHeldTransfer)
+	admin.POST("/fraud/holds/:hold_id/reject", api.requirePermission(db.PermFraudReview), api.handleRejectHeldTransfer)
+	admin.GET("/aml/accounts/:id/volumes", api.requirePermission(db.PermAMLRead), api.handleGetAMLVolumes)
+	admin.GET("/aml/cases", api.requirePermission(db.PermAMLRead), api.handleGetAMLCases)
+	admin.GET("/aml/cases/:case_id", api.requirePermission(db.PermAMLRead), api.handleGetAMLCase)
+	admin.POST("/aml/cases/:case_id/notes", api.requirePermission(db.PermAMLManage), api.handleAddAMLCaseNote)
+	admin.POST("/aml/cases/:case_id/close", api.requirePermission(db.PermAMLManage), api.handleCloseAMLCase)
+	admin.GET("/kyc", api.requirePermission(db.PermKYCRead), api.handleGetKYCQueue)
+	admin.GET("/kyc/:id", api.requirePermission(db.PermKYCRead), api.handleGetAccountKYC)
+	admin.GET("/kyc/:id/documents/:document_id", api.requirePermission(db.PermKYCRead), api.handleGetKYCDocument)
+	admin.POST("/kyc/:id/approve", api.requirePermission(db.PermKYCReview), api.handleApproveKYC)
+	admin.POST("/kyc/:id/reject", api.requirePermission(db.PermKYCReview), api.handleRejectKYC)
+	admin.GET("/audit", api.requirePermission(db.PermAuditRead), api.handleGetAuditLog)
+	admin.GET("/audit/verify", api.requirePermission(db.PermAuditRead), api.handleVerifyAuditLog)
+	admin.GET("/privacy/requests", api.requirePermission(db.PermPrivacyRead), api.handleGetAdminDataRequests)
+	admin.POST("/privacy/requests/:request_id/approve", api.requirePermission(db.PermPrivacyReview), api.handleApproveDataRequest)
+	admin.POST("/privacy/requests/:request_id/reject", api.requirePermission(db.PermPrivacyReview), api.handleRejectDataRequest)
+	admin.POST("/adjustments", api.requirePermission(db.PermAdjustmentsMake), api.handleCreateAdjustment)
+	admin.GET("/adjustments", api.requirePermission(db.PermAdjustmentsRead), api.handleGetAdjustments)
+	admin.POST("/adjustments/:adjustment_id/approve", api.requirePermission(db.PermAdjustmentsSign), api.handleApproveAdjustment)
+	admin.POST("/adjustments/:adjustment_id/reject", api.requirePermission(db.PermAdjustmentsSign), api.handleRejectAdjustment)
 	server.POST("/webhook",  api.handleTwilioWebhook, api.authWithTwilioOrJwt)
 	server.GET("/health", api.healthCheckHandler)
 
@@ -101,29 +280,53 @@ func  (api *ApiManager) jwtAuthenticate(context *gin.Context) {
 // first, if this is twilio req implement getAccountFromTwilioReq here...
 	
 	
-	token := context.Request.Header.Get("Authorization")
-
-	if token == "" {
+	// Accepts "Bearer <jwt>" as well as the bare token
+	token, err := utils.ExtractStringTokenFromHeader(context.Request.Header.Get("Authorization"))
+	if err != nil {
 		context.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "Not authorized"})
 		return
 	}
 
-	userId, err := utils.VerifyToken(token)
+	claims, err := utils.ParseAccessToken(token)
 
 	if err != nil {
 		context.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "Not authorized"})
 		return
 	}
 
-	context.Set("userId", userId)
+	context.Set("userId", claims.UserID)
+	context.Set(sessionIDKey, claims.SessionID)
+	context.Set(tokenIDKey, claims.TokenID)
+	context.Set(tokenExpiresAtKey, claims.ExpiresAt)
+	context.Set(authSourceKey, db.AuditSourceJWT)
 	context.Next()
 }
 
 
+// currentUserID returns the authenticated account ID set by the auth middleware.
+func currentUserID(ctx *gin.Context) (primitive.ObjectID, error) {
+	userId, exists := ctx.Get("userId")
+	if !exists {
+		return primitive.NilObjectID, errors.New("user ID not found in context")
+	}
+
+	userIdStr, ok := userId.(string)
+	if !ok || userIdStr == "" {
+		return primitive.NilObjectID, errors.New("invalid user ID in context")
+	}
+
+	return primitive.ObjectIDFromHex(userIdStr)
+}
+
 func (api *ApiManager)authWithTwilioOrJwt (c *gin.Context) {
+	if c.GetHeader(apiKeyHeader) != "" {
+		api.apiKeyAuthenticate(c)
+		return
+	}
 	if validateTwilioRequest(c) {
 		api.twilioAuthenticate(c)
-	} 
+		return
+	}
 	api.jwtAuthenticate(c)
 	
 }
@@ -132,6 +335,14 @@ func (api *ApiManager) Run() {
 	server := gin.Default()
 	api.RegisterRoutes(server)
 
+	keys, err := utils.Keys()
+	if err != nil {
+		log.Fatalf("Error loading token signing keys: %v", err)
+	}
+
+	go api.runMaintenanceFees()
+	go api.runKeyRotation(keys)
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "5252"
@@ -3,8 +3,11 @@ package api
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
+	"regexp"
 	"strings"
 
 	"github.com/tamir-liebermann/gobank/db"
@@ -25,7 +28,23 @@ const (
 	DEPOSIT_INTENT          = "deposit"
 	BALANCE_CHECK_INTENT    = "balance"
 	GET_ALL_ACCOUNTS_INTENT = "all accounts"
-	
+	SAVE_PAYEE_INTENT       = "save payee"
+	LIST_PAYEES_INTENT      = "payees"
+	REQUEST_MONEY_INTENT    = "request money"
+	PAY_REQUEST_INTENT      = "pay request"
+	DECLINE_REQUEST_INTENT  = "decline request"
+	MONEY_REQUESTS_INTENT   = "money requests"
+	SPLIT_INTENT            = "split"
+	SPLIT_STATUS_INTENT     = "split status"
+	CREATE_POCKET_INTENT    = "create pocket"
+	MOVE_POCKET_INTENT      = "move to pocket"
+	POCKET_GOAL_INTENT      = "pocket goal"
+	SET_BUDGET_INTENT       = "set budget"
+	BUDGET_STATUS_INTENT    = "budget status"
+	CONFIRM_INTENT          = "confirm"
+	CANCEL_INTENT           = "cancel"
+	EXPORT_DATA_INTENT      = "export data"
+	ERASE_DATA_INTENT       = "erase data"
 )
 
 // type AgentTransferRequest struct {
@@ -49,7 +68,6 @@ type GenericRequest struct {
 // @Failure 500 {object} ErrorResponse "Internal server error"
 // @Router /account/chatgpt [post]
 func (api *ApiManager) handleChatGPTRequest(ctx *gin.Context) {
-	spec := env.New()
 	var chatReq ChatReq
 	if err := ctx.ShouldBindJSON(&chatReq); err != nil {
 		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
@@ -65,6 +83,10 @@ func (api *ApiManager) handleChatGPTRequest(ctx *gin.Context) {
 		ctx.JSON(http.StatusBadRequest, gin.H{"error": "accountId is required"})
 		return
 	}
+	// WhatsApp messages keep their twilio source; in-app chat is audited as chat
+	if ctx.GetString(authSourceKey) != db.AuditSourceTwilio {
+		ctx.Set(authSourceKey, db.AuditSourceChat)
+	}
 	var acc db.BankAccount
 	twilioAcc, ok := ctx.Get(TwilioUser)
 	if ok {
@@ -83,104 +105,35 @@ func (api *ApiManager) handleChatGPTRequest(ctx *gin.Context) {
 		accountId = acc.ID.Hex()
 	}
 
-	client := openai.NewClient(spec.OpenaiApiKey)
-	
-
-	rules := `
-		You are a bank API, you reply in json objects only, if unsure ask for clarification ,
-		 try to guide the first time user present him the intent map in a human readable bullet pointes
-		 and not json.
-
-		If the user's intent is clear but the input does not match the spec please guide him on the correct request parameters
-	    Make it feel like a natrual conversation , you can use humor.
-
-		If the user wants to transfer to phone number, give them:
-		{
-			"intent": "transfer", // must be this keyword
-			"body":{
-				
-				to:"string", // must be the phone number only,
-				amount:"float" // must be specified
-			}
-			
-		}
-
-		If the user wants to search for another account by spesific phone number, give them: 
-		{
-			"intent": "find this account", // must be this keyword
-			"body": {
-				"phone_number":"string", // must be the phone number 
-			}
-		}
-
-		If the user wants to see his transactions history , give them a formatted table of the transactions history :
-		{
-		"intent": "transactions", // must be this keyword 
-			
+	// Keep the transcript of every exchange that got a reply
+	defer func() {
+		reply, ok := ctx.Get("response")
+		if !ok {
+			return
 		}
-
-		If the user wants to search for account by his name or his phone   , give them:
-		{
-			"intent": "search", // must be this keyword
-			"body": {
-				"account_holder": "string", // must be the account holder
-				"phone_number": "string", // must be the account's phone number
-			}
+		accountID, err := currentUserID(ctx)
+		if err != nil {
+			return
 		}
-
-		If the user wants to deposit money to his account , give them:
-		{
-			"intent": "deposit", // must be this keyword
-			"body": {
-				
-				"amount": "float" // must be specified
-			}
+		if err := api.accMgr.RecordChatMessage(accountID, ctx.GetString(authSourceKey), chatReq.UserText, fmt.Sprintf("%v", reply)); err != nil {
+			log.Printf("Error recording chat message for %s: %v", accountID.Hex(), err)
 		}
+	}()
 
-		If the user wants to check his account balance , give them :
-		{
-			"intent": "balance", // must be this keyword
-			"body": {
-				
-				"balance": "float" // must be specified
-			}
-		}
-
-		If the user is admin and wants to see the all the existing accounts, give them: 
-		{	
-			"intent": "all accounts", // must be this keyword
-			"body" :{
-				
-			}
+	textResp, ok := quickReply(userInput)
+	if !ok {
+		var err error
+		textResp, err = askChatGPT(userInput)
+		if err != nil {
+			fmt.Printf("ChatCompletion error: %v\n", err)
+			return
 		}
-	`
-	resp, err := client.CreateChatCompletion(
-		context.Background(),
-		openai.ChatCompletionRequest{
-			Model: openai.GPT3Dot5Turbo,
-			Messages: []openai.ChatCompletionMessage{
-				{
-					Role:    openai.ChatMessageRoleSystem,
-					Content: rules,
-				},
-				{
-					Role:    openai.ChatMessageRoleUser,
-					Content: userInput,
-				},
-			},
-		},
-	)
-	if err != nil {
-		fmt.Printf("ChatCompletion error: %v\n", err)
-		return
 	}
 
-	textResp := resp.Choices[0].Message.Content
-
 	var req GenericRequest
 	var response string
 
-	err = json.Unmarshal([]byte(textResp), &req)
+	err := json.Unmarshal([]byte(textResp), &req)
 	if err != nil {
 		ctx.JSON(http.StatusBadRequest, gin.H{"message": textResp})
 		response = fmt.Sprintf("%v", textResp)
@@ -196,9 +149,36 @@ func (api *ApiManager) handleChatGPTRequest(ctx *gin.Context) {
 		SEARCH_INTENT: "Please provide a valid account name or phone",
 		DEPOSIT_INTENT:"Please provide a valid amount",
 		BALANCE_CHECK_INTENT:"Check for typos",
-		GET_ALL_ACCOUNTS_INTENT:"You are not the Admin! ",
+		GET_ALL_ACCOUNTS_INTENT:"You are not allowed to list accounts",
+		SAVE_PAYEE_INTENT:"Please provide a nickname and a valid phone number",
+		LIST_PAYEES_INTENT:"Could not load your payees",
+		REQUEST_MONEY_INTENT:"Please provide who should pay and a valid amount",
+		PAY_REQUEST_INTENT:"Could not pay the request",
+		DECLINE_REQUEST_INTENT:"Could not decline the request",
+		MONEY_REQUESTS_INTENT:"Could not load your money requests",
+		SPLIT_INTENT:"Please provide a total and who to split it with",
+		SPLIT_STATUS_INTENT:"Could not load your splits",
+		CREATE_POCKET_INTENT:"Please provide a pocket name",
+		MOVE_POCKET_INTENT:"Please provide a pocket and a valid amount",
+		POCKET_GOAL_INTENT:"Could not load your pockets",
+		SET_BUDGET_INTENT:"Please provide a category or person and a monthly limit",
+		BUDGET_STATUS_INTENT:"Could not load your budgets",
+		CONFIRM_INTENT:"Could not complete the confirmed request",
+		CANCEL_INTENT:"Could not cancel the request",
+		EXPORT_DATA_INTENT:"Could not request your data export",
+		ERASE_DATA_INTENT:"Could not request erasure of your data",
 	}
    
+	// Staff-only intents need the same permission as their endpoint
+	if permission, ok := intentPermissions[req.Intent]; ok {
+		if err := api.checkPermission(ctx, permission); err != nil {
+			ctx.JSON(http.StatusForbidden, gin.H{"message": errorMsgMap[req.Intent]})
+			response = errorMsgMap[req.Intent]
+			ctx.Set("response", response)
+			return
+		}
+	}
+
 	// todo use transfer req
 	
 	switch req.Intent {
@@ -217,7 +197,16 @@ func (api *ApiManager) handleChatGPTRequest(ctx *gin.Context) {
 		}
 		accountId := fmt.Sprintf("%v", accountId)
 		
-		err = api.handleTransferIntent(accountId, transferReq.To, transferReq.Amount)
+		pending, err := api.handleTransferIntent(ctx, accountId, transferReq.To, transferReq.Amount, transferReq.Category)
+		var ambiguousPayee *AmbiguousPayeeError
+		if errors.As(err, &ambiguousPayee) {
+			response = ambiguousPayee.Error()
+			break
+		}
+		if reply, ok := transferStoppedReply(err); ok {
+			response = reply
+			break
+		}
 		if err != nil {
 			ctx.JSON(http.StatusInternalServerError, gin.H{"message": errorMsgMap[req.Intent]})
 			response = errorMsgMap[req.Intent]
@@ -225,7 +214,15 @@ func (api *ApiManager) handleChatGPTRequest(ctx *gin.Context) {
 			return
 		}
 		
+		if pending != nil {
+			response = pending.Summary
+			break
+		}
+
 		response = fmt.Sprintf("Transfer request processed successfully : %v To  %v", transferReq.Amount, transferReq.To)
+		if PhoneNumberRegexp.MatchString(transferReq.To) || primitive.IsValidObjectID(transferReq.To) {
+			response += "\nTip: reply \"save as <nickname>\" to add them to your payees."
+		}
 	case FIND_ACCOUNT_BY_PHONE_INTENT:
 		bodyBytes, err := json.Marshal(req.Body)
 	    if err != nil {
@@ -305,6 +302,11 @@ func (api *ApiManager) handleChatGPTRequest(ctx *gin.Context) {
 		}
 
 		 newBalance, err := api.handleDepositIntent(ctx, depositReq.Amount)
+		var kycLimit *db.KYCLimitError
+		if errors.As(err, &kycLimit) {
+			response = "Sorry, " + kycLimit.Error() + "."
+			break
+		}
     if err != nil {
         ctx.JSON(http.StatusInternalServerError, gin.H{"message": errorMsgMap[req.Intent]})
 		response = errorMsgMap[req.Intent]
@@ -331,7 +333,7 @@ func (api *ApiManager) handleChatGPTRequest(ctx *gin.Context) {
 	}
 
 	// Call API method to get balance and transactions for the current account
-	balance, transactions, err := api.handleCheckBalanceIntent(accountId, "")
+	account, transactions, err := api.handleCheckBalanceIntent(accountId, "")
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message:  errorMsgMap[req.Intent]})
 		response = errorMsgMap[req.Intent]
@@ -340,19 +342,9 @@ func (api *ApiManager) handleChatGPTRequest(ctx *gin.Context) {
 	}
 
 	// Prepare response with balance and transactions
-	transactionInfos := make([]TransactionInfo, 0)
-	for _, transaction := range transactions {
-		if transaction.ToAccount.Hex() == accountId {
-			transactionInfos = append(transactionInfos, TransactionInfo{
-				FromAccount: transaction.FromAccount.Hex(),
-				Amount:      transaction.Amount,
-			})
-		}
-	}
-
 	balResponse := BalanceResponse{
-		Balance:      balance,
-		Transactions: transactionInfos,
+		Balance:      fmt.Sprintf("%.2f", account.Balance),
+		Transactions: incomingTransfers(account.ID, transactions),
 	}
 
 	response =fmt.Sprintf("balance found: %v , ",balResponse.Balance )
@@ -382,12 +374,544 @@ func (api *ApiManager) handleChatGPTRequest(ctx *gin.Context) {
 		// Respond with the fetched accounts
 		response = fmt.Sprintf("Accounts: %v", accounts)
 
+	case SAVE_PAYEE_INTENT:
+		var savePayeeReq SavePayeeIntentReq
+		if err := decodeIntentBody(req.Body, &savePayeeReq); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": "please specify a clear request"})
+			return
+		}
+
+		payee, err := api.handleSavePayeeIntent(ctx, savePayeeReq)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			response = fmt.Sprintf("%s: %v", errorMsgMap[req.Intent], err)
+			ctx.Set("response", response)
+			return
+		}
+
+		response = fmt.Sprintf("Saved %s (%s) to your payees. Next time just say \"send 50 to %s\".", payee.Nickname, payee.PhoneNumber, payee.Nickname)
+
+	case LIST_PAYEES_INTENT:
+		payeesList, err := api.handleListPayeesIntent(ctx)
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"message": errorMsgMap[req.Intent]})
+			response = errorMsgMap[req.Intent]
+			ctx.Set("response", response)
+			return
+		}
+
+		response = payeesList
+
+	case REQUEST_MONEY_INTENT:
+		var moneyReq MoneyRequestReq
+		if err := decodeIntentBody(req.Body, &moneyReq); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": "please specify a clear request"})
+			return
+		}
+
+		request, err := api.handleRequestMoneyIntent(ctx, moneyReq)
+		var ambiguousPayee *AmbiguousPayeeError
+		if errors.As(err, &ambiguousPayee) {
+			response = ambiguousPayee.Error()
+			break
+		}
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			response = fmt.Sprintf("%s: %v", errorMsgMap[req.Intent], err)
+			ctx.Set("response", response)
+			return
+		}
+
+		response = fmt.Sprintf("Requested %.2f from %s. I'll let you know when they reply.", request.Amount, api.accountLabel(request.PayerID))
+
+	case PAY_REQUEST_INTENT, DECLINE_REQUEST_INTENT:
+		var replyReq MoneyRequestReplyReq
+		if err := decodeIntentBody(req.Body, &replyReq); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": "please specify a clear request"})
+			return
+		}
+
+		pay := req.Intent == PAY_REQUEST_INTENT
+		request, pending, err := api.handleMoneyRequestReplyIntent(ctx, replyReq, pay)
+		if reply, ok := transferStoppedReply(err); ok {
+			response = reply
+			break
+		}
+		if err != nil {
+			ctx.JSON(moneyRequestErrorStatus(err), gin.H{"message": err.Error()})
+			response = fmt.Sprintf("%s: %v", errorMsgMap[req.Intent], err)
+			ctx.Set("response", response)
+			return
+		}
+
+		if pending != nil {
+			response = pending.Summary
+		} else if pay {
+			response = fmt.Sprintf("Paid %.2f to %s.", request.Amount, api.accountLabel(request.RequesterID))
+		} else {
+			response = fmt.Sprintf("Declined the request for %.2f from %s.", request.Amount, api.accountLabel(request.RequesterID))
+		}
+
+	case MONEY_REQUESTS_INTENT:
+		requestsList, err := api.handleListMoneyRequestsIntent(ctx)
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"message": errorMsgMap[req.Intent]})
+			response = errorMsgMap[req.Intent]
+			ctx.Set("response", response)
+			return
+		}
+
+		response = requestsList
+
+	case SPLIT_INTENT:
+		var splitReq SplitIntentReq
+		if err := decodeIntentBody(req.Body, &splitReq); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": "please specify a clear request"})
+			return
+		}
+
+		split, err := api.handleSplitIntent(ctx, splitReq)
+		var ambiguousPayee *AmbiguousPayeeError
+		if errors.As(err, &ambiguousPayee) {
+			response = ambiguousPayee.Error()
+			break
+		}
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			response = fmt.Sprintf("%s: %v", errorMsgMap[req.Intent], err)
+			ctx.Set("response", response)
+			return
+		}
+
+		var sb strings.Builder
+		sb.WriteString(fmt.Sprintf("Split %.2f for %s. I sent payment requests to:\n", split.Total, split.Description))
+		for _, share := range split.Shares {
+			sb.WriteString(fmt.Sprintf("- %s: %.2f\n", api.accountLabel(share.AccountID), share.Amount))
+		}
+		if split.OwnerShare > 0 {
+			sb.WriteString(fmt.Sprintf("Your share is %.2f.", split.OwnerShare))
+		}
+		response = sb.String()
+
+	case SPLIT_STATUS_INTENT:
+		splitStatus, err := api.handleSplitStatusIntent(ctx)
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"message": errorMsgMap[req.Intent]})
+			response = errorMsgMap[req.Intent]
+			ctx.Set("response", response)
+			return
+		}
+
+		response = splitStatus
+
+	case CREATE_POCKET_INTENT:
+		var pocketReq CreatePocketRequest
+		if err := decodeIntentBody(req.Body, &pocketReq); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": "please specify a clear request"})
+			return
+		}
+
+		pocket, err := api.handleCreatePocketIntent(ctx, pocketReq)
+		if err != nil {
+			ctx.JSON(pocketErrorStatus(err), gin.H{"message": err.Error()})
+			response = fmt.Sprintf("%s: %v", errorMsgMap[req.Intent], err)
+			ctx.Set("response", response)
+			return
+		}
+
+		response = fmt.Sprintf("Created your %s pocket. Say \"move 100 to %s\" to start saving.", pocket.Name, pocket.Name)
+
+	case MOVE_POCKET_INTENT:
+		var moveReq MovePocketIntentReq
+		if err := decodeIntentBody(req.Body, &moveReq); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": "please specify a clear request"})
+			return
+		}
+
+		pocket, err := api.handleMovePocketIntent(ctx, moveReq)
+		if err != nil {
+			ctx.JSON(pocketErrorStatus(err), gin.H{"message": err.Error()})
+			response = fmt.Sprintf("%s: %v", errorMsgMap[req.Intent], err)
+			ctx.Set("response", response)
+			return
+		}
+
+		if moveReq.Direction == "out" {
+			response = fmt.Sprintf("Moved %.2f out of %s. ", moveReq.Amount, pocket.Name)
+		} else {
+			response = fmt.Sprintf("Moved %.2f to %s. ", moveReq.Amount, pocket.Name)
+		}
+		response += formatPocketProgress(pocketProgress(*pocket))
+
+	case POCKET_GOAL_INTENT:
+		var goalReq PocketGoalIntentReq
+		if err := decodeIntentBody(req.Body, &goalReq); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": "please specify a clear request"})
+			return
+		}
+
+		goal, err := api.handlePocketGoalIntent(ctx, goalReq)
+		if err != nil {
+			ctx.JSON(pocketErrorStatus(err), gin.H{"message": err.Error()})
+			response = fmt.Sprintf("%s: %v", errorMsgMap[req.Intent], err)
+			ctx.Set("response", response)
+			return
+		}
+
+		response = goal
+
+	case SET_BUDGET_INTENT:
+		var budgetReq BudgetRequest
+		if err := decodeIntentBody(req.Body, &budgetReq); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": "please specify a clear request"})
+			return
+		}
+
+		budget, err := api.handleSetBudgetIntent(ctx, budgetReq)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			response = fmt.Sprintf("%s: %v", errorMsgMap[req.Intent], err)
+			ctx.Set("response", response)
+			return
+		}
+
+		response = fmt.Sprintf("Set a monthly budget of %.2f for %s. I'll message you at %v%% of it.", budget.MonthlyLimit, budget.Name, budget.Thresholds)
+
+	case BUDGET_STATUS_INTENT:
+		budgetStatus, err := api.handleBudgetStatusIntent(ctx)
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"message": errorMsgMap[req.Intent]})
+			response = errorMsgMap[req.Intent]
+			ctx.Set("response", response)
+			return
+		}
+
+		response = budgetStatus
+
+	case CONFIRM_INTENT, CANCEL_INTENT:
+		var reply string
+		var err error
+		if req.Intent == CANCEL_INTENT {
+			reply, err = api.handleCancelIntent(ctx)
+		} else {
+			var confirmReq ConfirmIntentReq
+			if err := decodeIntentBody(req.Body, &confirmReq); err != nil {
+				ctx.JSON(http.StatusBadRequest, gin.H{"message": "please specify a clear request"})
+				return
+			}
+			reply, err = api.handleConfirmIntent(ctx, confirmReq.Code)
+		}
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"message": errorMsgMap[req.Intent]})
+			response = errorMsgMap[req.Intent]
+			ctx.Set("response", response)
+			return
+		}
+
+		response = reply
+
+	case EXPORT_DATA_INTENT, ERASE_DATA_INTENT:
+		handle := api.handleExportDataIntent
+		if req.Intent == ERASE_DATA_INTENT {
+			handle = api.handleEraseDataIntent
+		}
+		reply, err := handle(ctx)
+		if err != nil {
+			ctx.JSON(privacyErrorStatus(err), gin.H{"message": err.Error()})
+			response = fmt.Sprintf("%s: %v", errorMsgMap[req.Intent], err)
+			ctx.Set("response", response)
+			return
+		}
+
+		response = reply
+
 	}
 	ctx.JSON(http.StatusOK, gin.H{"response": response})
 	ctx.Set("response", response) // Set response in Gin context for retrieval
 	ctx.Next()
 
 }
+// askChatGPT asks the model to turn the user's text into an intent JSON object.
+func askChatGPT(userInput string) (string, error) {
+	spec := env.New()
+	client := openai.NewClient(spec.OpenaiApiKey)
+	
+
+	rules := `
+		You are a bank API, you reply in json objects only, if unsure ask for clarification ,
+		 try to guide the first time user present him the intent map in a human readable bullet pointes
+		 and not json.
+
+		If the user's intent is clear but the input does not match the spec please guide him on the correct request parameters
+	    Make it feel like a natrual conversation , you can use humor.
+
+		If the user wants to transfer to phone number, give them:
+		{
+			"intent": "transfer", // must be this keyword
+			"body":{
+				
+				to:"string", // the phone number, account id, account number (like IL34GOBK0000000001) or saved payee nickname exactly as the user wrote it,
+				amount:"float", // must be specified
+				category:"string" // optional spending category such as "groceries" or "rent" if the user mentions one
+			}
+			
+		}
+
+		If the user wants to save someone as a payee (for example "save him as Dana" right after a transfer), give them:
+		{
+			"intent": "save payee", // must be this keyword
+			"body": {
+				"nickname": "string", // must be specified
+				"to": "string" // phone number or account id, leave empty to save the last transfer's recipient
+			}
+		}
+
+		If the user wants to see his saved payees, give them:
+		{
+			"intent": "payees", // must be this keyword
+			"body": {
+			}
+		}
+
+		If the user wants to ask someone else to send him money, give them:
+		{
+			"intent": "request money", // must be this keyword
+			"body": {
+				"from": "string", // phone number, account id or saved payee nickname of who should pay
+				"amount": "float", // must be specified
+				"note": "string" // what the money is for
+			}
+		}
+
+		If the user wants to pay or decline a money request he received, give them:
+		{
+			"intent": "pay request", // or "decline request"
+			"body": {
+				"request_id": "string" // leave empty for the most recent request
+			}
+		}
+
+		If the user wants to see his pending money requests, give them:
+		{
+			"intent": "money requests", // must be this keyword
+			"body": {
+			}
+		}
+
+		If the user wants to split an expense with other people (for example "split 240 for dinner with Dana, Avi and Noa"), give them:
+		{
+			"intent": "split", // must be this keyword
+			"body": {
+				"amount": "float", // the total, must be specified
+				"description": "string", // what the expense was for
+				"participants": ["string"], // phone numbers, account ids or payee nicknames, not including the user
+				"shares": {"string": "float"}, // only if the user gave custom amounts, keyed by participant
+				"include_me": "bool" // false only if the user says he is not part of the split
+			}
+		}
+
+		If the user wants to know who has paid him back for a split, give them:
+		{
+			"intent": "split status", // must be this keyword
+			"body": {
+			}
+		}
+
+		If the user wants to create a savings pocket (for example "vacation" or "car"), give them:
+		{
+			"intent": "create pocket", // must be this keyword
+			"body": {
+				"name": "string", // must be specified
+				"target_amount": "float", // optional goal
+				"target_date": "string" // optional, YYYY-MM-DD
+			}
+		}
+
+		If the user wants to move money into or out of a pocket (for example "move 100 to vacation"), give them:
+		{
+			"intent": "move to pocket", // must be this keyword
+			"body": {
+				"pocket": "string", // the pocket name
+				"amount": "float", // must be specified
+				"direction": "string" // "in" to put money in the pocket, "out" to take it back
+			}
+		}
+
+		If the user asks about his pockets or how close he is to a goal (for example "how close am I to my car goal"), give them:
+		{
+			"intent": "pocket goal", // must be this keyword
+			"body": {
+				"pocket": "string" // the pocket name, leave empty for all pockets
+			}
+		}
+
+		If the user wants to set a monthly budget (for example "set a 1000 budget for groceries"), give them:
+		{
+			"intent": "set budget", // must be this keyword
+			"body": {
+				"category": "string", // the spending category, or
+				"counterparty": "string", // a phone number or payee nickname if the budget is for one person
+				"monthly_limit": "float", // must be specified
+				"thresholds": ["float"] // optional alert percentages, default 80 and 100
+			}
+		}
+
+		If the user asks how he is doing on his budgets, give them:
+		{
+			"intent": "budget status", // must be this keyword
+			"body": {
+			}
+		}
+
+		If the user confirms or cancels a transfer, payment or erasure he was just asked to confirm, give them:
+		{
+			"intent": "confirm", // or "cancel"
+			"body": {
+				"code": "string" // the confirmation code or PIN if he gave one, digits only
+			}
+		}
+
+		If the user wants a copy of all the data we hold about him, give them:
+		{
+			"intent": "export data", // must be this keyword
+			"body": {
+			}
+		}
+
+		If the user wants his personal data erased or his account forgotten, give them:
+		{
+			"intent": "erase data", // must be this keyword
+			"body": {
+			}
+		}
+
+		If the user wants to search for another account by spesific phone number, give them: 
+		{
+			"intent": "find this account", // must be this keyword
+			"body": {
+				"phone_number":"string", // must be the phone number 
+			}
+		}
+
+		If the user wants to see his transactions history , give them a formatted table of the transactions history :
+		{
+		"intent": "transactions", // must be this keyword 
+			
+		}
+
+		If the user wants to search for account by his name or his phone   , give them:
+		{
+			"intent": "search", // must be this keyword
+			"body": {
+				"account_holder": "string", // must be the account holder
+				"phone_number": "string", // must be the account's phone number
+			}
+		}
+
+		If the user wants to deposit money to his account , give them:
+		{
+			"intent": "deposit", // must be this keyword
+			"body": {
+				
+				"amount": "float" // must be specified
+			}
+		}
+
+		If the user wants to check his account balance , give them :
+		{
+			"intent": "balance", // must be this keyword
+			"body": {
+				
+				"balance": "float" // must be specified
+			}
+		}
+
+		If the user is admin and wants to see the all the existing accounts, give them: 
+		{	
+			"intent": "all accounts", // must be this keyword
+			"body" :{
+				
+			}
+		}
+	`
+	resp, err := client.CreateChatCompletion(
+		context.Background(),
+		openai.ChatCompletionRequest{
+			Model: openai.GPT3Dot5Turbo,
+			Messages: []openai.ChatCompletionMessage{
+				{
+					Role:    openai.ChatMessageRoleSystem,
+					Content: rules,
+				},
+				{
+					Role:    openai.ChatMessageRoleUser,
+					Content: userInput,
+				},
+			},
+		},
+	)
+	if err != nil {
+		return "", err
+	}
+
+	return resp.Choices[0].Message.Content, nil
+}
+
+var (
+	quickReplyRegexp   = regexp.MustCompile(`^(pay|decline)(?:\s+([0-9a-f]{24}))?[.!]?$`)
+	confirmReplyRegexp = regexp.MustCompile(`^(confirm|cancel)(?:\s+(\d{4,8}))?[.!]?$`)
+	codeReplyRegexp    = regexp.MustCompile(`^(\d{4,8})$`)
+)
+
+// quickReply recognises short WhatsApp replies such as "pay" or "decline" to a
+// money request, or "confirm" and "cancel" to a quoted transfer, optionally
+// with a confirmation code, and builds the intent JSON directly, without a
+// round trip to GPT. A reply of just a code confirms too.
+func quickReply(userInput string) (string, bool) {
+	if match := codeReplyRegexp.FindStringSubmatch(userInput); match != nil {
+		userInput = CONFIRM_INTENT + " " + match[1]
+	}
+	if match := confirmReplyRegexp.FindStringSubmatch(userInput); match != nil {
+		body := map[string]interface{}{}
+		if match[2] != "" {
+			body["code"] = match[2]
+		}
+		b, err := json.Marshal(GenericRequest{Intent: match[1], Body: body})
+		if err != nil {
+			return "", false
+		}
+		return string(b), true
+	}
+
+	match := quickReplyRegexp.FindStringSubmatch(userInput)
+	if match == nil {
+		return "", false
+	}
+
+	intent := PAY_REQUEST_INTENT
+	if match[1] == "decline" {
+		intent = DECLINE_REQUEST_INTENT
+	}
+
+	b, err := json.Marshal(GenericRequest{
+		Intent: intent,
+		Body:   map[string]interface{}{"request_id": match[2]},
+	})
+	if err != nil {
+		return "", false
+	}
+	return string(b), true
+}
+
+// decodeIntentBody converts the free-form body of a GPT intent into v.
+func decodeIntentBody(body map[string]interface{}, v interface{}) error {
+	bodyBytes, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(bodyBytes, v)
+}
+
 func (api *ApiManager) handleTransactionsIntent(ctx *gin.Context) (string, error) {
 	accountId, ok := ctx.Get("userId")
 	if !ok || accountId == "" {
@@ -413,29 +937,72 @@ func (api *ApiManager) handleTransactionsIntent(ctx *gin.Context) (string, error
 }
 
 
-func (api *ApiManager) handleTransferIntent(from, to string, amount float64) error {
+// handleTransferIntent sends a chat transfer straight away when it is free
+// and needs no confirmation code. Otherwise it is returned as a pending
+// action, and only goes through once the user replies "confirm".
+func (api *ApiManager) handleTransferIntent(ctx *gin.Context, from, to string, amount float64, category string) (*db.PendingAction, error) {
 	fromAccountID, err := primitive.ObjectIDFromHex(from)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	// 'to' may be an account ID, a phone number or a saved payee nickname
+	toAccountID, err := api.resolveRecipient(fromAccountID, to)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := api.chatStepUp(ctx, fromAccountID, amount); err != nil {
+		return nil, err
+	}
+
+	fee, err := api.accMgr.QuoteFee(db.FeeOperationTransfer, fromAccountID, amount)
+	if err != nil {
+		return nil, err
+	}
+	if fee > 0 || api.needsCode(db.PendingActionTransfer, amount) {
+		return api.quoteTransfer(fromAccountID, toAccountID, amount, category, fee)
 	}
-	var toAccountID primitive.ObjectID
-    // Check if 'to' is an ObjectID (account ID))
-     if toAccountID, err = primitive.ObjectIDFromHex(to); err != nil {
-        // 'to' is not a valid ObjectID, assume it's a phone number
-        account, err := api.accMgr.GetAccountByPhone(to)
-        if err != nil {
-            return fmt.Errorf("error finding account by phone: %v", err)
-        }
-        toAccountID = account.ID
-    }
 
     // Perform the transfer operation
-    err = api.accMgr.TransferAmountById(fromAccountID, toAccountID, amount)
+    _, err = api.performTransfer(ctx, fromAccountID, toAccountID, amount, db.TransferOptions{Category: category})
     if err != nil {
-        return fmt.Errorf("error transferring amount: %v", err)
+        return nil, fmt.Errorf("error transferring amount: %w", err)
     }
 
-    return nil
+    return nil, nil
+}
+
+func (api *ApiManager) handleSavePayeeIntent(ctx *gin.Context, req SavePayeeIntentReq) (*db.Payee, error) {
+	ownerID, err := currentUserID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return api.savePayee(ownerID, req.Nickname, req.To)
+}
+
+func (api *ApiManager) handleListPayeesIntent(ctx *gin.Context) (string, error) {
+	ownerID, err := currentUserID(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	payees, err := api.accMgr.GetPayees(ownerID)
+	if err != nil {
+		return "", fmt.Errorf("error fetching payees: %v", err)
+	}
+
+	if len(payees) == 0 {
+		return "You have no saved payees yet. After a transfer, reply \"save as <nickname>\" to add one.", nil
+	}
+
+	var sb strings.Builder
+	sb.WriteString("Your payees:\n")
+	for _, payee := range payees {
+		sb.WriteString(fmt.Sprintf("- %s: %s\n", payee.Nickname, payee.PhoneNumber))
+	}
+	return sb.String(), nil
 }
 
 func (api *ApiManager) handleSearchAccountByNameIntent(name string) ([]string, error) {
@@ -495,9 +1062,9 @@ func (api *ApiManager) handleDepositIntent( ctx *gin.Context,amount float64) (fl
 	}
 
 	// Perform the deposit operation
-	err = api.accMgr.DepositToAccount(amount, objectID)
+	_, err = api.performDeposit(ctx, objectID, amount)
 	if err != nil {
-		return 0,fmt.Errorf("error depositing to account: %v", err)
+		return 0,fmt.Errorf("error depositing to account: %w", err)
 	}
 	  account, err := api.accMgr.SearchAccountById(objectID)
     if err != nil {
@@ -509,46 +1076,46 @@ func (api *ApiManager) handleDepositIntent( ctx *gin.Context,amount float64) (fl
 }
 
 
-func (api *ApiManager) handleCheckBalanceIntent(accountID, accountName string) (string, []db.Transaction, error) {
+// handleCheckBalanceIntent finds the account by ID, account number or name and
+// returns it with its transaction history.
+func (api *ApiManager) handleCheckBalanceIntent(accountID, accountName string) (*db.BankAccount, []db.Transaction, error) {
 	var account *db.BankAccount
 	var err error
 
 	if accountID != "" {
-		objectID, err := primitive.ObjectIDFromHex(accountID)
+		objectID, err := api.accMgr.ResolveAccountRef(accountID)
 		if err != nil {
-			return "", nil, fmt.Errorf("invalid account ID format: %v", err)
+			return nil, nil, err
 		}
 		// Get the account by ID
 		account, err = api.accMgr.SearchAccountById(objectID)
 		if err != nil {
-			return "", nil, fmt.Errorf("error retrieving account by ID: %v", err)
+			return nil, nil, fmt.Errorf("error retrieving account by ID: %v", err)
 		}
 	} else if accountName != "" {
 		// Search account by name or phone
 		accounts, err := api.accMgr.SearchAccountByNameOrPhone(accountName)
 		if err != nil {
-			return "", nil, fmt.Errorf("error searching for account: %v", err)
+			return nil, nil, fmt.Errorf("error searching for account: %v", err)
 		}
 		if len(accounts) == 0 {
-			return "", nil, fmt.Errorf("no account found with the provided name")
+			return nil, nil, fmt.Errorf("no account found with the provided name")
 		}
 		account = accounts[0] // Assuming we take the first matched account
 	} else {
-		return "", nil, fmt.Errorf("account ID or name must be provided")
+		return nil, nil, fmt.Errorf("account ID or name must be provided")
 	}
 
 	if account == nil {
-		return "", nil, fmt.Errorf("account not found")
+		return nil, nil, fmt.Errorf("account not found")
 	}
 
 	// Retrieve the transactions
 	transactions, err := api.accMgr.GetTransactionsHistory(account.ID)
 	if err != nil {
-		return "", nil, fmt.Errorf("error retrieving transactions: %v", err)
+		return nil, nil, fmt.Errorf("error retrieving transactions: %v", err)
 	}
-	balanceStr := fmt.Sprintf("%.2f", account.Balance)
-
-	return balanceStr, transactions, nil
+	return account, transactions, nil
 	
 }
 
@@ -570,9 +1137,8 @@ func (api *ApiManager) handleGetAccountsIntent(ctx *gin.Context) ([]db.BankAccou
         return nil, fmt.Errorf("could not find account: %v", err)
     }
 
-    // Check the role of the account
-    if account.Role != "admin" {
-        return nil, fmt.Errorf("you are not authorized to perform this action")
+    if !db.HasPermission(account.Role, db.PermAccountsRead) {
+        return nil, errNotPermitted
     }
 
     // Call GetAccounts method to retrieve accounts
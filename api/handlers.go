@@ -1,11 +1,12 @@
 package api
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
-
-	// "strings"
+	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/tamir-liebermann/gobank/db"
@@ -25,6 +26,8 @@ import (
 // @Produce  json
 // @Param   account  body     CreateAccountRequest  true  "Account Information"
 // @Success 201 {object} string "Account created!"
+// @Failure 400 {object} ErrorResponse "Password does not meet the policy, or an opening balance was sent"
+// @Failure 403 {object} ErrorResponse "Staff role requested"
 // @Failure 500 {object} ErrorResponse "internal server error"
 // @Router /create [post]
 func (api *ApiManager) handleCreateAccount(ctx *gin.Context) {
@@ -35,22 +38,45 @@ func (api *ApiManager) handleCreateAccount(ctx *gin.Context) {
 
 	}
 
-	account, err := api.accMgr.CreateAccount(req.UserName, req.Password, req.Balance, req.PhoneNumber, req.Role)
+	// Staff roles are granted by an admin, never picked at signup. "user" is
+	// what clients sent before roles were named.
+	if req.Role != "" && req.Role != db.RoleCustomer && req.Role != "user" {
+		ctx.JSON(http.StatusForbidden, ErrorResponse{Message: "Only customer accounts can be created here; an admin grants staff roles"})
+		return
+	}
+
+	// Accounts open empty and are funded by deposits, which the KYC tier
+	// limits apply to
+	if req.Balance != 0 {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "New accounts start with a zero balance; make a deposit to fund it"})
+		return
+	}
+
+	if err := api.passwordPolicy.Check(req.Password); err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	account, err := api.accMgr.CreateAccount(req.UserName, req.Password, req.PhoneNumber, db.RoleCustomer)
 	if err != nil {
 
 		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Could not create account, try again later"})
 		return
 	}
+	api.audit(ctx, "account.create", account.ID.Hex(), map[string]string{"username": account.AccountHolder, "role": account.Role})
 
-	token, err := utils.GenerateToken(req.UserName, account.ID)
+	tokens, err := api.startSession(ctx, account, false)
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Error generating token "})
 		return
 	}
 	response := CreateAccountResponse{
-		Message: "Account created!",
-		Id:      account.ID.Hex(),
-		Token:   token,
+		Message:       "Account created!",
+		Id:            account.ID.Hex(),
+		AccountNumber: account.AccountNumber,
+		Token:         tokens.Token,
+		RefreshToken:  tokens.RefreshToken,
+		ExpiresIn:     tokens.ExpiresIn,
 	}
 	ctx.Set("UserRole", account.Role)
 	ctx.Next()
@@ -63,9 +89,11 @@ func (api *ApiManager) handleCreateAccount(ctx *gin.Context) {
 // @Accept  json
 // @Produce  json
 // @Param   login  body     LoginRequest  true  "Login Information"
-// @Success 200 {object} LoginResponse
+// @Success 200 {object} LoginResponse "Tokens, or a challenge to complete at /login/2fa when two-factor is on"
 // @Failure 400 {object} ErrorResponse "Bad request"
 // @Failure 401 {object} ErrorResponse "Unauthorized"
+// @Failure 403 {object} ErrorResponse "Password must be reset first"
+// @Failure 429 {object} ErrorResponse "Too many failed logins, see Retry-After"
 // @Failure 500 {object} ErrorResponse "Internal server error"
 // @Router /login [post]
 func (api *ApiManager) handleLogin(ctx *gin.Context) {
@@ -84,16 +112,18 @@ func (api *ApiManager) handleLogin(ctx *gin.Context) {
 		return
 	}
 
-	// Search for the account by user name (returns a slice of accounts)
-	accounts, err := api.accMgr.SearchAccountByNameOrPhone(req.UserName)
-	if err != nil {
+	// Slow down guessing per username and per client IP
+	if err := api.accMgr.CheckLoginThrottle(req.UserName, ctx.ClientIP()); api.refuseThrottledLogin(ctx, req.UserName, err) {
+		return
+	} else if err != nil {
 		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Internal server error"})
 		return
 	}
 
-	// Check if no accounts were found
-	if len(accounts) == 0 {
-		ctx.JSON(http.StatusUnauthorized, ErrorResponse{Message: "Invalid credentials"})
+	// The username must name the account exactly, by holder name or phone
+	accounts, err := api.accMgr.GetAccountsByLogin(req.UserName)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Internal server error"})
 		return
 	}
 
@@ -105,24 +135,61 @@ func (api *ApiManager) handleLogin(ctx *gin.Context) {
 			break
 		}
 	}
+	if len(accounts) == 0 {
+		utils.CheckPasswordHash(req.Password, dummyPasswordHash())
+	}
 
-	// If no account matches the provided password
+	// Unknown usernames and wrong passwords get the same answer
 	if account == nil {
+		api.recordLoginFailure(ctx, req.UserName, accounts)
 		ctx.JSON(http.StatusUnauthorized, ErrorResponse{Message: "Invalid credentials"})
 		return
 	}
+	if err := api.accMgr.ClearLoginFailures(req.UserName); err != nil {
+		log.Printf("Error clearing failed logins for %q: %v", req.UserName, err)
+	}
 
-	// Generate a token for the authenticated user
-	token, err := utils.GenerateToken(account.AccountHolder, account.ID)
+	// Default credentials are known to everyone, so they can't sign in; the
+	// owner resets the password with a code sent to their phone
+	if !account.MustChangePassword && req.Password == defaultGuestPassword {
+		if err := api.accMgr.RequirePasswordChange(account.ID); err != nil {
+			ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Internal server error"})
+			return
+		}
+		account.MustChangePassword = true
+	}
+	if account.MustChangePassword {
+		api.audit(ctx, "account.login_refused", account.ID.Hex(), map[string]string{"reason": "password_change_required"})
+		ctx.JSON(http.StatusForbidden, ErrorResponse{Message: errPasswordChangeRequired.Error()})
+		return
+	}
+
+	// With two-factor on, the password only earns a challenge for the code
+	if account.TwoFactor.Enabled() {
+		challenge, err := utils.GenerateChallengeToken(account.ID, loginChallengePurpose, loginChallengeTTL)
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Error generating token"})
+			return
+		}
+		ctx.JSON(http.StatusOK, LoginResponse{UserName: req.UserName, TwoFactorRequired: true, Challenge: challenge})
+		return
+	}
+
+	// Start a session for this device
+	tokens, err := api.startSession(ctx, account, false)
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Error generating token"})
 		return
 	}
 
+	api.audit(ctx, "account.login", account.ID.Hex(), nil)
+
 	// Prepare and send the response
 	response := LoginResponse{
-		UserName: req.UserName,
-		Token:    token,
+		UserName:     req.UserName,
+		Token:        tokens.Token,
+		RefreshToken: tokens.RefreshToken,
+		ExpiresIn:    tokens.ExpiresIn,
 	}
 
 	ctx.JSON(http.StatusOK, response)
@@ -132,18 +199,19 @@ func (api *ApiManager) handleLogin(ctx *gin.Context) {
 // @Description Get account details by its ID
 // @ID get-account-by-id
 // @Produce json
-// @Param id path string true "Account ID"
+// @Param id path string true "Account ID or account number"
 // @Success 200 {object} BankAccRes "Account found!"
 // @Failure 400 {object} ErrorResponse "Invalid ID format"
+// @Failure 403 {object} ErrorResponse "Not your account"
 // @Failure 404 {object} ErrorResponse "Account not found"
 // @Failure 500 {object} ErrorResponse "Internal server error"
 // @Router /account/{id} [get]
 // @Security BearerAuth
+// @Security ApiKeyAuth
 func (api *ApiManager) handleGetById(ctx *gin.Context) {
-	idParam := ctx.Param("id")
-	id, err := primitive.ObjectIDFromHex(idParam)
+	id, err := api.accMgr.ResolveAccountRef(ctx.Param("id"))
 	if err != nil {
-		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Invalid ID format"})
+		ctx.JSON(accountRefStatus(err), ErrorResponse{Message: err.Error()})
 		return
 	}
 
@@ -192,26 +260,53 @@ func (api *ApiManager) handleGetByNameOrPhone(ctx *gin.Context) {
 	ctx.JSON(http.StatusOK, accounts)
 }
 
-// @Param id path string true "Account ID"
+// @Description Customers closing their own account get an erasure request, which runs once an admin approves it. Staff can delete an empty account outright
+// @Param id path string true "Account ID or account number"
 // @Success 200 {object} string "Success"
+// @Success 202 {object} db.DataRequest "Erasure requested"
 // @Failure 400 {object} ErrorResponse "Invalid ID format"
+// @Failure 403 {object} ErrorResponse "Not your account"
 // @Failure 404 {object} ErrorResponse "Account not found"
+// @Failure 409 {object} ErrorResponse "Account not empty"
 // @Failure 500 {object} ErrorResponse "Internal server error"
 // @Router /account/{id} [delete]
 // @Security BearerAuth
 func (api *ApiManager) handleDeleteById(ctx *gin.Context) {
-	idParam := ctx.Param("id")
-	id, err := primitive.ObjectIDFromHex(idParam)
+	id, err := api.accMgr.ResolveAccountRef(ctx.Param("id"))
 	if err != nil {
-		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Invalid ID format"})
+		ctx.JSON(accountRefStatus(err), ErrorResponse{Message: err.Error()})
 		return
 	}
 
-	err = api.accMgr.DeleteAccountById(id)
+	// Owners go through the erasure flow, so closing an account always gets
+	// an admin's eyes and can't strand money
+	callerID, err := currentUserID(ctx)
 	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, ErrorResponse{Message: err.Error()})
+		return
+	}
+	if callerID == id {
+		request, err := api.requestPersonalData(ctx, id, db.DataRequestErasure)
+		if err != nil {
+			ctx.JSON(privacyErrorStatus(err), ErrorResponse{Message: err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusAccepted, request)
+		return
+	}
+
+	err = api.accMgr.DeleteAccountById(id)
+	if errors.Is(err, db.ErrAccountNotFound) {
+		ctx.JSON(http.StatusNotFound, ErrorResponse{Message: err.Error()})
+		return
+	} else if errors.Is(err, db.ErrErasureBalance) {
+		ctx.JSON(http.StatusConflict, ErrorResponse{Message: err.Error()})
+		return
+	} else if err != nil {
 		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: err.Error()})
 		return
 	}
+	api.audit(ctx, "account.delete", id.Hex(), nil)
 
 	ctx.JSON(http.StatusOK, gin.H{"message": "Account Deleted Successfully!"})
 }
@@ -225,55 +320,35 @@ func (api *ApiManager) handleDeleteById(ctx *gin.Context) {
 // @Failure 500 {object} ErrorResponse "Could not retrive accounts"
 // @Router /admin/accounts [get]
 // @Security BearerAuth
+// @Security ApiKeyAuth
 func (api *ApiManager) handleGetAccounts(ctx *gin.Context) {
-	// Assume you have set the userId in the context after authentication
-	userId, exists := ctx.Get("userId")
-	if !exists {
-		ctx.JSON(http.StatusUnauthorized, ErrorResponse{Message: "User ID not found"})
-		return
-	}
-
-	// Fetch the account based on userId
-	objectID, err := primitive.ObjectIDFromHex(userId.(string))
-	if err != nil {
-		ctx.JSON(http.StatusUnauthorized, ErrorResponse{Message: "Invalid user ID format"})
-		return
-	}
-
-	account, err := api.accMgr.SearchAccountById(objectID)
-	if err != nil {
-		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Could not find account"})
-		return
-	}
-
-	// Check the role of the account
-	if account.Role != "admin" {
-		ctx.JSON(http.StatusForbidden, ErrorResponse{Message: "You are not authorized to perform this action"})
-		return
-	}
-
 	// Fetch all accounts
 	accounts, err := api.accMgr.GetAccounts()
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Could not find accounts"})
 		return
 	}
+	api.audit(ctx, "admin.list_accounts", "", map[string]string{"count": strconv.Itoa(len(accounts))})
 
 	ctx.JSON(http.StatusOK, accounts)
 }
 
 // @Summary Transfer funds from one account to another
-// @Description Transfer funds from one bank account to another
+// @Description Transfer funds from one bank account to another. With two-factor on, large transfers need a fresh second factor
 // @ID transfer-funds
 // @Accept json
 // @Produce json
 // @Param request body TransferRequest true "Transfer Request"
 // @Success 200 {object} BankAccRes
+// @Success 202 {object} map[string]string "Transfer held for review, with its hold_id"
 // @Failure 400 {object} ErrorResponse "Bad request"
+// @Failure 403 {object} ErrorResponse "Not your account, second factor needed, transfer blocked or over the KYC limit"
 // @Failure 404 {object} ErrorResponse "Invalid account ID"
+// @Failure 409 {object} ErrorResponse "Recipient account has been erased"
 // @Failure 500 {object} ErrorResponse "Internal server error"
 // @Router /account/transfer [post]
 // @Security BearerAuth
+// @Security ApiKeyAuth
 func (api *ApiManager) handleTransfer(ctx *gin.Context) {
 	log.Println("transferHandler called")
 	var req TransferRequest
@@ -286,42 +361,123 @@ func (api *ApiManager) handleTransfer(ctx *gin.Context) {
 	}
 	log.Printf("Received transfer request: From=%s To=%s Amount=%f", req.From, req.To, req.Amount)
 
-	fromAccountID, err := primitive.ObjectIDFromHex(req.From)
+	fromAccountID, err := api.accMgr.ResolveAccountRef(req.From)
 	if err != nil {
-		ctx.JSON(http.StatusBadRequest, gin.H{"message": "invalid from account ID"})
+		ctx.JSON(accountRefStatus(err), gin.H{"message": "invalid from account", "error": err.Error()})
 		return
 	}
 
-	toAccountID, err := primitive.ObjectIDFromHex(req.To)
-	if err != nil {
-		ctx.JSON(http.StatusBadRequest, gin.H{"message": "invalid to account ID"})
+	// Money only leaves an account at its owner's request
+	if !api.authorizeAccount(ctx, fromAccountID, "") {
+		return
+	}
+	if req.Amount >= api.stepUpTransferAmount && !api.requireSecondFactor(ctx, fromAccountID) {
 		return
 	}
 
-	err = api.accMgr.TransferAmountById(fromAccountID, toAccountID, req.Amount)
+	toAccountID, err := api.accMgr.ResolveAccountRef(req.To)
 	if err != nil {
+		ctx.JSON(accountRefStatus(err), gin.H{"message": "invalid to account", "error": err.Error()})
+		return
+	}
+
+	transaction, err := api.performTransfer(ctx, fromAccountID, toAccountID, req.Amount, db.TransferOptions{Category: req.Category})
+	var held *db.TransferHeldError
+	if errors.As(err, &held) {
+		ctx.JSON(http.StatusAccepted, gin.H{"message": "transfer is on hold for review", "hold_id": held.Held.ID.Hex()})
+		return
+	}
+	if status, ok := transferStoppedStatus(err); ok {
+		ctx.JSON(status, gin.H{"message": "transfer refused", "error": err.Error()})
+		return
+	} else if errors.Is(err, db.ErrAccountErased) {
+		ctx.JSON(http.StatusConflict, gin.H{"message": "transfer refused", "error": err.Error()})
+		return
+	} else if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{"message": "transfer failed", "error": err.Error()})
 		return
 	}
 
-	ctx.JSON(http.StatusOK, gin.H{"message": "transfer successful"})
+	ctx.JSON(http.StatusOK, gin.H{"message": "transfer successful", "fee": transaction.Fee})
+}
+
+// performTransfer is the single path every transfer takes, whether it comes
+// from the REST API, a chat intent or a paid money request. ctx is the request
+// that triggered it and is only used for the audit log.
+func (api *ApiManager) performTransfer(ctx *gin.Context, fromAccountID, toAccountID primitive.ObjectID, amount float64, opts db.TransferOptions) (*db.Transaction, error) {
+	details := map[string]string{
+		"from":   fromAccountID.Hex(),
+		"to":     toAccountID.Hex(),
+		"amount": formatAmount(amount),
+	}
+
+	transaction, err := api.accMgr.TransferAmountWithOptions(fromAccountID, toAccountID, amount, opts)
+	var held *db.TransferHeldError
+	var blocked *db.TransferBlockedError
+	if errors.As(err, &held) {
+		api.audit(ctx, "transfer.held", held.Held.ID.Hex(), details)
+		go api.notifyAccount(fromAccountID, heldTransferMessage(held.Held))
+		return nil, err
+	} else if err != nil {
+		action := "transfer.failed"
+		if errors.As(err, &blocked) {
+			action = "transfer.blocked"
+		}
+		details["error"] = err.Error()
+		api.audit(ctx, action, fromAccountID.Hex(), details)
+		return nil, err
+	}
+
+	api.transferCompleted(ctx, transaction)
+	return transaction, nil
+}
+
+// transferCompleted audits a transfer that went through and runs the
+// follow-ups every transfer gets.
+func (api *ApiManager) transferCompleted(ctx *gin.Context, transaction *db.Transaction) {
+	api.audit(ctx, "transfer", transaction.ID.Hex(), map[string]string{
+		"from":   transaction.FromAccount.Hex(),
+		"to":     transaction.ToAccount.Hex(),
+		"amount": formatAmount(transaction.Amount),
+		"fee":    formatAmount(transaction.Fee),
+	})
+	go api.evaluateBudgets(transaction)
+	go api.screenAML(transaction.FromAccount)
+}
+
+// performDeposit is the single path for deposits, like performTransfer.
+func (api *ApiManager) performDeposit(ctx *gin.Context, accountID primitive.ObjectID, amount float64) (*db.Transaction, error) {
+	transaction, err := api.accMgr.DepositToAccount(amount, accountID)
+	if err != nil {
+		api.audit(ctx, "deposit.failed", accountID.Hex(), map[string]string{"amount": formatAmount(amount), "error": err.Error()})
+		return nil, err
+	}
+
+	api.audit(ctx, "deposit", transaction.ID.Hex(), map[string]string{
+		"account": accountID.Hex(),
+		"amount":  formatAmount(amount),
+		"fee":     formatAmount(transaction.Fee),
+	})
+	go api.screenAML(accountID)
+	return transaction, nil
 }
 
 // @Summary Get transactions history for an account
 // @Description Retrieve transaction history for a specific bank account
 // @ID get-transactions-history
 // @Produce json
-// @Param id path string true "Account ID"
+// @Param id path string true "Account ID or account number"
 // @Success 200 {object} AllTransactionsRes
 // @Failure 400 {object} ErrorResponse "Invalid account ID format"
+// @Failure 403 {object} ErrorResponse "Not your account"
 // @Failure 500 {object} ErrorResponse "Internal server error"
 // @Router /account/transactions/{id} [get]
 // @Security BearerAuth
+// @Security ApiKeyAuth
 func (api *ApiManager) handleGetTransactionsHistory(ctx *gin.Context) {
-	idParam := ctx.Param("id")
-	id, err := primitive.ObjectIDFromHex(idParam)
+	id, err := api.accMgr.ResolveAccountRef(ctx.Param("id"))
 	if err != nil {
-		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID format"})
+		ctx.JSON(accountRefStatus(err), gin.H{"error": err.Error()})
 		return
 	}
 
@@ -331,7 +487,7 @@ func (api *ApiManager) handleGetTransactionsHistory(ctx *gin.Context) {
 		return
 	}
 
-	table, err := utils.FormatTransactionsTable(transactions,idParam)
+	table, err := utils.FormatTransactionsTable(transactions, id.Hex())
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -349,6 +505,8 @@ func (api *ApiManager) handleGetTransactionsHistory(ctx *gin.Context) {
 // @Param deposit body DepositRequest true "Deposit Request"
 // @Success 200 {object} DepositResponse
 // @Failure 400 {object} ErrorResponse "Invalid request"
+// @Failure 403 {object} ErrorResponse "Not your account"
+// @Failure 409 {object} ErrorResponse "Account has been erased"
 // @Failure 500 {object} ErrorResponse "Error depositing to account"
 // @Router /account/deposit [post]
 func (api *ApiManager) handleDeposit(ctx *gin.Context) {
@@ -366,16 +524,28 @@ func (api *ApiManager) handleDeposit(ctx *gin.Context) {
 		return
 	}
 
-	// Convert the account ID from string to ObjectID
-	accountID, err := primitive.ObjectIDFromHex(req.AccountID)
+	// The account may be given by ID or account number
+	accountID, err := api.accMgr.ResolveAccountRef(req.AccountID)
 	if err != nil {
-		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Invalid account ID format"})
+		ctx.JSON(accountRefStatus(err), ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	// Tellers deposit for customers; everyone else only into their own account
+	if !api.authorizeAccount(ctx, accountID, db.PermAccountsDeposit) {
 		return
 	}
 
 	// Perform the deposit operation
-	err = api.accMgr.DepositToAccount(req.Amount, accountID)
-	if err != nil {
+	transaction, err := api.performDeposit(ctx, accountID, req.Amount)
+	var kycLimit *db.KYCLimitError
+	if errors.As(err, &kycLimit) {
+		ctx.JSON(http.StatusForbidden, ErrorResponse{Message: kycLimit.Error()})
+		return
+	} else if errors.Is(err, db.ErrAccountErased) {
+		ctx.JSON(http.StatusConflict, ErrorResponse{Message: err.Error()})
+		return
+	} else if err != nil {
 		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Error depositing to account"})
 		return
 	}
@@ -384,6 +554,7 @@ func (api *ApiManager) handleDeposit(ctx *gin.Context) {
 	response := DepositResponse{
 		Message: "Deposit successful",
 		Amount:  req.Amount,
+		Fee:     transaction.Fee,
 	}
 	ctx.JSON(http.StatusOK, response)
 }
@@ -394,10 +565,12 @@ func (api *ApiManager) handleDeposit(ctx *gin.Context) {
 // @Accept json
 // @Produce json
 // @Security BearerAuth
+// @Security ApiKeyAuth
 // @Param accountId query string false "Account ID"
 // @Param accountHolder query string false "Account Holder Name"
 // @Success 200 {object} BalanceResponse
 // @Failure 400 {object} ErrorResponse "Invalid request"
+// @Failure 403 {object} ErrorResponse "Not your account"
 // @Failure 500 {object} ErrorResponse "Internal server error"
 // @Router /account/balance [get]
 func (api *ApiManager) handleCheckBalance(ctx *gin.Context) {
@@ -409,33 +582,105 @@ func (api *ApiManager) handleCheckBalance(ctx *gin.Context) {
 		return
 	}
 
+	// Looking an account up by name is a staff search; customers give their account
+	if accountID != "" {
+		id, err := api.accMgr.ResolveAccountRef(accountID)
+		if err != nil {
+			ctx.JSON(accountRefStatus(err), ErrorResponse{Message: err.Error()})
+			return
+		}
+		if !api.authorizeAccount(ctx, id, db.PermAccountsRead) {
+			return
+		}
+	} else if err := api.checkPermission(ctx, db.PermAccountsRead); err != nil {
+		api.denyAccountAccess(ctx, accountName)
+		return
+	}
+
 	// Call handleCheckBalanceIntent
-	balance, transactions, err := api.handleCheckBalanceIntent(accountID, accountName)
+	account, transactions, err := api.handleCheckBalanceIntent(accountID, accountName)
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: err.Error()})
 		return
 	}
 
-	// Prepare the transaction info
-	transactionInfos := []TransactionInfo{}
+	// Prepare and send the response. accountId may be an account number, so
+	// incoming transfers are matched against the account it resolved to.
+	response := BalanceResponse{
+		Balance:      fmt.Sprintf("%.2f", account.Balance),
+		Transactions: incomingTransfers(account.ID, transactions),
+	}
+	ctx.JSON(http.StatusOK, response)
+}
+
+// incomingTransfers lists the transactions that paid money into the account.
+func incomingTransfers(accountID primitive.ObjectID, transactions []db.Transaction) []TransactionInfo {
+	infos := []TransactionInfo{}
 	for _, transaction := range transactions {
-		if transaction.ToAccount.Hex() == accountID {
-			transactionInfos = append(transactionInfos, TransactionInfo{
+		if transaction.ToAccount == accountID && transaction.FromAccount != transaction.ToAccount {
+			infos = append(infos, TransactionInfo{
 				FromAccount: transaction.FromAccount.Hex(),
 				Amount:      transaction.Amount,
 			})
 		}
 	}
-
-	// Prepare and send the response
-	response := BalanceResponse{
-		Balance:      balance,
-		Transactions: transactionInfos,
-	}
-	ctx.JSON(http.StatusOK, response)
+	return infos
 }
 
 func (api *ApiManager) healthCheckHandler(c *gin.Context) {
 	response := HealthResponse{Status: "OK"}
 	c.JSON(http.StatusOK, response)
 }
+
+// @Summary Change your phone number
+// @Description Move the account to a new phone number, which is also the WhatsApp number it chats from. The old number is told about the change. With two-factor on, this needs a fresh second factor
+// @ID change-phone-number
+// @Accept json
+// @Produce json
+// @Param phone body ChangePhoneRequest true "New phone number"
+// @Success 200 {object} string "Phone number changed"
+// @Failure 400 {object} ErrorResponse "Invalid phone number"
+// @Failure 403 {object} ErrorResponse "Second factor needed"
+// @Failure 409 {object} ErrorResponse "Number belongs to another account"
+// @Router /account/phone [put]
+// @Security BearerAuth
+func (api *ApiManager) handleChangePhoneNumber(ctx *gin.Context) {
+	var req ChangePhoneRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Bad request"})
+		return
+	}
+	phone := strings.TrimSpace(req.PhoneNumber)
+	if !PhoneNumberRegexp.MatchString(phone) {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "phone_number is not a valid international number"})
+		return
+	}
+	phone = phoneSeparators.Replace(phone)
+
+	account, ok := api.currentAccount(ctx)
+	if !ok {
+		return
+	}
+	if !api.requireSecondFactor(ctx, account.ID) {
+		return
+	}
+
+	if err := api.accMgr.UpdatePhoneNumber(account.ID, phone); errors.Is(err, db.ErrPhoneNumberTaken) {
+		ctx.JSON(http.StatusConflict, ErrorResponse{Message: err.Error()})
+		return
+	} else if err != nil {
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Could not change the phone number"})
+		return
+	}
+	api.audit(ctx, "account.phone_change", account.ID.Hex(), nil)
+
+	if account.PhoneNumber != "" && account.PhoneNumber != phone {
+		go func(previous string) {
+			if err := api.sendWhatsAppMessage("whatsapp:"+previous, "The phone number on your gobank account was changed. If this wasn't you, contact support."); err != nil {
+				log.Printf("Error telling %s about the phone number change: %v", account.ID.Hex(), err)
+			}
+		}(account.PhoneNumber)
+	}
+
+	ctx.JSON(http.StatusOK, "Phone number changed")
+}
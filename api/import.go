@@ -0,0 +1,402 @@
+package api
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tamir-liebermann/gobank/db"
+	"github.com/tamir-liebermann/gobank/utils"
+)
+
+// Import file formats.
+const (
+	ImportFormatCSV   = "csv"
+	ImportFormatJSONL = "jsonl"
+)
+
+// Row outcomes of an account import.
+const (
+	ImportRowCreated   = "created"
+	ImportRowValid     = "valid"
+	ImportRowDuplicate = "duplicate"
+	ImportRowInvalid   = "invalid"
+	ImportRowFailed    = "failed"
+)
+
+const (
+	// Every account costs a bcrypt hash at cost 14, so uploads through the
+	// API stay small enough to finish within a request. Bigger migrations
+	// go through the import-accounts command.
+	maxImportUploadRows = 500
+	maxImportUploadSize = 10 << 20
+
+	DefaultImportConcurrency = 4
+	MaxImportConcurrency     = 16
+)
+
+// ImportOptions controls an account import.
+type ImportOptions struct {
+	// DryRun validates and dedupes the rows without creating anything.
+	DryRun      bool
+	Concurrency int
+}
+
+var phoneSeparators = strings.NewReplacer(" ", "", "-", "", ".", "")
+
+// ImportFormatFromFilename guesses the format of an import file from its
+// extension. Anything that isn't a .csv is read as JSON lines.
+func ImportFormatFromFilename(name string) string {
+	if strings.EqualFold(filepath.Ext(name), ".csv") {
+		return ImportFormatCSV
+	}
+	return ImportFormatJSONL
+}
+
+// ParseAccountImport reads the accounts of an import file. Lines that can't
+// be read are kept as rows with a problem so they show up in the report
+// with their line number.
+func ParseAccountImport(r io.Reader, format string) ([]ImportAccountRow, error) {
+	switch format {
+	case ImportFormatCSV:
+		return parseAccountImportCSV(r)
+	case ImportFormatJSONL:
+		return parseAccountImportJSONL(r)
+	}
+	return nil, fmt.Errorf("unknown import format %q, use csv or jsonl", format)
+}
+
+func parseAccountImportJSONL(r io.Reader) ([]ImportAccountRow, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	var rows []ImportAccountRow
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		row := ImportAccountRow{Line: line}
+		if err := json.Unmarshal([]byte(text), &row); err != nil {
+			row.problem = "invalid JSON"
+		}
+		row.Line = line
+		rows = append(rows, row)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// parseAccountImportCSV reads rows under a header with user_name,
+// phone_number, balance and password columns, in any order. Only the
+// password column is optional.
+func parseAccountImportCSV(r io.Reader) ([]ImportAccountRow, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, errors.New("the CSV is empty")
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, required := range []string{"user_name", "phone_number", "balance"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("the CSV header is missing the %s column", required)
+		}
+	}
+
+	field := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	var rows []ImportAccountRow
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("invalid CSV: %v", err)
+		}
+		line, _ := reader.FieldPos(0)
+		row := ImportAccountRow{
+			Line:        line,
+			UserName:    field(record, "user_name"),
+			PhoneNumber: field(record, "phone_number"),
+			Password:    field(record, "password"),
+		}
+		if balance := field(record, "balance"); balance != "" {
+			if row.Balance, err = strconv.ParseFloat(balance, 64); err != nil {
+				row.problem = "balance is not a number"
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// validateImportRow checks a row on its own and returns the phone number in
+// the form it is stored in, which is how WhatsApp messages look it up.
+func validateImportRow(row ImportAccountRow) (string, error) {
+	if row.problem != "" {
+		return "", errors.New(row.problem)
+	}
+	if strings.TrimSpace(row.UserName) == "" {
+		return "", errors.New("user_name is required")
+	}
+	phone := strings.TrimSpace(row.PhoneNumber)
+	if !PhoneNumberRegexp.MatchString(phone) {
+		return "", errors.New("phone_number is not a valid international number")
+	}
+	if math.IsNaN(row.Balance) || math.IsInf(row.Balance, 0) || row.Balance < 0 {
+		return "", errors.New("balance must be zero or more")
+	}
+	if math.Round(row.Balance*100)/100 != row.Balance {
+		return "", errors.New("balance can have at most two decimals")
+	}
+	return phoneSeparators.Replace(phone), nil
+}
+
+func randomPassword() (string, error) {
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// ImportAccounts creates user accounts from the rows. Rows are validated and
+// deduplicated against each other and against existing accounts by phone
+// number first; the rest are hashed and inserted by a bounded pool of
+// workers. Rows without a password get a random one, and those customers
+// sign in over WhatsApp. ctx may be nil when run from the command line.
+func (api *ApiManager) ImportAccounts(ctx *gin.Context, rows []ImportAccountRow, opts ImportOptions) (*ImportAccountsRes, error) {
+	report := &ImportAccountsRes{DryRun: opts.DryRun, Total: len(rows), Rows: make([]ImportAccountResult, len(rows))}
+
+	phones := make([]string, len(rows))
+	seen := map[string]int{}
+	var candidates []string
+	for i, row := range rows {
+		report.Rows[i] = ImportAccountResult{Line: row.Line, UserName: row.UserName, PhoneNumber: row.PhoneNumber}
+		phone, err := validateImportRow(row)
+		if err != nil {
+			report.Rows[i].Status = ImportRowInvalid
+			report.Rows[i].Error = err.Error()
+			continue
+		}
+		report.Rows[i].PhoneNumber = phone
+		if first, ok := seen[phone]; ok {
+			report.Rows[i].Status = ImportRowDuplicate
+			report.Rows[i].Error = fmt.Sprintf("same phone number as line %d", first)
+			continue
+		}
+		seen[phone] = row.Line
+		phones[i] = phone
+		candidates = append(candidates, phone)
+	}
+
+	existing, err := api.accMgr.ExistingPhoneNumbers(candidates)
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []int
+	for i, phone := range phones {
+		switch {
+		case phone == "":
+		case existing[phone]:
+			report.Rows[i].Status = ImportRowDuplicate
+			report.Rows[i].Error = "an account with this phone number already exists"
+		case opts.DryRun:
+			report.Rows[i].Status = ImportRowValid
+		default:
+			pending = append(pending, i)
+		}
+	}
+
+	concurrency := opts.Concurrency
+	if concurrency < 1 {
+		concurrency = DefaultImportConcurrency
+	} else if concurrency > MaxImportConcurrency {
+		concurrency = MaxImportConcurrency
+	}
+
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				// Each worker owns the result it's given, so no locking is needed
+				api.importAccount(ctx, rows[i], phones[i], &report.Rows[i])
+			}
+		}()
+	}
+	for _, i := range pending {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+
+	for _, result := range report.Rows {
+		switch result.Status {
+		case ImportRowCreated:
+			report.Created++
+		case ImportRowValid:
+			report.Valid++
+		case ImportRowDuplicate:
+			report.Duplicates++
+		case ImportRowInvalid:
+			report.Invalid++
+		case ImportRowFailed:
+			report.Failed++
+		}
+	}
+
+	if !opts.DryRun {
+		api.audit(ctx, "account.import", "", map[string]string{
+			"rows":       strconv.Itoa(report.Total),
+			"created":    strconv.Itoa(report.Created),
+			"duplicates": strconv.Itoa(report.Duplicates),
+			"invalid":    strconv.Itoa(report.Invalid),
+			"failed":     strconv.Itoa(report.Failed),
+		})
+	}
+	return report, nil
+}
+
+func (api *ApiManager) importAccount(ctx *gin.Context, row ImportAccountRow, phone string, result *ImportAccountResult) {
+	password := row.Password
+	if password == "" {
+		var err error
+		if password, err = randomPassword(); err != nil {
+			result.Status = ImportRowFailed
+			result.Error = "could not generate a password"
+			return
+		}
+	}
+	hashedPw, err := utils.HashPassword(password)
+	if err != nil {
+		result.Status = ImportRowFailed
+		result.Error = "could not hash the password"
+		return
+	}
+
+	account, err := api.accMgr.ImportAccount(db.ImportedAccount{
+		Name:           strings.TrimSpace(row.UserName),
+		PhoneNumber:    phone,
+		PasswordHash:   hashedPw,
+		OpeningBalance: row.Balance,
+	})
+	if err != nil {
+		log.Printf("Error importing line %d: %v", row.Line, err)
+		result.Status = ImportRowFailed
+		result.Error = "could not create the account"
+		return
+	}
+
+	result.Status = ImportRowCreated
+	result.AccountID = account.ID.Hex()
+	result.AccountNumber = account.AccountNumber
+	api.audit(ctx, "account.create", account.ID.Hex(), map[string]string{
+		"username":        account.AccountHolder,
+		"role":            account.Role,
+		"opening_balance": formatAmount(account.Balance),
+		"import":          "true",
+	})
+}
+
+// readImportUpload reads an import file sent as a CSV or JSON lines body, or
+// as a multipart form file whose extension gives the format.
+func readImportUpload(ctx *gin.Context) ([]ImportAccountRow, error) {
+	ctx.Request.Body = http.MaxBytesReader(ctx.Writer, ctx.Request.Body, maxImportUploadSize)
+
+	contentType, _, _ := mime.ParseMediaType(ctx.GetHeader("Content-Type"))
+	switch contentType {
+	case "text/csv":
+		return ParseAccountImport(ctx.Request.Body, ImportFormatCSV)
+	case "application/x-ndjson", "application/jsonl", "application/json":
+		return ParseAccountImport(ctx.Request.Body, ImportFormatJSONL)
+	case "multipart/form-data":
+		header, err := ctx.FormFile("file")
+		if err != nil {
+			return nil, errors.New("an import file is required")
+		}
+		file, err := header.Open()
+		if err != nil {
+			return nil, errors.New("could not read the file")
+		}
+		defer file.Close()
+		return ParseAccountImport(file, ImportFormatFromFilename(header.Filename))
+	}
+	return nil, errors.New("send the accounts as text/csv, application/x-ndjson or a multipart file")
+}
+
+// @Summary Import accounts
+// @Description Create user accounts with opening balances from a CSV (user_name,phone_number,balance,password) or JSON lines file (admin only). Phone numbers already in use are reported as duplicates. Use dry_run to only validate. Files over 500 rows go through the import-accounts command
+// @ID import-accounts
+// @Accept text/csv
+// @Accept application/x-ndjson
+// @Accept multipart/form-data
+// @Produce json
+// @Param dry_run query bool false "Validate without creating accounts"
+// @Param concurrency query int false "Accounts created in parallel (1-16)"
+// @Success 200 {object} ImportAccountsRes
+// @Failure 400 {object} ErrorResponse "Invalid file"
+// @Failure 413 {object} ErrorResponse "Too many rows"
+// @Router /admin/accounts/import [post]
+// @Security BearerAuth
+func (api *ApiManager) handleImportAccounts(ctx *gin.Context) {
+	rows, err := readImportUpload(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: err.Error()})
+		return
+	}
+	if len(rows) == 0 {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "The file has no accounts"})
+		return
+	}
+	if len(rows) > maxImportUploadRows {
+		ctx.JSON(http.StatusRequestEntityTooLarge, ErrorResponse{Message: fmt.Sprintf("Upload at most %d accounts at a time, or use the import-accounts command", maxImportUploadRows)})
+		return
+	}
+
+	opts := ImportOptions{DryRun: ctx.Query("dry_run") == "true"}
+	if concurrency := ctx.Query("concurrency"); concurrency != "" {
+		if opts.Concurrency, err = strconv.Atoi(concurrency); err != nil {
+			ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "concurrency must be a number"})
+			return
+		}
+	}
+
+	report, err := api.ImportAccounts(ctx, rows, opts)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Internal server error"})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, report)
+}
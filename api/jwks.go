@@ -0,0 +1,49 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tamir-liebermann/gobank/utils"
+)
+
+// keyRotationInterval is how often the signing keys are checked for
+// rotation. Rotation itself happens every JWT_KEY_ROTATION.
+const keyRotationInterval = time.Hour
+
+// runKeyRotation rotates the token signing keys in the background.
+func (api *ApiManager) runKeyRotation(keys *utils.KeyRing) {
+	ticker := time.NewTicker(keyRotationInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		rotated, err := keys.RotateIfDue()
+		if err != nil {
+			log.Printf("Error rotating token signing keys: %v", err)
+			continue
+		}
+		if rotated {
+			log.Printf("Rotated the token signing key")
+		}
+	}
+}
+
+// @Summary Token verification keys
+// @Description The public keys gobank access tokens are signed with, as a JSON Web Key Set. Pick the key by the token's kid header; keys stay listed for a while after rotation so tokens signed before it still verify
+// @ID get-jwks
+// @Produce json
+// @Success 200 {object} utils.JWKSet
+// @Failure 500 {object} ErrorResponse "Keys not loaded"
+// @Router /.well-known/jwks.json [get]
+func (api *ApiManager) handleGetJWKS(ctx *gin.Context) {
+	keys, err := utils.Keys()
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Token keys are not available"})
+		return
+	}
+
+	ctx.Header("Cache-Control", "public, max-age=300")
+	ctx.JSON(http.StatusOK, keys.JWKS())
+}
@@ -0,0 +1,387 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tamir-liebermann/gobank/db"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const maxKYCDocumentSize = 10 << 20
+
+// kycDocumentTypes are the accepted uploads, by sniffed content type.
+var kycDocumentTypes = map[string]string{
+	"image/jpeg":      ".jpg",
+	"image/png":       ".png",
+	"application/pdf": ".pdf",
+}
+
+func kycErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, db.ErrKYCLocked), errors.Is(err, db.ErrKYCNotPending):
+		return http.StatusConflict
+	}
+	return http.StatusBadRequest
+}
+
+func isKYCDocumentKind(kind string) bool {
+	for _, k := range db.KYCDocumentKinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func kycStatusRes(profile *db.KYCProfile) KYCStatusRes {
+	return KYCStatusRes{Profile: *profile, Limits: db.KYCTierLimits[profile.State()]}
+}
+
+// @Summary Get KYC status
+// @Description The caller's identity verification state, details and current limits
+// @ID get-kyc
+// @Produce json
+// @Success 200 {object} KYCStatusRes
+// @Router /account/kyc [get]
+// @Security BearerAuth
+func (api *ApiManager) handleGetKYC(ctx *gin.Context) {
+	accountID, err := currentUserID(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	profile, err := api.accMgr.GetKYCProfile(accountID)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Internal server error"})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, kycStatusRes(profile))
+}
+
+// @Summary Set KYC details
+// @Description Set full name, date of birth (YYYY-MM-DD) and national ID. Only possible before submitting or after a rejection
+// @ID update-kyc
+// @Accept json
+// @Produce json
+// @Param details body KYCDetailsRequest true "Identity details"
+// @Success 200 {object} KYCStatusRes
+// @Failure 400 {object} ErrorResponse "Invalid details"
+// @Failure 409 {object} ErrorResponse "Details are locked"
+// @Router /account/kyc [put]
+// @Security BearerAuth
+func (api *ApiManager) handleUpdateKYC(ctx *gin.Context) {
+	accountID, err := currentUserID(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	var req KYCDetailsRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Bad request"})
+		return
+	}
+
+	profile, err := api.accMgr.UpdateKYCDetails(accountID, req.FullName, req.DateOfBirth, req.NationalID)
+	if err != nil {
+		ctx.JSON(kycErrorStatus(err), ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, kycStatusRes(profile))
+}
+
+// @Summary Upload a KYC document
+// @Description Upload an identity document (JPEG, PNG or PDF, up to 10MB) as multipart form data
+// @ID upload-kyc-document
+// @Accept multipart/form-data
+// @Produce json
+// @Param kind formData string true "id_card, passport, drivers_license, proof_of_address or selfie"
+// @Param file formData file true "Document"
+// @Success 201 {object} KYCStatusRes
+// @Failure 400 {object} ErrorResponse "Invalid document"
+// @Failure 409 {object} ErrorResponse "Details are locked"
+// @Router /account/kyc/documents [post]
+// @Security BearerAuth
+func (api *ApiManager) handleUploadKYCDocument(ctx *gin.Context) {
+	accountID, err := currentUserID(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	kind := ctx.PostForm("kind")
+	if !isKYCDocumentKind(kind) {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Unknown document kind"})
+		return
+	}
+
+	header, err := ctx.FormFile("file")
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "A file is required"})
+		return
+	}
+	if header.Size > maxKYCDocumentSize {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Documents can be at most 10MB"})
+		return
+	}
+
+	file, err := header.Open()
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Could not read the file"})
+		return
+	}
+	defer file.Close()
+
+	// Trust the content, not the file name or the client's content type
+	sniff := make([]byte, 512)
+	n, _ := io.ReadFull(file, sniff)
+	contentType := http.DetectContentType(sniff[:n])
+	extension, ok := kycDocumentTypes[contentType]
+	if !ok {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Documents must be JPEG, PNG or PDF"})
+		return
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Internal server error"})
+		return
+	}
+
+	document := db.KYCDocument{
+		ID:          primitive.NewObjectID(),
+		Kind:        kind,
+		FileName:    filepath.Base(header.Filename),
+		ContentType: contentType,
+		Size:        header.Size,
+		UploadedAt:  time.Now(),
+	}
+	document.BlobKey = fmt.Sprintf("%s/%s%s", accountID.Hex(), document.ID.Hex(), extension)
+
+	if err := api.blobs.Put(ctx.Request.Context(), document.BlobKey, io.LimitReader(file, maxKYCDocumentSize)); err != nil {
+		log.Printf("Error storing KYC document for %s: %v", accountID.Hex(), err)
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Could not store the document"})
+		return
+	}
+
+	profile, err := api.accMgr.AddKYCDocument(accountID, document)
+	if err != nil {
+		if deleteErr := api.blobs.Delete(context.Background(), document.BlobKey); deleteErr != nil {
+			log.Printf("Error removing orphaned KYC document %s: %v", document.BlobKey, deleteErr)
+		}
+		ctx.JSON(kycErrorStatus(err), ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusCreated, kycStatusRes(profile))
+}
+
+// @Summary Submit KYC for review
+// @Description Send the identity details and documents to the compliance team
+// @ID submit-kyc
+// @Produce json
+// @Success 200 {object} KYCStatusRes
+// @Failure 400 {object} ErrorResponse "Details or documents missing"
+// @Failure 409 {object} ErrorResponse "Already submitted or verified"
+// @Router /account/kyc/submit [post]
+// @Security BearerAuth
+func (api *ApiManager) handleSubmitKYC(ctx *gin.Context) {
+	accountID, err := currentUserID(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	profile, err := api.accMgr.SubmitKYC(accountID)
+	if err != nil {
+		ctx.JSON(kycErrorStatus(err), ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, kycStatusRes(profile))
+}
+
+// @Summary KYC review queue
+// @Description List accounts in a KYC state, pending_review by default (admin only)
+// @ID get-kyc-queue
+// @Produce json
+// @Param status query string false "unverified, pending_review, verified or rejected"
+// @Success 200 {object} KYCQueueRes
+// @Router /admin/kyc [get]
+// @Security BearerAuth
+func (api *ApiManager) handleGetKYCQueue(ctx *gin.Context) {
+	status := ctx.DefaultQuery("status", db.KYCPendingReview)
+	if _, ok := db.KYCTierLimits[status]; !ok {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Unknown KYC status"})
+		return
+	}
+
+	accounts, err := api.accMgr.GetKYCQueue(status)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Internal server error"})
+		return
+	}
+
+	entries := []KYCQueueEntry{}
+	for _, account := range accounts {
+		account.KYC.Status = account.KYC.State()
+		entries = append(entries, KYCQueueEntry{
+			AccountID:     account.ID.Hex(),
+			AccountHolder: account.AccountHolder,
+			PhoneNumber:   account.PhoneNumber,
+			Profile:       account.KYC,
+		})
+	}
+
+	ctx.JSON(http.StatusOK, KYCQueueRes{Accounts: entries})
+}
+
+// @Summary Get an account's KYC profile
+// @Description Identity details and documents of one account (admin only)
+// @ID get-account-kyc
+// @Produce json
+// @Param id path string true "Account ID or account number"
+// @Success 200 {object} KYCStatusRes
+// @Router /admin/kyc/{id} [get]
+// @Security BearerAuth
+func (api *ApiManager) handleGetAccountKYC(ctx *gin.Context) {
+	accountID, err := api.accMgr.ResolveAccountRef(ctx.Param("id"))
+	if err != nil {
+		ctx.JSON(accountRefStatus(err), ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	profile, err := api.accMgr.GetKYCProfile(accountID)
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, kycStatusRes(profile))
+}
+
+// @Summary Download a KYC document
+// @Description Download one of an account's identity documents (admin only)
+// @ID get-kyc-document
+// @Produce octet-stream
+// @Param id path string true "Account ID or account number"
+// @Param document_id path string true "Document ID"
+// @Success 200 {file} file
+// @Failure 404 {object} ErrorResponse "Document not found"
+// @Router /admin/kyc/{id}/documents/{document_id} [get]
+// @Security BearerAuth
+func (api *ApiManager) handleGetKYCDocument(ctx *gin.Context) {
+	accountID, err := api.accMgr.ResolveAccountRef(ctx.Param("id"))
+	if err != nil {
+		ctx.JSON(accountRefStatus(err), ErrorResponse{Message: err.Error()})
+		return
+	}
+	documentID, err := primitive.ObjectIDFromHex(ctx.Param("document_id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Invalid ID format"})
+		return
+	}
+
+	profile, err := api.accMgr.GetKYCProfile(accountID)
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	var document *db.KYCDocument
+	for i := range profile.Documents {
+		if profile.Documents[i].ID == documentID {
+			document = &profile.Documents[i]
+		}
+	}
+	if document == nil {
+		ctx.JSON(http.StatusNotFound, ErrorResponse{Message: "Document not found"})
+		return
+	}
+
+	blob, err := api.blobs.Get(ctx.Request.Context(), document.BlobKey)
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, ErrorResponse{Message: "Document not found"})
+		return
+	}
+	defer blob.Close()
+	api.audit(ctx, "kyc.document.view", accountID.Hex(), map[string]string{"document": documentID.Hex()})
+
+	ctx.DataFromReader(http.StatusOK, document.Size, document.ContentType, blob, map[string]string{
+		"Content-Disposition": fmt.Sprintf("attachment; filename=%q", document.FileName),
+	})
+}
+
+// @Summary Approve KYC
+// @Description Mark a pending account as verified, raising its limits (admin only)
+// @ID approve-kyc
+// @Produce json
+// @Param id path string true "Account ID or account number"
+// @Success 200 {object} KYCStatusRes
+// @Failure 409 {object} ErrorResponse "Not pending review"
+// @Router /admin/kyc/{id}/approve [post]
+// @Security BearerAuth
+func (api *ApiManager) handleApproveKYC(ctx *gin.Context) {
+	api.handleReviewKYC(ctx, true)
+}
+
+// @Summary Reject KYC
+// @Description Reject a pending account with a reason; the user can correct it and submit again (admin only)
+// @ID reject-kyc
+// @Accept json
+// @Produce json
+// @Param id path string true "Account ID or account number"
+// @Param reason body RejectKYCRequest true "Reason"
+// @Success 200 {object} KYCStatusRes
+// @Failure 409 {object} ErrorResponse "Not pending review"
+// @Router /admin/kyc/{id}/reject [post]
+// @Security BearerAuth
+func (api *ApiManager) handleRejectKYC(ctx *gin.Context) {
+	api.handleReviewKYC(ctx, false)
+}
+
+func (api *ApiManager) handleReviewKYC(ctx *gin.Context, approve bool) {
+	reviewerID, err := currentUserID(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	accountID, err := api.accMgr.ResolveAccountRef(ctx.Param("id"))
+	if err != nil {
+		ctx.JSON(accountRefStatus(err), ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	var req RejectKYCRequest
+	if !approve {
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Bad request"})
+			return
+		}
+	}
+
+	profile, err := api.accMgr.ReviewKYC(accountID, reviewerID, approve, req.Reason)
+	if err != nil {
+		ctx.JSON(kycErrorStatus(err), ErrorResponse{Message: err.Error()})
+		return
+	}
+	api.audit(ctx, "kyc.review", accountID.Hex(), map[string]string{"status": profile.Status, "reason": profile.RejectionReason})
+
+	if approve {
+		go api.notifyAccount(accountID, "Your identity has been verified. Your transfer and deposit limits have been raised.")
+	} else {
+		go api.notifyAccount(accountID, fmt.Sprintf("We couldn't verify your identity: %s. Please update your details and submit again.", profile.RejectionReason))
+	}
+
+	ctx.JSON(http.StatusOK, kycStatusRes(profile))
+}
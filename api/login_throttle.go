@@ -0,0 +1,147 @@
+package api
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tamir-liebermann/gobank/db"
+	"github.com/tamir-liebermann/gobank/utils"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// dummyPasswordHash is checked against when a login names no account, so
+// unknown usernames take as long to refuse as wrong passwords.
+var dummyPasswordHash = sync.OnceValue(func() string {
+	hash, err := utils.HashPassword("not a real password")
+	if err != nil {
+		log.Printf("Error hashing the dummy login password: %v", err)
+	}
+	return hash
+})
+
+func loginLockoutErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, db.ErrLoginLockoutNotFound), errors.Is(err, db.ErrAccountNotFound):
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+// refuseThrottledLogin answers 429 with a Retry-After header when err is a
+// throttled login, and reports whether it did.
+func (api *ApiManager) refuseThrottledLogin(ctx *gin.Context, username string, err error) bool {
+	var throttled *db.LoginThrottledError
+	if !errors.As(err, &throttled) {
+		return false
+	}
+	seconds := int((throttled.RetryAfter + time.Second - 1) / time.Second)
+	api.audit(ctx, "account.login_throttled", "", map[string]string{
+		"username":    username,
+		"ip":          ctx.ClientIP(),
+		"retry_after": strconv.Itoa(seconds),
+	})
+	ctx.Header("Retry-After", strconv.Itoa(seconds))
+	ctx.JSON(http.StatusTooManyRequests, ErrorResponse{Message: throttled.Error()})
+	return true
+}
+
+// recordLoginFailure counts a failed login against the username and the
+// client IP. When it locks the username, the accounts it names are told.
+// The client IP only comes from X-Forwarded-For behind TRUSTED_PROXIES, so a
+// caller can't dodge the per-IP count by sending a new address each time.
+func (api *ApiManager) recordLoginFailure(ctx *gin.Context, username string, accounts []*db.BankAccount) {
+	api.audit(ctx, "account.login_failed", "", map[string]string{"username": username, "ip": ctx.ClientIP()})
+
+	locked, err := api.accMgr.RecordLoginFailure(username, ctx.ClientIP())
+	if err != nil {
+		log.Printf("Error recording failed login for %q: %v", username, err)
+		return
+	}
+	for _, lockout := range locked {
+		api.audit(ctx, "account.login_locked", lockout.ID.Hex(), map[string]string{"kind": lockout.Kind, "key": lockout.Key})
+		if lockout.Kind != db.LoginKeyUsername {
+			continue
+		}
+		for _, account := range accounts {
+			go api.notifyAccount(account.ID, "There were too many failed attempts to log in to your gobank account, so logins are paused for 15 minutes. If this wasn't you, consider changing your password.")
+		}
+	}
+}
+
+// @Summary List login lockouts
+// @Description Usernames and IP addresses that are waiting out a login backoff or lockout after failed logins (needs accounts:read)
+// @ID get-login-lockouts
+// @Produce json
+// @Success 200 {object} LoginLockoutsRes
+// @Router /admin/login-lockouts [get]
+// @Security BearerAuth
+func (api *ApiManager) handleGetLoginLockouts(ctx *gin.Context) {
+	lockouts, err := api.accMgr.GetLoginLockouts()
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Could not load login lockouts"})
+		return
+	}
+	ctx.JSON(http.StatusOK, LoginLockoutsRes{Lockouts: lockouts})
+}
+
+// @Summary Lift a login lockout
+// @Description Clear the failed logins of a username or IP address, e.g. an office sharing one IP (needs logins:unlock)
+// @ID delete-login-lockout
+// @Produce json
+// @Param lockout_id path string true "Lockout ID"
+// @Success 200 {object} db.LoginAttempts
+// @Failure 404 {object} ErrorResponse "Lockout not found"
+// @Router /admin/login-lockouts/{lockout_id} [delete]
+// @Security BearerAuth
+func (api *ApiManager) handleDeleteLoginLockout(ctx *gin.Context) {
+	lockoutID, err := primitive.ObjectIDFromHex(ctx.Param("lockout_id"))
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, ErrorResponse{Message: db.ErrLoginLockoutNotFound.Error()})
+		return
+	}
+
+	lockout, err := api.accMgr.DeleteLoginLockout(lockoutID)
+	if err != nil {
+		ctx.JSON(loginLockoutErrorStatus(err), ErrorResponse{Message: err.Error()})
+		return
+	}
+	api.audit(ctx, "account.login_unlock", lockout.ID.Hex(), map[string]string{"kind": lockout.Kind, "key": lockout.Key})
+
+	ctx.JSON(http.StatusOK, lockout)
+}
+
+// @Summary Unlock an account's logins
+// @Description Clear the failed logins of the names an account logs in with, its holder name and phone number (needs logins:unlock)
+// @ID unlock-account-login
+// @Produce json
+// @Param id path string true "Account ID or account number"
+// @Success 200 {object} UnlockLoginRes
+// @Failure 404 {object} ErrorResponse "Account not found"
+// @Router /admin/accounts/{id}/unlock [post]
+// @Security BearerAuth
+func (api *ApiManager) handleUnlockAccountLogin(ctx *gin.Context) {
+	accountID, err := api.accMgr.ResolveAccountRef(ctx.Param("id"))
+	if err != nil {
+		ctx.JSON(accountRefStatus(err), ErrorResponse{Message: err.Error()})
+		return
+	}
+	account, err := api.accMgr.SearchAccountById(accountID)
+	if err != nil || account == nil {
+		ctx.JSON(http.StatusNotFound, ErrorResponse{Message: db.ErrAccountNotFound.Error()})
+		return
+	}
+
+	cleared, err := api.accMgr.UnlockLogin(account)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Could not unlock logins"})
+		return
+	}
+	api.audit(ctx, "account.login_unlock", accountID.Hex(), map[string]string{"cleared": strconv.FormatInt(cleared, 10)})
+
+	ctx.JSON(http.StatusOK, UnlockLoginRes{AccountID: accountID.Hex(), Cleared: cleared})
+}
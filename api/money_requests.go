@@ -0,0 +1,395 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tamir-liebermann/gobank/db"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// accountLabel returns a short human readable description of an account for
+// notifications, falling back to the hex ID when the account can't be loaded.
+func (api *ApiManager) accountLabel(id primitive.ObjectID) string {
+	account, err := api.accMgr.SearchAccountById(id)
+	if err != nil || account == nil {
+		return id.Hex()
+	}
+	return fmt.Sprintf("%s (%s)", account.AccountHolder, account.PhoneNumber)
+}
+
+// parseOptionalID parses a hex ObjectID, treating an empty string as "none".
+func parseOptionalID(id string) (primitive.ObjectID, error) {
+	id = strings.TrimSpace(id)
+	if id == "" {
+		return primitive.NilObjectID, nil
+	}
+	return primitive.ObjectIDFromHex(id)
+}
+
+func (api *ApiManager) createMoneyRequest(requesterID primitive.ObjectID, from string, amount float64, note string) (*db.MoneyRequest, error) {
+	payerID, err := api.resolveRecipient(requesterID, from)
+	if err != nil {
+		return nil, err
+	}
+
+	return api.requestMoney(requesterID, payerID, amount, note)
+}
+
+// requestMoney stores a money request and notifies the payer on WhatsApp.
+func (api *ApiManager) requestMoney(requesterID, payerID primitive.ObjectID, amount float64, note string) (*db.MoneyRequest, error) {
+	request, err := api.accMgr.CreateMoneyRequest(requesterID, payerID, amount, note, db.DefaultMoneyRequestTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	message := fmt.Sprintf("%s is requesting %.2f from you", api.accountLabel(requesterID), request.Amount)
+	if request.Note != "" {
+		message += fmt.Sprintf(" for %q", request.Note)
+	}
+	message += fmt.Sprintf(".\nReply \"pay\" to pay it or \"decline\" to decline (request %s, expires %s).",
+		request.ID.Hex(), request.ExpiresAt.Format("Jan 2 15:04"))
+	go api.notifyAccount(payerID, message)
+
+	return request, nil
+}
+
+// findIncomingMoneyRequest loads the request addressed to payerID. A nil
+// requestID selects the payer's most recent pending request.
+func (api *ApiManager) findIncomingMoneyRequest(payerID, requestID primitive.ObjectID) (*db.MoneyRequest, error) {
+	if requestID.IsZero() {
+		return api.accMgr.GetLatestPendingMoneyRequest(payerID)
+	}
+
+	request, err := api.accMgr.GetMoneyRequestById(requestID)
+	if err != nil {
+		return nil, err
+	}
+	if request.PayerID != payerID {
+		return nil, db.ErrMoneyRequestNotFound
+	}
+	return request, nil
+}
+
+// payMoneyRequest pays a pending request through the normal transfer path.
+// The request is claimed before the transfer so it can only be paid once,
+// and is released back to pending if the transfer fails. A payment held for
+// review leaves the request awaiting review until the hold is decided.
+func (api *ApiManager) payMoneyRequest(ctx *gin.Context, payerID, requestID primitive.ObjectID) (*db.MoneyRequest, error) {
+	request, err := api.findIncomingMoneyRequest(payerID, requestID)
+	if err != nil {
+		return nil, err
+	}
+
+	request, err = api.accMgr.SetMoneyRequestStatus(request.ID, db.MoneyRequestPending, db.MoneyRequestPaid)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = api.performTransfer(ctx, payerID, request.RequesterID, request.Amount, db.TransferOptions{MoneyRequestID: request.ID})
+	var held *db.TransferHeldError
+	if errors.As(err, &held) {
+		return nil, fmt.Errorf("error paying request: %w", err)
+	}
+	if err != nil {
+		if _, revertErr := api.accMgr.SetMoneyRequestStatus(request.ID, db.MoneyRequestPaid, db.MoneyRequestPending); revertErr != nil {
+			log.Printf("Error releasing money request %s after failed payment: %v", request.ID.Hex(), revertErr)
+		}
+		return nil, fmt.Errorf("error paying request: %w", err)
+	}
+
+	go api.notifyAccount(request.RequesterID, fmt.Sprintf("%s paid your request for %.2f.", api.accountLabel(payerID), request.Amount))
+	return request, nil
+}
+
+func (api *ApiManager) declineMoneyRequest(payerID, requestID primitive.ObjectID) (*db.MoneyRequest, error) {
+	request, err := api.findIncomingMoneyRequest(payerID, requestID)
+	if err != nil {
+		return nil, err
+	}
+
+	request, err = api.accMgr.SetMoneyRequestStatus(request.ID, db.MoneyRequestPending, db.MoneyRequestDeclined)
+	if err != nil {
+		return nil, err
+	}
+
+	go api.notifyAccount(request.RequesterID, fmt.Sprintf("%s declined your request for %.2f.", api.accountLabel(payerID), request.Amount))
+	return request, nil
+}
+
+func (api *ApiManager) cancelMoneyRequest(requesterID, requestID primitive.ObjectID) (*db.MoneyRequest, error) {
+	request, err := api.accMgr.GetMoneyRequestById(requestID)
+	if err != nil {
+		return nil, err
+	}
+	if request.RequesterID != requesterID {
+		return nil, db.ErrMoneyRequestNotFound
+	}
+
+	return api.accMgr.SetMoneyRequestStatus(request.ID, db.MoneyRequestPending, db.MoneyRequestCancelled)
+}
+
+func moneyRequestErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, db.ErrMoneyRequestNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, db.ErrMoneyRequestClosed):
+		return http.StatusConflict
+	}
+	if status, ok := transferStoppedStatus(err); ok {
+		return status
+	}
+	return http.StatusBadRequest
+}
+
+// @Summary Request money
+// @Description Ask another user (by phone, account ID or payee nickname) to send you money
+// @ID create-money-request
+// @Accept json
+// @Produce json
+// @Param request body MoneyRequestReq true "Money request"
+// @Success 201 {object} db.MoneyRequest
+// @Failure 400 {object} ErrorResponse "Bad request"
+// @Router /account/requests [post]
+// @Security BearerAuth
+func (api *ApiManager) handleCreateMoneyRequest(ctx *gin.Context) {
+	requesterID, err := currentUserID(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	var req MoneyRequestReq
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Bad request"})
+		return
+	}
+
+	request, err := api.createMoneyRequest(requesterID, req.From, req.Amount, req.Note)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusCreated, request)
+}
+
+// @Summary List money requests
+// @Description List money requests you sent (outgoing) or received (incoming)
+// @ID get-money-requests
+// @Produce json
+// @Param direction query string false "incoming (default) or outgoing"
+// @Param status query string false "pending, paid, declined, cancelled or expired"
+// @Success 200 {object} MoneyRequestsRes
+// @Failure 500 {object} ErrorResponse "Internal server error"
+// @Router /account/requests [get]
+// @Security BearerAuth
+func (api *ApiManager) handleGetMoneyRequests(ctx *gin.Context) {
+	accountID, err := currentUserID(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	incoming := ctx.DefaultQuery("direction", "incoming") != "outgoing"
+	requests, err := api.accMgr.GetMoneyRequests(accountID, incoming, ctx.Query("status"))
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Internal server error"})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, MoneyRequestsRes{Requests: requests})
+}
+
+// @Summary Pay a money request
+// @Description Pay a pending money request addressed to you
+// @ID pay-money-request
+// @Produce json
+// @Param request_id path string true "Money request ID"
+// @Success 200 {object} db.MoneyRequest
+// @Success 202 {object} ErrorResponse "Payment held for review; the request awaits the review"
+// @Failure 403 {object} ErrorResponse "Second factor needed, or payment blocked or over the KYC limit"
+// @Failure 404 {object} ErrorResponse "Request not found"
+// @Failure 409 {object} ErrorResponse "Request is no longer pending"
+// @Router /account/requests/{request_id}/pay [post]
+// @Security BearerAuth
+func (api *ApiManager) handlePayMoneyRequest(ctx *gin.Context) {
+	api.handleMoneyRequestAction(ctx, func(payerID, requestID primitive.ObjectID) (*db.MoneyRequest, error) {
+		// Paying a request moves money like a transfer, so large ones need
+		// the same fresh second factor
+		request, err := api.findIncomingMoneyRequest(payerID, requestID)
+		if err != nil {
+			return nil, err
+		}
+		if request.Amount >= api.stepUpTransferAmount && !api.requireSecondFactor(ctx, payerID) {
+			return nil, errSecondFactorRequired
+		}
+		return api.payMoneyRequest(ctx, payerID, requestID)
+	})
+}
+
+// @Summary Decline a money request
+// @Description Decline a pending money request addressed to you
+// @ID decline-money-request
+// @Produce json
+// @Param request_id path string true "Money request ID"
+// @Success 200 {object} db.MoneyRequest
+// @Failure 404 {object} ErrorResponse "Request not found"
+// @Failure 409 {object} ErrorResponse "Request is no longer pending"
+// @Router /account/requests/{request_id}/decline [post]
+// @Security BearerAuth
+func (api *ApiManager) handleDeclineMoneyRequest(ctx *gin.Context) {
+	api.handleMoneyRequestAction(ctx, api.declineMoneyRequest)
+}
+
+// @Summary Cancel a money request
+// @Description Cancel a pending money request you sent
+// @ID cancel-money-request
+// @Produce json
+// @Param request_id path string true "Money request ID"
+// @Success 200 {object} db.MoneyRequest
+// @Failure 404 {object} ErrorResponse "Request not found"
+// @Failure 409 {object} ErrorResponse "Request is no longer pending"
+// @Router /account/requests/{request_id}/cancel [post]
+// @Security BearerAuth
+func (api *ApiManager) handleCancelMoneyRequest(ctx *gin.Context) {
+	api.handleMoneyRequestAction(ctx, api.cancelMoneyRequest)
+}
+
+func (api *ApiManager) handleMoneyRequestAction(ctx *gin.Context, action func(accountID, requestID primitive.ObjectID) (*db.MoneyRequest, error)) {
+	accountID, err := currentUserID(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	requestID, err := primitive.ObjectIDFromHex(ctx.Param("request_id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Invalid ID format"})
+		return
+	}
+
+	request, err := action(accountID, requestID)
+	if errors.Is(err, errSecondFactorRequired) {
+		// requireSecondFactor has already answered
+		return
+	} else if err != nil {
+		ctx.JSON(moneyRequestErrorStatus(err), ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, request)
+}
+
+func (api *ApiManager) handleRequestMoneyIntent(ctx *gin.Context, req MoneyRequestReq) (*db.MoneyRequest, error) {
+	requesterID, err := currentUserID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return api.createMoneyRequest(requesterID, req.From, req.Amount, req.Note)
+}
+
+// handleMoneyRequestReplyIntent pays or declines a request from chat. Paying
+// one that needs a confirmation code is returned as a pending action instead.
+func (api *ApiManager) handleMoneyRequestReplyIntent(ctx *gin.Context, req MoneyRequestReplyReq, pay bool) (*db.MoneyRequest, *db.PendingAction, error) {
+	payerID, err := currentUserID(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	requestID, err := parseOptionalID(req.RequestID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid request id: %v", err)
+	}
+
+	if !pay {
+		request, err := api.declineMoneyRequest(payerID, requestID)
+		return request, nil, err
+	}
+
+	request, err := api.findIncomingMoneyRequest(payerID, requestID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := api.chatStepUp(ctx, payerID, request.Amount); err != nil {
+		return nil, nil, err
+	}
+	if api.needsCode(db.PendingActionPayRequest, request.Amount) {
+		summary := fmt.Sprintf("Paying %.2f to %s.", request.Amount, api.accountLabel(request.RequesterID))
+		payload := map[string]interface{}{"request_id": request.ID.Hex()}
+		action, err := api.createPendingAction(payerID, db.PendingActionPayRequest, payload, summary, request.Amount)
+		return nil, action, err
+	}
+
+	request, err = api.payMoneyRequest(ctx, payerID, request.ID)
+	return request, nil, err
+}
+
+func (api *ApiManager) confirmPendingPayRequest(ctx *gin.Context, payerID primitive.ObjectID, action *db.PendingAction) (string, error) {
+	var replyReq MoneyRequestReplyReq
+	if err := decodeIntentBody(action.Payload, &replyReq); err != nil {
+		return "", err
+	}
+	requestID, err := primitive.ObjectIDFromHex(replyReq.RequestID)
+	if err != nil {
+		return "", err
+	}
+
+	request, err := api.findIncomingMoneyRequest(payerID, requestID)
+	if err == nil {
+		err = api.chatStepUp(ctx, payerID, request.Amount)
+	}
+	if err == nil {
+		request, err = api.payMoneyRequest(ctx, payerID, requestID)
+	}
+	if errors.Is(err, db.ErrMoneyRequestNotFound) || errors.Is(err, db.ErrMoneyRequestClosed) {
+		return "Sorry, " + err.Error() + ".", nil
+	} else if reply, ok := transferStoppedReply(err); ok {
+		return reply, nil
+	} else if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Paid %.2f to %s.", request.Amount, api.accountLabel(request.RequesterID)), nil
+}
+
+func (api *ApiManager) handleListMoneyRequestsIntent(ctx *gin.Context) (string, error) {
+	accountID, err := currentUserID(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	incoming, err := api.accMgr.GetMoneyRequests(accountID, true, db.MoneyRequestPending)
+	if err != nil {
+		return "", err
+	}
+	outgoing, err := api.accMgr.GetMoneyRequests(accountID, false, db.MoneyRequestPending)
+	if err != nil {
+		return "", err
+	}
+
+	if len(incoming) == 0 && len(outgoing) == 0 {
+		return "You have no pending money requests.", nil
+	}
+
+	var sb strings.Builder
+	if len(incoming) > 0 {
+		sb.WriteString("Waiting for you to pay:\n")
+		for _, request := range incoming {
+			sb.WriteString(fmt.Sprintf("- %.2f to %s %q (reply \"pay %s\")\n",
+				request.Amount, api.accountLabel(request.RequesterID), request.Note, request.ID.Hex()))
+		}
+	}
+	if len(outgoing) > 0 {
+		sb.WriteString("You are waiting on:\n")
+		for _, request := range outgoing {
+			sb.WriteString(fmt.Sprintf("- %.2f from %s %q\n",
+				request.Amount, api.accountLabel(request.PayerID), request.Note))
+		}
+	}
+	return sb.String(), nil
+}
@@ -0,0 +1,85 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tamir-liebermann/gobank/db"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var errNotYourAccount = errors.New("you can only access your own account")
+
+// canAccessAccount reports whether the caller owns the account, or has a
+// role that grants permission over other people's accounts. An empty
+// permission means only the owner may.
+func (api *ApiManager) canAccessAccount(ctx *gin.Context, accountID primitive.ObjectID, permission string) (bool, error) {
+	callerID, err := currentUserID(ctx)
+	if err != nil {
+		return false, err
+	}
+	if callerID == accountID {
+		return true, nil
+	}
+	if permission == "" {
+		return false, nil
+	}
+
+	err = api.checkPermission(ctx, permission)
+	if errors.Is(err, errNotPermitted) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// denyAccountAccess answers 403 and records who tried to reach whose account.
+func (api *ApiManager) denyAccountAccess(ctx *gin.Context, target string) {
+	api.audit(ctx, "access.denied", target, map[string]string{
+		"method": ctx.Request.Method,
+		"route":  ctx.FullPath(),
+	})
+	ctx.AbortWithStatusJSON(http.StatusForbidden, ErrorResponse{Message: errNotYourAccount.Error()})
+}
+
+// authorizeAccount is the check for handlers that get the account from the
+// body. It writes the error response itself and reports whether to go on.
+func (api *ApiManager) authorizeAccount(ctx *gin.Context, accountID primitive.ObjectID, permission string) bool {
+	ok, err := api.canAccessAccount(ctx, accountID, permission)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusUnauthorized, ErrorResponse{Message: err.Error()})
+		return false
+	}
+	if !ok {
+		api.denyAccountAccess(ctx, accountID.Hex())
+		return false
+	}
+	return true
+}
+
+// requireAccountAccess guards routes with the account in the :id path
+// parameter. Malformed references are left for the handler to reject, but
+// an account that doesn't exist is a 403 like any other account that isn't
+// the caller's, so the answer doesn't tell which accounts exist.
+func (api *ApiManager) requireAccountAccess(permission string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		ref := ctx.Param("id")
+		accountID, err := api.accMgr.ResolveAccountRef(ref)
+		if errors.Is(err, db.ErrAccountNotFound) {
+			if permission != "" && api.checkPermission(ctx, permission) == nil {
+				ctx.Next()
+				return
+			}
+			api.denyAccountAccess(ctx, ref)
+			return
+		} else if err != nil {
+			ctx.Next()
+			return
+		}
+
+		if !api.authorizeAccount(ctx, accountID, permission) {
+			return
+		}
+		ctx.Next()
+	}
+}
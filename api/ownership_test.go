@@ -0,0 +1,244 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tamir-liebermann/gobank/db"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// These tests need a MongoDB replica set (transfers use transactions) at
+// MONGODB_URI and are skipped without one. They create throwaway accounts,
+// so point MONGODB_URI at a scratch database.
+
+type ownershipFixture struct {
+	api    *ApiManager
+	router *gin.Engine
+
+	owner    *db.BankAccount
+	other    *db.BankAccount
+	staff    *db.BankAccount
+	closing  *db.BankAccount // empty, closed by its owner
+	disposed *db.BankAccount // empty, deleted by staff
+
+	tokens map[primitive.ObjectID]string
+}
+
+func newOwnershipFixture(t *testing.T) *ownershipFixture {
+	t.Helper()
+	if os.Getenv("MONGODB_URI") == "" {
+		t.Skip("MONGODB_URI not set")
+	}
+	for _, name := range []string{
+		"TWILIO_AUTH", "TWILIO_ACC_SID", "OPENAI_API_KEY", "TWILIO_PHONE_NUM",
+		"TWILIO_SECRET", "TWILIO_API_KEY", "TWILIO_API_SECRET", "APP_WEBHOOK_URL",
+	} {
+		if os.Getenv(name) == "" {
+			t.Setenv(name, "test")
+		}
+	}
+	t.Setenv("JWT_KEY_DIR", t.TempDir())
+	t.Setenv("KYC_STORAGE_DIR", t.TempDir())
+
+	accMgr, err := db.InitDB()
+	if err != nil {
+		t.Fatalf("init db: %v", err)
+	}
+	gin.SetMode(gin.TestMode)
+	f := &ownershipFixture{
+		api:    NewApiManager(accMgr),
+		router: gin.New(),
+		tokens: map[primitive.ObjectID]string{},
+	}
+	f.api.RegisterRoutes(f.router)
+
+	f.owner = f.createAccount(t, 100, db.RoleCustomer)
+	f.other = f.createAccount(t, 100, db.RoleCustomer)
+	f.staff = f.createAccount(t, 0, db.RoleAdmin)
+	f.closing = f.createAccount(t, 0, db.RoleCustomer)
+	f.disposed = f.createAccount(t, 0, db.RoleCustomer)
+	return f
+}
+
+func (f *ownershipFixture) createAccount(t *testing.T, balance float64, role string) *db.BankAccount {
+	t.Helper()
+	suffix := primitive.NewObjectID().Hex()
+	phone := fmt.Sprintf("+1555%07d", rand.Intn(10000000))
+	account, err := f.api.accMgr.CreateAccount("owner-test-"+suffix, "owner-test-password", phone, role)
+	if err != nil {
+		t.Fatalf("create account: %v", err)
+	}
+	if balance > 0 {
+		if _, err := f.api.accMgr.DepositToAccount(balance, account.ID); err != nil {
+			t.Fatalf("fund account: %v", err)
+		}
+	}
+
+	session, refreshToken, err := f.api.accMgr.CreateSession(account.ID, "ownership-test", "127.0.0.1", false)
+	if err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	tokens, err := f.api.accessToken(account, session, refreshToken)
+	if err != nil {
+		t.Fatalf("access token: %v", err)
+	}
+	f.tokens[account.ID] = tokens.Token
+	return account
+}
+
+func (f *ownershipFixture) do(t *testing.T, caller *db.BankAccount, method, path string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	var reader *bytes.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			t.Fatalf("marshal body: %v", err)
+		}
+		reader = bytes.NewReader(payload)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+
+	req := httptest.NewRequest(method, path, reader)
+	req.Header.Set("Authorization", "Bearer "+f.tokens[caller.ID])
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	rec := httptest.NewRecorder()
+	f.router.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAccountOwnership(t *testing.T) {
+	f := newOwnershipFixture(t)
+
+	type route struct {
+		name   string
+		method string
+		// path and body are built for the account the request is about
+		path func(account *db.BankAccount) string
+		body func(account *db.BankAccount) interface{}
+		// staffAllowed is whether staff with the route's permission may use
+		// it on someone else's account; moving money out never is
+		staffAllowed bool
+	}
+	routes := []route{
+		{
+			name:         "get account",
+			method:       http.MethodGet,
+			path:         func(a *db.BankAccount) string { return "/account/" + a.ID.Hex() },
+			staffAllowed: true,
+		},
+		{
+			name:         "transaction history",
+			method:       http.MethodGet,
+			path:         func(a *db.BankAccount) string { return "/account/transactions/" + a.ID.Hex() },
+			staffAllowed: true,
+		},
+		{
+			name:   "transfer",
+			method: http.MethodPost,
+			path:   func(*db.BankAccount) string { return "/account/transfer" },
+			body: func(a *db.BankAccount) interface{} {
+				return TransferRequest{From: a.ID.Hex(), To: f.staff.ID.Hex(), Amount: 1}
+			},
+		},
+		{
+			name:   "deposit",
+			method: http.MethodPost,
+			path:   func(*db.BankAccount) string { return "/account/deposit" },
+			body: func(a *db.BankAccount) interface{} {
+				return DepositRequest{AccountID: a.ID.Hex(), Amount: 50}
+			},
+			staffAllowed: true,
+		},
+		{
+			name:         "balance",
+			method:       http.MethodGet,
+			path:         func(a *db.BankAccount) string { return "/account/balance?accountId=" + a.ID.Hex() },
+			staffAllowed: true,
+		},
+	}
+
+	for _, r := range routes {
+		r := r
+		body := func(account *db.BankAccount) interface{} {
+			if r.body == nil {
+				return nil
+			}
+			return r.body(account)
+		}
+
+		t.Run(r.name+"/owner", func(t *testing.T) {
+			rec := f.do(t, f.owner, r.method, r.path(f.owner), body(f.owner))
+			if rec.Code < 200 || rec.Code > 299 {
+				t.Fatalf("owner got %d, want 2xx: %s", rec.Code, rec.Body)
+			}
+		})
+
+		t.Run(r.name+"/other customer", func(t *testing.T) {
+			f.expectDenied(t, f.other, r.method, r.path(f.owner), body(f.owner), f.owner.ID.Hex())
+		})
+
+		t.Run(r.name+"/staff", func(t *testing.T) {
+			if !r.staffAllowed {
+				f.expectDenied(t, f.staff, r.method, r.path(f.owner), body(f.owner), f.owner.ID.Hex())
+				return
+			}
+			rec := f.do(t, f.staff, r.method, r.path(f.owner), body(f.owner))
+			if rec.Code < 200 || rec.Code > 299 {
+				t.Fatalf("staff got %d, want 2xx: %s", rec.Code, rec.Body)
+			}
+		})
+	}
+
+	// Deleting takes an empty account, so each case gets its own
+	t.Run("delete account/owner", func(t *testing.T) {
+		rec := f.do(t, f.closing, http.MethodDelete, "/account/"+f.closing.ID.Hex(), nil)
+		if rec.Code != http.StatusAccepted {
+			t.Fatalf("owner got %d, want %d: %s", rec.Code, http.StatusAccepted, rec.Body)
+		}
+	})
+	t.Run("delete account/other customer", func(t *testing.T) {
+		f.expectDenied(t, f.other, http.MethodDelete, "/account/"+f.owner.ID.Hex(), nil, f.owner.ID.Hex())
+	})
+	t.Run("delete account/staff", func(t *testing.T) {
+		rec := f.do(t, f.staff, http.MethodDelete, "/account/"+f.disposed.ID.Hex(), nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("staff got %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+		}
+	})
+}
+
+// expectDenied checks the caller gets a 403 and the attempt is in the audit log.
+func (f *ownershipFixture) expectDenied(t *testing.T, caller *db.BankAccount, method, path string, body interface{}, target string) {
+	t.Helper()
+	since := time.Now().Add(-time.Second)
+
+	rec := f.do(t, caller, method, path, body)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("got %d, want %d: %s", rec.Code, http.StatusForbidden, rec.Body)
+	}
+
+	entries, err := f.api.accMgr.GetAuditEntries(db.AuditFilter{
+		ActorID: caller.ID,
+		Action:  "access.denied",
+		Target:  target,
+		From:    since,
+	})
+	if err != nil {
+		t.Fatalf("audit entries: %v", err)
+	}
+	if len(entries) == 0 {
+		t.Fatalf("no access.denied audit entry for %s %s", method, path)
+	}
+}
@@ -0,0 +1,236 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tamir-liebermann/gobank/db"
+	"github.com/tamir-liebermann/gobank/utils"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// defaultGuestPassword is the password WhatsApp sign-up used to give every
+// guest. Accounts still on it must reset their password before signing in.
+const defaultGuestPassword = "abc"
+
+const (
+	resetCodeDigits = 6
+
+	resetChannelWhatsApp = "whatsapp"
+	resetChannelSMS      = "sms"
+)
+
+var errPasswordChangeRequired = errors.New("this account needs a new password; request a reset code at /password/reset/request")
+
+func passwordErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, utils.ErrWeakPassword):
+		return http.StatusBadRequest
+	case errors.Is(err, db.ErrPasswordResetInvalid):
+		return http.StatusUnauthorized
+	case errors.Is(err, db.ErrPasswordResetTooSoon):
+		return http.StatusTooManyRequests
+	case errors.Is(err, db.ErrAccountNotFound):
+		return http.StatusNotFound
+	}
+	return twoFactorErrorStatus(err)
+}
+
+// setPassword checks the new password against the policy, stores it and
+// signs the account out everywhere but keepSession, which may be nil.
+func (api *ApiManager) setPassword(ctx *gin.Context, accountID primitive.ObjectID, password string, keepSession primitive.ObjectID) error {
+	if err := api.passwordPolicy.Check(password); err != nil {
+		return err
+	}
+	hash, err := utils.HashPassword(password)
+	if err != nil {
+		return err
+	}
+	if err := api.accMgr.SetPassword(accountID, hash); err != nil {
+		return err
+	}
+
+	revoked, err := api.accMgr.RevokeOtherSessions(accountID, keepSession, db.SessionRevokedPassword)
+	if err != nil {
+		log.Printf("Error signing %s out after a password change: %v", accountID.Hex(), err)
+	}
+	api.audit(ctx, "account.password_change", accountID.Hex(), map[string]string{"sessions_revoked": strconv.FormatInt(revoked, 10)})
+	go api.notifyAccount(accountID, "The password on your gobank account was changed and your other devices were signed out. If this wasn't you, contact support.")
+	return nil
+}
+
+// @Summary Change your password
+// @Description Replace your password. The new one must meet the password policy. Your other devices are signed out; this one stays signed in. With two-factor on, this needs a fresh second factor
+// @ID change-password
+// @Accept json
+// @Produce json
+// @Param password body ChangePasswordRequest true "Current and new password"
+// @Success 200 {object} string "Password changed"
+// @Failure 400 {object} ErrorResponse "New password does not meet the policy"
+// @Failure 401 {object} ErrorResponse "Wrong password"
+// @Failure 403 {object} ErrorResponse "Second factor needed"
+// @Router /account/password [put]
+// @Security BearerAuth
+func (api *ApiManager) handleChangePassword(ctx *gin.Context) {
+	var req ChangePasswordRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Bad request"})
+		return
+	}
+
+	account, ok := api.currentAccount(ctx)
+	if !ok {
+		return
+	}
+	if !utils.CheckPasswordHash(req.CurrentPassword, account.Password) {
+		api.audit(ctx, "account.password_change_failed", account.ID.Hex(), nil)
+		ctx.JSON(http.StatusUnauthorized, ErrorResponse{Message: "Wrong password"})
+		return
+	}
+	if req.NewPassword == req.CurrentPassword {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "The new password must be different"})
+		return
+	}
+	if !api.requireSecondFactor(ctx, account.ID) {
+		return
+	}
+
+	// WhatsApp requests have no session, so every device is signed out
+	sessionID, _ := primitive.ObjectIDFromHex(ctx.GetString(sessionIDKey))
+	if err := api.setPassword(ctx, account.ID, req.NewPassword, sessionID); err != nil {
+		ctx.JSON(passwordErrorStatus(err), ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, "Password changed")
+}
+
+// @Summary Request a password reset code
+// @Description Send a single-use code to the phone number of an account, over WhatsApp or SMS. The code works for 15 minutes. The answer is the same whether or not the number has an account
+// @ID request-password-reset
+// @Accept json
+// @Produce json
+// @Param reset body PasswordResetRequest true "Phone number and channel"
+// @Success 202 {object} string "Code sent if the number has an account"
+// @Failure 400 {object} ErrorResponse "Invalid phone number or channel"
+// @Failure 429 {object} ErrorResponse "A code was just sent"
+// @Router /password/reset/request [post]
+func (api *ApiManager) handleRequestPasswordReset(ctx *gin.Context) {
+	var req PasswordResetRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Bad request"})
+		return
+	}
+	phone := strings.TrimSpace(req.PhoneNumber)
+	if !PhoneNumberRegexp.MatchString(phone) {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "phone_number is not a valid international number"})
+		return
+	}
+	phone = phoneSeparators.Replace(phone)
+
+	channel := strings.ToLower(strings.TrimSpace(req.Channel))
+	switch channel {
+	case "":
+		channel = resetChannelWhatsApp
+	case resetChannelWhatsApp, resetChannelSMS:
+	default:
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "channel must be whatsapp or sms"})
+		return
+	}
+
+	const sent = "If this number belongs to an account, a reset code is on its way"
+	account, err := api.accMgr.GetAccountByPhone(phone)
+	if errors.Is(err, mongo.ErrNoDocuments) || (err == nil && account.ErasedAt != nil) {
+		ctx.JSON(http.StatusAccepted, sent)
+		return
+	} else if err != nil {
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Could not send a reset code, try again later"})
+		return
+	}
+
+	code, err := utils.RandomDigits(resetCodeDigits)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Could not send a reset code, try again later"})
+		return
+	}
+	if err := api.accMgr.StartPasswordReset(account.ID, utils.HashCode(code)); err != nil {
+		ctx.JSON(passwordErrorStatus(err), ErrorResponse{Message: err.Error()})
+		return
+	}
+	api.audit(ctx, "account.password_reset_request", account.ID.Hex(), map[string]string{"channel": channel})
+
+	message := fmt.Sprintf("Your gobank password reset code is %s. It works once, for 15 minutes. Never share it with anyone; we will never ask for it.", code)
+	go func() {
+		send := api.sendWhatsAppMessage
+		to := "whatsapp:" + account.PhoneNumber
+		if channel == resetChannelSMS {
+			send, to = api.sendSMS, account.PhoneNumber
+		}
+		if err := send(to, message); err != nil {
+			log.Printf("Error sending password reset code to %s: %v", account.ID.Hex(), err)
+		}
+	}()
+
+	ctx.JSON(http.StatusAccepted, sent)
+}
+
+// @Summary Reset your password
+// @Description Set a new password with the code sent to the account's phone. The code works once. With two-factor on, an authenticator or recovery code is needed too. Every device is signed out
+// @ID reset-password
+// @Accept json
+// @Produce json
+// @Param reset body ResetPasswordRequest true "Phone number, reset code and new password"
+// @Success 200 {object} string "Password reset"
+// @Failure 400 {object} ErrorResponse "New password does not meet the policy"
+// @Failure 401 {object} ErrorResponse "Wrong or expired code"
+// @Router /password/reset [post]
+func (api *ApiManager) handleResetPassword(ctx *gin.Context) {
+	var req ResetPasswordRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Bad request"})
+		return
+	}
+	// Check the policy first so a weak password doesn't use up the code
+	if err := api.passwordPolicy.Check(req.NewPassword); err != nil {
+		ctx.JSON(passwordErrorStatus(err), ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	account, err := api.accMgr.GetAccountByPhone(phoneSeparators.Replace(strings.TrimSpace(req.PhoneNumber)))
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		ctx.JSON(http.StatusUnauthorized, ErrorResponse{Message: db.ErrPasswordResetInvalid.Error()})
+		return
+	} else if err != nil {
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Could not reset the password, try again later"})
+		return
+	}
+
+	if err := api.accMgr.UsePasswordResetCode(account.ID, strings.TrimSpace(req.Code)); err != nil {
+		if errors.Is(err, db.ErrPasswordResetInvalid) {
+			api.audit(ctx, "account.password_reset_failed", account.ID.Hex(), nil)
+		}
+		ctx.JSON(passwordErrorStatus(err), ErrorResponse{Message: err.Error()})
+		return
+	}
+	// The reset code is checked first, so nobody without the phone can use up
+	// the account's two-factor attempts
+	if account.TwoFactor.Enabled() {
+		if err := api.verifySecondFactor(ctx, account, req.TwoFactorCode); err != nil {
+			ctx.JSON(passwordErrorStatus(err), ErrorResponse{Message: err.Error()})
+			return
+		}
+	}
+
+	if err := api.setPassword(ctx, account.ID, req.NewPassword, primitive.NilObjectID); err != nil {
+		ctx.JSON(passwordErrorStatus(err), ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, "Password reset")
+}
@@ -0,0 +1,282 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tamir-liebermann/gobank/db"
+	"github.com/tamir-liebermann/gobank/utils"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// AmbiguousPayeeError is returned when a nickname is not the exact nickname
+// of a saved payee but starts one or more of them. Money is only sent to an
+// exact nickname, so the message is phrased as a question the chat bot can
+// relay.
+type AmbiguousPayeeError struct {
+	Nickname string
+	Matches  []db.Payee
+}
+
+func (e *AmbiguousPayeeError) Error() string {
+	names := make([]string, 0, len(e.Matches))
+	for _, payee := range e.Matches {
+		names = append(names, fmt.Sprintf("%s (%s)", payee.Nickname, payee.PhoneNumber))
+	}
+	if len(names) == 1 {
+		return fmt.Sprintf("You have no payee called %q. Did you mean %s? Use their full nickname to send money.", e.Nickname, names[0])
+	}
+	return fmt.Sprintf("I found several payees matching %q: %s. Which one did you mean?", e.Nickname, strings.Join(names, ", "))
+}
+
+// accountRefStatus maps errors from ResolveAccountRef to an HTTP status.
+func accountRefStatus(err error) int {
+	switch {
+	case errors.Is(err, db.ErrAccountNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, db.ErrInvalidAccountRef), errors.Is(err, db.ErrInvalidAccountNumber):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// lookupAccount finds an account by its ID, account number or phone number.
+func (api *ApiManager) lookupAccount(idOrPhone string) (*db.BankAccount, error) {
+	idOrPhone = strings.TrimSpace(idOrPhone)
+	if utils.LooksLikeAccountNumber(idOrPhone) {
+		id, err := api.accMgr.ResolveAccountRef(idOrPhone)
+		if err != nil {
+			return nil, err
+		}
+		idOrPhone = id.Hex()
+	}
+	if id, err := primitive.ObjectIDFromHex(idOrPhone); err == nil {
+		account, err := api.accMgr.SearchAccountById(id)
+		if err != nil {
+			return nil, err
+		}
+		if account == nil {
+			return nil, errors.New("account not found")
+		}
+		return account, nil
+	}
+
+	account, err := api.accMgr.GetAccountByPhone(idOrPhone)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, errors.New("account not found")
+	} else if err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+// resolveRecipient turns the "to" of a transfer into an account ID. It accepts
+// an account ID, an account number, a phone number or the exact nickname of
+// one of the owner's payees.
+func (api *ApiManager) resolveRecipient(ownerID primitive.ObjectID, to string) (primitive.ObjectID, error) {
+	to = strings.TrimSpace(to)
+	if to == "" {
+		return primitive.NilObjectID, errors.New("recipient is required")
+	}
+
+	if id, err := primitive.ObjectIDFromHex(to); err == nil {
+		return id, nil
+	}
+	if utils.LooksLikeAccountNumber(to) {
+		return api.accMgr.ResolveAccountRef(to)
+	}
+
+	if !PhoneNumberRegexp.MatchString(to) {
+		payees, exact, err := api.accMgr.FindPayeesByNickname(ownerID, to)
+		if err != nil {
+			return primitive.NilObjectID, fmt.Errorf("error searching payees: %v", err)
+		}
+		if exact {
+			return payees[0].AccountID, nil
+		}
+		// Prefix matches are only suggestions; "jo" must not pay "john"
+		if len(payees) > 0 {
+			return primitive.NilObjectID, &AmbiguousPayeeError{Nickname: to, Matches: payees}
+		}
+	}
+
+	account, err := api.lookupAccount(to)
+	if err != nil {
+		return primitive.NilObjectID, fmt.Errorf("error finding account by phone: %v", err)
+	}
+	return account.ID, nil
+}
+
+// savePayee adds the account identified by to (ID or phone) to the owner's
+// payees. When to is empty the recipient of the owner's last transfer is used.
+func (api *ApiManager) savePayee(ownerID primitive.ObjectID, nickname, to string) (*db.Payee, error) {
+	var account *db.BankAccount
+	var err error
+
+	if strings.TrimSpace(to) == "" {
+		lastTransfer, err := api.accMgr.GetMostRecentOutgoingTransaction(ownerID)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, errors.New("you have no recent transfer to save, tell me who to save")
+		} else if err != nil {
+			return nil, err
+		}
+		to = lastTransfer.ToAccount.Hex()
+	}
+
+	account, err = api.lookupAccount(to)
+	if err != nil {
+		return nil, err
+	}
+
+	if account.ID == ownerID {
+		return nil, errors.New("you cannot save your own account as a payee")
+	}
+
+	return api.accMgr.CreatePayee(ownerID, account.ID, nickname, account.PhoneNumber)
+}
+
+// @Summary List saved payees
+// @Description List the payees saved in the caller's address book
+// @ID get-payees
+// @Produce json
+// @Success 200 {object} PayeesRes
+// @Failure 401 {object} ErrorResponse "Unauthorized"
+// @Failure 500 {object} ErrorResponse "Internal server error"
+// @Router /account/payees [get]
+// @Security BearerAuth
+func (api *ApiManager) handleGetPayees(ctx *gin.Context) {
+	ownerID, err := currentUserID(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	payees, err := api.accMgr.GetPayees(ownerID)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Internal server error"})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, PayeesRes{Payees: payees})
+}
+
+// @Summary Save a payee
+// @Description Save an account (by phone number or account ID) under a nickname
+// @ID create-payee
+// @Accept json
+// @Produce json
+// @Param payee body CreatePayeeRequest true "Payee"
+// @Success 201 {object} db.Payee
+// @Failure 400 {object} ErrorResponse "Bad request"
+// @Failure 404 {object} ErrorResponse "Account not found"
+// @Failure 409 {object} ErrorResponse "Nickname already in use"
+// @Router /account/payees [post]
+// @Security BearerAuth
+func (api *ApiManager) handleCreatePayee(ctx *gin.Context) {
+	ownerID, err := currentUserID(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	var req CreatePayeeRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Bad request"})
+		return
+	}
+
+	payee, err := api.savePayee(ownerID, req.Nickname, req.To)
+	if errors.Is(err, db.ErrPayeeExists) {
+		ctx.JSON(http.StatusConflict, ErrorResponse{Message: err.Error()})
+		return
+	} else if err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusCreated, payee)
+}
+
+// @Summary Rename a payee
+// @Description Change the nickname of a saved payee
+// @ID rename-payee
+// @Accept json
+// @Produce json
+// @Param payee_id path string true "Payee ID"
+// @Param payee body RenamePayeeRequest true "New nickname"
+// @Success 200 {object} db.Payee
+// @Failure 400 {object} ErrorResponse "Bad request"
+// @Failure 404 {object} ErrorResponse "Payee not found"
+// @Failure 409 {object} ErrorResponse "Nickname already in use"
+// @Router /account/payees/{payee_id} [put]
+// @Security BearerAuth
+func (api *ApiManager) handleRenamePayee(ctx *gin.Context) {
+	ownerID, err := currentUserID(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	payeeID, err := primitive.ObjectIDFromHex(ctx.Param("payee_id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Invalid ID format"})
+		return
+	}
+
+	var req RenamePayeeRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Bad request"})
+		return
+	}
+
+	payee, err := api.accMgr.RenamePayee(ownerID, payeeID, req.Nickname)
+	switch {
+	case errors.Is(err, db.ErrPayeeNotFound):
+		ctx.JSON(http.StatusNotFound, ErrorResponse{Message: err.Error()})
+	case errors.Is(err, db.ErrPayeeExists):
+		ctx.JSON(http.StatusConflict, ErrorResponse{Message: err.Error()})
+	case err != nil:
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Internal server error"})
+	default:
+		ctx.JSON(http.StatusOK, payee)
+	}
+}
+
+// @Summary Delete a payee
+// @Description Remove a payee from the caller's address book
+// @ID delete-payee
+// @Produce json
+// @Param payee_id path string true "Payee ID"
+// @Success 200 {object} string "Payee deleted"
+// @Failure 400 {object} ErrorResponse "Invalid ID format"
+// @Failure 404 {object} ErrorResponse "Payee not found"
+// @Router /account/payees/{payee_id} [delete]
+// @Security BearerAuth
+func (api *ApiManager) handleDeletePayee(ctx *gin.Context) {
+	ownerID, err := currentUserID(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	payeeID, err := primitive.ObjectIDFromHex(ctx.Param("payee_id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Invalid ID format"})
+		return
+	}
+
+	err = api.accMgr.DeletePayee(ownerID, payeeID)
+	if errors.Is(err, db.ErrPayeeNotFound) {
+		ctx.JSON(http.StatusNotFound, ErrorResponse{Message: err.Error()})
+		return
+	} else if err != nil {
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Internal server error"})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"message": "Payee deleted"})
+}
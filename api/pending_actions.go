@@ -0,0 +1,298 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tamir-liebermann/gobank/db"
+	"github.com/tamir-liebermann/gobank/utils"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// pendingTransfer is the payload of a chat transfer waiting for confirmation.
+type pendingTransfer struct {
+	To       string  `json:"to"`
+	Amount   float64 `json:"amount"`
+	Category string  `json:"category"`
+	Fee      float64 `json:"fee"`
+}
+
+// confirmCodeDigits is the length of the one-time codes sent to confirm chat
+// actions.
+const confirmCodeDigits = 6
+
+// needsCode reports whether a chat action of this kind and amount must be
+// confirmed with a one-time code or the transaction PIN. Erasure moves no
+// money, so the amount threshold doesn't apply to it.
+func (api *ApiManager) needsCode(kind string, amount float64) bool {
+	if !api.confirmActions[kind] {
+		return false
+	}
+	return kind == db.PendingActionErasure || amount >= api.confirmAmount
+}
+
+// createPendingAction stores a chat action waiting for confirmation and
+// returns it with the reply instructions added to its summary. When the
+// action needs a code, the account's transaction PIN is asked for, or a
+// one-time code is sent to its WhatsApp number.
+func (api *ApiManager) createPendingAction(accountID primitive.ObjectID, kind string, payload map[string]interface{}, summary string, amount float64) (*db.PendingAction, error) {
+	challenge, codeHash, code := db.ConfirmPlain, "", ""
+	if api.needsCode(kind, amount) {
+		account, err := api.accMgr.SearchAccountById(accountID)
+		if err != nil {
+			return nil, err
+		}
+		if account == nil {
+			return nil, db.ErrAccountNotFound
+		}
+		if confirmLocked(account) {
+			return nil, db.ErrConfirmLocked
+		}
+
+		if account.TransactionPIN != "" {
+			challenge = db.ConfirmPIN
+		} else {
+			if code, err = utils.RandomDigits(confirmCodeDigits); err != nil {
+				return nil, err
+			}
+			challenge, codeHash = db.ConfirmCode, utils.HashCode(code)
+		}
+	}
+
+	action, err := api.accMgr.CreatePendingAction(accountID, kind, payload, summary, db.DefaultPendingActionTTL, challenge, codeHash)
+	if err != nil {
+		return nil, err
+	}
+
+	minutes := int(db.DefaultPendingActionTTL / time.Minute)
+	switch challenge {
+	case db.ConfirmCode:
+		go api.notifyAccount(accountID, fmt.Sprintf("Your gobank confirmation code is %s. It works once, for %d minutes. Never share it with anyone.", code, minutes))
+		action.Summary += fmt.Sprintf(" We sent you a confirmation code; reply \"confirm <code>\" within %d minutes to go ahead, or \"cancel\" to drop it.", minutes)
+	case db.ConfirmPIN:
+		action.Summary += fmt.Sprintf(" Reply \"confirm <PIN>\" with your transaction PIN within %d minutes to go ahead, or \"cancel\" to drop it.", minutes)
+	default:
+		action.Summary += " Reply \"confirm\" to go ahead or \"cancel\" to drop it."
+	}
+	return action, nil
+}
+
+// confirmLocked reports whether too many wrong codes paused the account's
+// chat confirmations.
+func confirmLocked(account *db.BankAccount) bool {
+	return account.ConfirmLockedUntil != nil && time.Now().Before(*account.ConfirmLockedUntil)
+}
+
+// checkConfirmCode checks the code or PIN the user replied with against the
+// action's challenge.
+func checkConfirmCode(account *db.BankAccount, action *db.PendingAction, code string) bool {
+	switch action.Challenge {
+	case db.ConfirmCode:
+		return utils.CheckCodeHash(code, action.CodeHash)
+	case db.ConfirmPIN:
+		return code != "" && utils.CheckPasswordHash(code, account.TransactionPIN)
+	}
+	return true
+}
+
+// quoteTransfer stores a chat transfer as a pending action and returns it, so
+// the fee can be shown, and a code asked for, before anything is sent.
+func (api *ApiManager) quoteTransfer(fromAccountID, toAccountID primitive.ObjectID, amount float64, category string, fee float64) (*db.PendingAction, error) {
+	summary := fmt.Sprintf("Sending %.2f to %s.", amount, api.accountLabel(toAccountID))
+	if fee > 0 {
+		summary = fmt.Sprintf("Sending %.2f to %s costs a %.2f fee (%.2f in total).", amount, api.accountLabel(toAccountID), fee, amount+fee)
+	}
+	payload := map[string]interface{}{
+		"to":       toAccountID.Hex(),
+		"amount":   amount,
+		"category": category,
+		"fee":      fee,
+	}
+	return api.createPendingAction(fromAccountID, db.PendingActionTransfer, payload, summary, amount)
+}
+
+func (api *ApiManager) confirmPendingTransfer(ctx *gin.Context, accountID primitive.ObjectID, action *db.PendingAction) (string, error) {
+	var transfer pendingTransfer
+	if err := decodeIntentBody(action.Payload, &transfer); err != nil {
+		return "", err
+	}
+	toAccountID, err := primitive.ObjectIDFromHex(transfer.To)
+	if err != nil {
+		return "", err
+	}
+
+	// The schedule may have changed since the quote; never charge more than was shown
+	fee, err := api.accMgr.QuoteFee(db.FeeOperationTransfer, accountID, transfer.Amount)
+	if err != nil {
+		return "", err
+	}
+	if fee > transfer.Fee {
+		requote, err := api.quoteTransfer(accountID, toAccountID, transfer.Amount, transfer.Category, fee)
+		if err != nil {
+			return "", err
+		}
+		return "The fee has changed. " + requote.Summary, nil
+	}
+
+	// The step-up may have lapsed while the code was on its way
+	if err := api.chatStepUp(ctx, accountID, transfer.Amount); err != nil {
+		if reply, ok := transferStoppedReply(err); ok {
+			return reply, nil
+		}
+		return "", err
+	}
+
+	transaction, err := api.performTransfer(ctx, accountID, toAccountID, transfer.Amount, db.TransferOptions{Category: transfer.Category})
+	if reply, ok := transferStoppedReply(err); ok {
+		return reply, nil
+	} else if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Sent %.2f to %s (fee %.2f).", transaction.Amount, api.accountLabel(toAccountID), transaction.Fee), nil
+}
+
+func (api *ApiManager) handleConfirmIntent(ctx *gin.Context, code string) (string, error) {
+	accountID, err := currentUserID(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	action, err := api.accMgr.PeekPendingAction(accountID)
+	if errors.Is(err, db.ErrNoPendingAction) {
+		return "There is nothing waiting for your confirmation.", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	if action.Challenge != db.ConfirmPlain && code == "" {
+		if action.Challenge == db.ConfirmPIN {
+			return "Reply \"confirm <PIN>\" with your transaction PIN to go ahead.", nil
+		}
+		return "Reply \"confirm <code>\" with the code we sent you to go ahead.", nil
+	}
+
+	account, err := api.accMgr.SearchAccountById(accountID)
+	if err != nil {
+		return "", err
+	}
+	if account == nil {
+		return "", db.ErrAccountNotFound
+	}
+	// A locked account can't keep guessing, whatever is waiting
+	if action.Challenge != db.ConfirmPlain && confirmLocked(account) {
+		return "Sorry, " + db.ErrConfirmLocked.Error() + ".", nil
+	}
+
+	if !checkConfirmCode(account, action, code) {
+		left, err := api.accMgr.RecordConfirmFailure(action)
+		if errors.Is(err, db.ErrNoPendingAction) {
+			return "There is nothing waiting for your confirmation.", nil
+		} else if err != nil {
+			return "", err
+		}
+		api.audit(ctx, "chat.confirm_failed", action.ID.Hex(), map[string]string{"kind": action.Kind, "left": strconv.Itoa(left)})
+		if left > 0 {
+			return fmt.Sprintf("That code is wrong. You have %d more tries.", left), nil
+		}
+		go api.notifyAccount(accountID, "A chat action was cancelled after too many wrong confirmation codes. If this wasn't you, change your password.")
+		return fmt.Sprintf("That code is wrong. Nothing was sent, and confirmations are paused for %d minutes.", int(db.ConfirmLockout/time.Minute)), nil
+	}
+
+	if action.Challenge != db.ConfirmPlain {
+		if err := api.accMgr.ClearConfirmFailures(accountID); err != nil {
+			return "", err
+		}
+	}
+
+	action, err = api.accMgr.TakePendingActionByID(accountID, action.ID)
+	if errors.Is(err, db.ErrNoPendingAction) {
+		return "There is nothing waiting for your confirmation.", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	switch action.Kind {
+	case db.PendingActionTransfer:
+		return api.confirmPendingTransfer(ctx, accountID, action)
+	case db.PendingActionPayRequest:
+		return api.confirmPendingPayRequest(ctx, accountID, action)
+	case db.PendingActionErasure:
+		return api.confirmPendingErasure(ctx, accountID)
+	}
+	return "", fmt.Errorf("unknown pending action %q", action.Kind)
+}
+
+func (api *ApiManager) handleCancelIntent(ctx *gin.Context) (string, error) {
+	accountID, err := currentUserID(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = api.accMgr.TakePendingAction(accountID)
+	if errors.Is(err, db.ErrNoPendingAction) {
+		return "There is nothing to cancel.", nil
+	} else if err != nil {
+		return "", err
+	}
+	return "Cancelled, nothing was sent.", nil
+}
+
+var transactionPINRegexp = regexp.MustCompile(`^\d{4,6}$`)
+
+// @Summary Set your transaction PIN
+// @Description Set the 4 to 6 digit PIN that confirms transfers and other sensitive chat actions instead of a one-time code. An empty PIN removes it. Needs your password, and a fresh second factor when two-factor is on
+// @ID set-transaction-pin
+// @Accept json
+// @Produce json
+// @Param pin body SetPINRequest true "Password and new PIN"
+// @Success 200 {object} string "Transaction PIN updated"
+// @Failure 400 {object} ErrorResponse "PIN must be 4 to 6 digits"
+// @Failure 401 {object} ErrorResponse "Wrong password"
+// @Failure 403 {object} ErrorResponse "Second factor needed"
+// @Router /account/pin [put]
+// @Security BearerAuth
+func (api *ApiManager) handleSetTransactionPIN(ctx *gin.Context) {
+	var req SetPINRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Bad request"})
+		return
+	}
+	if req.PIN != "" && !transactionPINRegexp.MatchString(req.PIN) {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "PIN must be 4 to 6 digits"})
+		return
+	}
+
+	account, ok := api.currentAccount(ctx)
+	if !ok {
+		return
+	}
+	if !utils.CheckPasswordHash(req.Password, account.Password) {
+		ctx.JSON(http.StatusUnauthorized, ErrorResponse{Message: "Wrong password"})
+		return
+	}
+	if !api.requireSecondFactor(ctx, account.ID) {
+		return
+	}
+
+	pinHash := ""
+	if req.PIN != "" {
+		var err error
+		if pinHash, err = utils.HashPassword(req.PIN); err != nil {
+			ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Could not set the PIN"})
+			return
+		}
+	}
+	if err := api.accMgr.SetTransactionPIN(account.ID, pinHash); err != nil {
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Could not set the PIN"})
+		return
+	}
+	api.audit(ctx, "account.pin_change", account.ID.Hex(), map[string]string{"removed": strconv.FormatBool(req.PIN == "")})
+	go api.notifyAccount(account.ID, "The transaction PIN on your gobank account was changed. If this wasn't you, contact support.")
+
+	ctx.JSON(http.StatusOK, "Transaction PIN updated")
+}
@@ -0,0 +1,344 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tamir-liebermann/gobank/db"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// pocketProgress works out how far a pocket is from its goal.
+func pocketProgress(pocket db.Pocket) PocketProgressRes {
+	progress := PocketProgressRes{Pocket: pocket}
+	if pocket.TargetAmount <= 0 {
+		return progress
+	}
+
+	progress.Percent = math.Min(100, math.Round(pocket.Balance/pocket.TargetAmount*1000)/10)
+	progress.Remaining = math.Max(0, pocket.TargetAmount-pocket.Balance)
+
+	if pocket.TargetDate != nil && progress.Remaining > 0 {
+		daysLeft := int(math.Ceil(time.Until(*pocket.TargetDate).Hours() / 24))
+		if daysLeft > 0 {
+			progress.DaysLeft = daysLeft
+			months := math.Max(1, float64(daysLeft)/30)
+			progress.MonthlyNeeded = math.Ceil(progress.Remaining/months*100) / 100
+		}
+	}
+	return progress
+}
+
+func formatPocketProgress(progress PocketProgressRes) string {
+	pocket := progress.Pocket
+	if pocket.TargetAmount <= 0 {
+		return fmt.Sprintf("%s has %.2f. It has no goal yet.", pocket.Name, pocket.Balance)
+	}
+	if progress.Remaining == 0 {
+		return fmt.Sprintf("%s has %.2f, you reached your %.2f goal!", pocket.Name, pocket.Balance, pocket.TargetAmount)
+	}
+
+	msg := fmt.Sprintf("%s has %.2f of %.2f (%.1f%%), %.2f to go.", pocket.Name, pocket.Balance, pocket.TargetAmount, progress.Percent, progress.Remaining)
+	if progress.DaysLeft > 0 {
+		msg += fmt.Sprintf(" Put aside about %.2f a month to make it by %s.", progress.MonthlyNeeded, pocket.TargetDate.Format("Jan 2 2006"))
+	} else if pocket.TargetDate != nil {
+		msg += fmt.Sprintf(" The target date %s has passed.", pocket.TargetDate.Format("Jan 2 2006"))
+	}
+	return msg
+}
+
+// parseTargetDate accepts either a plain date or an RFC3339 timestamp.
+func parseTargetDate(value string) (*time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil, nil
+	}
+
+	for _, layout := range []string{"2006-01-02", time.RFC3339} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return &t, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid target date %q, use YYYY-MM-DD", value)
+}
+
+func pocketErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, db.ErrPocketNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, db.ErrPocketExists):
+		return http.StatusConflict
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// @Summary List pockets
+// @Description List the savings pockets of the caller's account
+// @ID get-pockets
+// @Produce json
+// @Success 200 {object} PocketsRes
+// @Failure 500 {object} ErrorResponse "Internal server error"
+// @Router /account/pockets [get]
+// @Security BearerAuth
+func (api *ApiManager) handleGetPockets(ctx *gin.Context) {
+	accountID, err := currentUserID(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	pockets, err := api.accMgr.GetPockets(accountID)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Internal server error"})
+		return
+	}
+
+	res := PocketsRes{Pockets: []PocketProgressRes{}}
+	for _, pocket := range pockets {
+		res.Pockets = append(res.Pockets, pocketProgress(pocket))
+	}
+	ctx.JSON(http.StatusOK, res)
+}
+
+// @Summary Create a pocket
+// @Description Create a named savings pocket with an optional target amount and date
+// @ID create-pocket
+// @Accept json
+// @Produce json
+// @Param pocket body CreatePocketRequest true "Pocket"
+// @Success 201 {object} db.Pocket
+// @Failure 400 {object} ErrorResponse "Bad request"
+// @Failure 409 {object} ErrorResponse "Pocket already exists"
+// @Router /account/pockets [post]
+// @Security BearerAuth
+func (api *ApiManager) handleCreatePocket(ctx *gin.Context) {
+	accountID, err := currentUserID(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	var req CreatePocketRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Bad request"})
+		return
+	}
+
+	targetDate, err := parseTargetDate(req.TargetDate)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	pocket, err := api.accMgr.CreatePocket(accountID, req.Name, req.TargetAmount, targetDate)
+	if err != nil {
+		ctx.JSON(pocketErrorStatus(err), ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusCreated, pocket)
+}
+
+// @Summary Get a pocket
+// @Description Get a pocket and its progress towards its goal
+// @ID get-pocket
+// @Produce json
+// @Param pocket_id path string true "Pocket ID"
+// @Success 200 {object} PocketProgressRes
+// @Failure 404 {object} ErrorResponse "Pocket not found"
+// @Router /account/pockets/{pocket_id} [get]
+// @Security BearerAuth
+func (api *ApiManager) handleGetPocket(ctx *gin.Context) {
+	accountID, pocketID, ok := pocketParams(ctx)
+	if !ok {
+		return
+	}
+
+	pocket, err := api.accMgr.GetPocketById(accountID, pocketID)
+	if err != nil {
+		ctx.JSON(pocketErrorStatus(err), ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, pocketProgress(*pocket))
+}
+
+// @Summary Update a pocket goal
+// @Description Change the target amount and date of a pocket
+// @ID update-pocket
+// @Accept json
+// @Produce json
+// @Param pocket_id path string true "Pocket ID"
+// @Param goal body UpdatePocketGoalRequest true "Goal"
+// @Success 200 {object} PocketProgressRes
+// @Failure 400 {object} ErrorResponse "Bad request"
+// @Failure 404 {object} ErrorResponse "Pocket not found"
+// @Router /account/pockets/{pocket_id} [put]
+// @Security BearerAuth
+func (api *ApiManager) handleUpdatePocketGoal(ctx *gin.Context) {
+	accountID, pocketID, ok := pocketParams(ctx)
+	if !ok {
+		return
+	}
+
+	var req UpdatePocketGoalRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Bad request"})
+		return
+	}
+
+	targetDate, err := parseTargetDate(req.TargetDate)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	pocket, err := api.accMgr.UpdatePocketGoal(accountID, pocketID, req.TargetAmount, targetDate)
+	if err != nil {
+		ctx.JSON(pocketErrorStatus(err), ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, pocketProgress(*pocket))
+}
+
+// @Summary Delete a pocket
+// @Description Close a pocket and return its balance to the main account balance
+// @ID delete-pocket
+// @Produce json
+// @Param pocket_id path string true "Pocket ID"
+// @Success 200 {object} string "Pocket deleted"
+// @Failure 404 {object} ErrorResponse "Pocket not found"
+// @Router /account/pockets/{pocket_id} [delete]
+// @Security BearerAuth
+func (api *ApiManager) handleDeletePocket(ctx *gin.Context) {
+	accountID, pocketID, ok := pocketParams(ctx)
+	if !ok {
+		return
+	}
+
+	if err := api.accMgr.DeletePocket(accountID, pocketID); err != nil {
+		ctx.JSON(pocketErrorStatus(err), ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"message": "Pocket deleted"})
+}
+
+// @Summary Move money in or out of a pocket
+// @Description Move money between the main balance and a pocket (direction "in" or "out")
+// @ID move-pocket-funds
+// @Accept json
+// @Produce json
+// @Param pocket_id path string true "Pocket ID"
+// @Param move body MovePocketRequest true "Move"
+// @Success 200 {object} PocketProgressRes
+// @Failure 400 {object} ErrorResponse "Bad request"
+// @Failure 404 {object} ErrorResponse "Pocket not found"
+// @Router /account/pockets/{pocket_id}/move [post]
+// @Security BearerAuth
+func (api *ApiManager) handleMovePocketFunds(ctx *gin.Context) {
+	accountID, pocketID, ok := pocketParams(ctx)
+	if !ok {
+		return
+	}
+
+	var req MovePocketRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Bad request"})
+		return
+	}
+	if req.Direction != "in" && req.Direction != "out" {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Direction must be \"in\" or \"out\""})
+		return
+	}
+
+	pocket, err := api.accMgr.MovePocketFunds(accountID, pocketID, req.Amount, req.Direction == "in")
+	if err != nil {
+		ctx.JSON(pocketErrorStatus(err), ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, pocketProgress(*pocket))
+}
+
+func pocketParams(ctx *gin.Context) (primitive.ObjectID, primitive.ObjectID, bool) {
+	accountID, err := currentUserID(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, ErrorResponse{Message: err.Error()})
+		return primitive.NilObjectID, primitive.NilObjectID, false
+	}
+
+	pocketID, err := primitive.ObjectIDFromHex(ctx.Param("pocket_id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Invalid ID format"})
+		return primitive.NilObjectID, primitive.NilObjectID, false
+	}
+	return accountID, pocketID, true
+}
+
+func (api *ApiManager) handleCreatePocketIntent(ctx *gin.Context, req CreatePocketRequest) (*db.Pocket, error) {
+	accountID, err := currentUserID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	targetDate, err := parseTargetDate(req.TargetDate)
+	if err != nil {
+		return nil, err
+	}
+	return api.accMgr.CreatePocket(accountID, req.Name, req.TargetAmount, targetDate)
+}
+
+func (api *ApiManager) handleMovePocketIntent(ctx *gin.Context, req MovePocketIntentReq) (*db.Pocket, error) {
+	accountID, err := currentUserID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	pocket, err := api.accMgr.FindPocketByName(accountID, req.Pocket)
+	if errors.Is(err, db.ErrPocketNotFound) {
+		return nil, fmt.Errorf("you have no pocket called %q, ask me to create it first", req.Pocket)
+	} else if err != nil {
+		return nil, err
+	}
+
+	return api.accMgr.MovePocketFunds(accountID, pocket.ID, req.Amount, req.Direction != "out")
+}
+
+func (api *ApiManager) handlePocketGoalIntent(ctx *gin.Context, req PocketGoalIntentReq) (string, error) {
+	accountID, err := currentUserID(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	if strings.TrimSpace(req.Pocket) == "" {
+		pockets, err := api.accMgr.GetPockets(accountID)
+		if err != nil {
+			return "", err
+		}
+		if len(pockets) == 0 {
+			return "You have no pockets yet. Try \"create a vacation pocket with a goal of 3000\".", nil
+		}
+
+		var sb strings.Builder
+		for _, pocket := range pockets {
+			sb.WriteString(formatPocketProgress(pocketProgress(pocket)) + "\n")
+		}
+		return sb.String(), nil
+	}
+
+	pocket, err := api.accMgr.FindPocketByName(accountID, req.Pocket)
+	if errors.Is(err, db.ErrPocketNotFound) {
+		return "", fmt.Errorf("you have no pocket called %q", req.Pocket)
+	} else if err != nil {
+		return "", err
+	}
+	return formatPocketProgress(pocketProgress(*pocket)), nil
+}
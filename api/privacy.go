@@ -0,0 +1,370 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tamir-liebermann/gobank/db"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func privacyErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, db.ErrDataRequestNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, db.ErrDataRequestOpen), errors.Is(err, db.ErrDataRequestClosed),
+		errors.Is(err, db.ErrErasureBalance), errors.Is(err, db.ErrAccountErased):
+		return http.StatusConflict
+	}
+	return http.StatusBadRequest
+}
+
+// requestPersonalData opens an export or erasure request for the account.
+// Nothing happens until an admin approves it.
+func (api *ApiManager) requestPersonalData(ctx *gin.Context, accountID primitive.ObjectID, kind string) (*db.DataRequest, error) {
+	source := ctx.GetString(authSourceKey)
+	if source == "" {
+		source = db.AuditSourceSystem
+	}
+
+	request, err := api.accMgr.CreateDataRequest(accountID, kind, source)
+	if err != nil {
+		return nil, err
+	}
+	api.audit(ctx, "privacy.request", accountID.Hex(), map[string]string{"kind": kind, "request": request.ID.Hex()})
+	return request, nil
+}
+
+func dataRequestReply(request *db.DataRequest) string {
+	if request.Kind == db.DataRequestErasure {
+		return "Your erasure request has been sent for approval. We'll message you before your data is erased."
+	}
+	return "Your data export request has been sent for approval. We'll message you when it's ready to download."
+}
+
+// runDataRequest runs an approved request in the background.
+func (api *ApiManager) runDataRequest(request *db.DataRequest) {
+	var exportKey string
+	var err error
+	switch request.Kind {
+	case db.DataRequestExport:
+		exportKey, err = api.exportPersonalData(request)
+	case db.DataRequestErasure:
+		err = api.erasePersonalData(request)
+	default:
+		err = fmt.Errorf("unknown data request kind %q", request.Kind)
+	}
+
+	if completeErr := api.accMgr.CompleteDataRequest(request, exportKey, err); completeErr != nil {
+		log.Printf("Error completing data request %s: %v", request.ID.Hex(), completeErr)
+		return
+	}
+	details := map[string]string{"kind": request.Kind, "request": request.ID.Hex(), "status": request.Status}
+	if err != nil {
+		log.Printf("Data request %s failed: %v", request.ID.Hex(), err)
+		details["error"] = err.Error()
+	}
+	api.audit(nil, "privacy.complete", request.AccountID.Hex(), details)
+
+	if request.Kind == db.DataRequestExport {
+		if err != nil {
+			go api.notifyAccount(request.AccountID, "We couldn't prepare your data export. Our team has been notified.")
+			return
+		}
+		go api.notifyAccount(request.AccountID, fmt.Sprintf("Your data export is ready. Download it in the app under privacy requests (request %s).", request.ID.Hex()))
+	}
+}
+
+func (api *ApiManager) exportPersonalData(request *db.DataRequest) (string, error) {
+	export, err := api.accMgr.CollectPersonalData(request.AccountID)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.MarshalIndent(export, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	key := fmt.Sprintf("exports/%s/%s.json", request.AccountID.Hex(), request.ID.Hex())
+	if err := api.blobs.Put(context.TODO(), key, bytes.NewReader(data)); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// erasePersonalData pseudonymizes the account and removes the files that
+// held its personal data: KYC documents and earlier exports.
+func (api *ApiManager) erasePersonalData(request *db.DataRequest) error {
+	exports, err := api.accMgr.GetDataRequests(request.AccountID, db.DataRequestCompleted)
+	if err != nil {
+		return err
+	}
+
+	blobKeys, err := api.accMgr.EraseAccount(request.AccountID)
+	if err != nil {
+		return err
+	}
+	for _, export := range exports {
+		if export.ExportKey != "" {
+			blobKeys = append(blobKeys, export.ExportKey)
+		}
+	}
+	for _, key := range blobKeys {
+		if err := api.blobs.Delete(context.TODO(), key); err != nil {
+			log.Printf("Error deleting %s while erasing account %s: %v", key, request.AccountID.Hex(), err)
+		}
+	}
+	return nil
+}
+
+// @Summary Request a data export
+// @Description Ask for a machine-readable copy of everything held about your account. Runs once an admin approves it
+// @ID request-data-export
+// @Produce json
+// @Success 202 {object} db.DataRequest
+// @Failure 409 {object} ErrorResponse "An export is already open"
+// @Router /account/privacy/export [post]
+// @Security BearerAuth
+func (api *ApiManager) handleRequestDataExport(ctx *gin.Context) {
+	api.handleCreateDataRequest(ctx, db.DataRequestExport)
+}
+
+// @Summary Request account erasure
+// @Description Ask for your personal data to be erased. The account must be empty. Runs once an admin approves it
+// @ID request-data-erasure
+// @Produce json
+// @Success 202 {object} db.DataRequest
+// @Failure 409 {object} ErrorResponse "Account not empty or an erasure is already open"
+// @Router /account/privacy/erasure [post]
+// @Security BearerAuth
+func (api *ApiManager) handleRequestDataErasure(ctx *gin.Context) {
+	api.handleCreateDataRequest(ctx, db.DataRequestErasure)
+}
+
+func (api *ApiManager) handleCreateDataRequest(ctx *gin.Context, kind string) {
+	accountID, err := currentUserID(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	request, err := api.requestPersonalData(ctx, accountID, kind)
+	if err != nil {
+		ctx.JSON(privacyErrorStatus(err), ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusAccepted, request)
+}
+
+// @Summary List your data requests
+// @Description Export and erasure requests for your account, newest first
+// @ID get-data-requests
+// @Produce json
+// @Success 200 {object} DataRequestsRes
+// @Router /account/privacy/requests [get]
+// @Security BearerAuth
+func (api *ApiManager) handleGetDataRequests(ctx *gin.Context) {
+	accountID, err := currentUserID(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	requests, err := api.accMgr.GetDataRequests(accountID, "")
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Internal server error"})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, DataRequestsRes{Requests: requests})
+}
+
+// @Summary Download a data export
+// @Description Download the JSON file of a completed export
+// @ID download-data-export
+// @Produce json
+// @Param request_id path string true "Data request ID"
+// @Success 200 {object} db.PersonalDataExport
+// @Failure 404 {object} ErrorResponse "Export not found"
+// @Router /account/privacy/requests/{request_id}/download [get]
+// @Security BearerAuth
+func (api *ApiManager) handleDownloadDataExport(ctx *gin.Context) {
+	accountID, err := currentUserID(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	requestID, err := primitive.ObjectIDFromHex(ctx.Param("request_id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Invalid ID format"})
+		return
+	}
+
+	request, err := api.accMgr.GetDataRequestById(requestID)
+	if err != nil || request.AccountID != accountID || request.ExportKey == "" {
+		ctx.JSON(http.StatusNotFound, ErrorResponse{Message: "Export not found"})
+		return
+	}
+
+	blob, err := api.blobs.Get(ctx.Request.Context(), request.ExportKey)
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, ErrorResponse{Message: "Export not found"})
+		return
+	}
+	defer blob.Close()
+	api.audit(ctx, "privacy.download", accountID.Hex(), map[string]string{"request": requestID.Hex()})
+
+	ctx.DataFromReader(http.StatusOK, -1, "application/json", blob, map[string]string{
+		"Content-Disposition": fmt.Sprintf("attachment; filename=\"gobank-export-%s.json\"", requestID.Hex()),
+	})
+}
+
+// @Summary List data requests
+// @Description The privacy request queue. Defaults to requests pending approval (admin only)
+// @ID get-admin-data-requests
+// @Produce json
+// @Param status query string false "pending_approval, running, completed, rejected or failed; 'all' for everything"
+// @Success 200 {object} DataRequestsRes
+// @Router /admin/privacy/requests [get]
+// @Security BearerAuth
+func (api *ApiManager) handleGetAdminDataRequests(ctx *gin.Context) {
+	status := ctx.DefaultQuery("status", db.DataRequestPendingApproval)
+	if status == "all" {
+		status = ""
+	}
+
+	requests, err := api.accMgr.GetDataRequests(primitive.NilObjectID, status)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Internal server error"})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, DataRequestsRes{Requests: requests})
+}
+
+// @Summary Approve a data request
+// @Description Approve an export or erasure; the job starts straight away (admin only)
+// @ID approve-data-request
+// @Accept json
+// @Produce json
+// @Param request_id path string true "Data request ID"
+// @Param note body ReviewDataRequest false "Optional note"
+// @Success 200 {object} db.DataRequest
+// @Failure 409 {object} ErrorResponse "No longer pending approval"
+// @Router /admin/privacy/requests/{request_id}/approve [post]
+// @Security BearerAuth
+func (api *ApiManager) handleApproveDataRequest(ctx *gin.Context) {
+	api.handleReviewDataRequest(ctx, true)
+}
+
+// @Summary Reject a data request
+// @Description Reject an export or erasure request (admin only)
+// @ID reject-data-request
+// @Accept json
+// @Produce json
+// @Param request_id path string true "Data request ID"
+// @Param note body ReviewDataRequest false "Optional note"
+// @Success 200 {object} db.DataRequest
+// @Failure 409 {object} ErrorResponse "No longer pending approval"
+// @Router /admin/privacy/requests/{request_id}/reject [post]
+// @Security BearerAuth
+func (api *ApiManager) handleRejectDataRequest(ctx *gin.Context) {
+	api.handleReviewDataRequest(ctx, false)
+}
+
+func (api *ApiManager) handleReviewDataRequest(ctx *gin.Context, approve bool) {
+	reviewerID, err := currentUserID(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	requestID, err := primitive.ObjectIDFromHex(ctx.Param("request_id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Invalid ID format"})
+		return
+	}
+
+	// The note is optional, so an empty body is fine
+	var req ReviewDataRequest
+	if ctx.Request.ContentLength > 0 {
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Bad request"})
+			return
+		}
+	}
+
+	request, err := api.accMgr.ReviewDataRequest(requestID, reviewerID, approve, req.Note)
+	if err != nil {
+		ctx.JSON(privacyErrorStatus(err), ErrorResponse{Message: err.Error()})
+		return
+	}
+	api.audit(ctx, "privacy.review", request.AccountID.Hex(), map[string]string{
+		"kind":    request.Kind,
+		"request": request.ID.Hex(),
+		"status":  request.Status,
+	})
+
+	switch {
+	case !approve:
+		go api.notifyAccount(request.AccountID, fmt.Sprintf("Your %s request was declined. Please contact support for details.", request.Kind))
+	case request.Kind == db.DataRequestErasure:
+		// The phone number is gone once the job has run, so say goodbye first
+		api.notifyAccount(request.AccountID, "Your erasure request was approved. Your personal data is being erased now.")
+		go api.runDataRequest(request)
+	default:
+		go api.runDataRequest(request)
+	}
+
+	ctx.JSON(http.StatusOK, request)
+}
+
+func (api *ApiManager) handleExportDataIntent(ctx *gin.Context) (string, error) {
+	accountID, err := currentUserID(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	request, err := api.requestPersonalData(ctx, accountID, db.DataRequestExport)
+	if err != nil {
+		return "", err
+	}
+	return dataRequestReply(request), nil
+}
+
+// handleEraseDataIntent only quotes the erasure; it is requested once the
+// user replies "confirm".
+func (api *ApiManager) handleEraseDataIntent(ctx *gin.Context) (string, error) {
+	accountID, err := currentUserID(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	summary := "This will permanently erase your name, phone number, identity details, payees and chat history. " +
+		"Your account must be empty and can't be used afterwards."
+	action, err := api.createPendingAction(accountID, db.PendingActionErasure, map[string]interface{}{}, summary, 0)
+	if errors.Is(err, db.ErrConfirmLocked) {
+		return "Sorry, " + err.Error() + ".", nil
+	} else if err != nil {
+		return "", err
+	}
+	return action.Summary, nil
+}
+
+func (api *ApiManager) confirmPendingErasure(ctx *gin.Context, accountID primitive.ObjectID) (string, error) {
+	request, err := api.requestPersonalData(ctx, accountID, db.DataRequestErasure)
+	if errors.Is(err, db.ErrErasureBalance) || errors.Is(err, db.ErrDataRequestOpen) {
+		return "Sorry, " + err.Error() + ".", nil
+	} else if err != nil {
+		return "", err
+	}
+	return dataRequestReply(request), nil
+}
@@ -0,0 +1,148 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tamir-liebermann/gobank/db"
+)
+
+var errNotPermitted = errors.New("you are not authorized to perform this action")
+
+// intentPermissions lists the chat intents that are staff-only, with the
+// permission their endpoint needs.
+var intentPermissions = map[string]string{
+	GET_ALL_ACCOUNTS_INTENT: db.PermAccountsRead,
+}
+
+// checkPermission reports whether the authenticated account's role grants
+// permission.
+func (api *ApiManager) checkPermission(ctx *gin.Context, permission string) error {
+	userID, err := currentUserID(ctx)
+	if err != nil {
+		return err
+	}
+
+	account, err := api.accMgr.SearchAccountById(userID)
+	if err != nil || account == nil {
+		return errors.New("could not find account")
+	}
+	if !db.HasPermission(account.Role, permission) {
+		return errNotPermitted
+	}
+	// API keys only get the permissions their scopes cover
+	if key, ok := currentAPIKey(ctx); ok && !key.Grants(permission) {
+		return errNotPermitted
+	}
+	return nil
+}
+
+// requirePermission only lets accounts whose role grants permission through.
+func (api *ApiManager) requirePermission(permission string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if err := api.checkPermission(ctx, permission); errors.Is(err, errNotPermitted) {
+			ctx.AbortWithStatusJSON(http.StatusForbidden, ErrorResponse{Message: err.Error()})
+			return
+		} else if err != nil {
+			ctx.AbortWithStatusJSON(http.StatusUnauthorized, ErrorResponse{Message: err.Error()})
+			return
+		}
+
+		ctx.Next()
+	}
+}
+
+func roleErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, db.ErrAccountNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, db.ErrUnknownRole), errors.Is(err, db.ErrRoleNotGrantable):
+		return http.StatusBadRequest
+	case errors.Is(err, db.ErrOwnRole):
+		return http.StatusForbidden
+	}
+	return http.StatusConflict
+}
+
+// @Summary List roles
+// @Description The named roles and the permissions each one grants (needs roles:manage)
+// @ID get-roles
+// @Produce json
+// @Success 200 {object} RolesRes
+// @Router /admin/roles [get]
+// @Security BearerAuth
+func (api *ApiManager) handleGetRoles(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, RolesRes{Roles: db.RolePermissions})
+}
+
+// @Summary Grant a role
+// @Description Give an account a role, replacing the one it has. Admins can't change their own role, and the last admin can't be demoted (needs roles:manage)
+// @ID grant-role
+// @Accept json
+// @Produce json
+// @Param id path string true "Account ID or account number"
+// @Param role body GrantRoleRequest true "Role"
+// @Success 200 {object} RoleRes
+// @Failure 400 {object} ErrorResponse "Unknown role"
+// @Failure 403 {object} ErrorResponse "Own role"
+// @Failure 404 {object} ErrorResponse "Account not found"
+// @Failure 409 {object} ErrorResponse "Last admin"
+// @Router /admin/accounts/{id}/role [put]
+// @Security BearerAuth
+func (api *ApiManager) handleGrantRole(ctx *gin.Context) {
+	var req GrantRoleRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Bad request"})
+		return
+	}
+
+	api.setRole(ctx, req.Role)
+}
+
+// @Summary Revoke a role
+// @Description Take an account's staff role away, making it a customer again (needs roles:manage)
+// @ID revoke-role
+// @Produce json
+// @Param id path string true "Account ID or account number"
+// @Success 200 {object} RoleRes
+// @Failure 403 {object} ErrorResponse "Own role"
+// @Failure 404 {object} ErrorResponse "Account not found"
+// @Failure 409 {object} ErrorResponse "Last admin"
+// @Router /admin/accounts/{id}/role [delete]
+// @Security BearerAuth
+func (api *ApiManager) handleRevokeRole(ctx *gin.Context) {
+	api.setRole(ctx, db.RoleCustomer)
+}
+
+func (api *ApiManager) setRole(ctx *gin.Context, role string) {
+	actorID, err := currentUserID(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	accountID, err := api.accMgr.ResolveAccountRef(ctx.Param("id"))
+	if err != nil {
+		ctx.JSON(accountRefStatus(err), ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	before, err := api.accMgr.SearchAccountById(accountID)
+	if err != nil || before == nil {
+		ctx.JSON(http.StatusNotFound, ErrorResponse{Message: db.ErrAccountNotFound.Error()})
+		return
+	}
+	previous := before.Role
+
+	account, err := api.accMgr.SetAccountRole(actorID, accountID, role)
+	if err != nil {
+		ctx.JSON(roleErrorStatus(err), ErrorResponse{Message: err.Error()})
+		return
+	}
+	if previous != account.Role {
+		api.audit(ctx, "account.role", accountID.Hex(), map[string]string{"from": previous, "to": account.Role})
+	}
+
+	ctx.JSON(http.StatusOK, RoleRes{AccountID: accountID.Hex(), Role: account.Role, Permissions: db.RolePermissions[account.Role]})
+}
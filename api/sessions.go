@@ -0,0 +1,235 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tamir-liebermann/gobank/db"
+	"github.com/tamir-liebermann/gobank/utils"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func sessionErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, db.ErrSessionNotFound), errors.Is(err, db.ErrAccountNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, db.ErrInvalidRefreshToken), errors.Is(err, db.ErrRefreshTokenReused),
+		errors.Is(err, db.ErrSessionRevoked), errors.Is(err, db.ErrSessionExpired):
+		return http.StatusUnauthorized
+	}
+	return http.StatusInternalServerError
+}
+
+// startSession signs the account in on the calling device. secondFactor is
+// whether the login proved one.
+func (api *ApiManager) startSession(ctx *gin.Context, account *db.BankAccount, secondFactor bool) (*TokenRes, error) {
+	session, refreshToken, err := api.accMgr.CreateSession(account.ID, ctx.Request.UserAgent(), ctx.ClientIP(), secondFactor)
+	if err != nil {
+		return nil, err
+	}
+	return api.accessToken(account, session, refreshToken)
+}
+
+func (api *ApiManager) accessToken(account *db.BankAccount, session *db.Session, refreshToken string) (*TokenRes, error) {
+	token, _, err := utils.GenerateAccessToken(account.AccountHolder, account.ID, session.ID.Hex())
+	if err != nil {
+		return nil, err
+	}
+	return &TokenRes{
+		Token:        token,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int(utils.AccessTokenTTL / time.Second),
+	}, nil
+}
+
+// @Summary Refresh an access token
+// @Description Trade a refresh token for a new access token and a new refresh token. Each refresh token works once; using one again revokes its session
+// @ID refresh-token
+// @Accept json
+// @Produce json
+// @Param token body RefreshTokenRequest true "Refresh token"
+// @Success 200 {object} TokenRes
+// @Failure 400 {object} ErrorResponse "Bad request"
+// @Failure 401 {object} ErrorResponse "Invalid, expired, revoked or reused refresh token"
+// @Router /token/refresh [post]
+func (api *ApiManager) handleRefreshToken(ctx *gin.Context) {
+	var req RefreshTokenRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil || req.RefreshToken == "" {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Bad request"})
+		return
+	}
+
+	session, refreshToken, err := api.accMgr.RotateSession(req.RefreshToken, ctx.Request.UserAgent(), ctx.ClientIP())
+	if errors.Is(err, db.ErrRefreshTokenReused) {
+		api.audit(ctx, "session.reuse", session.ID.Hex(), map[string]string{
+			"account": session.AccountID.Hex(),
+			"ip":      ctx.ClientIP(),
+		})
+		go api.notifyAccount(session.AccountID, "Someone used an old sign-in token for your account, so we signed that device out. If this wasn't you, change your password.")
+	}
+	if err != nil {
+		ctx.JSON(sessionErrorStatus(err), ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	account, err := api.accMgr.SearchAccountById(session.AccountID)
+	if err != nil || account == nil || account.ErasedAt != nil {
+		ctx.JSON(http.StatusUnauthorized, ErrorResponse{Message: db.ErrSessionRevoked.Error()})
+		return
+	}
+
+	tokens, err := api.accessToken(account, session, refreshToken)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Error generating token"})
+		return
+	}
+	ctx.Set("userId", account.ID.Hex())
+	ctx.Set(authSourceKey, db.AuditSourceJWT)
+	api.audit(ctx, "session.refresh", session.ID.Hex(), nil)
+
+	ctx.JSON(http.StatusOK, tokens)
+}
+
+// @Summary Log out
+// @Description End the current session. The access token stops working right away and the refresh token can't be used again
+// @ID logout
+// @Produce json
+// @Success 200 {object} string "Logged out"
+// @Failure 400 {object} ErrorResponse "Not signed in with a token"
+// @Router /account/logout [post]
+// @Security BearerAuth
+func (api *ApiManager) handleLogout(ctx *gin.Context) {
+	userID, err := currentUserID(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	// WhatsApp requests have no session to end
+	sessionID, err := primitive.ObjectIDFromHex(ctx.GetString(sessionIDKey))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "There is no session to log out of"})
+		return
+	}
+
+	if expiresAt, ok := ctx.Value(tokenExpiresAtKey).(time.Time); ok {
+		if err := api.accMgr.DenyToken(ctx.GetString(tokenIDKey), expiresAt); err != nil {
+			ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Could not log out, try again later"})
+			return
+		}
+	}
+	err = api.accMgr.RevokeSession(userID, sessionID, db.SessionRevokedLogout)
+	if err != nil && !errors.Is(err, db.ErrSessionNotFound) {
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Could not log out, try again later"})
+		return
+	}
+	api.audit(ctx, "account.logout", sessionID.Hex(), nil)
+
+	ctx.JSON(http.StatusOK, "Logged out")
+}
+
+// @Summary List your sessions
+// @Description The devices signed in to your account, most recently used first, with the IP address and user agent they last refreshed from
+// @ID get-sessions
+// @Produce json
+// @Success 200 {object} SessionsRes
+// @Router /account/sessions [get]
+// @Security BearerAuth
+func (api *ApiManager) handleGetSessions(ctx *gin.Context) {
+	userID, err := currentUserID(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	sessions, err := api.accMgr.GetActiveSessions(userID)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Could not load sessions"})
+		return
+	}
+	ctx.JSON(http.StatusOK, SessionsRes{Sessions: sessions, CurrentSessionID: ctx.GetString(sessionIDKey)})
+}
+
+// @Summary Revoke a session
+// @Description Sign one of your devices out
+// @ID revoke-session
+// @Produce json
+// @Param session_id path string true "Session ID"
+// @Success 200 {object} string "Session revoked"
+// @Failure 404 {object} ErrorResponse "Session not found"
+// @Router /account/sessions/{session_id} [delete]
+// @Security BearerAuth
+func (api *ApiManager) handleRevokeSession(ctx *gin.Context) {
+	userID, err := currentUserID(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	sessionID, err := primitive.ObjectIDFromHex(ctx.Param("session_id"))
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, ErrorResponse{Message: db.ErrSessionNotFound.Error()})
+		return
+	}
+
+	if err := api.accMgr.RevokeSession(userID, sessionID, db.SessionRevokedUser); err != nil {
+		ctx.JSON(sessionErrorStatus(err), ErrorResponse{Message: err.Error()})
+		return
+	}
+	api.audit(ctx, "session.revoke", sessionID.Hex(), nil)
+
+	ctx.JSON(http.StatusOK, "Session revoked")
+}
+
+// @Summary List an account's sessions
+// @Description The devices signed in to an account, with IP address and user agent (needs accounts:read)
+// @ID get-account-sessions
+// @Produce json
+// @Param id path string true "Account ID or account number"
+// @Success 200 {object} SessionsRes
+// @Failure 404 {object} ErrorResponse "Account not found"
+// @Router /admin/accounts/{id}/sessions [get]
+// @Security BearerAuth
+func (api *ApiManager) handleGetAccountSessions(ctx *gin.Context) {
+	accountID, err := api.accMgr.ResolveAccountRef(ctx.Param("id"))
+	if err != nil {
+		ctx.JSON(accountRefStatus(err), ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	sessions, err := api.accMgr.GetActiveSessions(accountID)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Could not load sessions"})
+		return
+	}
+	ctx.JSON(http.StatusOK, SessionsRes{Sessions: sessions})
+}
+
+// @Summary Revoke all of an account's sessions
+// @Description Sign an account out everywhere, e.g. when its credentials may have leaked. Its access tokens stop working right away (needs sessions:revoke)
+// @ID revoke-account-sessions
+// @Produce json
+// @Param id path string true "Account ID or account number"
+// @Success 200 {object} RevokeSessionsRes
+// @Failure 404 {object} ErrorResponse "Account not found"
+// @Router /admin/accounts/{id}/sessions/revoke [post]
+// @Security BearerAuth
+func (api *ApiManager) handleRevokeAccountSessions(ctx *gin.Context) {
+	accountID, err := api.accMgr.ResolveAccountRef(ctx.Param("id"))
+	if err != nil {
+		ctx.JSON(accountRefStatus(err), ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	revoked, err := api.accMgr.RevokeAllSessions(accountID, db.SessionRevokedAdmin)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Could not revoke sessions"})
+		return
+	}
+	api.audit(ctx, "session.revoke_all", accountID.Hex(), map[string]string{"revoked": strconv.FormatInt(revoked, 10)})
+
+	ctx.JSON(http.StatusOK, RevokeSessionsRes{AccountID: accountID.Hex(), Revoked: revoked})
+}
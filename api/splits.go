@@ -0,0 +1,314 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tamir-liebermann/gobank/db"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// createSplit divides an expense paid by ownerID between the participants and
+// sends each of them a money request for their share. Every participant is
+// resolved before any request goes out, so a typo or an ambiguous nickname
+// never leaves a half-created split behind.
+func (api *ApiManager) createSplit(ownerID primitive.ObjectID, req CreateSplitRequest) (*db.Split, error) {
+	if req.Total <= 0 {
+		return nil, errors.New("total must be greater than zero")
+	}
+	if len(req.Participants) == 0 {
+		return nil, errors.New("at least one participant is required")
+	}
+
+	includeOwner := req.IncludeMe == nil || *req.IncludeMe
+	custom := false
+	seen := map[primitive.ObjectID]bool{}
+	var shares []db.SplitShare
+
+	for _, participant := range req.Participants {
+		accountID, err := api.resolveRecipient(ownerID, participant.To)
+		if err != nil {
+			return nil, err
+		}
+		if accountID == ownerID {
+			includeOwner = true
+			continue
+		}
+		if seen[accountID] {
+			return nil, fmt.Errorf("%s is listed more than once", participant.To)
+		}
+		seen[accountID] = true
+
+		if participant.Amount < 0 {
+			return nil, errors.New("share amounts cannot be negative")
+		}
+		if participant.Amount > 0 {
+			custom = true
+		}
+		shares = append(shares, db.SplitShare{AccountID: accountID, Amount: participant.Amount})
+	}
+
+	if len(shares) == 0 {
+		return nil, errors.New("you need at least one other participant to split with")
+	}
+
+	split := db.Split{
+		ID:          primitive.NewObjectID(),
+		OwnerID:     ownerID,
+		Description: strings.TrimSpace(req.Description),
+		Total:       req.Total,
+		Shares:      shares,
+	}
+
+	if custom {
+		split.Method = db.SplitCustom
+		var sum float64
+		for _, share := range shares {
+			if share.Amount == 0 {
+				return nil, errors.New("custom splits need an amount for every participant")
+			}
+			sum += share.Amount
+		}
+		split.OwnerShare = math.Round((req.Total-sum)*100) / 100
+		if split.OwnerShare < 0 {
+			return nil, fmt.Errorf("shares add up to %.2f, which is more than the total of %.2f", sum, req.Total)
+		}
+	} else {
+		split.Method = db.SplitEqual
+		n := len(shares)
+		if includeOwner {
+			n++
+		}
+		amounts := db.EqualShares(req.Total, n)
+		if includeOwner {
+			// The owner takes the first share, and with it any leftover cents.
+			split.OwnerShare = amounts[0]
+			amounts = amounts[1:]
+		}
+		for i := range split.Shares {
+			split.Shares[i].Amount = amounts[i]
+		}
+	}
+
+	note := "your share"
+	if split.Description != "" {
+		note = fmt.Sprintf("your share of %s", split.Description)
+	}
+
+	for i, share := range split.Shares {
+		request, err := api.requestMoney(ownerID, share.AccountID, share.Amount, note)
+		if err != nil {
+			api.cancelSplitRequests(ownerID, split.Shares[:i])
+			return nil, err
+		}
+		split.Shares[i].RequestID = request.ID
+	}
+
+	created, err := api.accMgr.CreateSplit(split)
+	if err != nil {
+		api.cancelSplitRequests(ownerID, split.Shares)
+		return nil, err
+	}
+	return created, nil
+}
+
+func (api *ApiManager) cancelSplitRequests(ownerID primitive.ObjectID, shares []db.SplitShare) {
+	for _, share := range shares {
+		if _, err := api.cancelMoneyRequest(ownerID, share.RequestID); err != nil {
+			log.Printf("Error cancelling money request %s of failed split: %v", share.RequestID.Hex(), err)
+		}
+	}
+}
+
+// splitStatus reports, for each participant, whether their request has been paid.
+func (api *ApiManager) splitStatus(split *db.Split) (*SplitStatusRes, error) {
+	ids := make([]primitive.ObjectID, 0, len(split.Shares))
+	for _, share := range split.Shares {
+		ids = append(ids, share.RequestID)
+	}
+
+	requests, err := api.accMgr.GetMoneyRequestsByIds(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &SplitStatusRes{Split: *split, Collected: split.OwnerShare}
+	for _, share := range split.Shares {
+		status := requests[share.RequestID].Status
+		if status == db.MoneyRequestPaid {
+			res.Collected += share.Amount
+		} else {
+			res.Outstanding += share.Amount
+		}
+		res.Participants = append(res.Participants, SplitParticipantStatus{
+			AccountID: share.AccountID,
+			Name:      api.accountLabel(share.AccountID),
+			Amount:    share.Amount,
+			Status:    status,
+		})
+	}
+	return res, nil
+}
+
+func formatSplitStatus(status *SplitStatusRes) string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("%s: %.2f split %s, %.2f collected, %.2f outstanding\n",
+		status.Split.Description, status.Split.Total, status.Split.Method, status.Collected, status.Outstanding))
+	for _, participant := range status.Participants {
+		sb.WriteString(fmt.Sprintf("- %s owes %.2f: %s\n", participant.Name, participant.Amount, participant.Status))
+	}
+	return sb.String()
+}
+
+// @Summary Split an expense
+// @Description Split an expense equally or by custom shares and send each participant a money request
+// @ID create-split
+// @Accept json
+// @Produce json
+// @Param split body CreateSplitRequest true "Split"
+// @Success 201 {object} db.Split
+// @Failure 400 {object} ErrorResponse "Bad request"
+// @Router /account/splits [post]
+// @Security BearerAuth
+func (api *ApiManager) handleCreateSplit(ctx *gin.Context) {
+	ownerID, err := currentUserID(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	var req CreateSplitRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Bad request"})
+		return
+	}
+
+	split, err := api.createSplit(ownerID, req)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusCreated, split)
+}
+
+// @Summary List splits
+// @Description List the expenses you split with others
+// @ID get-splits
+// @Produce json
+// @Success 200 {object} SplitsRes
+// @Failure 500 {object} ErrorResponse "Internal server error"
+// @Router /account/splits [get]
+// @Security BearerAuth
+func (api *ApiManager) handleGetSplits(ctx *gin.Context) {
+	ownerID, err := currentUserID(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	splits, err := api.accMgr.GetSplits(ownerID)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Internal server error"})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, SplitsRes{Splits: splits})
+}
+
+// @Summary Get split status
+// @Description Show who has paid their share of a split
+// @ID get-split
+// @Produce json
+// @Param split_id path string true "Split ID"
+// @Success 200 {object} SplitStatusRes
+// @Failure 400 {object} ErrorResponse "Invalid ID format"
+// @Failure 404 {object} ErrorResponse "Split not found"
+// @Router /account/splits/{split_id} [get]
+// @Security BearerAuth
+func (api *ApiManager) handleGetSplit(ctx *gin.Context) {
+	ownerID, err := currentUserID(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	splitID, err := primitive.ObjectIDFromHex(ctx.Param("split_id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Invalid ID format"})
+		return
+	}
+
+	split, err := api.accMgr.GetSplitById(ownerID, splitID)
+	if errors.Is(err, db.ErrSplitNotFound) {
+		ctx.JSON(http.StatusNotFound, ErrorResponse{Message: err.Error()})
+		return
+	} else if err != nil {
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Internal server error"})
+		return
+	}
+
+	status, err := api.splitStatus(split)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Internal server error"})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, status)
+}
+
+func (api *ApiManager) handleSplitIntent(ctx *gin.Context, req SplitIntentReq) (*db.Split, error) {
+	ownerID, err := currentUserID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	splitReq := CreateSplitRequest{
+		Description: req.Description,
+		Total:       req.Amount,
+		IncludeMe:   req.IncludeMe,
+	}
+	for _, participant := range req.Participants {
+		splitReq.Participants = append(splitReq.Participants, SplitParticipantReq{
+			To:     participant,
+			Amount: req.Shares[participant],
+		})
+	}
+
+	return api.createSplit(ownerID, splitReq)
+}
+
+func (api *ApiManager) handleSplitStatusIntent(ctx *gin.Context) (string, error) {
+	ownerID, err := currentUserID(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	splits, err := api.accMgr.GetSplits(ownerID)
+	if err != nil {
+		return "", err
+	}
+	if len(splits) == 0 {
+		return "You haven't split any expenses yet.", nil
+	}
+
+	// Only the most recent few are interesting in a chat
+	if len(splits) > 3 {
+		splits = splits[:3]
+	}
+
+	var sb strings.Builder
+	for i := range splits {
+		status, err := api.splitStatus(&splits[i])
+		if err != nil {
+			return "", err
+		}
+		sb.WriteString(formatSplitStatus(status))
+	}
+	return sb.String(), nil
+}
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"net/url"
 	"regexp"
@@ -14,6 +15,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/tamir-liebermann/gobank/db"
 	"github.com/tamir-liebermann/gobank/env"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"github.com/twilio/twilio-go/client"
 
@@ -22,10 +24,19 @@ import (
 const TwilioUser = "twilio_user"
 
 func (api *ApiManager) sendWhatsAppMessage(to, message string) error {
+	return api.sendTwilioMessage(env.New().TwilioPhoneNum, to, message)
+}
+
+// sendSMS texts a phone number from the same Twilio number WhatsApp messages
+// come from.
+func (api *ApiManager) sendSMS(to, message string) error {
+	return api.sendTwilioMessage(strings.TrimPrefix(env.New().TwilioPhoneNum, "whatsapp:"), to, message)
+}
+
+func (api *ApiManager) sendTwilioMessage(from, to, message string) error {
 	spec := env.New()
 	accountSid := spec.TwilioAccSid
 	authToken := spec.TwilioAuth
-    from := spec.TwilioPhoneNum
     
 
 	urlStr := fmt.Sprintf("https://api.twilio.com/2010-04-01/Accounts/%s/Messages.json", accountSid)
@@ -69,6 +80,21 @@ func (api *ApiManager) sendWhatsAppMessage(to, message string) error {
 	return nil
 }
 
+// notifyAccount sends a WhatsApp message to the phone number of an account.
+// Errors are only logged: a failed notification must not fail the operation
+// that triggered it.
+func (api *ApiManager) notifyAccount(accountID primitive.ObjectID, message string) {
+	account, err := api.accMgr.SearchAccountById(accountID)
+	if err != nil || account == nil || account.PhoneNumber == "" {
+		log.Printf("Cannot notify account %s: no phone number on file", accountID.Hex())
+		return
+	}
+
+	if err := api.sendWhatsAppMessage("whatsapp:"+account.PhoneNumber, message); err != nil {
+		log.Printf("Error notifying account %s: %v", accountID.Hex(), err)
+	}
+}
+
 func splitMessage(msg string, maxLen int) []string {
 	var parts []string
 	for i := 0; i < len(msg); i += maxLen {
@@ -101,16 +127,27 @@ func (api *ApiManager) getAccountFromTwilioReq( ctx *gin.Context, req TwilioReq)
 	if err != nil {
 		if errors.Is(err, mongo.ErrNoDocuments) {
 			//  return create account
-			account, err = api.accMgr.CreateAccount("guest", "abc", 1000, phone ,"user")
+			// Guests chat over WhatsApp; to sign in elsewhere they set a
+			// password with a reset code first
+			password, err := randomPassword()
+			if err != nil {
+				return nil, err
+			}
+			account, err = api.accMgr.CreateAccount("guest", password, phone ,db.RoleCustomer)
 
 			if err != nil {
 				return nil, err
 			}
+			if err := api.accMgr.RequirePasswordChange(account.ID); err != nil {
+				return nil, err
+			}
+			account.MustChangePassword = true
 		}else{
             return nil, err
         }
 	}
 	ctx.Set("userId", account.ID.Hex())
+	ctx.Set(authSourceKey, db.AuditSourceTwilio)
 	return account, nil
 
 }
@@ -0,0 +1,469 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tamir-liebermann/gobank/db"
+	"github.com/tamir-liebermann/gobank/utils"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	loginChallengePurpose = "login_2fa"
+	loginChallengeTTL     = 5 * time.Minute
+
+	// stepUpWindow is how long after proving a second factor a session may
+	// do sensitive things without proving it again.
+	stepUpWindow = 5 * time.Minute
+)
+
+var (
+	errInvalidTwoFactorCode = errors.New("invalid code")
+	errSecondFactorRequired = errors.New("this needs a fresh second factor; send a code to /account/2fa/step-up and try again")
+	errStepUpUnavailable    = errors.New("this needs a fresh second factor, which can't be given over WhatsApp; please make it in the app")
+
+	totpCodeRegexp = regexp.MustCompile(`^\d{6}$`)
+)
+
+func twoFactorErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errInvalidTwoFactorCode), errors.Is(err, db.ErrTwoFactorCodeUsed):
+		return http.StatusUnauthorized
+	case errors.Is(err, db.ErrTwoFactorLocked):
+		return http.StatusTooManyRequests
+	case errors.Is(err, db.ErrTwoFactorEnabled), errors.Is(err, db.ErrTwoFactorNotEnabled), errors.Is(err, db.ErrTwoFactorNotEnrolled):
+		return http.StatusConflict
+	case errors.Is(err, db.ErrAccountNotFound):
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+// verifySecondFactor checks an authenticator code or a recovery code. Every
+// wrong code counts towards locking the account's second factor for a while.
+func (api *ApiManager) verifySecondFactor(ctx *gin.Context, account *db.BankAccount, code string) error {
+	if !account.TwoFactor.Enabled() {
+		return db.ErrTwoFactorNotEnabled
+	}
+	if account.TwoFactor.Locked() {
+		return db.ErrTwoFactorLocked
+	}
+
+	code = strings.TrimSpace(code)
+	if totpCodeRegexp.MatchString(code) {
+		if step, ok := utils.MatchTOTP(account.TwoFactor.Secret, code, time.Now()); ok {
+			return api.accMgr.UseTwoFactorStep(account.ID, step)
+		}
+	} else if code != "" {
+		used, err := api.accMgr.UseRecoveryCode(account.ID, utils.HashRecoveryCode(code))
+		if err != nil {
+			return err
+		}
+		if used {
+			api.audit(ctx, "2fa.recovery_code", account.ID.Hex(), nil)
+			return nil
+		}
+	}
+
+	locked, err := api.accMgr.RecordTwoFactorFailure(account.ID)
+	if err != nil {
+		return err
+	}
+	api.audit(ctx, "2fa.failed", account.ID.Hex(), nil)
+	if locked {
+		go api.notifyAccount(account.ID, "Too many wrong two-factor codes were entered for your account, so two-factor sign-in is paused for 15 minutes.")
+		return db.ErrTwoFactorLocked
+	}
+	return errInvalidTwoFactorCode
+}
+
+// requireSecondFactor lets sensitive operations through when the account has
+// no second factor, or the session proved one within the step-up window. It
+// writes the error response itself and reports whether to go on.
+func (api *ApiManager) requireSecondFactor(ctx *gin.Context, accountID primitive.ObjectID) bool {
+	account, err := api.accMgr.SearchAccountById(accountID)
+	if err != nil || account == nil {
+		ctx.AbortWithStatusJSON(http.StatusNotFound, ErrorResponse{Message: db.ErrAccountNotFound.Error()})
+		return false
+	}
+	if !api.secondFactorFresh(ctx, account) {
+		ctx.AbortWithStatusJSON(http.StatusForbidden, ErrorResponse{Message: errSecondFactorRequired.Error()})
+		return false
+	}
+	return true
+}
+
+// secondFactorFresh reports whether the account has no second factor, or the
+// session proved one within the step-up window.
+func (api *ApiManager) secondFactorFresh(ctx *gin.Context, account *db.BankAccount) bool {
+	if !account.TwoFactor.Enabled() {
+		return true
+	}
+
+	// Requests without a session, e.g. over WhatsApp, can't step up
+	sessionID, err := primitive.ObjectIDFromHex(ctx.GetString(sessionIDKey))
+	if err != nil {
+		return false
+	}
+	session, err := api.accMgr.GetSession(sessionID)
+	return err == nil && session.SecondFactorAt != nil && time.Since(*session.SecondFactorAt) < stepUpWindow
+}
+
+// chatStepUp is the step-up check for money moved from a chat. Large amounts
+// need a fresh second factor as they do over REST; when the chat has no
+// session to step up, e.g. WhatsApp, it says to use the app instead.
+func (api *ApiManager) chatStepUp(ctx *gin.Context, accountID primitive.ObjectID, amount float64) error {
+	if amount < api.stepUpTransferAmount {
+		return nil
+	}
+	account, err := api.accMgr.SearchAccountById(accountID)
+	if err != nil {
+		return err
+	}
+	if account == nil {
+		return db.ErrAccountNotFound
+	}
+	if api.secondFactorFresh(ctx, account) {
+		return nil
+	}
+	if ctx.GetString(sessionIDKey) == "" {
+		return errStepUpUnavailable
+	}
+	return errSecondFactorRequired
+}
+
+// currentAccount loads the authenticated account, or writes the error.
+func (api *ApiManager) currentAccount(ctx *gin.Context) (*db.BankAccount, bool) {
+	userID, err := currentUserID(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, ErrorResponse{Message: err.Error()})
+		return nil, false
+	}
+	account, err := api.accMgr.SearchAccountById(userID)
+	if err != nil || account == nil {
+		ctx.JSON(http.StatusNotFound, ErrorResponse{Message: db.ErrAccountNotFound.Error()})
+		return nil, false
+	}
+	return account, true
+}
+
+// @Summary Two-factor status
+// @Description Whether two-factor authentication is on and how many recovery codes are left
+// @ID get-two-factor
+// @Produce json
+// @Success 200 {object} TwoFactorStatusRes
+// @Router /account/2fa [get]
+// @Security BearerAuth
+func (api *ApiManager) handleGetTwoFactor(ctx *gin.Context) {
+	account, ok := api.currentAccount(ctx)
+	if !ok {
+		return
+	}
+
+	ctx.JSON(http.StatusOK, TwoFactorStatusRes{
+		Enabled:           account.TwoFactor.Enabled(),
+		EnabledAt:         account.TwoFactor.EnabledAt,
+		RecoveryCodesLeft: len(account.TwoFactor.RecoveryCodes),
+	})
+}
+
+// @Summary Start two-factor enrollment
+// @Description Generate an authenticator secret, as an otpauth URI and a QR code PNG. Two-factor is only turned on once a code from the authenticator is sent to /account/2fa/verify
+// @ID enroll-two-factor
+// @Produce json
+// @Success 200 {object} TwoFactorEnrollRes
+// @Failure 409 {object} ErrorResponse "Already on"
+// @Router /account/2fa/enroll [post]
+// @Security BearerAuth
+func (api *ApiManager) handleEnrollTwoFactor(ctx *gin.Context) {
+	account, ok := api.currentAccount(ctx)
+	if !ok {
+		return
+	}
+
+	label := account.AccountNumber
+	if label == "" {
+		label = account.AccountHolder
+	}
+	enrollment, err := utils.NewTOTPEnrollment(label)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Could not generate a secret"})
+		return
+	}
+	if err := api.accMgr.StartTwoFactorEnrollment(account.ID, enrollment.Secret); err != nil {
+		ctx.JSON(twoFactorErrorStatus(err), ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, TwoFactorEnrollRes{
+		Secret:     enrollment.Secret,
+		OtpauthURI: enrollment.URI,
+		QRCodePNG:  enrollment.QRCodePNG,
+	})
+}
+
+// @Summary Turn two-factor on
+// @Description Confirm enrollment with a code from the authenticator. Returns recovery codes, which are shown only this once
+// @ID verify-two-factor
+// @Accept json
+// @Produce json
+// @Param code body TwoFactorCodeRequest true "Authenticator code"
+// @Success 200 {object} RecoveryCodesRes
+// @Failure 401 {object} ErrorResponse "Invalid code"
+// @Failure 409 {object} ErrorResponse "Not enrolling"
+// @Router /account/2fa/verify [post]
+// @Security BearerAuth
+func (api *ApiManager) handleVerifyTwoFactor(ctx *gin.Context) {
+	var req TwoFactorCodeRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Bad request"})
+		return
+	}
+
+	account, ok := api.currentAccount(ctx)
+	if !ok {
+		return
+	}
+	if account.TwoFactor.Enabled() {
+		ctx.JSON(http.StatusConflict, ErrorResponse{Message: db.ErrTwoFactorEnabled.Error()})
+		return
+	}
+	secret := account.TwoFactor.PendingSecret
+	if secret == "" {
+		ctx.JSON(http.StatusConflict, ErrorResponse{Message: db.ErrTwoFactorNotEnrolled.Error()})
+		return
+	}
+
+	step, ok := utils.MatchTOTP(secret, strings.TrimSpace(req.Code), time.Now())
+	if !ok {
+		ctx.JSON(http.StatusUnauthorized, ErrorResponse{Message: errInvalidTwoFactorCode.Error()})
+		return
+	}
+	codes, hashes, err := utils.NewRecoveryCodes()
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Could not generate recovery codes"})
+		return
+	}
+	if err := api.accMgr.EnableTwoFactor(account.ID, secret, step, hashes); err != nil {
+		ctx.JSON(twoFactorErrorStatus(err), ErrorResponse{Message: err.Error()})
+		return
+	}
+	api.markSecondFactor(ctx)
+	api.audit(ctx, "2fa.enable", account.ID.Hex(), nil)
+
+	ctx.JSON(http.StatusOK, RecoveryCodesRes{RecoveryCodes: codes})
+}
+
+// markSecondFactor records on the current session that it just proved a
+// second factor. Requests without a session have nothing to mark.
+func (api *ApiManager) markSecondFactor(ctx *gin.Context) (time.Time, bool) {
+	sessionID, err := primitive.ObjectIDFromHex(ctx.GetString(sessionIDKey))
+	if err != nil {
+		return time.Time{}, false
+	}
+	if err := api.accMgr.MarkSecondFactor(sessionID); err != nil {
+		return time.Time{}, false
+	}
+	return time.Now().Add(stepUpWindow), true
+}
+
+// @Summary Prove a second factor
+// @Description Send an authenticator or recovery code so this session may do sensitive things, such as large transfers or changing the phone number, for the next few minutes
+// @ID step-up-two-factor
+// @Accept json
+// @Produce json
+// @Param code body TwoFactorCodeRequest true "Authenticator or recovery code"
+// @Success 200 {object} StepUpRes
+// @Failure 400 {object} ErrorResponse "Not signed in with a token"
+// @Failure 401 {object} ErrorResponse "Invalid code"
+// @Failure 429 {object} ErrorResponse "Too many wrong codes"
+// @Router /account/2fa/step-up [post]
+// @Security BearerAuth
+func (api *ApiManager) handleStepUp(ctx *gin.Context) {
+	var req TwoFactorCodeRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Bad request"})
+		return
+	}
+
+	account, ok := api.currentAccount(ctx)
+	if !ok {
+		return
+	}
+	if err := api.verifySecondFactor(ctx, account, req.Code); err != nil {
+		ctx.JSON(twoFactorErrorStatus(err), ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	validUntil, ok := api.markSecondFactor(ctx)
+	if !ok {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "There is no session to step up"})
+		return
+	}
+	ctx.JSON(http.StatusOK, StepUpRes{ValidUntil: validUntil})
+}
+
+// @Summary Replace recovery codes
+// @Description Generate new recovery codes; the old ones stop working
+// @ID regenerate-recovery-codes
+// @Accept json
+// @Produce json
+// @Param code body TwoFactorCodeRequest true "Authenticator or recovery code"
+// @Success 200 {object} RecoveryCodesRes
+// @Failure 401 {object} ErrorResponse "Invalid code"
+// @Failure 409 {object} ErrorResponse "Two-factor is off"
+// @Router /account/2fa/recovery-codes [post]
+// @Security BearerAuth
+func (api *ApiManager) handleRegenerateRecoveryCodes(ctx *gin.Context) {
+	var req TwoFactorCodeRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Bad request"})
+		return
+	}
+
+	account, ok := api.currentAccount(ctx)
+	if !ok {
+		return
+	}
+	if err := api.verifySecondFactor(ctx, account, req.Code); err != nil {
+		ctx.JSON(twoFactorErrorStatus(err), ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	codes, hashes, err := utils.NewRecoveryCodes()
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Could not generate recovery codes"})
+		return
+	}
+	if err := api.accMgr.ReplaceRecoveryCodes(account.ID, hashes); err != nil {
+		ctx.JSON(twoFactorErrorStatus(err), ErrorResponse{Message: err.Error()})
+		return
+	}
+	api.audit(ctx, "2fa.recovery_codes", account.ID.Hex(), nil)
+
+	ctx.JSON(http.StatusOK, RecoveryCodesRes{RecoveryCodes: codes})
+}
+
+// @Summary Turn two-factor off
+// @Description Remove the authenticator and recovery codes
+// @ID disable-two-factor
+// @Accept json
+// @Produce json
+// @Param code body TwoFactorCodeRequest true "Authenticator or recovery code"
+// @Success 200 {object} string "Two-factor authentication turned off"
+// @Failure 401 {object} ErrorResponse "Invalid code"
+// @Failure 409 {object} ErrorResponse "Two-factor is off"
+// @Router /account/2fa/disable [post]
+// @Security BearerAuth
+func (api *ApiManager) handleDisableTwoFactor(ctx *gin.Context) {
+	var req TwoFactorCodeRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Bad request"})
+		return
+	}
+
+	account, ok := api.currentAccount(ctx)
+	if !ok {
+		return
+	}
+	if err := api.verifySecondFactor(ctx, account, req.Code); err != nil {
+		ctx.JSON(twoFactorErrorStatus(err), ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	if err := api.accMgr.DisableTwoFactor(account.ID); err != nil {
+		ctx.JSON(twoFactorErrorStatus(err), ErrorResponse{Message: err.Error()})
+		return
+	}
+	api.audit(ctx, "2fa.disable", account.ID.Hex(), nil)
+	go api.notifyAccount(account.ID, "Two-factor authentication was turned off for your account. If this wasn't you, contact support.")
+
+	ctx.JSON(http.StatusOK, "Two-factor authentication turned off")
+}
+
+// @Summary Complete a two-factor login
+// @Description Trade the challenge /login returned and an authenticator or recovery code for tokens
+// @ID login-two-factor
+// @Accept json
+// @Produce json
+// @Param login body TwoFactorLoginRequest true "Challenge and code"
+// @Success 200 {object} LoginResponse
+// @Failure 401 {object} ErrorResponse "Invalid challenge or code"
+// @Failure 429 {object} ErrorResponse "Too many wrong codes"
+// @Router /login/2fa [post]
+func (api *ApiManager) handleLoginTwoFactor(ctx *gin.Context) {
+	var req TwoFactorLoginRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Message: "Bad request"})
+		return
+	}
+
+	userID, err := utils.ParseChallengeToken(req.Challenge, loginChallengePurpose)
+	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, ErrorResponse{Message: "Invalid or expired challenge, log in again"})
+		return
+	}
+	accountID, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, ErrorResponse{Message: "Invalid or expired challenge, log in again"})
+		return
+	}
+	account, err := api.accMgr.SearchAccountById(accountID)
+	if err != nil || account == nil || account.ErasedAt != nil {
+		ctx.JSON(http.StatusUnauthorized, ErrorResponse{Message: "Invalid or expired challenge, log in again"})
+		return
+	}
+
+	ctx.Set(authSourceKey, db.AuditSourceJWT)
+	if err := api.verifySecondFactor(ctx, account, req.Code); err != nil {
+		ctx.JSON(twoFactorErrorStatus(err), ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	tokens, err := api.startSession(ctx, account, true)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Message: "Error generating token"})
+		return
+	}
+	ctx.Set("userId", account.ID.Hex())
+	api.audit(ctx, "account.login", account.ID.Hex(), map[string]string{"second_factor": "totp"})
+
+	ctx.JSON(http.StatusOK, LoginResponse{
+		UserName:     account.AccountHolder,
+		Token:        tokens.Token,
+		RefreshToken: tokens.RefreshToken,
+		ExpiresIn:    tokens.ExpiresIn,
+	})
+}
+
+// @Summary Reset an account's two-factor
+// @Description Turn two-factor off for a customer who lost their authenticator and recovery codes. The customer is told over WhatsApp (needs 2fa:reset)
+// @ID reset-two-factor
+// @Produce json
+// @Param id path string true "Account ID or account number"
+// @Success 200 {object} string "Two-factor authentication reset"
+// @Failure 404 {object} ErrorResponse "Account not found"
+// @Failure 409 {object} ErrorResponse "Two-factor is off"
+// @Router /admin/accounts/{id}/2fa/reset [post]
+// @Security BearerAuth
+func (api *ApiManager) handleResetTwoFactor(ctx *gin.Context) {
+	accountID, err := api.accMgr.ResolveAccountRef(ctx.Param("id"))
+	if err != nil {
+		ctx.JSON(accountRefStatus(err), ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	if err := api.accMgr.DisableTwoFactor(accountID); err != nil {
+		ctx.JSON(twoFactorErrorStatus(err), ErrorResponse{Message: err.Error()})
+		return
+	}
+	api.audit(ctx, "2fa.reset", accountID.Hex(), nil)
+	go api.notifyAccount(accountID, "Our staff turned two-factor authentication off for your account. Set it up again in the app. If you didn't ask for this, contact support.")
+
+	ctx.JSON(http.StatusOK, "Two-factor authentication reset")
+}
@@ -1,6 +1,8 @@
 package api
 
 import (
+	"time"
+
 	"github.com/tamir-liebermann/gobank/db"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
@@ -15,8 +17,13 @@ import (
 // )
 
 type LoginResponse struct {
-	UserName string `json:"user_name"`
-	Token    string `json:"token"`
+	UserName     string `json:"user_name"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+
+	TwoFactorRequired bool   `json:"two_factor_required,omitempty"`
+	Challenge         string `json:"challenge,omitempty"`
 }
 
 type LoginRequest struct {
@@ -31,23 +38,27 @@ type IdRequest struct {
 type IdResponse = LoginResponse
 
 type CreateAccountResponse struct {
-	Message string `json:"message"`
-	Id      string `json:"_id"`
-	Token   string `json:"token"`
+	Message       string `json:"message"`
+	Id            string `json:"_id"`
+	AccountNumber string `json:"account_number"`
+	Token         string `json:"token"`
+	RefreshToken  string `json:"refresh_token"`
+	ExpiresIn     int    `json:"expires_in"`
 }
 
 type CreateAccountRequest struct {
 	Password    string  `json:"password"`
 	UserName    string  `json:"user_name"`
-	Balance     float64 `json:"balance"`
+	Balance     float64 `json:"balance"` // must be 0; accounts are funded by deposits
 	PhoneNumber string  `json:"phone_number"`
 	Role        string  `json:"role"`
 }
 
 type TransferRequest struct {
-	From   string  `json:"from"`
-	To     string  `json:"to"`
-	Amount float64 `json:"amount"`
+	From     string  `json:"from"`
+	To       string  `json:"to"`
+	Amount   float64 `json:"amount"`
+	Category string  `json:"category"`
 }
 
 type AccNameReq struct {
@@ -95,6 +106,7 @@ type DepositRequest struct {
 type DepositResponse struct {
 	Message string  `json:"message"`
 	Amount  float64 `json:"amount"`
+	Fee     float64 `json:"fee,omitempty"`
 }
 
 type GPTRequest struct {
@@ -119,4 +131,462 @@ type HealthResponse struct {
 
 type PhoneRequest struct {
 	PhoneNumber string `json:"phone_number"`
-}
\ No newline at end of file
+}
+
+type CreatePayeeRequest struct {
+	Nickname string `json:"nickname" binding:"required"`
+	To       string `json:"to" binding:"required"` // phone number or account ID
+}
+
+type RenamePayeeRequest struct {
+	Nickname string `json:"nickname" binding:"required"`
+}
+
+type PayeesRes struct {
+	Payees []db.Payee `json:"payees"`
+}
+
+type SavePayeeIntentReq struct {
+	Nickname string `json:"nickname"`
+	To       string `json:"to"`
+}
+
+type MoneyRequestReq struct {
+	From   string  `json:"from" binding:"required"` // phone number, account ID or payee nickname
+	Amount float64 `json:"amount" binding:"required"`
+	Note   string  `json:"note"`
+}
+
+type MoneyRequestReplyReq struct {
+	RequestID string `json:"request_id"`
+}
+
+type ConfirmIntentReq struct {
+	Code string `json:"code"` // one-time code or transaction PIN
+}
+
+type MoneyRequestsRes struct {
+	Requests []db.MoneyRequest `json:"requests"`
+}
+
+type SplitParticipantReq struct {
+	To     string  `json:"to" binding:"required"` // phone number, account ID or payee nickname
+	Amount float64 `json:"amount"`                // custom share, leave empty to split equally
+}
+
+type CreateSplitRequest struct {
+	Description  string                `json:"description"`
+	Total        float64               `json:"total" binding:"required"`
+	Participants []SplitParticipantReq `json:"participants" binding:"required"`
+	IncludeMe    *bool                 `json:"include_me"` // whether the caller takes an equal share, default true
+}
+
+type SplitParticipantStatus struct {
+	AccountID primitive.ObjectID `json:"account_id"`
+	Name      string             `json:"name"`
+	Amount    float64            `json:"amount"`
+	Status    string             `json:"status"`
+}
+
+type SplitStatusRes struct {
+	Split        db.Split                 `json:"split"`
+	Participants []SplitParticipantStatus `json:"participants"`
+	Collected    float64                  `json:"collected"`
+	Outstanding  float64                  `json:"outstanding"`
+}
+
+type SplitsRes struct {
+	Splits []db.Split `json:"splits"`
+}
+
+type SplitIntentReq struct {
+	Amount       float64            `json:"amount"`
+	Description  string             `json:"description"`
+	Participants []string           `json:"participants"`
+	Shares       map[string]float64 `json:"shares"`
+	IncludeMe    *bool              `json:"include_me"`
+}
+
+type CreatePocketRequest struct {
+	Name         string  `json:"name" binding:"required"`
+	TargetAmount float64 `json:"target_amount"`
+	TargetDate   string  `json:"target_date"` // YYYY-MM-DD
+}
+
+type UpdatePocketGoalRequest struct {
+	TargetAmount float64 `json:"target_amount"`
+	TargetDate   string  `json:"target_date"` // YYYY-MM-DD
+}
+
+type MovePocketRequest struct {
+	Amount    float64 `json:"amount" binding:"required"`
+	Direction string  `json:"direction" binding:"required"` // "in" to the pocket or "out" of it
+}
+
+type PocketProgressRes struct {
+	Pocket        db.Pocket `json:"pocket"`
+	Percent       float64   `json:"percent"`
+	Remaining     float64   `json:"remaining"`
+	DaysLeft      int       `json:"days_left,omitempty"`
+	MonthlyNeeded float64   `json:"monthly_needed,omitempty"`
+}
+
+type PocketsRes struct {
+	Pockets []PocketProgressRes `json:"pockets"`
+}
+
+type MovePocketIntentReq struct {
+	Pocket    string  `json:"pocket"`
+	Amount    float64 `json:"amount"`
+	Direction string  `json:"direction"`
+}
+
+type PocketGoalIntentReq struct {
+	Pocket string `json:"pocket"`
+}
+
+type BudgetRequest struct {
+	Name         string    `json:"name"`
+	Category     string    `json:"category"`     // either a category...
+	Counterparty string    `json:"counterparty"` // ...or a phone number, account ID or payee nickname
+	MonthlyLimit float64   `json:"monthly_limit"`
+	Thresholds   []float64 `json:"thresholds"` // alert percentages, default 80 and 100
+}
+
+type BudgetStatusRes struct {
+	Budget    db.Budget `json:"budget"`
+	Spent     float64   `json:"spent"`
+	Remaining float64   `json:"remaining"`
+	Percent   float64   `json:"percent"`
+}
+
+type BudgetsRes struct {
+	Budgets []BudgetStatusRes `json:"budgets"`
+}
+
+type FeeRuleRequest struct {
+	Name      string  `json:"name"`
+	Operation string  `json:"operation"`
+	Role      string  `json:"role"`
+	MinAmount float64 `json:"min_amount"`
+	Flat      float64 `json:"flat"`
+	Percent   float64 `json:"percent"`
+	MaxFee    float64 `json:"max_fee"`
+}
+
+type FeeRulesRes struct {
+	Fees []db.FeeRule `json:"fees"`
+}
+
+type FeeQuoteRes struct {
+	Operation string  `json:"operation"`
+	Amount    float64 `json:"amount"`
+	Fee       float64 `json:"fee"`
+}
+
+type FraudRuleRequest struct {
+	Name           string  `json:"name"`
+	Kind           string  `json:"kind"`
+	Outcome        string  `json:"outcome"`
+	Amount         float64 `json:"amount"`
+	Count          int     `json:"count"`
+	WindowMinutes  int     `json:"window_minutes"`
+	AccountAgeDays int     `json:"account_age_days"`
+	BalancePercent float64 `json:"balance_percent"`
+}
+
+type FraudRulesRes struct {
+	Rules []db.FraudRule `json:"rules"`
+}
+
+type HeldTransfersRes struct {
+	Transfers []db.HeldTransfer `json:"transfers"`
+}
+
+type ReviewHeldTransferRequest struct {
+	Note string `json:"note"`
+}
+
+type AMLVolumesRes struct {
+	AccountID string         `json:"account_id"`
+	Volumes   []db.AMLVolume `json:"volumes"`
+}
+
+type AMLCasesRes struct {
+	Cases []db.AMLCase `json:"cases"`
+}
+
+type AMLAccountRes struct {
+	ID            string    `json:"id"`
+	AccountHolder string    `json:"account_holder"`
+	PhoneNumber   string    `json:"phone_number"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// AMLCaseFileRes is the exportable suspicious-activity case file.
+type AMLCaseFileRes struct {
+	Case         db.AMLCase       `json:"case"`
+	Account      AMLAccountRes    `json:"account"`
+	Transactions []db.Transaction `json:"transactions"`
+	GeneratedAt  time.Time        `json:"generated_at"`
+}
+
+type AMLCaseNoteRequest struct {
+	Text string `json:"text"`
+}
+
+type CloseAMLCaseRequest struct {
+	Resolution string `json:"resolution"`
+}
+
+type KYCDetailsRequest struct {
+	FullName    string `json:"full_name"`
+	DateOfBirth string `json:"date_of_birth"`
+	NationalID  string `json:"national_id"`
+}
+
+type KYCStatusRes struct {
+	Profile db.KYCProfile `json:"profile"`
+	Limits  db.KYCLimits  `json:"limits"`
+}
+
+type KYCQueueRes struct {
+	Accounts []KYCQueueEntry `json:"accounts"`
+}
+
+type KYCQueueEntry struct {
+	AccountID     string        `json:"account_id"`
+	AccountHolder string        `json:"account_holder"`
+	PhoneNumber   string        `json:"phone_number"`
+	Profile       db.KYCProfile `json:"profile"`
+}
+
+type RejectKYCRequest struct {
+	Reason string `json:"reason"`
+}
+
+type AuditLogRes struct {
+	Entries []db.AuditEntry `json:"entries"`
+}
+
+type DataRequestsRes struct {
+	Requests []db.DataRequest `json:"requests"`
+}
+
+type ReviewDataRequest struct {
+	Note string `json:"note"`
+}
+
+type BatchRowRequest struct {
+	Recipient string  `json:"recipient"`
+	Amount    float64 `json:"amount"`
+	Memo      string  `json:"memo"`
+}
+
+type BatchRequest struct {
+	Mode string            `json:"mode"`
+	Rows []BatchRowRequest `json:"rows"`
+}
+
+type BatchesRes struct {
+	Batches []db.Batch `json:"batches"`
+}
+
+// ImportAccountRow is one account of an import file. The same field names
+// are used as CSV column names.
+type ImportAccountRow struct {
+	Line        int     `json:"-"`
+	UserName    string  `json:"user_name"`
+	PhoneNumber string  `json:"phone_number"`
+	Balance     float64 `json:"balance"`
+	Password    string  `json:"password"`
+
+	problem string
+}
+
+type ImportAccountResult struct {
+	Line          int    `json:"line"`
+	UserName      string `json:"user_name"`
+	PhoneNumber   string `json:"phone_number"`
+	Status        string `json:"status"`
+	Error         string `json:"error,omitempty"`
+	AccountID     string `json:"account_id,omitempty"`
+	AccountNumber string `json:"account_number,omitempty"`
+}
+
+type ImportAccountsRes struct {
+	DryRun     bool                  `json:"dry_run"`
+	Total      int                   `json:"total"`
+	Created    int                   `json:"created"`
+	Valid      int                   `json:"valid"`
+	Duplicates int                   `json:"duplicates"`
+	Invalid    int                   `json:"invalid"`
+	Failed     int                   `json:"failed"`
+	Rows       []ImportAccountResult `json:"rows"`
+}
+
+type TransferVolumeRes struct {
+	From   time.Time        `json:"from"`
+	To     time.Time        `json:"to"`
+	Count  int64            `json:"count"`
+	Volume float64          `json:"volume"`
+	Fees   float64          `json:"fees"`
+	Days   []db.DailyVolume `json:"days"`
+}
+
+type CounterpartiesRes struct {
+	From           time.Time         `json:"from"`
+	To             time.Time         `json:"to"`
+	Counterparties []db.Counterparty `json:"counterparties"`
+}
+
+type AccountSearchRes struct {
+	Accounts []db.BankAccount `json:"accounts"`
+	Total    int64            `json:"total"`
+	Page     int64            `json:"page"`
+	PageSize int64            `json:"page_size"`
+}
+
+type AccountOverviewRes struct {
+	Account            db.BankAccount   `json:"account"`
+	Balance            float64          `json:"balance"`
+	PocketBalance      float64          `json:"pocket_balance"`
+	Pockets            []db.Pocket      `json:"pockets"`
+	OpenAMLCases       []db.AMLCase     `json:"open_aml_cases"`
+	RecentTransactions []db.Transaction `json:"recent_transactions"`
+}
+
+type CreateAdjustmentRequest struct {
+	Account   string  `json:"account"`
+	Direction string  `json:"direction"`
+	Amount    float64 `json:"amount"`
+	Reason    string  `json:"reason"`
+}
+
+type ReviewAdjustmentRequest struct {
+	Note string `json:"note"`
+}
+
+type AdjustmentsRes struct {
+	Adjustments []db.Adjustment `json:"adjustments"`
+}
+
+type GrantRoleRequest struct {
+	Role string `json:"role"`
+}
+
+type RoleRes struct {
+	AccountID   string   `json:"account_id"`
+	Role        string   `json:"role"`
+	Permissions []string `json:"permissions"`
+}
+
+type RolesRes struct {
+	Roles map[string][]string `json:"roles"`
+}
+
+type RefreshTokenRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// TokenRes is a fresh access token and the refresh token that replaces the
+// one that was used. ExpiresIn is the access token's lifetime in seconds.
+type TokenRes struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+type SessionsRes struct {
+	Sessions         []*db.Session `json:"sessions"`
+	CurrentSessionID string        `json:"current_session_id,omitempty"`
+}
+
+type RevokeSessionsRes struct {
+	AccountID string `json:"account_id"`
+	Revoked   int64  `json:"revoked"`
+}
+
+type TwoFactorCodeRequest struct {
+	Code string `json:"code"`
+}
+
+type TwoFactorLoginRequest struct {
+	Challenge string `json:"challenge"`
+	Code      string `json:"code"`
+}
+
+type TwoFactorStatusRes struct {
+	Enabled           bool       `json:"enabled"`
+	EnabledAt         *time.Time `json:"enabled_at,omitempty"`
+	RecoveryCodesLeft int        `json:"recovery_codes_left"`
+}
+
+// TwoFactorEnrollRes is a new authenticator secret. QRCodePNG is the
+// otpauth URI as a base64 PNG image.
+type TwoFactorEnrollRes struct {
+	Secret     string `json:"secret"`
+	OtpauthURI string `json:"otpauth_uri"`
+	QRCodePNG  []byte `json:"qr_png"`
+}
+
+type RecoveryCodesRes struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+type StepUpRes struct {
+	ValidUntil time.Time `json:"valid_until"`
+}
+
+type ChangePhoneRequest struct {
+	PhoneNumber string `json:"phone_number"`
+}
+
+type SetPINRequest struct {
+	Password string `json:"password"`
+	PIN      string `json:"pin"` // 4 to 6 digits, empty to remove the PIN
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+type PasswordResetRequest struct {
+	PhoneNumber string `json:"phone_number"`
+	Channel     string `json:"channel"` // whatsapp (default) or sms
+}
+
+type ResetPasswordRequest struct {
+	PhoneNumber   string `json:"phone_number"`
+	Code          string `json:"code"`
+	NewPassword   string `json:"new_password"`
+	TwoFactorCode string `json:"two_factor_code,omitempty"` // needed when two-factor is on
+}
+
+type LoginLockoutsRes struct {
+	Lockouts []db.LoginAttempts `json:"lockouts"`
+}
+
+type UnlockLoginRes struct {
+	AccountID string `json:"account_id"`
+	Cleared   int64  `json:"cleared"`
+}
+
+type CreateAPIKeyRequest struct {
+	Name       string     `json:"name"`                  // e.g. "payroll"
+	Account    string     `json:"account"`               // account ID or number the key acts as
+	Scopes     []string   `json:"scopes"`                // accounts:read, transfers:create
+	AllowedIPs []string   `json:"allowed_ips,omitempty"` // IPs or CIDR ranges, empty for any
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+}
+
+// CreateAPIKeyRes holds the only copy of the key; gobank keeps its hash.
+type CreateAPIKeyRes struct {
+	APIKey *db.APIKey `json:"api_key"`
+	Key    string     `json:"key"`
+}
+
+type APIKeysRes struct {
+	Keys []db.APIKey `json:"keys"`
+}
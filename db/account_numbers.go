@@ -0,0 +1,99 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/tamir-liebermann/gobank/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrInvalidAccountRef    = errors.New("not an account ID or account number")
+	ErrInvalidAccountNumber = errors.New("account number is invalid, please check it for typos")
+	ErrAccountNotFound      = errors.New("account not found")
+)
+
+// nextAccountNumber allocates the next serial and returns its account number.
+// Serials are never reused, so an account keeps its number for good.
+func (m *AccManager) nextAccountNumber(ctx context.Context) (string, error) {
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+
+	var counter struct {
+		Seq int64 `bson:"seq"`
+	}
+	err := m.counters.FindOneAndUpdate(ctx, bson.M{"_id": "account_number"}, bson.M{"$inc": bson.M{"seq": 1}}, opts).Decode(&counter)
+	if err != nil {
+		return "", err
+	}
+	return utils.NewAccountNumber(m.bankCode, counter.Seq), nil
+}
+
+// ensureAccountNumbers numbers the accounts created before account numbers
+// existed, oldest first.
+func (m *AccManager) ensureAccountNumbers() error {
+	filter := bson.M{"account_number": bson.M{"$exists": false}}
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}).SetProjection(bson.M{"_id": 1})
+
+	cursor, err := m.accounts.Find(context.TODO(), filter, opts)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(context.TODO())
+
+	for cursor.Next(context.TODO()) {
+		var account BankAccount
+		if err := cursor.Decode(&account); err != nil {
+			return err
+		}
+		number, err := m.nextAccountNumber(context.TODO())
+		if err != nil {
+			return err
+		}
+		// Another instance may have numbered it in the meantime
+		_, err = m.accounts.UpdateOne(context.TODO(),
+			bson.M{"_id": account.ID, "account_number": bson.M{"$exists": false}},
+			bson.M{"$set": bson.M{"account_number": number}})
+		if err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+func (m *AccManager) GetAccountByNumber(number string) (*BankAccount, error) {
+	var account BankAccount
+	err := m.accounts.FindOne(context.TODO(), bson.M{"account_number": utils.NormalizeAccountNumber(number)}).Decode(&account)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrAccountNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
+
+// ResolveAccountRef turns either an account ID or an account number into the
+// account ID. IDs are returned as they are; numbers are checked against their
+// check digits before they are looked up.
+func (m *AccManager) ResolveAccountRef(ref string) (primitive.ObjectID, error) {
+	ref = strings.TrimSpace(ref)
+	if id, err := primitive.ObjectIDFromHex(ref); err == nil {
+		return id, nil
+	}
+	if !utils.LooksLikeAccountNumber(ref) {
+		return primitive.NilObjectID, ErrInvalidAccountRef
+	}
+	if !utils.ValidAccountNumber(ref) {
+		return primitive.NilObjectID, ErrInvalidAccountNumber
+	}
+
+	account, err := m.GetAccountByNumber(ref)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	return account.ID, nil
+}
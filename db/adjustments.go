@@ -0,0 +1,229 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Adjustment directions.
+const (
+	AdjustmentCredit = "credit"
+	AdjustmentDebit  = "debit"
+)
+
+// Adjustment states. Only an approved adjustment has moved money.
+const (
+	AdjustmentPending  = "pending"
+	AdjustmentApproved = "approved"
+	AdjustmentRejected = "rejected"
+)
+
+const maxAdjustmentReasonLength = 500
+
+var (
+	ErrAdjustmentNotFound   = errors.New("adjustment not found")
+	ErrAdjustmentClosed     = errors.New("adjustment was already reviewed")
+	ErrAdjustmentSelfReview = errors.New("an adjustment must be reviewed by a different admin than the one who proposed it")
+	ErrAdjustmentOverdraw   = errors.New("the debit is larger than the account balance")
+)
+
+// Adjustment is a manual credit or debit proposed by one admin. It only
+// posts once a second admin approves it.
+type Adjustment struct {
+	ID            primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	AccountID     primitive.ObjectID `bson:"account_id" json:"account_id"`
+	Direction     string             `bson:"direction" json:"direction"`
+	Amount        float64            `bson:"amount" json:"amount"`
+	Reason        string             `bson:"reason" json:"reason"`
+	Status        string             `bson:"status" json:"status"`
+	RequestedBy   primitive.ObjectID `bson:"requested_by" json:"requested_by"`
+	ReviewedBy    primitive.ObjectID `bson:"reviewed_by,omitempty" json:"reviewed_by,omitempty"`
+	ReviewNote    string             `bson:"review_note,omitempty" json:"review_note,omitempty"`
+	TransactionID primitive.ObjectID `bson:"transaction_id,omitempty" json:"transaction_id,omitempty"`
+	CreatedAt     time.Time          `bson:"created_at" json:"created_at"`
+	ReviewedAt    *time.Time         `bson:"reviewed_at,omitempty" json:"reviewed_at,omitempty"`
+}
+
+func validateAdjustment(adjustment *Adjustment) error {
+	adjustment.Reason = strings.TrimSpace(adjustment.Reason)
+	switch {
+	case adjustment.Direction != AdjustmentCredit && adjustment.Direction != AdjustmentDebit:
+		return errors.New("direction must be credit or debit")
+	case adjustment.Amount <= 0 || math.IsInf(adjustment.Amount, 0) || math.IsNaN(adjustment.Amount):
+		return errors.New("amount must be greater than zero")
+	case roundCents(adjustment.Amount) != adjustment.Amount:
+		return errors.New("amount can have at most two decimals")
+	case adjustment.Reason == "":
+		return errors.New("a reason is required")
+	case len(adjustment.Reason) > maxAdjustmentReasonLength:
+		return errors.New("the reason is too long")
+	}
+	return nil
+}
+
+// CreateAdjustment records a proposed adjustment. Nothing is posted yet.
+func (m *AccManager) CreateAdjustment(adjustment Adjustment) (*Adjustment, error) {
+	if err := validateAdjustment(&adjustment); err != nil {
+		return nil, err
+	}
+
+	account, err := m.SearchAccountById(adjustment.AccountID)
+	if err != nil || account == nil {
+		return nil, ErrAccountNotFound
+	}
+	if account.ErasedAt != nil {
+		return nil, ErrAccountErased
+	}
+
+	adjustment.Status = AdjustmentPending
+	adjustment.CreatedAt = time.Now()
+	result, err := m.adjustments.InsertOne(context.TODO(), adjustment)
+	if err != nil {
+		return nil, err
+	}
+	adjustment.ID = result.InsertedID.(primitive.ObjectID)
+	return &adjustment, nil
+}
+
+func (m *AccManager) GetAdjustmentById(id primitive.ObjectID) (*Adjustment, error) {
+	var adjustment Adjustment
+	err := m.adjustments.FindOne(context.TODO(), bson.M{"_id": id}).Decode(&adjustment)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrAdjustmentNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &adjustment, nil
+}
+
+// GetAdjustments lists adjustments oldest first, optionally only those in
+// one state or on one account.
+func (m *AccManager) GetAdjustments(status string, accountID primitive.ObjectID) ([]Adjustment, error) {
+	filter := bson.M{}
+	if status != "" {
+		filter["status"] = status
+	}
+	if !accountID.IsZero() {
+		filter["account_id"] = accountID
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}})
+
+	cursor, err := m.adjustments.Find(context.TODO(), filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+
+	adjustments := []Adjustment{}
+	if err := cursor.All(context.TODO(), &adjustments); err != nil {
+		return nil, err
+	}
+	return adjustments, nil
+}
+
+// claimAdjustment closes a pending adjustment that the reviewer didn't
+// propose. When nothing matches it works out which of the conditions failed.
+func (m *AccManager) claimAdjustment(ctx context.Context, id, reviewerID primitive.ObjectID, status, note string) (*Adjustment, error) {
+	filter := bson.M{"_id": id, "status": AdjustmentPending, "requested_by": bson.M{"$ne": reviewerID}}
+	update := bson.M{"$set": bson.M{
+		"status":      status,
+		"reviewed_by": reviewerID,
+		"review_note": strings.TrimSpace(note),
+		"reviewed_at": time.Now(),
+	}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var adjustment Adjustment
+	err := m.adjustments.FindOneAndUpdate(ctx, filter, update, opts).Decode(&adjustment)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		existing, findErr := m.GetAdjustmentById(id)
+		switch {
+		case findErr != nil:
+			return nil, findErr
+		case existing.Status != AdjustmentPending:
+			return nil, ErrAdjustmentClosed
+		default:
+			return nil, ErrAdjustmentSelfReview
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	return &adjustment, nil
+}
+
+func (m *AccManager) RejectAdjustment(id, reviewerID primitive.ObjectID, note string) (*Adjustment, error) {
+	return m.claimAdjustment(context.TODO(), id, reviewerID, AdjustmentRejected, note)
+}
+
+// ApproveAdjustment closes the adjustment and posts it in one database
+// transaction, so an adjustment is either still pending or fully booked.
+// A debit that would overdraw the account leaves it pending.
+func (m *AccManager) ApproveAdjustment(id, reviewerID primitive.ObjectID, note string) (*Adjustment, *Transaction, error) {
+	session, err := m.client.StartSession()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer session.EndSession(context.TODO())
+
+	var adjustment *Adjustment
+	var transaction Transaction
+	_, err = session.WithTransaction(context.TODO(), func(sessCtx mongo.SessionContext) (interface{}, error) {
+		var err error
+		adjustment, err = m.claimAdjustment(sessCtx, id, reviewerID, AdjustmentApproved, note)
+		if err != nil {
+			return nil, err
+		}
+
+		transaction = Transaction{
+			Amount:    adjustment.Amount,
+			Timestamp: time.Now(),
+			Type:      TransactionAdjustment,
+			Memo:      adjustment.Reason,
+		}
+		filter := bson.M{"_id": adjustment.AccountID}
+		change := adjustment.Amount
+		if adjustment.Direction == AdjustmentDebit {
+			filter["balance"] = bson.M{"$gte": adjustment.Amount}
+			change = -adjustment.Amount
+			transaction.FromAccount = adjustment.AccountID
+		} else {
+			transaction.ToAccount = adjustment.AccountID
+		}
+
+		result, err := m.accounts.UpdateOne(sessCtx, filter, bson.M{
+			"$inc": bson.M{"balance": change},
+			"$set": bson.M{"updated_at": time.Now()},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if result.MatchedCount == 0 {
+			if adjustment.Direction == AdjustmentDebit {
+				return nil, ErrAdjustmentOverdraw
+			}
+			return nil, ErrAccountNotFound
+		}
+
+		insertResult, err := m.transactions.InsertOne(sessCtx, transaction)
+		if err != nil {
+			return nil, err
+		}
+		transaction.ID = insertResult.InsertedID.(primitive.ObjectID)
+
+		adjustment.TransactionID = transaction.ID
+		_, err = m.adjustments.UpdateOne(sessCtx, bson.M{"_id": adjustment.ID}, bson.M{"$set": bson.M{"transaction_id": transaction.ID}})
+		return nil, err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return adjustment, &transaction, nil
+}
@@ -0,0 +1,398 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// AMLWindow is a rolling window over which cash-in (deposits) and outgoing
+// transfer volumes are added up and compared with their limits.
+type AMLWindow struct {
+	Name          string
+	Duration      time.Duration
+	CashInLimit   float64
+	TransferLimit float64
+}
+
+var AMLWindows = []AMLWindow{
+	{Name: "24h", Duration: 24 * time.Hour, CashInLimit: 10000, TransferLimit: 10000},
+	{Name: "7d", Duration: 7 * 24 * time.Hour, CashInLimit: 25000, TransferLimit: 25000},
+	{Name: "30d", Duration: 30 * 24 * time.Hour, CashInLimit: 50000, TransferLimit: 50000},
+}
+
+// Structuring is several deposits kept just under the reporting threshold:
+// at least AMLStructuringCount deposits between AMLStructuringFloor of the
+// threshold and the threshold itself within AMLStructuringWindow.
+const (
+	AMLReportingThreshold = 10000.0
+	AMLStructuringFloor   = 0.9
+	AMLStructuringCount   = 3
+	AMLStructuringWindow  = 7 * 24 * time.Hour
+)
+
+// Kinds of suspicious activity.
+const (
+	AMLCashInThreshold   = "cash_in_threshold"
+	AMLTransferThreshold = "transfer_threshold"
+	AMLStructuring       = "structuring"
+)
+
+const (
+	AMLCaseOpen   = "open"
+	AMLCaseClosed = "closed"
+)
+
+var (
+	ErrAMLCaseNotFound = errors.New("case not found")
+	ErrAMLCaseClosed   = errors.New("case is already closed")
+)
+
+// AMLVolume is an account's activity over one rolling window.
+type AMLVolume struct {
+	Window        string  `json:"window"`
+	CashIn        float64 `json:"cash_in"`
+	CashInCount   int     `json:"cash_in_count"`
+	Transfers     float64 `json:"transfers"`
+	TransferCount int     `json:"transfer_count"`
+}
+
+type AMLCaseNote struct {
+	AuthorID  primitive.ObjectID `bson:"author_id" json:"author_id"`
+	Text      string             `bson:"text" json:"text"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+}
+
+// AMLCase is a suspicious-activity case. While a case is open, further
+// activity of the same kind and window is added to it rather than opening
+// a new one.
+type AMLCase struct {
+	ID             primitive.ObjectID   `bson:"_id,omitempty" json:"id"`
+	AccountID      primitive.ObjectID   `bson:"account_id" json:"account_id"`
+	Kind           string               `bson:"kind" json:"kind"`
+	Window         string               `bson:"window" json:"window"`
+	Total          float64              `bson:"total" json:"total"`
+	Count          int                  `bson:"count" json:"count"`
+	Limit          float64              `bson:"limit" json:"limit"`
+	TransactionIDs []primitive.ObjectID `bson:"transaction_ids" json:"transaction_ids"`
+	Status         string               `bson:"status" json:"status"`
+	Notes          []AMLCaseNote        `bson:"notes" json:"notes"`
+	Resolution     string               `bson:"resolution,omitempty" json:"resolution,omitempty"`
+	ClosedBy       primitive.ObjectID   `bson:"closed_by,omitempty" json:"closed_by,omitempty"`
+	CreatedAt      time.Time            `bson:"created_at" json:"created_at"`
+	UpdatedAt      time.Time            `bson:"updated_at" json:"updated_at"`
+	ClosedAt       *time.Time           `bson:"closed_at,omitempty" json:"closed_at,omitempty"`
+}
+
+// amlFlag is one finding of ScreenAML before it is filed into a case.
+type amlFlag struct {
+	kind, window   string
+	total, limit   float64
+	transactionIDs []primitive.ObjectID
+}
+
+// recentActivity returns the account's deposits and outgoing transfers over
+// the longest AML window.
+func (m *AccManager) recentActivity(accountID primitive.ObjectID) (deposits, transfers []Transaction, err error) {
+	longest := time.Duration(0)
+	for _, window := range AMLWindows {
+		if window.Duration > longest {
+			longest = window.Duration
+		}
+	}
+	if AMLStructuringWindow > longest {
+		longest = AMLStructuringWindow
+	}
+
+	filter := bson.M{
+		"timestamp": bson.M{"$gte": time.Now().Add(-longest)},
+		"$or": []bson.M{
+			{"to_account": accountID, "type": TransactionDeposit},
+			{"from_account": accountID, "type": bson.M{"$in": []interface{}{TransactionTransfer, nil}}},
+		},
+	}
+	cursor, err := m.transactions.Find(context.TODO(), filter, options.Find().SetSort(bson.D{{Key: "timestamp", Value: 1}}))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer cursor.Close(context.TODO())
+
+	var transactions []Transaction
+	if err := cursor.All(context.TODO(), &transactions); err != nil {
+		return nil, nil, err
+	}
+	for _, transaction := range transactions {
+		if transaction.Type == TransactionDeposit {
+			deposits = append(deposits, transaction)
+		} else {
+			transfers = append(transfers, transaction)
+		}
+	}
+	return deposits, transfers, nil
+}
+
+// reviewedAMLTransactions returns, per kind and window, the transactions
+// already cleared by a closed case. They don't count towards a new case, so
+// closing a case doesn't immediately reopen it for the same activity.
+func (m *AccManager) reviewedAMLTransactions(accountID primitive.ObjectID) (map[string]map[primitive.ObjectID]bool, error) {
+	closed, err := m.GetAMLCases(AMLCaseClosed, accountID)
+	if err != nil {
+		return nil, err
+	}
+
+	reviewed := map[string]map[primitive.ObjectID]bool{}
+	for _, amlCase := range closed {
+		key := amlCase.Kind + "/" + amlCase.Window
+		if reviewed[key] == nil {
+			reviewed[key] = map[primitive.ObjectID]bool{}
+		}
+		for _, id := range amlCase.TransactionIDs {
+			reviewed[key][id] = true
+		}
+	}
+	return reviewed, nil
+}
+
+// unreviewed drops the transactions in reviewed.
+func unreviewed(transactions []Transaction, reviewed map[primitive.ObjectID]bool) []Transaction {
+	if len(reviewed) == 0 {
+		return transactions
+	}
+	var kept []Transaction
+	for _, transaction := range transactions {
+		if !reviewed[transaction.ID] {
+			kept = append(kept, transaction)
+		}
+	}
+	return kept
+}
+
+func sumSince(transactions []Transaction, since time.Time) (float64, []primitive.ObjectID) {
+	var total float64
+	var ids []primitive.ObjectID
+	for _, transaction := range transactions {
+		if transaction.Timestamp.Before(since) {
+			continue
+		}
+		total += transaction.Amount
+		ids = append(ids, transaction.ID)
+	}
+	return total, ids
+}
+
+// GetAMLVolumes returns the account's cumulative cash-in and transfer volume
+// over each rolling window.
+func (m *AccManager) GetAMLVolumes(accountID primitive.ObjectID) ([]AMLVolume, error) {
+	deposits, transfers, err := m.recentActivity(accountID)
+	if err != nil {
+		return nil, err
+	}
+
+	volumes := []AMLVolume{}
+	for _, window := range AMLWindows {
+		since := time.Now().Add(-window.Duration)
+		cashIn, depositIDs := sumSince(deposits, since)
+		sent, transferIDs := sumSince(transfers, since)
+		volumes = append(volumes, AMLVolume{
+			Window:        window.Name,
+			CashIn:        roundCents(cashIn),
+			CashInCount:   len(depositIDs),
+			Transfers:     roundCents(sent),
+			TransferCount: len(transferIDs),
+		})
+	}
+	return volumes, nil
+}
+
+// ScreenAML checks the account's recent activity against the AML limits and
+// files every finding into a case. It returns the cases that were opened or
+// updated.
+func (m *AccManager) ScreenAML(accountID primitive.ObjectID) ([]AMLCase, error) {
+	deposits, transfers, err := m.recentActivity(accountID)
+	if err != nil {
+		return nil, err
+	}
+
+	reviewed, err := m.reviewedAMLTransactions(accountID)
+	if err != nil {
+		return nil, err
+	}
+
+	var flags []amlFlag
+	for _, window := range AMLWindows {
+		since := time.Now().Add(-window.Duration)
+		cashInDeposits := unreviewed(deposits, reviewed[AMLCashInThreshold+"/"+window.Name])
+		if cashIn, ids := sumSince(cashInDeposits, since); cashIn >= window.CashInLimit {
+			flags = append(flags, amlFlag{AMLCashInThreshold, window.Name, cashIn, window.CashInLimit, ids})
+		}
+		sentTransfers := unreviewed(transfers, reviewed[AMLTransferThreshold+"/"+window.Name])
+		if sent, ids := sumSince(sentTransfers, since); sent >= window.TransferLimit {
+			flags = append(flags, amlFlag{AMLTransferThreshold, window.Name, sent, window.TransferLimit, ids})
+		}
+	}
+
+	var nearThreshold []Transaction
+	structuringSince := time.Now().Add(-AMLStructuringWindow)
+	structuringWindow := fmt.Sprintf("%.0fd", AMLStructuringWindow.Hours()/24)
+	for _, deposit := range unreviewed(deposits, reviewed[AMLStructuring+"/"+structuringWindow]) {
+		if !deposit.Timestamp.Before(structuringSince) &&
+			deposit.Amount >= AMLReportingThreshold*AMLStructuringFloor && deposit.Amount < AMLReportingThreshold {
+			nearThreshold = append(nearThreshold, deposit)
+		}
+	}
+	if len(nearThreshold) >= AMLStructuringCount {
+		total, ids := sumSince(nearThreshold, structuringSince)
+		flags = append(flags, amlFlag{AMLStructuring, structuringWindow, total, AMLReportingThreshold, ids})
+	}
+
+	cases := []AMLCase{}
+	for _, flag := range flags {
+		amlCase, err := m.fileAMLCase(accountID, flag)
+		if err != nil {
+			return nil, err
+		}
+		cases = append(cases, *amlCase)
+	}
+	return cases, nil
+}
+
+func (m *AccManager) fileAMLCase(accountID primitive.ObjectID, flag amlFlag) (*AMLCase, error) {
+	filter := bson.M{"account_id": accountID, "kind": flag.kind, "window": flag.window, "status": AMLCaseOpen}
+	update := bson.M{
+		"$set": bson.M{
+			"total":      roundCents(flag.total),
+			"count":      len(flag.transactionIDs),
+			"limit":      flag.limit,
+			"updated_at": time.Now(),
+		},
+		"$addToSet":    bson.M{"transaction_ids": bson.M{"$each": flag.transactionIDs}},
+		"$setOnInsert": bson.M{"notes": []AMLCaseNote{}, "created_at": time.Now()},
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+
+	// There is at most one open case per kind and window. Two screenings
+	// racing to open it both upsert; the loser hits the unique index and
+	// retries, which updates the case the winner opened.
+	var amlCase AMLCase
+	err := m.amlCases.FindOneAndUpdate(context.TODO(), filter, update, opts).Decode(&amlCase)
+	if mongo.IsDuplicateKeyError(err) {
+		err = m.amlCases.FindOneAndUpdate(context.TODO(), filter, update, opts).Decode(&amlCase)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &amlCase, nil
+}
+
+func (m *AccManager) GetAMLCases(status string, accountID primitive.ObjectID) ([]AMLCase, error) {
+	filter := bson.M{}
+	if status != "" {
+		filter["status"] = status
+	}
+	if !accountID.IsZero() {
+		filter["account_id"] = accountID
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "updated_at", Value: -1}})
+
+	cursor, err := m.amlCases.Find(context.TODO(), filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+
+	cases := []AMLCase{}
+	if err := cursor.All(context.TODO(), &cases); err != nil {
+		return nil, err
+	}
+	return cases, nil
+}
+
+func (m *AccManager) GetAMLCaseById(id primitive.ObjectID) (*AMLCase, error) {
+	var amlCase AMLCase
+	err := m.amlCases.FindOne(context.TODO(), bson.M{"_id": id}).Decode(&amlCase)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrAMLCaseNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &amlCase, nil
+}
+
+func (m *AccManager) AddAMLCaseNote(id, authorID primitive.ObjectID, text string) (*AMLCase, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return nil, errors.New("note text is required")
+	}
+
+	note := AMLCaseNote{AuthorID: authorID, Text: text, CreatedAt: time.Now()}
+	update := bson.M{
+		"$push": bson.M{"notes": note},
+		"$set":  bson.M{"updated_at": time.Now()},
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var amlCase AMLCase
+	err := m.amlCases.FindOneAndUpdate(context.TODO(), bson.M{"_id": id}, update, opts).Decode(&amlCase)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrAMLCaseNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &amlCase, nil
+}
+
+func (m *AccManager) CloseAMLCase(id, closedBy primitive.ObjectID, resolution string) (*AMLCase, error) {
+	resolution = strings.TrimSpace(resolution)
+	if resolution == "" {
+		return nil, errors.New("a resolution is required to close a case")
+	}
+
+	now := time.Now()
+	update := bson.M{"$set": bson.M{
+		"status":     AMLCaseClosed,
+		"resolution": resolution,
+		"closed_by":  closedBy,
+		"closed_at":  now,
+		"updated_at": now,
+	}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var amlCase AMLCase
+	err := m.amlCases.FindOneAndUpdate(context.TODO(), bson.M{"_id": id, "status": AMLCaseOpen}, update, opts).Decode(&amlCase)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		if _, findErr := m.GetAMLCaseById(id); findErr != nil {
+			return nil, findErr
+		}
+		return nil, ErrAMLCaseClosed
+	} else if err != nil {
+		return nil, err
+	}
+	return &amlCase, nil
+}
+
+// GetTransactionsByIds loads transactions in timestamp order.
+func (m *AccManager) GetTransactionsByIds(ids []primitive.ObjectID) ([]Transaction, error) {
+	transactions := []Transaction{}
+	if len(ids) == 0 {
+		return transactions, nil
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "timestamp", Value: 1}})
+	cursor, err := m.transactions.Find(context.TODO(), bson.M{"_id": bson.M{"$in": ids}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+
+	if err := cursor.All(context.TODO(), &transactions); err != nil {
+		return nil, err
+	}
+	return transactions, nil
+}
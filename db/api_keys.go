@@ -0,0 +1,246 @@
+package db
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/tamir-liebermann/gobank/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Scopes limit what an API key can do. A key never has more rights than the
+// account it acts as; its scopes narrow them further.
+const (
+	ScopeAccountsRead    = "accounts:read"
+	ScopeTransfersCreate = "transfers:create"
+)
+
+// ScopePermissions maps every scope to the role permissions it lets a key
+// use. Scopes that only cover the key account's own money need none.
+var ScopePermissions = map[string][]string{
+	ScopeAccountsRead:    {PermAccountsRead},
+	ScopeTransfersCreate: {},
+}
+
+// apiKeyPrefix starts every API key, so leaked keys are easy to spot.
+const apiKeyPrefix = "gbk_"
+
+var (
+	ErrAPIKeyNotFound     = errors.New("API key not found")
+	ErrInvalidAPIKey      = errors.New("invalid API key")
+	ErrAPIKeyRevoked      = errors.New("API key has been revoked")
+	ErrAPIKeyExpired      = errors.New("API key has expired")
+	ErrAPIKeyIPNotAllowed = errors.New("API key can't be used from this IP address")
+	ErrUnknownScope       = errors.New("unknown scope")
+	ErrInvalidAllowedIP   = errors.New("allowed IPs must be IP addresses or CIDR ranges")
+)
+
+// APIKey lets a service call gobank as an account without logging in. Only
+// the hash of the key is stored; the key itself is shown once, on creation.
+type APIKey struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Name       string             `bson:"name" json:"name"`
+	AccountID  primitive.ObjectID `bson:"account_id" json:"account_id"`
+	Hash       string             `bson:"hash" json:"-"`
+	Scopes     []string           `bson:"scopes" json:"scopes"`
+	AllowedIPs []string           `bson:"allowed_ips,omitempty" json:"allowed_ips,omitempty"`
+	CreatedBy  primitive.ObjectID `bson:"created_by" json:"created_by"`
+	CreatedAt  time.Time          `bson:"created_at" json:"created_at"`
+	ExpiresAt  *time.Time         `bson:"expires_at,omitempty" json:"expires_at,omitempty"`
+	LastUsedAt *time.Time         `bson:"last_used_at,omitempty" json:"last_used_at,omitempty"`
+	LastUsedIP string             `bson:"last_used_ip,omitempty" json:"last_used_ip,omitempty"`
+	RevokedAt  *time.Time         `bson:"revoked_at,omitempty" json:"revoked_at,omitempty"`
+}
+
+// HasScope reports whether the key was given scope.
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Grants reports whether one of the key's scopes covers permission.
+func (k *APIKey) Grants(permission string) bool {
+	for _, scope := range k.Scopes {
+		for _, granted := range ScopePermissions[scope] {
+			if granted == permission {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// allows reports whether the key may be used from ip. Keys without an
+// allowlist work from anywhere.
+func (k *APIKey) allows(ip string) bool {
+	if len(k.AllowedIPs) == 0 {
+		return true
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, allowed := range k.AllowedIPs {
+		if _, network, err := net.ParseCIDR(allowed); err == nil {
+			if network.Contains(addr) {
+				return true
+			}
+		} else if allowedAddr := net.ParseIP(allowed); allowedAddr != nil && allowedAddr.Equal(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidScope reports whether scope is one of the named scopes.
+func ValidScope(scope string) bool {
+	_, ok := ScopePermissions[scope]
+	return ok
+}
+
+// CreateAPIKey stores a new key acting as accountID and returns it with the
+// key to hand to the service, of the form gbk_<key id>_<secret>.
+func (m *AccManager) CreateAPIKey(name string, accountID primitive.ObjectID, scopes, allowedIPs []string, expiresAt *time.Time, createdBy primitive.ObjectID) (*APIKey, string, error) {
+	for _, scope := range scopes {
+		if !ValidScope(scope) {
+			return nil, "", ErrUnknownScope
+		}
+	}
+	for _, allowed := range allowedIPs {
+		if _, _, err := net.ParseCIDR(allowed); err != nil && net.ParseIP(allowed) == nil {
+			return nil, "", ErrInvalidAllowedIP
+		}
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", err
+	}
+	key := APIKey{
+		ID:         primitive.NewObjectID(),
+		Name:       name,
+		AccountID:  accountID,
+		Scopes:     scopes,
+		AllowedIPs: allowedIPs,
+		CreatedBy:  createdBy,
+		CreatedAt:  time.Now(),
+		ExpiresAt:  expiresAt,
+	}
+	raw := apiKeyPrefix + key.ID.Hex() + "_" + hex.EncodeToString(secret)
+	key.Hash = utils.HashCode(raw)
+
+	if _, err := m.apiKeys.InsertOne(context.TODO(), key); err != nil {
+		return nil, "", err
+	}
+	return &key, raw, nil
+}
+
+// AuthenticateAPIKey finds the key raw belongs to and checks it may be used
+// from ip, recording when and where it was last used.
+func (m *AccManager) AuthenticateAPIKey(raw, ip string) (*APIKey, error) {
+	rest, ok := strings.CutPrefix(raw, apiKeyPrefix)
+	if !ok {
+		return nil, ErrInvalidAPIKey
+	}
+	idHex, _, ok := strings.Cut(rest, "_")
+	if !ok {
+		return nil, ErrInvalidAPIKey
+	}
+	id, err := primitive.ObjectIDFromHex(idHex)
+	if err != nil {
+		return nil, ErrInvalidAPIKey
+	}
+
+	key, err := m.GetAPIKey(id)
+	if errors.Is(err, ErrAPIKeyNotFound) {
+		return nil, ErrInvalidAPIKey
+	} else if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(utils.HashCode(raw)), []byte(key.Hash)) != 1 {
+		return nil, ErrInvalidAPIKey
+	}
+
+	now := time.Now()
+	switch {
+	case key.RevokedAt != nil:
+		return nil, ErrAPIKeyRevoked
+	case key.ExpiresAt != nil && now.After(*key.ExpiresAt):
+		return nil, ErrAPIKeyExpired
+	case !key.allows(ip):
+		return key, ErrAPIKeyIPNotAllowed
+	}
+
+	_, err = m.apiKeys.UpdateOne(context.TODO(),
+		bson.M{"_id": key.ID},
+		bson.M{"$set": bson.M{"last_used_at": now, "last_used_ip": ip}})
+	if err != nil {
+		return nil, err
+	}
+	key.LastUsedAt, key.LastUsedIP = &now, ip
+	return key, nil
+}
+
+func (m *AccManager) GetAPIKey(id primitive.ObjectID) (*APIKey, error) {
+	var key APIKey
+	err := m.apiKeys.FindOne(context.TODO(), bson.M{"_id": id}).Decode(&key)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrAPIKeyNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+// GetAPIKeys lists API keys, newest first. A zero accountID lists every key.
+func (m *AccManager) GetAPIKeys(accountID primitive.ObjectID) ([]APIKey, error) {
+	filter := bson.M{}
+	if !accountID.IsZero() {
+		filter["account_id"] = accountID
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}})
+
+	cursor, err := m.apiKeys.Find(context.TODO(), filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+
+	keys := []APIKey{}
+	if err := cursor.All(context.TODO(), &keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// RevokeAPIKey stops a key from working. Revoked keys are kept so the audit
+// log can still be traced back to them.
+func (m *AccManager) RevokeAPIKey(id primitive.ObjectID) (*APIKey, error) {
+	var key APIKey
+	err := m.apiKeys.FindOneAndUpdate(context.TODO(),
+		bson.M{"_id": id, "revoked_at": nil},
+		bson.M{"$set": bson.M{"revoked_at": time.Now()}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&key)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		if _, err := m.GetAPIKey(id); err != nil {
+			return nil, err
+		}
+		return nil, ErrAPIKeyRevoked
+	} else if err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
@@ -0,0 +1,358 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Batch modes. An all-or-nothing batch runs in one database transaction and
+// either every row goes through or none does; a best-effort batch runs each
+// row on its own and skips the ones that fail.
+const (
+	BatchAllOrNothing = "all_or_nothing"
+	BatchBestEffort   = "best_effort"
+)
+
+// Batch states. A batch is created as a preview and only runs once its owner
+// confirms it.
+const (
+	BatchPreview   = "preview"
+	BatchRunning   = "running"
+	BatchCompleted = "completed"
+	BatchPartial   = "partially_completed"
+	BatchFailed    = "failed"
+	BatchCancelled = "cancelled"
+)
+
+// Batch row states.
+const (
+	BatchRowValid     = "valid"
+	BatchRowInvalid   = "invalid"
+	BatchRowCompleted = "completed"
+	BatchRowFailed    = "failed"
+	BatchRowHeld      = "held"
+	BatchRowSkipped   = "skipped"
+)
+
+// MaxBatchRows caps the size of a single batch.
+const MaxBatchRows = 1000
+
+var (
+	ErrBatchNotFound   = errors.New("batch not found")
+	ErrBatchNotPreview = errors.New("batch is no longer awaiting confirmation")
+	ErrBatchInvalid    = errors.New("an all-or-nothing batch can't run while it has invalid rows")
+)
+
+type BatchRow struct {
+	Line          int                `bson:"line" json:"line"`
+	Recipient     string             `bson:"recipient" json:"recipient"`
+	RecipientID   primitive.ObjectID `bson:"recipient_id,omitempty" json:"recipient_id,omitempty"`
+	RecipientName string             `bson:"recipient_name,omitempty" json:"recipient_name,omitempty"`
+	Amount        float64            `bson:"amount" json:"amount"`
+	Memo          string             `bson:"memo,omitempty" json:"memo,omitempty"`
+	Fee           float64            `bson:"fee" json:"fee"`
+	Status        string             `bson:"status" json:"status"`
+	Error         string             `bson:"error,omitempty" json:"error,omitempty"`
+	TransactionID primitive.ObjectID `bson:"transaction_id,omitempty" json:"transaction_id,omitempty"`
+}
+
+// Batch is a set of transfers from one account, validated up front and run
+// together once confirmed.
+type Batch struct {
+	ID             primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	OwnerID        primitive.ObjectID `bson:"owner_id" json:"owner_id"`
+	Mode           string             `bson:"mode" json:"mode"`
+	Status         string             `bson:"status" json:"status"`
+	IdempotencyKey string             `bson:"idempotency_key,omitempty" json:"idempotency_key,omitempty"`
+	Rows           []BatchRow         `bson:"rows,omitempty" json:"rows,omitempty"`
+	RowCount       int                `bson:"row_count" json:"row_count"`
+	InvalidCount   int                `bson:"invalid_count" json:"invalid_count"`
+	CompletedCount int                `bson:"completed_count" json:"completed_count"`
+	Total          float64            `bson:"total" json:"total"`
+	TotalFees      float64            `bson:"total_fees" json:"total_fees"`
+	Warnings       []string           `bson:"warnings,omitempty" json:"warnings,omitempty"`
+	Error          string             `bson:"error,omitempty" json:"error,omitempty"`
+	CreatedAt      time.Time          `bson:"created_at" json:"created_at"`
+	ConfirmedAt    *time.Time         `bson:"confirmed_at,omitempty" json:"confirmed_at,omitempty"`
+	CompletedAt    *time.Time         `bson:"completed_at,omitempty" json:"completed_at,omitempty"`
+}
+
+// BatchRowKey is the idempotency key of a row's transfer, so a row can never
+// be paid twice however often the batch is retried.
+func BatchRowKey(batchID primitive.ObjectID, line int) string {
+	return fmt.Sprintf("batch:%s:%d", batchID.Hex(), line)
+}
+
+// CreateBatch stores a validated batch as a preview. When the batch carries
+// an idempotency key that the owner already used, the earlier batch is
+// returned instead and created is false.
+func (m *AccManager) CreateBatch(batch Batch) (result *Batch, created bool, err error) {
+	if batch.IdempotencyKey != "" {
+		existing, err := m.getBatchByIdempotencyKey(batch.OwnerID, batch.IdempotencyKey)
+		if err != nil || existing != nil {
+			return existing, false, err
+		}
+	}
+
+	batch.Status = BatchPreview
+	batch.RowCount = len(batch.Rows)
+	batch.InvalidCount, batch.Total, batch.TotalFees = 0, 0, 0
+	for _, row := range batch.Rows {
+		if row.Status == BatchRowInvalid {
+			batch.InvalidCount++
+			continue
+		}
+		batch.Total = roundCents(batch.Total + row.Amount)
+		batch.TotalFees = roundCents(batch.TotalFees + row.Fee)
+	}
+	batch.CreatedAt = time.Now()
+
+	insertResult, err := m.batches.InsertOne(context.TODO(), batch)
+	if mongo.IsDuplicateKeyError(err) && batch.IdempotencyKey != "" {
+		// Lost a race with the same upload
+		existing, err := m.getBatchByIdempotencyKey(batch.OwnerID, batch.IdempotencyKey)
+		return existing, false, err
+	} else if err != nil {
+		return nil, false, err
+	}
+	batch.ID = insertResult.InsertedID.(primitive.ObjectID)
+	return &batch, true, nil
+}
+
+func (m *AccManager) getBatchByIdempotencyKey(ownerID primitive.ObjectID, key string) (*Batch, error) {
+	var batch Batch
+	err := m.batches.FindOne(context.TODO(), bson.M{"owner_id": ownerID, "idempotency_key": key}).Decode(&batch)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &batch, nil
+}
+
+func (m *AccManager) GetBatchById(ownerID, batchID primitive.ObjectID) (*Batch, error) {
+	var batch Batch
+	err := m.batches.FindOne(context.TODO(), bson.M{"_id": batchID, "owner_id": ownerID}).Decode(&batch)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrBatchNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &batch, nil
+}
+
+// GetBatches lists the owner's batches, newest first, without their rows.
+func (m *AccManager) GetBatches(ownerID primitive.ObjectID) ([]Batch, error) {
+	opts := options.Find().
+		SetSort(bson.D{{Key: "created_at", Value: -1}}).
+		SetProjection(bson.M{"rows": 0})
+
+	cursor, err := m.batches.Find(context.TODO(), bson.M{"owner_id": ownerID}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+
+	batches := []Batch{}
+	if err := cursor.All(context.TODO(), &batches); err != nil {
+		return nil, err
+	}
+	return batches, nil
+}
+
+// setBatchStatus moves a batch out of preview. Only one caller can win, so a
+// double-clicked confirm runs the batch once.
+func (m *AccManager) setBatchStatus(ownerID, batchID primitive.ObjectID, status string, set bson.M) (*Batch, error) {
+	set["status"] = status
+	filter := bson.M{"_id": batchID, "owner_id": ownerID, "status": BatchPreview}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var batch Batch
+	err := m.batches.FindOneAndUpdate(context.TODO(), filter, bson.M{"$set": set}, opts).Decode(&batch)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		if _, findErr := m.GetBatchById(ownerID, batchID); findErr != nil {
+			return nil, findErr
+		}
+		return nil, ErrBatchNotPreview
+	} else if err != nil {
+		return nil, err
+	}
+	return &batch, nil
+}
+
+// ConfirmBatch claims a previewed batch for running.
+func (m *AccManager) ConfirmBatch(ownerID, batchID primitive.ObjectID) (*Batch, error) {
+	batch, err := m.GetBatchById(ownerID, batchID)
+	if err != nil {
+		return nil, err
+	}
+	if batch.Status == BatchPreview && batch.Mode == BatchAllOrNothing && batch.InvalidCount > 0 {
+		return nil, ErrBatchInvalid
+	}
+	return m.setBatchStatus(ownerID, batchID, BatchRunning, bson.M{"confirmed_at": time.Now()})
+}
+
+func (m *AccManager) CancelBatch(ownerID, batchID primitive.ObjectID) (*Batch, error) {
+	return m.setBatchStatus(ownerID, batchID, BatchCancelled, bson.M{"completed_at": time.Now()})
+}
+
+// UpdateBatchRow saves the outcome of one row while a best-effort batch runs.
+func (m *AccManager) UpdateBatchRow(batchID primitive.ObjectID, index int, row BatchRow) error {
+	_, err := m.batches.UpdateOne(context.TODO(), bson.M{"_id": batchID},
+		bson.M{"$set": bson.M{fmt.Sprintf("rows.%d", index): row}})
+	return err
+}
+
+// countBatchOutcome works out the batch's completed count and final state
+// from its rows.
+func countBatchOutcome(batch *Batch) {
+	batch.CompletedCount = 0
+	for _, row := range batch.Rows {
+		if row.Status == BatchRowCompleted {
+			batch.CompletedCount++
+		}
+	}
+
+	switch {
+	case batch.CompletedCount == batch.RowCount:
+		batch.Status = BatchCompleted
+	case batch.CompletedCount == 0:
+		batch.Status = BatchFailed
+	default:
+		batch.Status = BatchPartial
+	}
+}
+
+// FinishBatch stores the final rows and works out the batch's final state.
+func (m *AccManager) FinishBatch(batch *Batch, batchErr error) error {
+	now := time.Now()
+	countBatchOutcome(batch)
+	if batchErr != nil {
+		batch.Error = batchErr.Error()
+	}
+	batch.CompletedAt = &now
+
+	_, err := m.batches.UpdateOne(context.TODO(), bson.M{"_id": batch.ID}, bson.M{"$set": bson.M{
+		"rows":            batch.Rows,
+		"status":          batch.Status,
+		"completed_count": batch.CompletedCount,
+		"error":           batch.Error,
+		"completed_at":    now,
+	}})
+	return err
+}
+
+// settleHeldBatchRow records the review of a held batch row: completed with
+// the transaction when the transfer went through, failed with why otherwise.
+// A finished batch then gets its state worked out again, so its report shows
+// the outcome.
+func (m *AccManager) settleHeldBatchRow(held *HeldTransfer, transaction *Transaction, failure string) error {
+	if held.BatchID.IsZero() {
+		return nil
+	}
+
+	set := bson.M{"rows.$.status": BatchRowFailed, "rows.$.error": failure}
+	if transaction != nil {
+		set = bson.M{
+			"rows.$.status":         BatchRowCompleted,
+			"rows.$.error":          "",
+			"rows.$.fee":            transaction.Fee,
+			"rows.$.transaction_id": transaction.ID,
+		}
+	}
+	filter := bson.M{"_id": held.BatchID, "rows": bson.M{"$elemMatch": bson.M{"line": held.BatchLine, "status": BatchRowHeld}}}
+	result, err := m.batches.UpdateOne(context.TODO(), filter, bson.M{"$set": set})
+	if err != nil || result.MatchedCount == 0 {
+		return err
+	}
+
+	var batch Batch
+	if err := m.batches.FindOne(context.TODO(), bson.M{"_id": held.BatchID}).Decode(&batch); err != nil {
+		return err
+	}
+	// A batch still running is worked out by FinishBatch
+	if batch.Status == BatchRunning {
+		return nil
+	}
+	countBatchOutcome(&batch)
+	_, err = m.batches.UpdateOne(context.TODO(), bson.M{"_id": batch.ID}, bson.M{"$set": bson.M{
+		"status":          batch.Status,
+		"completed_count": batch.CompletedCount,
+	}})
+	return err
+}
+
+// BatchTransfer is one transfer of an all-or-nothing batch.
+type BatchTransfer struct {
+	To     primitive.ObjectID
+	Amount float64
+	Opts   TransferOptions
+}
+
+// BatchRowError says which transfer stopped an all-or-nothing batch.
+type BatchRowError struct {
+	Index int
+	Err   error
+}
+
+func (e *BatchRowError) Error() string {
+	return fmt.Sprintf("row %d: %v", e.Index+1, e.Err)
+}
+
+func (e *BatchRowError) Unwrap() error {
+	return e.Err
+}
+
+// TransferBatch makes every transfer in one database transaction. If any of
+// them fails, including being stopped by fraud screening, nothing moves.
+func (m *AccManager) TransferBatch(fromAccountID primitive.ObjectID, transfers []BatchTransfer) ([]*Transaction, error) {
+	session, err := m.client.StartSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.EndSession(context.TODO())
+
+	result, err := session.WithTransaction(context.TODO(), func(sessCtx mongo.SessionContext) (interface{}, error) {
+		transactions := make([]*Transaction, 0, len(transfers))
+		for i, transfer := range transfers {
+			transaction, err := m.transferInSession(sessCtx, fromAccountID, transfer.To, transfer.Amount, transfer.Opts)
+			var screened *screeningResult
+			if errors.As(err, &screened) {
+				return nil, &BatchRowError{Index: i, Err: fmt.Errorf("stopped by fraud screening: %s", strings.Join(screened.reasons, "; "))}
+			} else if err != nil {
+				return nil, &BatchRowError{Index: i, Err: err}
+			}
+			transactions = append(transactions, transaction)
+		}
+		return transactions, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.([]*Transaction), nil
+}
+
+// GetTransactionByIdempotencyKey returns the transaction made under the key,
+// or nil if there is none.
+func (m *AccManager) GetTransactionByIdempotencyKey(key string) (*Transaction, error) {
+	return m.getTransactionByIdempotencyKey(context.TODO(), key)
+}
+
+func (m *AccManager) getTransactionByIdempotencyKey(ctx context.Context, key string) (*Transaction, error) {
+	var transaction Transaction
+	err := m.transactions.FindOne(ctx, bson.M{"idempotency_key": key}).Decode(&transaction)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &transaction, nil
+}
@@ -0,0 +1,215 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrBudgetNotFound = errors.New("budget not found")
+
+// DefaultBudgetThresholds are the percentages of a budget at which an alert
+// is sent when the budget doesn't configure its own.
+var DefaultBudgetThresholds = []float64{80, 100}
+
+// Budget is a monthly spending limit for one category or one counterparty.
+// AlertedMonth and AlertedThresholds remember which alerts already went out
+// so each threshold is only reported once a month.
+type Budget struct {
+	ID                primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	AccountID         primitive.ObjectID `bson:"account_id" json:"account_id"`
+	Name              string             `bson:"name" json:"name"`
+	Category          string             `bson:"category,omitempty" json:"category,omitempty"`
+	Counterparty      primitive.ObjectID `bson:"counterparty,omitempty" json:"counterparty,omitempty"`
+	MonthlyLimit      float64            `bson:"monthly_limit" json:"monthly_limit"`
+	Thresholds        []float64          `bson:"thresholds" json:"thresholds"`
+	AlertedMonth      string             `bson:"alerted_month,omitempty" json:"-"`
+	AlertedThresholds []float64          `bson:"alerted_thresholds,omitempty" json:"-"`
+	CreatedAt         time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt         time.Time          `bson:"updated_at" json:"updated_at"`
+}
+
+// NormalizeCategory is how categories are compared and stored.
+func NormalizeCategory(category string) string {
+	return strings.ToLower(strings.TrimSpace(category))
+}
+
+// Matches reports whether an outgoing transaction counts towards the budget.
+func (b *Budget) Matches(transaction *Transaction) bool {
+	if !b.Counterparty.IsZero() {
+		return transaction.ToAccount == b.Counterparty
+	}
+	return b.Category != "" && transaction.Category == b.Category
+}
+
+func validateBudget(budget *Budget) error {
+	budget.Name = strings.TrimSpace(budget.Name)
+	budget.Category = NormalizeCategory(budget.Category)
+
+	if budget.MonthlyLimit <= 0 {
+		return errors.New("monthly limit must be greater than zero")
+	}
+	if budget.Category == "" && budget.Counterparty.IsZero() {
+		return errors.New("a budget needs a category or a counterparty")
+	}
+	if budget.Category != "" && !budget.Counterparty.IsZero() {
+		return errors.New("a budget can have a category or a counterparty, not both")
+	}
+	if len(budget.Thresholds) == 0 {
+		budget.Thresholds = DefaultBudgetThresholds
+	}
+	for _, threshold := range budget.Thresholds {
+		if threshold <= 0 {
+			return errors.New("thresholds must be positive percentages")
+		}
+	}
+	sort.Float64s(budget.Thresholds)
+
+	if budget.Name == "" {
+		budget.Name = budget.Category
+	}
+	return nil
+}
+
+func (m *AccManager) CreateBudget(budget Budget) (*Budget, error) {
+	if err := validateBudget(&budget); err != nil {
+		return nil, err
+	}
+	budget.ID = primitive.NilObjectID
+	budget.CreatedAt = time.Now()
+	budget.UpdatedAt = time.Now()
+
+	insertResult, err := m.budgets.InsertOne(context.TODO(), budget)
+	if err != nil {
+		return nil, err
+	}
+	budget.ID = insertResult.InsertedID.(primitive.ObjectID)
+	return &budget, nil
+}
+
+func (m *AccManager) UpdateBudget(budget Budget) (*Budget, error) {
+	if err := validateBudget(&budget); err != nil {
+		return nil, err
+	}
+
+	update := bson.M{"$set": bson.M{
+		"name":          budget.Name,
+		"category":      budget.Category,
+		"counterparty":  budget.Counterparty,
+		"monthly_limit": budget.MonthlyLimit,
+		"thresholds":    budget.Thresholds,
+		"updated_at":    time.Now(),
+	}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var updated Budget
+	err := m.budgets.FindOneAndUpdate(context.TODO(), bson.M{"_id": budget.ID, "account_id": budget.AccountID}, update, opts).Decode(&updated)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrBudgetNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
+
+func (m *AccManager) GetBudgets(accountID primitive.ObjectID) ([]Budget, error) {
+	cursor, err := m.budgets.Find(context.TODO(), bson.M{"account_id": accountID})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+
+	budgets := []Budget{}
+	if err := cursor.All(context.TODO(), &budgets); err != nil {
+		return nil, err
+	}
+	return budgets, nil
+}
+
+func (m *AccManager) DeleteBudget(accountID, budgetID primitive.ObjectID) error {
+	deleteResult, err := m.budgets.DeleteOne(context.TODO(), bson.M{"_id": budgetID, "account_id": accountID})
+	if err != nil {
+		return err
+	}
+	if deleteResult.DeletedCount == 0 {
+		return ErrBudgetNotFound
+	}
+	return nil
+}
+
+// BudgetMonth returns the key and the start of the calendar month containing t.
+func BudgetMonth(t time.Time) (string, time.Time) {
+	t = t.UTC()
+	start := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return start.Format("2006-01"), start
+}
+
+// GetBudgetSpending sums the account's outgoing transfers counted by the
+// budget since the start of the current month.
+func (m *AccManager) GetBudgetSpending(budget *Budget) (float64, error) {
+	_, monthStart := BudgetMonth(time.Now())
+
+	match := bson.M{
+		"from_account": budget.AccountID,
+		"timestamp":    bson.M{"$gte": monthStart},
+		"type":         bson.M{"$in": []interface{}{TransactionTransfer, nil}},
+	}
+	if !budget.Counterparty.IsZero() {
+		match["to_account"] = budget.Counterparty
+	} else {
+		match["category"] = budget.Category
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$group", Value: bson.M{"_id": nil, "total": bson.M{"$sum": "$amount"}}}},
+	}
+	cursor, err := m.transactions.Aggregate(context.TODO(), pipeline)
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(context.TODO())
+
+	var result []struct {
+		Total float64 `bson:"total"`
+	}
+	if err := cursor.All(context.TODO(), &result); err != nil {
+		return 0, err
+	}
+	if len(result) == 0 {
+		return 0, nil
+	}
+	return result[0].Total, nil
+}
+
+// MarkBudgetAlert records that the alert for threshold was sent this month.
+// It returns false if it had already been sent, which makes it safe to call
+// from concurrent transfers: only one of them gets to send the alert.
+func (m *AccManager) MarkBudgetAlert(budgetID primitive.ObjectID, threshold float64) (bool, error) {
+	month, _ := BudgetMonth(time.Now())
+
+	// Start the month with a clean slate
+	_, err := m.budgets.UpdateOne(context.TODO(),
+		bson.M{"_id": budgetID, "alerted_month": bson.M{"$ne": month}},
+		bson.M{"$set": bson.M{"alerted_month": month, "alerted_thresholds": []float64{}}},
+	)
+	if err != nil {
+		return false, err
+	}
+
+	result, err := m.budgets.UpdateOne(context.TODO(),
+		bson.M{"_id": budgetID, "alerted_month": month, "alerted_thresholds": bson.M{"$ne": threshold}},
+		bson.M{"$push": bson.M{"alerted_thresholds": threshold}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount == 1, nil
+}
@@ -0,0 +1,331 @@
+package db
+
+import (
+	"context"
+	"regexp"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Account states as the dashboard reports them.
+const (
+	AccountStatusActive = "active"
+	AccountStatusErased = "erased"
+)
+
+const (
+	DefaultAccountPageSize = 50
+	MaxAccountPageSize     = 200
+)
+
+// AccountStats counts accounts and sums the money the bank holds for its
+// customers. The revenue account is counted under its role but its balance
+// is not a customer deposit.
+type AccountStats struct {
+	Total            int64            `json:"total"`
+	ByRole           map[string]int64 `json:"by_role"`
+	ByStatus         map[string]int64 `json:"by_status"`
+	ByKYCStatus      map[string]int64 `json:"by_kyc_status"`
+	CustomerBalances float64          `json:"customer_balances"`
+	PocketBalances   float64          `json:"pocket_balances"`
+	TotalDeposits    float64          `json:"total_deposits"`
+	GeneratedAt      time.Time        `json:"generated_at"`
+}
+
+type DailyVolume struct {
+	Day    string  `bson:"_id" json:"day"`
+	Count  int64   `bson:"count" json:"count"`
+	Volume float64 `bson:"volume" json:"volume"`
+	Fees   float64 `bson:"fees" json:"fees"`
+}
+
+// Counterparty is an account ranked by how much it sent and received in
+// transfers.
+type Counterparty struct {
+	AccountID     primitive.ObjectID `bson:"_id" json:"account_id"`
+	AccountHolder string             `bson:"account_holder" json:"account_holder"`
+	AccountNumber string             `bson:"account_number" json:"account_number"`
+	Count         int64              `bson:"count" json:"count"`
+	Sent          float64            `bson:"sent" json:"sent"`
+	Received      float64            `bson:"received" json:"received"`
+	Volume        float64            `bson:"volume" json:"volume"`
+}
+
+// AccountSearch filters the admin account search. Zero values don't filter.
+type AccountSearch struct {
+	Name        string
+	Phone       string
+	Role        string
+	Status      string
+	MinBalance  *float64
+	MaxBalance  *float64
+	CreatedFrom time.Time
+	CreatedTo   time.Time
+	Page        int64
+	PageSize    int64
+}
+
+type groupCount struct {
+	ID    string `bson:"_id"`
+	Count int64  `bson:"count"`
+}
+
+func countsByKey(groups []groupCount) map[string]int64 {
+	counts := map[string]int64{}
+	for _, group := range groups {
+		key := group.ID
+		if key == "" {
+			key = "none"
+		}
+		counts[key] += group.Count
+	}
+	return counts
+}
+
+// transferFilter matches transfers between customers in [from, to). Transfers
+// recorded before transactions had a type have none.
+func transferFilter(from, to time.Time) bson.M {
+	return bson.M{
+		"type":      bson.M{"$in": []interface{}{TransactionTransfer, nil}},
+		"timestamp": bson.M{"$gte": from, "$lt": to},
+	}
+}
+
+func (m *AccManager) GetAccountStats() (*AccountStats, error) {
+	erased := bson.M{"$cond": bson.A{bson.M{"$gt": bson.A{"$erased_at", nil}}, AccountStatusErased, AccountStatusActive}}
+	pipeline := mongo.Pipeline{
+		{{Key: "$facet", Value: bson.M{
+			"by_role":   bson.A{bson.M{"$group": bson.M{"_id": "$role", "count": bson.M{"$sum": 1}}}},
+			"by_status": bson.A{bson.M{"$group": bson.M{"_id": erased, "count": bson.M{"$sum": 1}}}},
+			"by_kyc":    bson.A{bson.M{"$group": bson.M{"_id": "$kyc.status", "count": bson.M{"$sum": 1}}}},
+			"balances": bson.A{
+				bson.M{"$match": bson.M{"role": bson.M{"$ne": RoleBank}}},
+				bson.M{"$group": bson.M{"_id": nil, "total": bson.M{"$sum": "$balance"}}},
+			},
+		}}},
+	}
+
+	cursor, err := m.accounts.Aggregate(context.TODO(), pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+
+	var facets []struct {
+		ByRole   []groupCount `bson:"by_role"`
+		ByStatus []groupCount `bson:"by_status"`
+		ByKYC    []groupCount `bson:"by_kyc"`
+		Balances []struct {
+			Total float64 `bson:"total"`
+		} `bson:"balances"`
+	}
+	if err := cursor.All(context.TODO(), &facets); err != nil {
+		return nil, err
+	}
+
+	stats := &AccountStats{GeneratedAt: time.Now()}
+	if len(facets) > 0 {
+		stats.ByRole = countsByKey(facets[0].ByRole)
+		stats.ByStatus = countsByKey(facets[0].ByStatus)
+		stats.ByKYCStatus = countsByKey(facets[0].ByKYC)
+		if len(facets[0].Balances) > 0 {
+			stats.CustomerBalances = roundCents(facets[0].Balances[0].Total)
+		}
+	}
+	for _, count := range stats.ByRole {
+		stats.Total += count
+	}
+
+	pockets, err := m.pockets.Aggregate(context.TODO(), mongo.Pipeline{
+		{{Key: "$group", Value: bson.M{"_id": nil, "total": bson.M{"$sum": "$balance"}}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer pockets.Close(context.TODO())
+
+	var pocketTotals []struct {
+		Total float64 `bson:"total"`
+	}
+	if err := pockets.All(context.TODO(), &pocketTotals); err != nil {
+		return nil, err
+	}
+	if len(pocketTotals) > 0 {
+		stats.PocketBalances = roundCents(pocketTotals[0].Total)
+	}
+	stats.TotalDeposits = roundCents(stats.CustomerBalances + stats.PocketBalances)
+	return stats, nil
+}
+
+// GetTransferVolumeByDay sums transfers per UTC day in [from, to). Days
+// without transfers are left out.
+func (m *AccManager) GetTransferVolumeByDay(from, to time.Time) ([]DailyVolume, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: transferFilter(from, to)}},
+		{{Key: "$group", Value: bson.M{
+			"_id":    bson.M{"$dateToString": bson.M{"format": "%Y-%m-%d", "date": "$timestamp"}},
+			"count":  bson.M{"$sum": 1},
+			"volume": bson.M{"$sum": "$amount"},
+			"fees":   bson.M{"$sum": "$fee"},
+		}}},
+		{{Key: "$sort", Value: bson.M{"_id": 1}}},
+	}
+
+	cursor, err := m.transactions.Aggregate(context.TODO(), pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+
+	days := []DailyVolume{}
+	if err := cursor.All(context.TODO(), &days); err != nil {
+		return nil, err
+	}
+	for i := range days {
+		days[i].Volume = roundCents(days[i].Volume)
+		days[i].Fees = roundCents(days[i].Fees)
+	}
+	return days, nil
+}
+
+// GetTopCounterparties ranks accounts by transfer volume in [from, to),
+// counting both sides of every transfer.
+func (m *AccManager) GetTopCounterparties(from, to time.Time, limit int64) ([]Counterparty, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: transferFilter(from, to)}},
+		{{Key: "$project", Value: bson.M{"parties": bson.A{
+			bson.M{"account": "$from_account", "sent": "$amount", "received": 0},
+			bson.M{"account": "$to_account", "sent": 0, "received": "$amount"},
+		}}}},
+		{{Key: "$unwind", Value: "$parties"}},
+		{{Key: "$group", Value: bson.M{
+			"_id":      "$parties.account",
+			"count":    bson.M{"$sum": 1},
+			"sent":     bson.M{"$sum": "$parties.sent"},
+			"received": bson.M{"$sum": "$parties.received"},
+		}}},
+		{{Key: "$addFields", Value: bson.M{"volume": bson.M{"$add": bson.A{"$sent", "$received"}}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "volume", Value: -1}, {Key: "_id", Value: 1}}}},
+		{{Key: "$limit", Value: limit}},
+		{{Key: "$lookup", Value: bson.M{"from": m.accounts.Name(), "localField": "_id", "foreignField": "_id", "as": "account"}}},
+		{{Key: "$addFields", Value: bson.M{
+			"account_holder": bson.M{"$arrayElemAt": bson.A{"$account.account_holder", 0}},
+			"account_number": bson.M{"$arrayElemAt": bson.A{"$account.account_number", 0}},
+		}}},
+		{{Key: "$project", Value: bson.M{"account": 0}}},
+	}
+
+	cursor, err := m.transactions.Aggregate(context.TODO(), pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+
+	counterparties := []Counterparty{}
+	if err := cursor.All(context.TODO(), &counterparties); err != nil {
+		return nil, err
+	}
+	for i := range counterparties {
+		counterparties[i].Sent = roundCents(counterparties[i].Sent)
+		counterparties[i].Received = roundCents(counterparties[i].Received)
+		counterparties[i].Volume = roundCents(counterparties[i].Volume)
+	}
+	return counterparties, nil
+}
+
+// SearchAccounts returns one page of matching accounts, newest first, and
+// the number of matches over all pages.
+func (m *AccManager) SearchAccounts(search AccountSearch) ([]BankAccount, int64, error) {
+	filter := bson.M{}
+	if search.Name != "" {
+		filter["account_holder"] = bson.M{"$regex": regexp.QuoteMeta(search.Name), "$options": "i"}
+	}
+	if search.Phone != "" {
+		filter["phone_number"] = bson.M{"$regex": regexp.QuoteMeta(search.Phone)}
+	}
+	if search.Role != "" {
+		filter["role"] = search.Role
+	}
+	switch search.Status {
+	case AccountStatusActive:
+		filter["erased_at"] = bson.M{"$exists": false}
+	case AccountStatusErased:
+		filter["erased_at"] = bson.M{"$exists": true}
+	}
+	balance := bson.M{}
+	if search.MinBalance != nil {
+		balance["$gte"] = *search.MinBalance
+	}
+	if search.MaxBalance != nil {
+		balance["$lte"] = *search.MaxBalance
+	}
+	if len(balance) > 0 {
+		filter["balance"] = balance
+	}
+	created := bson.M{}
+	if !search.CreatedFrom.IsZero() {
+		created["$gte"] = search.CreatedFrom
+	}
+	if !search.CreatedTo.IsZero() {
+		created["$lt"] = search.CreatedTo
+	}
+	if len(created) > 0 {
+		filter["created_at"] = created
+	}
+
+	pageSize := search.PageSize
+	if pageSize <= 0 {
+		pageSize = DefaultAccountPageSize
+	} else if pageSize > MaxAccountPageSize {
+		pageSize = MaxAccountPageSize
+	}
+	page := search.Page
+	if page < 1 {
+		page = 1
+	}
+
+	total, err := m.accounts.CountDocuments(context.TODO(), filter)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}).
+		SetSkip((page - 1) * pageSize).
+		SetLimit(pageSize).
+		SetProjection(bson.M{"password": 0})
+	cursor, err := m.accounts.Find(context.TODO(), filter, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer cursor.Close(context.TODO())
+
+	accounts := []BankAccount{}
+	if err := cursor.All(context.TODO(), &accounts); err != nil {
+		return nil, 0, err
+	}
+	return accounts, total, nil
+}
+
+// GetRecentTransactions returns the account's latest transactions in either
+// direction, newest first.
+func (m *AccManager) GetRecentTransactions(accountID primitive.ObjectID, limit int64) ([]Transaction, error) {
+	filter := bson.M{"$or": []bson.M{{"from_account": accountID}, {"to_account": accountID}}}
+	opts := options.Find().SetSort(bson.D{{Key: "timestamp", Value: -1}}).SetLimit(limit)
+
+	cursor, err := m.transactions.Find(context.TODO(), filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+
+	transactions := []Transaction{}
+	if err := cursor.All(context.TODO(), &transactions); err != nil {
+		return nil, err
+	}
+	return transactions, nil
+}
@@ -21,32 +21,93 @@ import (
 // swagger:model
 type BankAccount struct {
 	ID            primitive.ObjectID `bson:"_id,omitempty"`
+	AccountNumber string             `bson:"account_number,omitempty"`
 	AccountHolder string             `bson:"account_holder"`
 	Balance       float64            `bson:"balance"`
 	CreatedAt     time.Time          `bson:"created_at"`
 	UpdatedAt     time.Time          `bson:"updated_at"`
-	Password      string             `bson:"password"`
+	Password      string             `bson:"password" json:"-"`
 	PhoneNumber   string             `bson:"phone_number"`
-	Role		  string			 `bson:"role"`
+	Role          string             `bson:"role"`
+
+	MaintenanceMonth string `bson:"maintenance_month,omitempty" json:"-"`
+	// KYC holds identity documents; it is only served by the KYC endpoints
+	KYC       KYCProfile `bson:"kyc" json:"-"`
+	TwoFactor TwoFactor  `bson:"two_factor,omitempty" json:"-"`
+
+	TransactionPIN     string     `bson:"transaction_pin,omitempty" json:"-"`
+	ConfirmLockedUntil *time.Time `bson:"confirm_locked_until,omitempty" json:"-"`
+	ConfirmFailures    int        `bson:"confirm_failures,omitempty" json:"-"`
+
+	MustChangePassword bool           `bson:"must_change_password,omitempty" json:"must_change_password,omitempty"`
+	PasswordChangedAt  *time.Time     `bson:"password_changed_at,omitempty" json:"-"`
+	PasswordReset      *PasswordReset `bson:"password_reset,omitempty" json:"-"`
+	ErasedAt           *time.Time     `bson:"erased_at,omitempty" json:"erased_at,omitempty"`
 }
 
+// Transaction types. Transactions recorded before types existed have an
+// empty Type and are plain transfers.
+const (
+	TransactionTransfer  = "transfer"
+	TransactionPocketIn  = "pocket_in"
+	TransactionPocketOut = "pocket_out"
+	TransactionDeposit   = "deposit"
+	TransactionFee       = "fee"
+
+	TransactionOpeningBalance = "opening_balance"
+	TransactionAdjustment     = "adjustment"
+)
+
 type Transaction struct {
 	ID          primitive.ObjectID `bson:"_id,omitempty" json:"id"`
 	FromAccount primitive.ObjectID `bson:"from_account" json:"from_account"`
 	ToAccount   primitive.ObjectID `bson:"to_account" json:"to_account"`
 	Amount      float64            `bson:"amount" json:"amount"`
 	Timestamp   time.Time          `bson:"timestamp" json:"timestamp"`
+	Type        string             `bson:"type,omitempty" json:"type,omitempty"`
+	PocketID    primitive.ObjectID `bson:"pocket_id,omitempty" json:"pocket_id,omitempty"`
+	Category    string             `bson:"category,omitempty" json:"category,omitempty"`
+	Fee         float64            `bson:"fee,omitempty" json:"fee,omitempty"`
+	Memo        string             `bson:"memo,omitempty" json:"memo,omitempty"`
+
+	IdempotencyKey string `bson:"idempotency_key,omitempty" json:"-"`
 }
 
 type AccManager struct {
 	client       *mongo.Client
 	transactions *mongo.Collection
 	accounts     *mongo.Collection
+	payees       *mongo.Collection
+
+	moneyRequests *mongo.Collection
+	splits        *mongo.Collection
+	pockets       *mongo.Collection
+	budgets       *mongo.Collection
+
+	feeRules       *mongo.Collection
+	pendingActions *mongo.Collection
+	fraudRules     *mongo.Collection
+	heldTransfers  *mongo.Collection
+	amlCases       *mongo.Collection
+	auditLog       *mongo.Collection
+	chatMessages   *mongo.Collection
+	dataRequests   *mongo.Collection
+	counters       *mongo.Collection
+	batches        *mongo.Collection
+	adjustments    *mongo.Collection
+	sessions       *mongo.Collection
+	revokedTokens  *mongo.Collection
+	loginAttempts  *mongo.Collection
+	apiKeys        *mongo.Collection
+
+	bankCode         string
+	revenueAccountID primitive.ObjectID
+	auditMu          sync.Mutex
 }
 
 func InitDB() (*AccManager, error) {
 	spec := env.New()
-	mgr, err := NewManager(spec.MongoSecret)
+	mgr, err := NewManager(spec.MongoSecret, spec.BankCode)
 	// mgr, err := NewManager("mongodb://localhost:27017")
 	if err != nil {
 		log.Fatal(err)
@@ -61,7 +122,10 @@ func InitDB() (*AccManager, error) {
 var singletonClient *mongo.Client
 var once sync.Once
 
-func NewManager(uri string) (*AccManager, error) {
+func NewManager(uri string, bankCode string) (*AccManager, error) {
+	if !utils.ValidBankCode(bankCode) {
+		return nil, fmt.Errorf("bank code %q must be 4 upper-case letters or digits", bankCode)
+	}
 	clientOptions := options.Client().ApplyURI(uri)
 	once.Do(func() {
 
@@ -81,27 +145,236 @@ func NewManager(uri string) (*AccManager, error) {
 	})
 
 	db := singletonClient.Database("banktest")
-	return &AccManager{
+	mgr := &AccManager{
 		client:       singletonClient,
 		transactions: db.Collection("transactions"),
 		accounts:     db.Collection("accs"),
-	}, nil
+		payees:       db.Collection("payees"),
+
+		moneyRequests: db.Collection("money_requests"),
+		splits:        db.Collection("splits"),
+		pockets:       db.Collection("pockets"),
+		budgets:       db.Collection("budgets"),
+
+		feeRules:       db.Collection("fee_rules"),
+		pendingActions: db.Collection("pending_actions"),
+		fraudRules:     db.Collection("fraud_rules"),
+		heldTransfers:  db.Collection("held_transfers"),
+		amlCases:       db.Collection("aml_cases"),
+		auditLog:       db.Collection("audit_log"),
+		chatMessages:   db.Collection("chat_messages"),
+		dataRequests:   db.Collection("data_requests"),
+		counters:       db.Collection("counters"),
+		batches:        db.Collection("batches"),
+		adjustments:    db.Collection("adjustments"),
+		sessions:       db.Collection("sessions"),
+		revokedTokens:  db.Collection("revoked_tokens"),
+		loginAttempts:  db.Collection("login_attempts"),
+		apiKeys:        db.Collection("api_keys"),
+
+		bankCode: bankCode,
+	}
+
+	if err := mgr.ensureIndexes(); err != nil {
+		return nil, err
+	}
+	if err := mgr.ensureAccountNumbers(); err != nil {
+		return nil, err
+	}
+	if err := mgr.ensureRoles(); err != nil {
+		return nil, err
+	}
+	if err := mgr.EnsureRevenueAccount(); err != nil {
+		return nil, err
+	}
+	if err := mgr.ensureDefaultFraudRules(); err != nil {
+		return nil, err
+	}
+	return mgr, nil
+}
+
+func (m *AccManager) ensureIndexes() error {
+	_, err := m.payees.Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "owner_id", Value: 1}, {Key: "nickname_key", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = m.moneyRequests.Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "payer_id", Value: 1}, {Key: "status", Value: 1}, {Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "requester_id", Value: 1}, {Key: "created_at", Value: -1}}},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = m.splits.Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys: bson.D{{Key: "owner_id", Value: 1}, {Key: "created_at", Value: -1}},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = m.pockets.Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "account_id", Value: 1}, {Key: "name_key", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = m.budgets.Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys: bson.D{{Key: "account_id", Value: 1}},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = m.pendingActions.Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "account_id", Value: 1}}},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = m.heldTransfers.Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys: bson.D{{Key: "status", Value: 1}, {Key: "created_at", Value: 1}},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = m.accounts.Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "kyc.status", Value: 1}, {Key: "kyc.submitted_at", Value: 1}}},
+		{Keys: bson.D{{Key: "account_number", Value: 1}}, Options: options.Index().SetUnique(true).SetSparse(true)},
+		{Keys: bson.D{{Key: "created_at", Value: -1}}},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = m.amlCases.Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "account_id", Value: 1}, {Key: "kind", Value: 1}, {Key: "window", Value: 1}},
+			Options: options.Index().SetUnique(true).
+				SetPartialFilterExpression(bson.M{"status": AMLCaseOpen}),
+		},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "updated_at", Value: -1}}},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = m.auditLog.Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "seq", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "actor_id", Value: 1}, {Key: "seq", Value: -1}}},
+		{Keys: bson.D{{Key: "action", Value: 1}, {Key: "seq", Value: -1}}},
+		{Keys: bson.D{{Key: "request_id", Value: 1}}},
+		{Keys: bson.D{{Key: "target", Value: 1}}},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = m.chatMessages.Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys: bson.D{{Key: "account_id", Value: 1}, {Key: "created_at", Value: 1}},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = m.dataRequests.Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "account_id", Value: 1}, {Key: "kind", Value: 1}, {Key: "status", Value: 1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "created_at", Value: -1}}},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = m.batches.Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "owner_id", Value: 1}, {Key: "created_at", Value: -1}}},
+		{
+			Keys: bson.D{{Key: "owner_id", Value: 1}, {Key: "idempotency_key", Value: 1}},
+			Options: options.Index().SetUnique(true).
+				SetPartialFilterExpression(bson.M{"idempotency_key": bson.M{"$exists": true}}),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = m.adjustments.Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "created_at", Value: 1}}},
+		{Keys: bson.D{{Key: "account_id", Value: 1}}},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = m.sessions.Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "account_id", Value: 1}, {Key: "last_used_at", Value: -1}}},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = m.revokedTokens.Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "jti", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = m.loginAttempts.Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "kind", Value: 1}, {Key: "key", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = m.apiKeys.Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys: bson.D{{Key: "account_id", Value: 1}, {Key: "created_at", Value: -1}},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = m.transactions.Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "from_account", Value: 1}, {Key: "timestamp", Value: -1}}},
+		{Keys: bson.D{{Key: "to_account", Value: 1}, {Key: "timestamp", Value: -1}}},
+		{Keys: bson.D{{Key: "idempotency_key", Value: 1}}, Options: options.Index().SetUnique(true).SetSparse(true)},
+		{Keys: bson.D{{Key: "timestamp", Value: 1}}},
+	})
+	return err
 }
 
-func (m *AccManager) CreateAccount(name string, password string, balance float64, phoneNumber string , role string) (*BankAccount, error) {
+// CreateAccount opens an empty account; money only comes in through deposits
+// and transfers, which are checked against the KYC tier limits.
+func (m *AccManager) CreateAccount(name string, password string, phoneNumber string , role string) (*BankAccount, error) {
 
 	hashedPw, err := utils.HashPassword(password)
 	if err != nil {
 		return nil, err
 	}
+	accountNumber, err := m.nextAccountNumber(context.TODO())
+	if err != nil {
+		return nil, err
+	}
 	account := BankAccount{
+		AccountNumber: accountNumber,
 		AccountHolder: name,
 		CreatedAt:     time.Now(),
 		UpdatedAt:     time.Now(),
-		Balance:       balance,
 		Password:      hashedPw,
 		PhoneNumber:   phoneNumber,
 		Role:          role,
+		KYC:           KYCProfile{Status: KYCUnverified},
 	}	
 
 	acc := m.client.Database("banktest").Collection("accs")
@@ -136,7 +409,22 @@ func (m *AccManager) DeleteAccount(accountNumber string) error {
 	return nil
 }
 
+// DeleteAccountById removes an account outright. Like an erasure it refuses
+// while the account or any of its pockets still holds money.
 func (m *AccManager) DeleteAccountById(id primitive.ObjectID) error {
+	account, err := m.SearchAccountById(id)
+	if err != nil {
+		return err
+	}
+	if account == nil {
+		return ErrAccountNotFound
+	}
+	if account.ErasedAt == nil {
+		if err := m.checkErasable(context.TODO(), account); err != nil {
+			return err
+		}
+	}
+
 	filter := bson.D{{Key: "_id", Value: id}}
 	acc := m.client.Database("banktest").Collection("accs")
 
@@ -147,6 +435,14 @@ func (m *AccManager) DeleteAccountById(id primitive.ObjectID) error {
 	if deleteResult.DeletedCount == 0 {
 		return fmt.Errorf("no documents found with id: %v", id)
 	}
+	if _, err := m.sessions.DeleteMany(context.TODO(), bson.M{"account_id": id}); err != nil {
+		return err
+	}
+	if _, err := m.apiKeys.UpdateMany(context.TODO(),
+		bson.M{"account_id": id, "revoked_at": nil},
+		bson.M{"$set": bson.M{"revoked_at": time.Now()}}); err != nil {
+		return err
+	}
 
 	fmt.Printf("Deleted %v document(s)\n", deleteResult.DeletedCount)
 	return nil
@@ -196,6 +492,31 @@ func (m *AccManager) GetAccountByPhone(phone string) (*BankAccount, error) {
 	return &account, err
 }
 
+var ErrPhoneNumberTaken = errors.New("this phone number belongs to another account")
+
+// UpdatePhoneNumber moves an account to a new phone number, which is also
+// where its WhatsApp messages come from.
+func (m *AccManager) UpdatePhoneNumber(id primitive.ObjectID, phone string) error {
+	taken, err := m.accounts.CountDocuments(context.TODO(), bson.M{"phone_number": phone, "_id": bson.M{"$ne": id}})
+	if err != nil {
+		return err
+	}
+	if taken > 0 {
+		return ErrPhoneNumberTaken
+	}
+
+	result, err := m.accounts.UpdateOne(context.TODO(),
+		bson.M{"_id": id, "erased_at": nil},
+		bson.M{"$set": bson.M{"phone_number": phone, "updated_at": time.Now()}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrAccountNotFound
+	}
+	return nil
+}
+
 func (m *AccManager) SearchAccountById(id primitive.ObjectID) (*BankAccount, error) {
 	filter := bson.M{"_id": id}
 	var account BankAccount
@@ -236,79 +557,162 @@ func (m *AccManager) GetAccounts() ([]BankAccount, error) {
 	return accounts, nil
 }
 
+// TransferOptions carries the optional details recorded with a transfer.
+// SkipScreening is only set when an admin approves a held transfer.
+type TransferOptions struct {
+	Category      string
+	Memo          string
+	SkipScreening bool
+	// IdempotencyKey makes retries safe: a transfer whose key was already
+	// used returns the original transaction instead of moving money again.
+	IdempotencyKey string
+	// MoneyRequestID is the request this transfer pays, if any. A held
+	// transfer keeps the request claimed until it is reviewed.
+	MoneyRequestID primitive.ObjectID
+	// BatchID and BatchLine are the batch row this transfer runs, if any.
+	// A held row is updated once the hold is reviewed.
+	BatchID   primitive.ObjectID
+	BatchLine int
+}
+
 func (m *AccManager) TransferAmountById(fromAccountId, toAccountId primitive.ObjectID, amount float64) error {
+	_, err := m.TransferAmountWithOptions(fromAccountId, toAccountId, amount, TransferOptions{})
+	return err
+}
+
+// TransferAmountWithOptions moves amount between two accounts in a database
+// transaction and returns the recorded Transaction.
+func (m *AccManager) TransferAmountWithOptions(fromAccountId, toAccountId primitive.ObjectID, amount float64, opts TransferOptions) (*Transaction, error) {
 	session, err := m.client.StartSession()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer session.EndSession(context.TODO())
 
 	callback := func(sessCtx mongo.SessionContext) (interface{}, error) {
-		collection := m.accounts
+		return m.transferInSession(sessCtx, fromAccountId, toAccountId, amount, opts)
+	}
 
-		// Find the from account and ensure sufficient funds
-		var fromAccount BankAccount
-		err := collection.FindOne(sessCtx, bson.M{"_id": fromAccountId}).Decode(&fromAccount)
-		if err != nil {
-			return nil, err
-		}
+	result, err := session.WithTransaction(context.Background(), callback)
+	var screened *screeningResult
+	if errors.As(err, &screened) {
+		return nil, m.recordScreenedTransfer(screened, fromAccountId, toAccountId, amount, opts)
+	} else if err != nil {
+		return nil, err
+	}
 
-		if fromAccount.Balance < amount {
-			return nil, errors.New("insufficient funds")
-		}
+	return result.(*Transaction), nil
+}
 
-		// Find the to account
-		var toAccount BankAccount
-		err = collection.FindOne(sessCtx, bson.M{"_id": toAccountId}).Decode(&toAccount)
-		if err != nil {
-			return nil, err
+// transferInSession does the work of a transfer inside the caller's session,
+// so several transfers can share a single database transaction.
+func (m *AccManager) transferInSession(sessCtx mongo.SessionContext, fromAccountId, toAccountId primitive.ObjectID, amount float64, opts TransferOptions) (*Transaction, error) {
+	if amount <= 0 {
+		return nil, errors.New("transfer amount must be greater than zero")
+	}
+	if fromAccountId == toAccountId {
+		return nil, errors.New("cannot transfer to the same account")
+	}
+
+	if opts.IdempotencyKey != "" {
+		existing, err := m.getTransactionByIdempotencyKey(sessCtx, opts.IdempotencyKey)
+		if err != nil || existing != nil {
+			return existing, err
 		}
+	}
 
-		// Perform the transfer
-		fromAccount.Balance -= amount
-		toAccount.Balance += amount
+	collection := m.accounts
 
-		// Update the from account
-		_, err = collection.UpdateOne(
-			sessCtx,
-			bson.M{"_id": fromAccountId},
-			bson.M{"$set": bson.M{"balance": fromAccount.Balance, "updated_at": time.Now()}},
-		)
-		if err != nil {
-			return nil, err
-		}
+	// Find the from account and ensure sufficient funds
+	var fromAccount BankAccount
+	err := collection.FindOne(sessCtx, bson.M{"_id": fromAccountId}).Decode(&fromAccount)
+	if err != nil {
+		return nil, err
+	}
 
-		// Update the to account
-		_, err = collection.UpdateOne(
-			sessCtx,
-			bson.M{"_id": toAccountId},
-			bson.M{"$set": bson.M{"balance": toAccount.Balance, "updated_at": time.Now()}},
-		)
-		if err != nil {
-			return nil, err
-		}
+	fee, err := m.quoteFee(sessCtx, FeeOperationTransfer, fromAccount.Role, amount)
+	if err != nil {
+		return nil, err
+	}
 
-		// Record the transaction
-		transaction := Transaction{
-			FromAccount: fromAccountId,
-			ToAccount:   toAccountId,
-			Amount:      amount,
-			Timestamp:   time.Now(),
-		}
-		_, err = m.transactions.InsertOne(sessCtx, transaction)
+	if fromAccount.Balance < amount+fee {
+		return nil, errors.New("insufficient funds")
+	}
+
+	if err := m.checkKYCLimits(sessCtx, &fromAccount, FeeOperationTransfer, amount); err != nil {
+		return nil, err
+	}
+
+	// Find the to account
+	var toAccount BankAccount
+	err = collection.FindOne(sessCtx, bson.M{"_id": toAccountId}).Decode(&toAccount)
+	if err != nil {
+		return nil, err
+	}
+	// An erased account is only kept for the ledger; nothing can be paid into it
+	if toAccount.ErasedAt != nil {
+		return nil, ErrAccountErased
+	}
+
+	// Screen the transfer before anything moves
+	if !opts.SkipScreening {
+		outcome, reasons, err := m.screenTransfer(sessCtx, &fromAccount, toAccountId, amount)
 		if err != nil {
 			return nil, err
 		}
+		if outcome != FraudAllow {
+			return nil, &screeningResult{outcome: outcome, reasons: reasons}
+		}
+	}
 
-		return nil, nil
+	// Perform the transfer
+	fromAccount.Balance -= amount
+	toAccount.Balance += amount
+
+	// Update the from account
+	_, err = collection.UpdateOne(
+		sessCtx,
+		bson.M{"_id": fromAccountId},
+		bson.M{"$set": bson.M{"balance": fromAccount.Balance, "updated_at": time.Now()}},
+	)
+	if err != nil {
+		return nil, err
 	}
 
-	_, err = session.WithTransaction(context.Background(), callback)
+	// Update the to account
+	_, err = collection.UpdateOne(
+		sessCtx,
+		bson.M{"_id": toAccountId},
+		bson.M{"$set": bson.M{"balance": toAccount.Balance, "updated_at": time.Now()}},
+	)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	// Record the transaction
+	transaction := Transaction{
+		FromAccount: fromAccountId,
+		ToAccount:   toAccountId,
+		Amount:      amount,
+		Timestamp:   time.Now(),
+		Type:        TransactionTransfer,
+		Category:    NormalizeCategory(opts.Category),
+		Fee:         fee,
+		Memo:        opts.Memo,
+
+		IdempotencyKey: opts.IdempotencyKey,
+	}
+	insertResult, err := m.transactions.InsertOne(sessCtx, transaction)
+	if err != nil {
+		return nil, err
+	}
+	transaction.ID = insertResult.InsertedID.(primitive.ObjectID)
+
+	if err := m.chargeFeeInSession(sessCtx, fromAccountId, fee, FeeOperationTransfer); err != nil {
+		return nil, err
+	}
+
+	return &transaction, nil
 }
 
 func (m *AccManager) GetTransactionsHistory(accountId primitive.ObjectID) ([]Transaction, error) {
@@ -342,31 +746,76 @@ func (m *AccManager) GetTransactionsHistory(accountId primitive.ObjectID) ([]Tra
 	return transactions, nil
 }
 
-func (m *AccManager) DepositToAccount(amount float64, accountId primitive.ObjectID) error {
+// DepositToAccount credits amount, less any deposit fee, to the account and
+// records the deposit, all in one database transaction.
+func (m *AccManager) DepositToAccount(amount float64, accountId primitive.ObjectID) (*Transaction, error) {
 	// Ensure the amount is positive
 	if amount <= 0 {
-		return errors.New("deposit amount must be greater than zero")
+		return nil, errors.New("deposit amount must be greater than zero")
 	}
 
-	// Define the filter and update
-	filter := bson.M{"_id": accountId}
-	update := bson.M{"$inc": bson.M{"balance": amount}}
-
-	// Get the collection
-	accCollection := m.client.Database("banktest").Collection("accs")
-
-	// Perform the update
-	result, err := accCollection.UpdateOne(context.TODO(), filter, update)
+	session, err := m.client.StartSession()
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer session.EndSession(context.TODO())
+
+	callback := func(sessCtx mongo.SessionContext) (interface{}, error) {
+		var account BankAccount
+		err := m.accounts.FindOne(sessCtx, bson.M{"_id": accountId}).Decode(&account)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, errors.New("account not found")
+		} else if err != nil {
+			return nil, err
+		}
+		if account.ErasedAt != nil {
+			return nil, ErrAccountErased
+		}
 
-	// Check if any document was modified
-	if result.ModifiedCount == 0 {
-		return errors.New("account not found or no update made")
+		if err := m.checkKYCLimits(sessCtx, &account, FeeOperationDeposit, amount); err != nil {
+			return nil, err
+		}
+
+		fee, err := m.quoteFee(sessCtx, FeeOperationDeposit, account.Role, amount)
+		if err != nil {
+			return nil, err
+		}
+		if fee >= amount {
+			return nil, fmt.Errorf("deposit does not cover the %.2f fee", fee)
+		}
+
+		_, err = m.accounts.UpdateOne(sessCtx,
+			bson.M{"_id": accountId},
+			bson.M{"$inc": bson.M{"balance": amount}, "$set": bson.M{"updated_at": time.Now()}},
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		transaction := Transaction{
+			ToAccount: accountId,
+			Amount:    amount,
+			Timestamp: time.Now(),
+			Type:      TransactionDeposit,
+			Fee:       fee,
+		}
+		insertResult, err := m.transactions.InsertOne(sessCtx, transaction)
+		if err != nil {
+			return nil, err
+		}
+		transaction.ID = insertResult.InsertedID.(primitive.ObjectID)
+
+		if err := m.chargeFeeInSession(sessCtx, accountId, fee, FeeOperationDeposit); err != nil {
+			return nil, err
+		}
+		return &transaction, nil
 	}
 
-	return nil
+	result, err := session.WithTransaction(context.Background(), callback)
+	if err != nil {
+		return nil, err
+	}
+	return result.(*Transaction), nil
 }
 
 func (m *AccManager) GetAccountBalance(accountId primitive.ObjectID) (float64, error) {
@@ -404,3 +853,16 @@ func (m *AccManager) GetMostRecentTransaction(accountID primitive.ObjectID) (*Tr
     return &transaction, nil
 }
 
+// GetMostRecentOutgoingTransaction returns the last transfer sent from accountID.
+func (m *AccManager) GetMostRecentOutgoingTransaction(accountID primitive.ObjectID) (*Transaction, error) {
+	filter := bson.M{"from_account": accountID, "type": bson.M{"$in": []interface{}{TransactionTransfer, nil}}}
+	sort := bson.D{{Key: "timestamp", Value: -1}}
+
+	var transaction Transaction
+	err := m.transactions.FindOne(context.TODO(), filter, options.FindOne().SetSort(sort)).Decode(&transaction)
+	if err != nil {
+		return nil, err
+	}
+
+	return &transaction, nil
+}
@@ -0,0 +1,297 @@
+package db
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Operations a fee rule can apply to. There is no currency conversion in
+// gobank yet, so there are no FX fees either.
+const (
+	FeeOperationTransfer    = "transfer"
+	FeeOperationDeposit     = "deposit"
+	FeeOperationMaintenance = "maintenance"
+)
+
+// RoleBank marks the bank's own revenue account, which fees are paid into.
+const RoleBank = "bank"
+
+var ErrFeeRuleNotFound = errors.New("fee rule not found")
+
+// FeeRule is one line of the fee schedule. A rule applies to an operation,
+// optionally only for accounts with a given role and only for amounts above
+// MinAmount (maintenance rules ignore MinAmount). The fee is Flat plus Percent of the amount, capped at MaxFee.
+type FeeRule struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Name      string             `bson:"name" json:"name"`
+	Operation string             `bson:"operation" json:"operation"`
+	Role      string             `bson:"role,omitempty" json:"role,omitempty"`
+	MinAmount float64            `bson:"min_amount" json:"min_amount"`
+	Flat      float64            `bson:"flat" json:"flat"`
+	Percent   float64            `bson:"percent" json:"percent"`
+	MaxFee    float64            `bson:"max_fee,omitempty" json:"max_fee,omitempty"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+}
+
+func (r *FeeRule) applies(operation, role string, amount float64) bool {
+	if r.Operation != operation {
+		return false
+	}
+	if r.Role != "" && r.Role != role {
+		return false
+	}
+	// Maintenance fees are charged on the account, not on an amount
+	if operation == FeeOperationMaintenance {
+		return true
+	}
+	return amount > r.MinAmount
+}
+
+func (r *FeeRule) compute(amount float64) float64 {
+	fee := r.Flat + amount*r.Percent/100
+	if r.MaxFee > 0 && fee > r.MaxFee {
+		fee = r.MaxFee
+	}
+	return fee
+}
+
+func roundCents(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
+
+func (m *AccManager) CreateFeeRule(rule FeeRule) (*FeeRule, error) {
+	switch rule.Operation {
+	case FeeOperationTransfer, FeeOperationDeposit, FeeOperationMaintenance:
+	default:
+		return nil, fmt.Errorf("unknown operation %q", rule.Operation)
+	}
+	if rule.Role != "" && rule.Role != RoleBank && !ValidRole(rule.Role) {
+		return nil, fmt.Errorf("unknown role %q", rule.Role)
+	}
+	if rule.Flat < 0 || rule.Percent < 0 || rule.MinAmount < 0 || rule.MaxFee < 0 {
+		return nil, errors.New("fee amounts cannot be negative")
+	}
+	if rule.Flat == 0 && rule.Percent == 0 {
+		return nil, errors.New("a fee rule needs a flat fee or a percentage")
+	}
+
+	rule.ID = primitive.NilObjectID
+	rule.CreatedAt = time.Now()
+	insertResult, err := m.feeRules.InsertOne(context.TODO(), rule)
+	if err != nil {
+		return nil, err
+	}
+	rule.ID = insertResult.InsertedID.(primitive.ObjectID)
+	return &rule, nil
+}
+
+func (m *AccManager) GetFeeRules() ([]FeeRule, error) {
+	cursor, err := m.feeRules.Find(context.TODO(), bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+
+	rules := []FeeRule{}
+	if err := cursor.All(context.TODO(), &rules); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func (m *AccManager) DeleteFeeRule(id primitive.ObjectID) error {
+	deleteResult, err := m.feeRules.DeleteOne(context.TODO(), bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if deleteResult.DeletedCount == 0 {
+		return ErrFeeRuleNotFound
+	}
+	return nil
+}
+
+// quoteFee adds up every rule of the schedule that applies to the operation.
+// The bank's own account never pays fees.
+func (m *AccManager) quoteFee(ctx context.Context, operation, role string, amount float64) (float64, error) {
+	if role == RoleBank {
+		return 0, nil
+	}
+
+	cursor, err := m.feeRules.Find(ctx, bson.M{"operation": operation})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var rules []FeeRule
+	if err := cursor.All(ctx, &rules); err != nil {
+		return 0, err
+	}
+
+	var fee float64
+	for i := range rules {
+		if rules[i].applies(operation, role, amount) {
+			fee += rules[i].compute(amount)
+		}
+	}
+	return roundCents(fee), nil
+}
+
+// QuoteFee returns the fee the account would pay for the operation, so it can
+// be shown to the user before anything is charged.
+func (m *AccManager) QuoteFee(operation string, accountID primitive.ObjectID, amount float64) (float64, error) {
+	account, err := m.SearchAccountById(accountID)
+	if err != nil {
+		return 0, err
+	}
+	if account == nil {
+		return 0, errors.New("account not found")
+	}
+	return m.quoteFee(context.TODO(), operation, account.Role, amount)
+}
+
+// EnsureRevenueAccount loads the bank's revenue account, creating it on first start.
+func (m *AccManager) EnsureRevenueAccount() error {
+	var account BankAccount
+	err := m.accounts.FindOne(context.TODO(), bson.M{"role": RoleBank}).Decode(&account)
+	if err == nil {
+		m.revenueAccountID = account.ID
+		return nil
+	} else if !errors.Is(err, mongo.ErrNoDocuments) {
+		return err
+	}
+
+	// Nobody should ever log into the revenue account
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+	created, err := m.CreateAccount("gobank revenue", hex.EncodeToString(secret), "", RoleBank)
+	if err != nil {
+		return err
+	}
+	m.revenueAccountID = created.ID
+	return nil
+}
+
+// chargeFeeInSession moves fee from the account to the revenue account and
+// records it, inside the caller's database transaction.
+func (m *AccManager) chargeFeeInSession(sessCtx mongo.SessionContext, accountID primitive.ObjectID, fee float64, operation string) error {
+	if fee <= 0 {
+		return nil
+	}
+	if m.revenueAccountID.IsZero() {
+		return errors.New("revenue account is not configured")
+	}
+
+	_, err := m.accounts.UpdateOne(sessCtx,
+		bson.M{"_id": accountID},
+		bson.M{"$inc": bson.M{"balance": -fee}, "$set": bson.M{"updated_at": time.Now()}},
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.accounts.UpdateOne(sessCtx,
+		bson.M{"_id": m.revenueAccountID},
+		bson.M{"$inc": bson.M{"balance": fee}, "$set": bson.M{"updated_at": time.Now()}},
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.transactions.InsertOne(sessCtx, Transaction{
+		FromAccount: accountID,
+		ToAccount:   m.revenueAccountID,
+		Amount:      fee,
+		Timestamp:   time.Now(),
+		Type:        TransactionFee,
+		Category:    operation,
+	})
+	return err
+}
+
+// ChargeMaintenanceFees charges this month's maintenance fee to every account
+// that hasn't paid it yet. It is safe to run repeatedly: each account is
+// stamped with the month it was charged for in the same transaction.
+func (m *AccManager) ChargeMaintenanceFees() (int, error) {
+	month := time.Now().UTC().Format("2006-01")
+	filter := bson.M{"role": bson.M{"$ne": RoleBank}, "maintenance_month": bson.M{"$ne": month}}
+
+	cursor, err := m.accounts.Find(context.TODO(), filter, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return 0, err
+	}
+	var accounts []BankAccount
+	err = cursor.All(context.TODO(), &accounts)
+	cursor.Close(context.TODO())
+	if err != nil {
+		return 0, err
+	}
+
+	charged := 0
+	for _, account := range accounts {
+		ok, err := m.chargeMaintenanceFee(account.ID, month)
+		if err != nil {
+			log.Printf("Error charging maintenance fee to %s: %v", account.ID.Hex(), err)
+			continue
+		}
+		if ok {
+			charged++
+		}
+	}
+	return charged, nil
+}
+
+func (m *AccManager) chargeMaintenanceFee(accountID primitive.ObjectID, month string) (bool, error) {
+	session, err := m.client.StartSession()
+	if err != nil {
+		return false, err
+	}
+	defer session.EndSession(context.TODO())
+
+	callback := func(sessCtx mongo.SessionContext) (interface{}, error) {
+		var account BankAccount
+		err := m.accounts.FindOneAndUpdate(sessCtx,
+			bson.M{"_id": accountID, "maintenance_month": bson.M{"$ne": month}},
+			bson.M{"$set": bson.M{"maintenance_month": month}},
+		).Decode(&account)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+
+		fee, err := m.quoteFee(sessCtx, FeeOperationMaintenance, account.Role, account.Balance)
+		if err != nil {
+			return false, err
+		}
+		// Never push an account below zero for maintenance
+		fee = math.Min(fee, math.Max(0, account.Balance))
+		if fee <= 0 {
+			return false, nil
+		}
+
+		if err := m.chargeFeeInSession(sessCtx, accountID, roundCents(fee), FeeOperationMaintenance); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
+	result, err := session.WithTransaction(context.Background(), callback)
+	if err != nil {
+		return false, err
+	}
+	return result.(bool), nil
+}
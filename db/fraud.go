@@ -0,0 +1,427 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Kinds of fraud rule.
+const (
+	// FraudRuleNewPayee fires on the first transfer to a recipient above Amount.
+	FraudRuleNewPayee = "new_payee"
+	// FraudRuleVelocity fires when the sender already made Count transfers
+	// within the last WindowMinutes.
+	FraudRuleVelocity = "velocity"
+	// FraudRuleNewAccountDrain fires when an account younger than
+	// AccountAgeDays sends BalancePercent or more of its balance at once.
+	FraudRuleNewAccountDrain = "new_account_drain"
+)
+
+// Screening outcomes, from least to most severe.
+const (
+	FraudAllow = "allow"
+	FraudHold  = "hold"
+	FraudBlock = "block"
+)
+
+// Statuses of a screened transfer.
+const (
+	HeldTransferPending  = "pending"
+	HeldTransferApproved = "approved"
+	HeldTransferRejected = "rejected"
+	HeldTransferFailed   = "failed"
+	HeldTransferBlocked  = "blocked"
+)
+
+var (
+	ErrFraudRuleNotFound    = errors.New("fraud rule not found")
+	ErrHeldTransferNotFound = errors.New("held transfer not found")
+	ErrHeldTransferClosed   = errors.New("held transfer was already reviewed")
+)
+
+// FraudRule is one screening rule. Which fields matter depends on Kind.
+type FraudRule struct {
+	ID             primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Name           string             `bson:"name" json:"name"`
+	Kind           string             `bson:"kind" json:"kind"`
+	Outcome        string             `bson:"outcome" json:"outcome"`
+	Amount         float64            `bson:"amount,omitempty" json:"amount,omitempty"`
+	Count          int                `bson:"count,omitempty" json:"count,omitempty"`
+	WindowMinutes  int                `bson:"window_minutes,omitempty" json:"window_minutes,omitempty"`
+	AccountAgeDays int                `bson:"account_age_days,omitempty" json:"account_age_days,omitempty"`
+	BalancePercent float64            `bson:"balance_percent,omitempty" json:"balance_percent,omitempty"`
+	CreatedAt      time.Time          `bson:"created_at" json:"created_at"`
+}
+
+// DefaultFraudRules are installed the first time the bank starts.
+var DefaultFraudRules = []FraudRule{
+	{Name: "Large first transfer to a new recipient", Kind: FraudRuleNewPayee, Outcome: FraudHold, Amount: 5000},
+	{Name: "Many transfers in a short time", Kind: FraudRuleVelocity, Outcome: FraudHold, Count: 5, WindowMinutes: 10},
+	{Name: "New account draining its balance", Kind: FraudRuleNewAccountDrain, Outcome: FraudHold, AccountAgeDays: 7, BalancePercent: 90},
+}
+
+// HeldTransfer is a transfer stopped by screening. Held transfers wait in the
+// review queue for an admin; blocked ones are kept for the record only.
+type HeldTransfer struct {
+	ID            primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	FromAccount   primitive.ObjectID `bson:"from_account" json:"from_account"`
+	ToAccount     primitive.ObjectID `bson:"to_account" json:"to_account"`
+	Amount        float64            `bson:"amount" json:"amount"`
+	Category      string             `bson:"category,omitempty" json:"category,omitempty"`
+	Memo          string             `bson:"memo,omitempty" json:"memo,omitempty"`
+	Reasons       []string           `bson:"reasons" json:"reasons"`
+	Status        string             `bson:"status" json:"status"`
+	ReviewedBy    primitive.ObjectID `bson:"reviewed_by,omitempty" json:"reviewed_by,omitempty"`
+	ReviewNote    string             `bson:"review_note,omitempty" json:"review_note,omitempty"`
+	TransactionID primitive.ObjectID `bson:"transaction_id,omitempty" json:"transaction_id,omitempty"`
+	CreatedAt     time.Time          `bson:"created_at" json:"created_at"`
+	ReviewedAt    *time.Time         `bson:"reviewed_at,omitempty" json:"reviewed_at,omitempty"`
+	// The original transfer's options are carried through review, so the
+	// approved transfer is the one that was asked for and whatever it was
+	// paying for is settled with it.
+	IdempotencyKey string             `bson:"idempotency_key,omitempty" json:"-"`
+	MoneyRequestID primitive.ObjectID `bson:"money_request_id,omitempty" json:"money_request_id,omitempty"`
+	BatchID        primitive.ObjectID `bson:"batch_id,omitempty" json:"batch_id,omitempty"`
+	BatchLine      int                `bson:"batch_line,omitempty" json:"batch_line,omitempty"`
+}
+
+// TransferHeldError is returned when a transfer was put on hold for review.
+type TransferHeldError struct {
+	Held *HeldTransfer
+}
+
+func (e *TransferHeldError) Error() string {
+	return "transfer is on hold for review: " + strings.Join(e.Held.Reasons, "; ")
+}
+
+// TransferBlockedError is returned when screening refused a transfer outright.
+type TransferBlockedError struct {
+	Reasons []string
+}
+
+func (e *TransferBlockedError) Error() string {
+	return "transfer was blocked: " + strings.Join(e.Reasons, "; ")
+}
+
+// screeningResult aborts the transfer's database transaction so the stopped
+// transfer can be recorded once nothing has moved.
+type screeningResult struct {
+	outcome string
+	reasons []string
+}
+
+func (r *screeningResult) Error() string {
+	return "transfer stopped by screening: " + strings.Join(r.reasons, "; ")
+}
+
+func validateFraudRule(rule *FraudRule) error {
+	switch rule.Outcome {
+	case FraudHold, FraudBlock:
+	default:
+		return fmt.Errorf("outcome must be %q or %q", FraudHold, FraudBlock)
+	}
+
+	switch rule.Kind {
+	case FraudRuleNewPayee:
+		if rule.Amount < 0 {
+			return errors.New("amount cannot be negative")
+		}
+	case FraudRuleVelocity:
+		if rule.Count <= 0 || rule.WindowMinutes <= 0 {
+			return errors.New("count and window_minutes must be greater than zero")
+		}
+	case FraudRuleNewAccountDrain:
+		if rule.AccountAgeDays <= 0 || rule.BalancePercent <= 0 {
+			return errors.New("account_age_days and balance_percent must be greater than zero")
+		}
+	default:
+		return fmt.Errorf("unknown rule kind %q", rule.Kind)
+	}
+
+	if strings.TrimSpace(rule.Name) == "" {
+		rule.Name = rule.Kind
+	}
+	return nil
+}
+
+func (m *AccManager) CreateFraudRule(rule FraudRule) (*FraudRule, error) {
+	if err := validateFraudRule(&rule); err != nil {
+		return nil, err
+	}
+	rule.ID = primitive.NilObjectID
+	rule.CreatedAt = time.Now()
+
+	insertResult, err := m.fraudRules.InsertOne(context.TODO(), rule)
+	if err != nil {
+		return nil, err
+	}
+	rule.ID = insertResult.InsertedID.(primitive.ObjectID)
+	return &rule, nil
+}
+
+func (m *AccManager) GetFraudRules() ([]FraudRule, error) {
+	cursor, err := m.fraudRules.Find(context.TODO(), bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+
+	rules := []FraudRule{}
+	if err := cursor.All(context.TODO(), &rules); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func (m *AccManager) DeleteFraudRule(id primitive.ObjectID) error {
+	deleteResult, err := m.fraudRules.DeleteOne(context.TODO(), bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if deleteResult.DeletedCount == 0 {
+		return ErrFraudRuleNotFound
+	}
+	return nil
+}
+
+// ensureDefaultFraudRules installs DefaultFraudRules into an empty rule set.
+func (m *AccManager) ensureDefaultFraudRules() error {
+	count, err := m.fraudRules.CountDocuments(context.TODO(), bson.M{})
+	if err != nil || count > 0 {
+		return err
+	}
+	for _, rule := range DefaultFraudRules {
+		if _, err := m.CreateFraudRule(rule); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// screenTransfer runs every fraud rule against a transfer about to be made
+// and returns the most severe outcome with the reasons of the rules that fired.
+func (m *AccManager) screenTransfer(sessCtx mongo.SessionContext, fromAccount *BankAccount, toAccountID primitive.ObjectID, amount float64) (string, []string, error) {
+	if fromAccount.Role == RoleBank {
+		return FraudAllow, nil, nil
+	}
+
+	cursor, err := m.fraudRules.Find(sessCtx, bson.M{})
+	if err != nil {
+		return "", nil, err
+	}
+	var rules []FraudRule
+	err = cursor.All(sessCtx, &rules)
+	cursor.Close(sessCtx)
+	if err != nil {
+		return "", nil, err
+	}
+
+	outcome := FraudAllow
+	var reasons []string
+	transfers := bson.M{"from_account": fromAccount.ID, "type": bson.M{"$in": []interface{}{TransactionTransfer, nil}}}
+
+	for _, rule := range rules {
+		fired := false
+		switch rule.Kind {
+		case FraudRuleNewPayee:
+			if amount <= rule.Amount {
+				continue
+			}
+			filter := bson.M{"to_account": toAccountID}
+			for k, v := range transfers {
+				filter[k] = v
+			}
+			previous, err := m.transactions.CountDocuments(sessCtx, filter, options.Count().SetLimit(1))
+			if err != nil {
+				return "", nil, err
+			}
+			fired = previous == 0
+
+		case FraudRuleVelocity:
+			filter := bson.M{"timestamp": bson.M{"$gte": time.Now().Add(-time.Duration(rule.WindowMinutes) * time.Minute)}}
+			for k, v := range transfers {
+				filter[k] = v
+			}
+			recent, err := m.transactions.CountDocuments(sessCtx, filter)
+			if err != nil {
+				return "", nil, err
+			}
+			fired = recent >= int64(rule.Count)
+
+		case FraudRuleNewAccountDrain:
+			age := time.Since(fromAccount.CreatedAt)
+			fired = age < time.Duration(rule.AccountAgeDays)*24*time.Hour &&
+				fromAccount.Balance > 0 && amount >= fromAccount.Balance*rule.BalancePercent/100
+		}
+
+		if !fired {
+			continue
+		}
+		reasons = append(reasons, rule.Name)
+		if rule.Outcome == FraudBlock || outcome == FraudAllow {
+			outcome = rule.Outcome
+		}
+	}
+	return outcome, reasons, nil
+}
+
+// recordScreenedTransfer stores a transfer stopped by screening and returns
+// the error the caller of the transfer should see.
+func (m *AccManager) recordScreenedTransfer(result *screeningResult, fromAccountID, toAccountID primitive.ObjectID, amount float64, opts TransferOptions) error {
+	held := HeldTransfer{
+		FromAccount: fromAccountID,
+		ToAccount:   toAccountID,
+		Amount:      amount,
+		Category:    NormalizeCategory(opts.Category),
+		Memo:        opts.Memo,
+		Reasons:     result.reasons,
+		Status:      HeldTransferPending,
+		CreatedAt:   time.Now(),
+
+		IdempotencyKey: opts.IdempotencyKey,
+		MoneyRequestID: opts.MoneyRequestID,
+		BatchID:        opts.BatchID,
+		BatchLine:      opts.BatchLine,
+	}
+	if result.outcome == FraudBlock {
+		held.Status = HeldTransferBlocked
+	}
+
+	// A request being paid stays claimed while the payment is reviewed, so it
+	// can't be paid a second time in the meantime
+	holdsRequest := result.outcome != FraudBlock && !opts.MoneyRequestID.IsZero()
+	if holdsRequest {
+		if _, err := m.SetMoneyRequestStatus(opts.MoneyRequestID, MoneyRequestPaid, MoneyRequestAwaitingReview); err != nil {
+			return err
+		}
+	}
+
+	insertResult, err := m.heldTransfers.InsertOne(context.TODO(), held)
+	if err != nil {
+		if holdsRequest {
+			m.SetMoneyRequestStatus(opts.MoneyRequestID, MoneyRequestAwaitingReview, MoneyRequestPaid)
+		}
+		return err
+	}
+	held.ID = insertResult.InsertedID.(primitive.ObjectID)
+
+	if result.outcome == FraudBlock {
+		return &TransferBlockedError{Reasons: result.reasons}
+	}
+	return &TransferHeldError{Held: &held}
+}
+
+func (m *AccManager) GetHeldTransfers(status string) ([]HeldTransfer, error) {
+	filter := bson.M{}
+	if status != "" {
+		filter["status"] = status
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}})
+
+	cursor, err := m.heldTransfers.Find(context.TODO(), filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+
+	held := []HeldTransfer{}
+	if err := cursor.All(context.TODO(), &held); err != nil {
+		return nil, err
+	}
+	return held, nil
+}
+
+// ReviewHeldTransfer closes a pending held transfer as approved or rejected.
+// It does not move any money: the caller makes an approved transfer (with
+// SkipScreening) and reports back through CompleteHeldTransfer.
+func (m *AccManager) ReviewHeldTransfer(id, reviewerID primitive.ObjectID, approve bool, note string) (*HeldTransfer, error) {
+	status := HeldTransferRejected
+	if approve {
+		status = HeldTransferApproved
+	}
+
+	update := bson.M{"$set": bson.M{
+		"status":      status,
+		"reviewed_by": reviewerID,
+		"review_note": strings.TrimSpace(note),
+		"reviewed_at": time.Now(),
+	}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var held HeldTransfer
+	err := m.heldTransfers.FindOneAndUpdate(context.TODO(), bson.M{"_id": id, "status": HeldTransferPending}, update, opts).Decode(&held)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		count, countErr := m.heldTransfers.CountDocuments(context.TODO(), bson.M{"_id": id})
+		if countErr == nil && count > 0 {
+			return nil, ErrHeldTransferClosed
+		}
+		return nil, ErrHeldTransferNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	if !approve {
+		if err := m.settleHeldMoneyRequest(&held, false); err != nil {
+			return nil, err
+		}
+		if err := m.settleHeldBatchRow(&held, nil, "declined after review"); err != nil {
+			return nil, err
+		}
+	}
+	return &held, nil
+}
+
+// settleHeldMoneyRequest finishes the money request a held transfer was
+// paying: it is paid if the transfer went through, and otherwise goes back
+// to pending so the payer can try again.
+func (m *AccManager) settleHeldMoneyRequest(held *HeldTransfer, paid bool) error {
+	if held.MoneyRequestID.IsZero() {
+		return nil
+	}
+
+	status := MoneyRequestPending
+	if paid {
+		status = MoneyRequestPaid
+	}
+	_, err := m.SetMoneyRequestStatus(held.MoneyRequestID, MoneyRequestAwaitingReview, status)
+	if errors.Is(err, ErrMoneyRequestClosed) {
+		return nil
+	}
+	return err
+}
+
+// CompleteHeldTransfer records the outcome of the transfer made for an
+// approved held transfer: the resulting transaction, or why it failed. The
+// money request or batch row the transfer was for is settled with it.
+func (m *AccManager) CompleteHeldTransfer(held *HeldTransfer, transaction *Transaction, transferErr error) error {
+	set := bson.M{}
+	failure := ""
+	if transferErr != nil {
+		failure = "transfer failed: " + transferErr.Error()
+		held.Status = HeldTransferFailed
+		held.ReviewNote = strings.TrimSpace(held.ReviewNote + " (" + failure + ")")
+		set["status"] = held.Status
+		set["review_note"] = held.ReviewNote
+		transaction = nil
+	} else {
+		held.TransactionID = transaction.ID
+		set["transaction_id"] = transaction.ID
+	}
+
+	_, err := m.heldTransfers.UpdateOne(context.TODO(), bson.M{"_id": held.ID}, bson.M{"$set": set})
+	if err != nil {
+		return err
+	}
+	if err := m.settleHeldMoneyRequest(held, transferErr == nil); err != nil {
+		return err
+	}
+	return m.settleHeldBatchRow(held, transaction, failure)
+}
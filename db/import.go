@@ -0,0 +1,95 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ImportedAccount is an account brought over from another system. The
+// password is already hashed so callers can spread the bcrypt work out.
+type ImportedAccount struct {
+	Name           string
+	PhoneNumber    string
+	PasswordHash   string
+	OpeningBalance float64
+}
+
+// ExistingPhoneNumbers returns which of the phone numbers already belong to
+// an account.
+func (m *AccManager) ExistingPhoneNumbers(phones []string) (map[string]bool, error) {
+	existing := map[string]bool{}
+	if len(phones) == 0 {
+		return existing, nil
+	}
+
+	cursor, err := m.accounts.Find(context.TODO(), bson.M{"phone_number": bson.M{"$in": phones}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+
+	for cursor.Next(context.TODO()) {
+		var account BankAccount
+		if err := cursor.Decode(&account); err != nil {
+			return nil, err
+		}
+		existing[account.PhoneNumber] = true
+	}
+	return existing, cursor.Err()
+}
+
+// ImportAccount creates a user account with its opening balance. The balance
+// is booked as an opening_balance transaction in the same database
+// transaction, so migrated money shows up in the ledger like any other.
+func (m *AccManager) ImportAccount(imported ImportedAccount) (*BankAccount, error) {
+	accountNumber, err := m.nextAccountNumber(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := m.client.StartSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.EndSession(context.TODO())
+
+	now := time.Now()
+	account := BankAccount{
+		AccountNumber: accountNumber,
+		AccountHolder: imported.Name,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+		Balance:       imported.OpeningBalance,
+		Password:      imported.PasswordHash,
+		PhoneNumber:   imported.PhoneNumber,
+		Role:          RoleCustomer,
+		KYC:           KYCProfile{Status: KYCUnverified},
+	}
+
+	_, err = session.WithTransaction(context.TODO(), func(sessCtx mongo.SessionContext) (interface{}, error) {
+		insertResult, err := m.accounts.InsertOne(sessCtx, account)
+		if err != nil {
+			return nil, err
+		}
+		account.ID = insertResult.InsertedID.(primitive.ObjectID)
+
+		if imported.OpeningBalance == 0 {
+			return nil, nil
+		}
+		_, err = m.transactions.InsertOne(sessCtx, Transaction{
+			ToAccount: account.ID,
+			Amount:    imported.OpeningBalance,
+			Timestamp: now,
+			Type:      TransactionOpeningBalance,
+		})
+		return nil, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
@@ -0,0 +1,289 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// KYC states. An account starts unverified, is submitted for review once the
+// identity details and at least one document are in, and is then verified or
+// rejected by an admin. A rejected account can correct its details and
+// submit again.
+const (
+	KYCUnverified    = "unverified"
+	KYCPendingReview = "pending_review"
+	KYCVerified      = "verified"
+	KYCRejected      = "rejected"
+)
+
+// Kinds of identity document that can be uploaded.
+var KYCDocumentKinds = []string{"id_card", "passport", "drivers_license", "proof_of_address", "selfie"}
+
+var (
+	ErrKYCLocked     = errors.New("identity details can't be changed while under review or after verification")
+	ErrKYCNotPending = errors.New("account is not pending KYC review")
+	ErrKYCIncomplete = errors.New("full name, date of birth, national ID and at least one document are required")
+)
+
+type KYCDocument struct {
+	ID          primitive.ObjectID `bson:"_id" json:"id"`
+	Kind        string             `bson:"kind" json:"kind"`
+	FileName    string             `bson:"file_name" json:"file_name"`
+	ContentType string             `bson:"content_type" json:"content_type"`
+	Size        int64              `bson:"size" json:"size"`
+	BlobKey     string             `bson:"blob_key" json:"-"`
+	UploadedAt  time.Time          `bson:"uploaded_at" json:"uploaded_at"`
+}
+
+// KYCProfile is the identity data held for an account.
+type KYCProfile struct {
+	Status          string             `bson:"status" json:"status"`
+	FullName        string             `bson:"full_name,omitempty" json:"full_name,omitempty"`
+	DateOfBirth     string             `bson:"date_of_birth,omitempty" json:"date_of_birth,omitempty"`
+	NationalID      string             `bson:"national_id,omitempty" json:"national_id,omitempty"`
+	Documents       []KYCDocument      `bson:"documents,omitempty" json:"documents,omitempty"`
+	SubmittedAt     *time.Time         `bson:"submitted_at,omitempty" json:"submitted_at,omitempty"`
+	ReviewedAt      *time.Time         `bson:"reviewed_at,omitempty" json:"reviewed_at,omitempty"`
+	ReviewedBy      primitive.ObjectID `bson:"reviewed_by,omitempty" json:"reviewed_by,omitempty"`
+	RejectionReason string             `bson:"rejection_reason,omitempty" json:"rejection_reason,omitempty"`
+}
+
+// State is the profile's KYC state. Accounts created before KYC existed have
+// no status and count as unverified.
+func (p *KYCProfile) State() string {
+	if p.Status == "" {
+		return KYCUnverified
+	}
+	return p.Status
+}
+
+// KYCLimits caps what an account can move. A limit of zero means the
+// operation is not allowed at all.
+type KYCLimits struct {
+	MaxTransfer    float64 `json:"max_transfer"`
+	DailyTransfers float64 `json:"daily_transfers"`
+	DailyDeposits  float64 `json:"daily_deposits"`
+}
+
+// KYCTierLimits ties limits to the KYC state of the account.
+var KYCTierLimits = map[string]KYCLimits{
+	KYCUnverified:    {MaxTransfer: 500, DailyTransfers: 1000, DailyDeposits: 1000},
+	KYCPendingReview: {MaxTransfer: 500, DailyTransfers: 1000, DailyDeposits: 1000},
+	KYCVerified:      {MaxTransfer: 10000, DailyTransfers: 50000, DailyDeposits: 50000},
+	KYCRejected:      {},
+}
+
+// KYCLimitError is returned when an operation is over the account's tier limits.
+type KYCLimitError struct {
+	Tier      string
+	Operation string
+	Limit     float64
+}
+
+func (e *KYCLimitError) Error() string {
+	if e.Limit == 0 {
+		return fmt.Sprintf("%ss are not allowed while identity verification is %s", e.Operation, strings.ReplaceAll(e.Tier, "_", " "))
+	}
+	if e.Tier == KYCVerified {
+		return fmt.Sprintf("this would exceed your %s limit of %.2f", e.Operation, e.Limit)
+	}
+	return fmt.Sprintf("this would exceed the %.2f %s limit for unverified accounts; verify your identity to raise it", e.Limit, e.Operation)
+}
+
+var nationalIDRegexp = regexp.MustCompile(`^[A-Za-z0-9-]{5,20}$`)
+
+func validateKYCDetails(fullName, dateOfBirth, nationalID string) error {
+	if strings.TrimSpace(fullName) == "" {
+		return errors.New("full name is required")
+	}
+	dob, err := time.Parse("2006-01-02", dateOfBirth)
+	if err != nil {
+		return errors.New("date of birth must be YYYY-MM-DD")
+	}
+	if dob.AddDate(18, 0, 0).After(time.Now()) {
+		return errors.New("account holders must be at least 18 years old")
+	}
+	if !nationalIDRegexp.MatchString(nationalID) {
+		return errors.New("national ID must be 5 to 20 letters, digits or dashes")
+	}
+	return nil
+}
+
+// editableKYC matches accounts whose identity details can still change.
+func editableKYC(accountID primitive.ObjectID) bson.M {
+	return bson.M{"_id": accountID, "kyc.status": bson.M{"$in": []interface{}{KYCUnverified, KYCRejected, nil}}}
+}
+
+func (m *AccManager) kycUpdate(filter, update bson.M, notMatched error) (*KYCProfile, error) {
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var account BankAccount
+	err := m.accounts.FindOneAndUpdate(context.TODO(), filter, update, opts).Decode(&account)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, notMatched
+	} else if err != nil {
+		return nil, err
+	}
+	account.KYC.Status = account.KYC.State()
+	return &account.KYC, nil
+}
+
+func (m *AccManager) GetKYCProfile(accountID primitive.ObjectID) (*KYCProfile, error) {
+	account, err := m.SearchAccountById(accountID)
+	if err != nil {
+		return nil, err
+	}
+	if account == nil {
+		return nil, errors.New("account not found")
+	}
+	account.KYC.Status = account.KYC.State()
+	return &account.KYC, nil
+}
+
+func (m *AccManager) UpdateKYCDetails(accountID primitive.ObjectID, fullName, dateOfBirth, nationalID string) (*KYCProfile, error) {
+	fullName = strings.Join(strings.Fields(fullName), " ")
+	nationalID = strings.TrimSpace(nationalID)
+	if err := validateKYCDetails(fullName, dateOfBirth, nationalID); err != nil {
+		return nil, err
+	}
+
+	update := bson.M{"$set": bson.M{
+		"kyc.full_name":     fullName,
+		"kyc.date_of_birth": dateOfBirth,
+		"kyc.national_id":   nationalID,
+		"updated_at":        time.Now(),
+	}}
+	return m.kycUpdate(editableKYC(accountID), update, ErrKYCLocked)
+}
+
+func (m *AccManager) AddKYCDocument(accountID primitive.ObjectID, document KYCDocument) (*KYCProfile, error) {
+	update := bson.M{
+		"$push": bson.M{"kyc.documents": document},
+		"$set":  bson.M{"updated_at": time.Now()},
+	}
+	return m.kycUpdate(editableKYC(accountID), update, ErrKYCLocked)
+}
+
+// SubmitKYC moves a complete profile to pending review.
+func (m *AccManager) SubmitKYC(accountID primitive.ObjectID) (*KYCProfile, error) {
+	profile, err := m.GetKYCProfile(accountID)
+	if err != nil {
+		return nil, err
+	}
+	if profile.State() != KYCUnverified && profile.State() != KYCRejected {
+		return nil, ErrKYCLocked
+	}
+	if profile.FullName == "" || profile.DateOfBirth == "" || profile.NationalID == "" || len(profile.Documents) == 0 {
+		return nil, ErrKYCIncomplete
+	}
+
+	update := bson.M{
+		"$set":   bson.M{"kyc.status": KYCPendingReview, "kyc.submitted_at": time.Now(), "updated_at": time.Now()},
+		"$unset": bson.M{"kyc.rejection_reason": ""},
+	}
+	return m.kycUpdate(editableKYC(accountID), update, ErrKYCLocked)
+}
+
+// ReviewKYC verifies or rejects an account that is pending review.
+func (m *AccManager) ReviewKYC(accountID, reviewerID primitive.ObjectID, approve bool, reason string) (*KYCProfile, error) {
+	set := bson.M{
+		"kyc.status":      KYCVerified,
+		"kyc.reviewed_at": time.Now(),
+		"kyc.reviewed_by": reviewerID,
+		"updated_at":      time.Now(),
+	}
+	if !approve {
+		reason = strings.TrimSpace(reason)
+		if reason == "" {
+			return nil, errors.New("a reason is required to reject")
+		}
+		set["kyc.status"] = KYCRejected
+		set["kyc.rejection_reason"] = reason
+	}
+
+	filter := bson.M{"_id": accountID, "kyc.status": KYCPendingReview}
+	return m.kycUpdate(filter, bson.M{"$set": set}, ErrKYCNotPending)
+}
+
+// GetKYCQueue lists accounts in the given KYC state, oldest submission first.
+func (m *AccManager) GetKYCQueue(status string) ([]BankAccount, error) {
+	filter := bson.M{"kyc.status": status}
+	if status == KYCUnverified {
+		filter["kyc.status"] = bson.M{"$in": []interface{}{KYCUnverified, nil}}
+	}
+	opts := options.Find().
+		SetSort(bson.D{{Key: "kyc.submitted_at", Value: 1}}).
+		SetProjection(bson.M{"password": 0})
+
+	cursor, err := m.accounts.Find(context.TODO(), filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+
+	accounts := []BankAccount{}
+	if err := cursor.All(context.TODO(), &accounts); err != nil {
+		return nil, err
+	}
+	return accounts, nil
+}
+
+// checkKYCLimits enforces the account's tier limits on a transfer or
+// deposit, counting what it already moved over the last 24 hours.
+func (m *AccManager) checkKYCLimits(sessCtx mongo.SessionContext, account *BankAccount, operation string, amount float64) error {
+	if account.Role == RoleBank {
+		return nil
+	}
+
+	tier := account.KYC.State()
+	limits := KYCTierLimits[tier]
+
+	daily := limits.DailyDeposits
+	match := bson.M{"to_account": account.ID, "type": TransactionDeposit}
+	if operation == FeeOperationTransfer {
+		if amount > limits.MaxTransfer {
+			return &KYCLimitError{Tier: tier, Operation: "transfer", Limit: limits.MaxTransfer}
+		}
+		daily = limits.DailyTransfers
+		match = bson.M{"from_account": account.ID, "type": bson.M{"$in": []interface{}{TransactionTransfer, nil}}}
+	}
+	if daily == 0 {
+		return &KYCLimitError{Tier: tier, Operation: operation, Limit: 0}
+	}
+
+	match["timestamp"] = bson.M{"$gte": time.Now().Add(-24 * time.Hour)}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$group", Value: bson.M{"_id": nil, "total": bson.M{"$sum": "$amount"}}}},
+	}
+	cursor, err := m.transactions.Aggregate(sessCtx, pipeline)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(sessCtx)
+
+	var result []struct {
+		Total float64 `bson:"total"`
+	}
+	if err := cursor.All(sessCtx, &result); err != nil {
+		return err
+	}
+	var total float64
+	if len(result) > 0 {
+		total = result[0].Total
+	}
+
+	if total+amount > daily {
+		return &KYCLimitError{Tier: tier, Operation: "daily " + operation, Limit: daily}
+	}
+	return nil
+}
@@ -0,0 +1,251 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Failed logins are counted per username and per client IP.
+const (
+	LoginKeyUsername = "username"
+	LoginKeyIP       = "ip"
+)
+
+// The first FreeLoginFailures failures cost nothing. Each one after that
+// doubles the wait before the next try, starting at a second, and reaching
+// MaxLoginFailures (per username) or MaxIPLoginFailures (per IP) locks logins
+// for LoginLockout. Counts are forgotten LoginFailureMemory after the last
+// failure.
+const (
+	FreeLoginFailures  = 3
+	MaxLoginFailures   = 10
+	MaxIPLoginFailures = 50
+	LoginLockout       = 15 * time.Minute
+	LoginFailureMemory = 24 * time.Hour
+)
+
+var ErrLoginLockoutNotFound = errors.New("login lockout not found")
+
+// LoginThrottledError is returned while logins for a username or IP wait
+// out their backoff or lockout.
+type LoginThrottledError struct {
+	RetryAfter time.Duration
+	Locked     bool
+}
+
+func (e *LoginThrottledError) Error() string {
+	if e.Locked {
+		return "too many failed logins, logins are locked for a while"
+	}
+	return "too many failed logins, wait a moment before trying again"
+}
+
+// LoginAttempts is the failed login count for one username or IP.
+type LoginAttempts struct {
+	ID            primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Kind          string             `bson:"kind" json:"kind"`
+	Key           string             `bson:"key" json:"key"`
+	Failures      int                `bson:"failures" json:"failures"`
+	LastFailureAt time.Time          `bson:"last_failure_at" json:"last_failure_at"`
+	RetryAt       time.Time          `bson:"retry_at" json:"retry_at"`
+	LockedUntil   *time.Time         `bson:"locked_until,omitempty" json:"locked_until,omitempty"`
+	ExpiresAt     time.Time          `bson:"expires_at" json:"-"`
+}
+
+// LoginKey normalises a username so "Alice" and "alice " share a count.
+func LoginKey(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+func maxLoginFailures(kind string) int {
+	if kind == LoginKeyIP {
+		return MaxIPLoginFailures
+	}
+	return MaxLoginFailures
+}
+
+// loginBackoff is how long to wait after the nth failure in a row.
+func loginBackoff(failures int) time.Duration {
+	if failures <= FreeLoginFailures {
+		return 0
+	}
+	backoff := time.Duration(math.Pow(2, float64(failures-FreeLoginFailures-1))) * time.Second
+	if backoff > LoginLockout {
+		return LoginLockout
+	}
+	return backoff
+}
+
+// CheckLoginThrottle returns a *LoginThrottledError if the username or the
+// IP has to wait before trying to log in again.
+func (m *AccManager) CheckLoginThrottle(username, ip string) error {
+	cursor, err := m.loginAttempts.Find(context.TODO(), bson.M{"$or": []bson.M{
+		{"kind": LoginKeyUsername, "key": LoginKey(username)},
+		{"kind": LoginKeyIP, "key": ip},
+	}})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(context.TODO())
+
+	var attempts []LoginAttempts
+	if err := cursor.All(context.TODO(), &attempts); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	var throttled *LoginThrottledError
+	for _, a := range attempts {
+		retryAt, locked := a.RetryAt, false
+		if a.LockedUntil != nil && a.LockedUntil.After(retryAt) {
+			retryAt, locked = *a.LockedUntil, true
+		}
+		if !retryAt.After(now) {
+			continue
+		}
+		if throttled == nil || retryAt.Sub(now) > throttled.RetryAfter {
+			throttled = &LoginThrottledError{RetryAfter: retryAt.Sub(now), Locked: locked}
+		}
+	}
+	if throttled != nil {
+		return throttled
+	}
+	return nil
+}
+
+// RecordLoginFailure counts a failed login against the username and the IP.
+// It reports which of them this failure locked.
+func (m *AccManager) RecordLoginFailure(username, ip string) ([]LoginAttempts, error) {
+	var locked []LoginAttempts
+	for _, key := range []struct{ kind, key string }{{LoginKeyUsername, LoginKey(username)}, {LoginKeyIP, ip}} {
+		if key.key == "" {
+			continue
+		}
+		attempts, err := m.recordLoginFailure(key.kind, key.key)
+		if err != nil {
+			return nil, err
+		}
+		if attempts.LockedUntil != nil && attempts.Failures == maxLoginFailures(key.kind) {
+			locked = append(locked, *attempts)
+		}
+	}
+	return locked, nil
+}
+
+func (m *AccManager) recordLoginFailure(kind, key string) (*LoginAttempts, error) {
+	now := time.Now()
+	var attempts LoginAttempts
+	err := m.loginAttempts.FindOneAndUpdate(context.TODO(),
+		bson.M{"kind": kind, "key": key},
+		bson.M{
+			"$inc": bson.M{"failures": 1},
+			"$set": bson.M{"last_failure_at": now, "expires_at": now.Add(LoginFailureMemory)},
+		},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).Decode(&attempts)
+	if err != nil {
+		return nil, err
+	}
+
+	set := bson.M{"retry_at": now.Add(loginBackoff(attempts.Failures))}
+	if attempts.Failures >= maxLoginFailures(kind) {
+		lockedUntil := now.Add(LoginLockout)
+		set["locked_until"] = lockedUntil
+		attempts.LockedUntil = &lockedUntil
+	}
+	if _, err := m.loginAttempts.UpdateOne(context.TODO(), bson.M{"_id": attempts.ID}, bson.M{"$set": set}); err != nil {
+		return nil, err
+	}
+	return &attempts, nil
+}
+
+// ClearLoginFailures forgets the failed logins of a username after it logs
+// in. Failures of the IP stay, so one good login doesn't reset a password
+// spraying run.
+func (m *AccManager) ClearLoginFailures(username string) error {
+	_, err := m.loginAttempts.DeleteOne(context.TODO(), bson.M{"kind": LoginKeyUsername, "key": LoginKey(username)})
+	return err
+}
+
+// GetLoginLockouts lists the usernames and IPs currently waiting out a
+// backoff or lockout, most recent failure first.
+func (m *AccManager) GetLoginLockouts() ([]LoginAttempts, error) {
+	now := time.Now()
+	filter := bson.M{"$or": []bson.M{
+		{"retry_at": bson.M{"$gt": now}},
+		{"locked_until": bson.M{"$gt": now}},
+	}}
+	opts := options.Find().SetSort(bson.D{{Key: "last_failure_at", Value: -1}})
+
+	cursor, err := m.loginAttempts.Find(context.TODO(), filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+
+	lockouts := []LoginAttempts{}
+	if err := cursor.All(context.TODO(), &lockouts); err != nil {
+		return nil, err
+	}
+	return lockouts, nil
+}
+
+// DeleteLoginLockout lifts one lockout from GetLoginLockouts.
+func (m *AccManager) DeleteLoginLockout(id primitive.ObjectID) (*LoginAttempts, error) {
+	var attempts LoginAttempts
+	err := m.loginAttempts.FindOneAndDelete(context.TODO(), bson.M{"_id": id}).Decode(&attempts)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrLoginLockoutNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &attempts, nil
+}
+
+// UnlockLogin lifts the lockout of every username an account logs in with:
+// its account holder name and its phone number.
+func (m *AccManager) UnlockLogin(account *BankAccount) (int64, error) {
+	keys := []string{LoginKey(account.AccountHolder)}
+	if account.PhoneNumber != "" {
+		keys = append(keys, LoginKey(account.PhoneNumber))
+	}
+	result, err := m.loginAttempts.DeleteMany(context.TODO(), bson.M{"kind": LoginKeyUsername, "key": bson.M{"$in": keys}})
+	if err != nil {
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
+
+// GetAccountsByLogin finds the accounts a login name refers to: accounts
+// whose holder name or phone number is exactly name.
+func (m *AccManager) GetAccountsByLogin(name string) ([]*BankAccount, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, nil
+	}
+
+	cursor, err := m.accounts.Find(context.TODO(), bson.M{
+		"erased_at": nil,
+		"$or": []bson.M{
+			{"account_holder": name},
+			{"phone_number": name},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+
+	var accounts []*BankAccount
+	if err := cursor.All(context.TODO(), &accounts); err != nil {
+		return nil, err
+	}
+	return accounts, nil
+}
@@ -0,0 +1,160 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	MoneyRequestPending   = "pending"
+	MoneyRequestPaid      = "paid"
+	MoneyRequestDeclined  = "declined"
+	MoneyRequestCancelled = "cancelled"
+	MoneyRequestExpired   = "expired"
+	// MoneyRequestAwaitingReview is a request whose payment is held for
+	// fraud review. It is neither payable nor expired until the review ends.
+	MoneyRequestAwaitingReview = "awaiting_review"
+
+	DefaultMoneyRequestTTL = 7 * 24 * time.Hour
+)
+
+var (
+	ErrMoneyRequestNotFound = errors.New("money request not found")
+	ErrMoneyRequestClosed   = errors.New("money request is no longer pending")
+)
+
+// MoneyRequest is a request from RequesterID asking PayerID to send Amount.
+type MoneyRequest struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	RequesterID primitive.ObjectID `bson:"requester_id" json:"requester_id"`
+	PayerID     primitive.ObjectID `bson:"payer_id" json:"payer_id"`
+	Amount      float64            `bson:"amount" json:"amount"`
+	Note        string             `bson:"note" json:"note"`
+	Status      string             `bson:"status" json:"status"`
+	ExpiresAt   time.Time          `bson:"expires_at" json:"expires_at"`
+	CreatedAt   time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt   time.Time          `bson:"updated_at" json:"updated_at"`
+}
+
+func (m *AccManager) CreateMoneyRequest(requesterID, payerID primitive.ObjectID, amount float64, note string, ttl time.Duration) (*MoneyRequest, error) {
+	if amount <= 0 {
+		return nil, errors.New("requested amount must be greater than zero")
+	}
+	if requesterID == payerID {
+		return nil, errors.New("you cannot request money from yourself")
+	}
+	if ttl <= 0 {
+		ttl = DefaultMoneyRequestTTL
+	}
+
+	now := time.Now()
+	request := MoneyRequest{
+		RequesterID: requesterID,
+		PayerID:     payerID,
+		Amount:      amount,
+		Note:        note,
+		Status:      MoneyRequestPending,
+		ExpiresAt:   now.Add(ttl),
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+
+	insertResult, err := m.moneyRequests.InsertOne(context.TODO(), request)
+	if err != nil {
+		return nil, err
+	}
+
+	request.ID = insertResult.InsertedID.(primitive.ObjectID)
+	return &request, nil
+}
+
+// expireMoneyRequests marks every pending request past its expiry as expired.
+func (m *AccManager) expireMoneyRequests() error {
+	filter := bson.M{"status": MoneyRequestPending, "expires_at": bson.M{"$lte": time.Now()}}
+	update := bson.M{"$set": bson.M{"status": MoneyRequestExpired, "updated_at": time.Now()}}
+	_, err := m.moneyRequests.UpdateMany(context.TODO(), filter, update)
+	return err
+}
+
+func (m *AccManager) GetMoneyRequestById(id primitive.ObjectID) (*MoneyRequest, error) {
+	if err := m.expireMoneyRequests(); err != nil {
+		return nil, err
+	}
+
+	var request MoneyRequest
+	err := m.moneyRequests.FindOne(context.TODO(), bson.M{"_id": id}).Decode(&request)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrMoneyRequestNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &request, nil
+}
+
+// GetMoneyRequests lists requests the account sent (incoming=false) or
+// received (incoming=true), newest first. An empty status matches any status.
+func (m *AccManager) GetMoneyRequests(accountID primitive.ObjectID, incoming bool, status string) ([]MoneyRequest, error) {
+	if err := m.expireMoneyRequests(); err != nil {
+		return nil, err
+	}
+
+	filter := bson.M{"requester_id": accountID}
+	if incoming {
+		filter = bson.M{"payer_id": accountID}
+	}
+	if status != "" {
+		filter["status"] = status
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}})
+	cursor, err := m.moneyRequests.Find(context.TODO(), filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+
+	requests := []MoneyRequest{}
+	if err := cursor.All(context.TODO(), &requests); err != nil {
+		return nil, err
+	}
+	return requests, nil
+}
+
+// GetLatestPendingMoneyRequest returns the newest pending request addressed to payerID.
+func (m *AccManager) GetLatestPendingMoneyRequest(payerID primitive.ObjectID) (*MoneyRequest, error) {
+	requests, err := m.GetMoneyRequests(payerID, true, MoneyRequestPending)
+	if err != nil {
+		return nil, err
+	}
+	if len(requests) == 0 {
+		return nil, ErrMoneyRequestNotFound
+	}
+	return &requests[0], nil
+}
+
+// SetMoneyRequestStatus atomically moves a request from one status to another.
+// Moving out of pending only succeeds while the request has not expired, so
+// two concurrent replies can never both pay the same request.
+func (m *AccManager) SetMoneyRequestStatus(id primitive.ObjectID, from, to string) (*MoneyRequest, error) {
+	filter := bson.M{"_id": id, "status": from}
+	if from == MoneyRequestPending {
+		filter["expires_at"] = bson.M{"$gt": time.Now()}
+	}
+	update := bson.M{"$set": bson.M{"status": to, "updated_at": time.Now()}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var request MoneyRequest
+	err := m.moneyRequests.FindOneAndUpdate(context.TODO(), filter, update, opts).Decode(&request)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrMoneyRequestClosed
+	} else if err != nil {
+		return nil, err
+	}
+	return &request, nil
+}
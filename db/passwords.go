@@ -0,0 +1,129 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/tamir-liebermann/gobank/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// A reset code works once, for PasswordResetTTL, and is thrown away after
+// MaxPasswordResetAttempts wrong guesses. A new one can be requested every
+// PasswordResetCooldown.
+const (
+	PasswordResetTTL         = 15 * time.Minute
+	PasswordResetCooldown    = time.Minute
+	MaxPasswordResetAttempts = 5
+)
+
+var (
+	ErrPasswordResetInvalid = errors.New("the reset code is wrong or has expired")
+	ErrPasswordResetTooSoon = errors.New("a reset code was just sent, wait a minute before asking for another")
+)
+
+// PasswordReset is a password reset code waiting to be used.
+type PasswordReset struct {
+	CodeHash    string    `bson:"code_hash"`
+	RequestedAt time.Time `bson:"requested_at"`
+	ExpiresAt   time.Time `bson:"expires_at"`
+	Attempts    int       `bson:"attempts,omitempty"`
+}
+
+// StartPasswordReset stores the hash of a new reset code for the account,
+// replacing any earlier one.
+func (m *AccManager) StartPasswordReset(accountID primitive.ObjectID, codeHash string) error {
+	now := time.Now()
+	result, err := m.accounts.UpdateOne(context.TODO(),
+		bson.M{"_id": accountID, "$or": []bson.M{
+			{"password_reset": nil},
+			{"password_reset.requested_at": bson.M{"$lt": now.Add(-PasswordResetCooldown)}},
+		}},
+		bson.M{"$set": bson.M{"password_reset": PasswordReset{
+			CodeHash:    codeHash,
+			RequestedAt: now,
+			ExpiresAt:   now.Add(PasswordResetTTL),
+		}}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrPasswordResetTooSoon
+	}
+	return nil
+}
+
+// UsePasswordResetCode spends the account's reset code. A wrong code counts
+// as an attempt, and the code is dropped once they run out.
+func (m *AccManager) UsePasswordResetCode(accountID primitive.ObjectID, code string) error {
+	account, err := m.SearchAccountById(accountID)
+	if err != nil {
+		return err
+	}
+	if account == nil || account.PasswordReset == nil || time.Now().After(account.PasswordReset.ExpiresAt) {
+		return ErrPasswordResetInvalid
+	}
+	reset := account.PasswordReset
+
+	if utils.CheckCodeHash(code, reset.CodeHash) {
+		// Only the request that removes the code gets to use it
+		result, err := m.accounts.UpdateOne(context.TODO(),
+			bson.M{"_id": accountID, "password_reset.code_hash": reset.CodeHash},
+			bson.M{"$unset": bson.M{"password_reset": ""}})
+		if err != nil {
+			return err
+		}
+		if result.ModifiedCount == 0 {
+			return ErrPasswordResetInvalid
+		}
+		return nil
+	}
+
+	var updated BankAccount
+	err = m.accounts.FindOneAndUpdate(context.TODO(),
+		bson.M{"_id": accountID, "password_reset.code_hash": reset.CodeHash},
+		bson.M{"$inc": bson.M{"password_reset.attempts": 1}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&updated)
+	if err != nil {
+		return ErrPasswordResetInvalid
+	}
+	if updated.PasswordReset != nil && updated.PasswordReset.Attempts >= MaxPasswordResetAttempts {
+		if _, err := m.accounts.UpdateOne(context.TODO(),
+			bson.M{"_id": accountID},
+			bson.M{"$unset": bson.M{"password_reset": ""}}); err != nil {
+			return err
+		}
+	}
+	return ErrPasswordResetInvalid
+}
+
+// SetPassword replaces the account's password hash. It clears a pending
+// reset code and the flag forcing a password change.
+func (m *AccManager) SetPassword(accountID primitive.ObjectID, passwordHash string) error {
+	now := time.Now()
+	result, err := m.accounts.UpdateOne(context.TODO(),
+		bson.M{"_id": accountID},
+		bson.M{
+			"$set":   bson.M{"password": passwordHash, "password_changed_at": now, "updated_at": now},
+			"$unset": bson.M{"password_reset": "", "must_change_password": ""},
+		})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrAccountNotFound
+	}
+	return nil
+}
+
+// RequirePasswordChange stops the account from signing in with its current
+// password; it has to be reset first.
+func (m *AccManager) RequirePasswordChange(accountID primitive.ObjectID) error {
+	_, err := m.accounts.UpdateOne(context.TODO(),
+		bson.M{"_id": accountID},
+		bson.M{"$set": bson.M{"must_change_password": true, "updated_at": time.Now()}})
+	return err
+}
@@ -0,0 +1,159 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrPayeeExists   = errors.New("a payee with this nickname already exists")
+	ErrPayeeNotFound = errors.New("payee not found")
+)
+
+// Payee is an entry in a user's address book of saved transfer recipients.
+type Payee struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	OwnerID     primitive.ObjectID `bson:"owner_id" json:"owner_id"`
+	Nickname    string             `bson:"nickname" json:"nickname"`
+	NicknameKey string             `bson:"nickname_key" json:"-"`
+	AccountID   primitive.ObjectID `bson:"account_id" json:"account_id"`
+	PhoneNumber string             `bson:"phone_number" json:"phone_number"`
+	CreatedAt   time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt   time.Time          `bson:"updated_at" json:"updated_at"`
+}
+
+func payeeNicknameKey(nickname string) string {
+	return strings.ToLower(strings.Join(strings.Fields(nickname), " "))
+}
+
+func (m *AccManager) CreatePayee(ownerID, accountID primitive.ObjectID, nickname, phoneNumber string) (*Payee, error) {
+	nickname = strings.TrimSpace(nickname)
+	if nickname == "" {
+		return nil, errors.New("nickname is required")
+	}
+
+	payee := Payee{
+		OwnerID:     ownerID,
+		Nickname:    nickname,
+		NicknameKey: payeeNicknameKey(nickname),
+		AccountID:   accountID,
+		PhoneNumber: phoneNumber,
+		CreatedAt:   time.Now(),
+		UpdatedAt:   time.Now(),
+	}
+
+	insertResult, err := m.payees.InsertOne(context.TODO(), payee)
+	if mongo.IsDuplicateKeyError(err) {
+		return nil, ErrPayeeExists
+	} else if err != nil {
+		return nil, err
+	}
+
+	payee.ID = insertResult.InsertedID.(primitive.ObjectID)
+	return &payee, nil
+}
+
+func (m *AccManager) GetPayees(ownerID primitive.ObjectID) ([]Payee, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "nickname_key", Value: 1}})
+	cursor, err := m.payees.Find(context.TODO(), bson.M{"owner_id": ownerID}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+
+	payees := []Payee{}
+	if err := cursor.All(context.TODO(), &payees); err != nil {
+		return nil, err
+	}
+	return payees, nil
+}
+
+func (m *AccManager) GetPayeeById(ownerID, payeeID primitive.ObjectID) (*Payee, error) {
+	var payee Payee
+	err := m.payees.FindOne(context.TODO(), bson.M{"_id": payeeID, "owner_id": ownerID}).Decode(&payee)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrPayeeNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &payee, nil
+}
+
+// FindPayeesByNickname returns the owner's payees matching nickname and
+// whether the match is exact. An exact (case-insensitive) match wins;
+// otherwise every payee whose nickname starts with the given text is returned
+// as a suggestion, so the caller can ask which one was meant.
+func (m *AccManager) FindPayeesByNickname(ownerID primitive.ObjectID, nickname string) ([]Payee, bool, error) {
+	key := payeeNicknameKey(nickname)
+	if key == "" {
+		return nil, false, nil
+	}
+
+	var exact Payee
+	err := m.payees.FindOne(context.TODO(), bson.M{"owner_id": ownerID, "nickname_key": key}).Decode(&exact)
+	if err == nil {
+		return []Payee{exact}, true, nil
+	} else if !errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, false, err
+	}
+
+	filter := bson.M{
+		"owner_id":     ownerID,
+		"nickname_key": primitive.Regex{Pattern: "^" + regexp.QuoteMeta(key)},
+	}
+	cursor, err := m.payees.Find(context.TODO(), filter)
+	if err != nil {
+		return nil, false, err
+	}
+	defer cursor.Close(context.TODO())
+
+	var payees []Payee
+	if err := cursor.All(context.TODO(), &payees); err != nil {
+		return nil, false, err
+	}
+	return payees, false, nil
+}
+
+func (m *AccManager) RenamePayee(ownerID, payeeID primitive.ObjectID, nickname string) (*Payee, error) {
+	nickname = strings.TrimSpace(nickname)
+	if nickname == "" {
+		return nil, errors.New("nickname is required")
+	}
+
+	update := bson.M{"$set": bson.M{
+		"nickname":     nickname,
+		"nickname_key": payeeNicknameKey(nickname),
+		"updated_at":   time.Now(),
+	}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var payee Payee
+	err := m.payees.FindOneAndUpdate(context.TODO(), bson.M{"_id": payeeID, "owner_id": ownerID}, update, opts).Decode(&payee)
+	if mongo.IsDuplicateKeyError(err) {
+		return nil, ErrPayeeExists
+	} else if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrPayeeNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &payee, nil
+}
+
+func (m *AccManager) DeletePayee(ownerID, payeeID primitive.ObjectID) error {
+	deleteResult, err := m.payees.DeleteOne(context.TODO(), bson.M{"_id": payeeID, "owner_id": ownerID})
+	if err != nil {
+		return err
+	}
+	if deleteResult.DeletedCount == 0 {
+		return ErrPayeeNotFound
+	}
+	return nil
+}
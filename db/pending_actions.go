@@ -0,0 +1,190 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Kinds of chat actions that wait for the user to reply "confirm".
+const (
+	PendingActionTransfer   = "transfer"
+	PendingActionErasure    = "erasure"
+	PendingActionPayRequest = "pay_request"
+)
+
+// How a pending action is confirmed: with a plain "confirm", with a one-time
+// code that came with the summary, or with the account's transaction PIN.
+const (
+	ConfirmPlain = ""
+	ConfirmCode  = "code"
+	ConfirmPIN   = "pin"
+)
+
+// DefaultPendingActionTTL is how long a chat action waits for confirmation.
+const DefaultPendingActionTTL = 10 * time.Minute
+
+// After MaxConfirmAttempts wrong codes in a row the pending action is dropped,
+// and the account can't confirm chat actions for ConfirmLockout. Wrong codes
+// are counted on the account, so asking for a new action doesn't reset them.
+const (
+	MaxConfirmAttempts = 3
+	ConfirmLockout     = 15 * time.Minute
+)
+
+var (
+	ErrNoPendingAction = errors.New("nothing is waiting for confirmation")
+	ErrConfirmLocked   = errors.New("too many wrong codes were entered, so confirmations are paused for a while")
+)
+
+// PendingAction is a chat action that was quoted to the user but only runs
+// once they confirm it. An account has at most one at a time; asking for
+// something new replaces whatever was waiting.
+type PendingAction struct {
+	ID        primitive.ObjectID     `bson:"_id,omitempty" json:"id"`
+	AccountID primitive.ObjectID     `bson:"account_id" json:"account_id"`
+	Kind      string                 `bson:"kind" json:"kind"`
+	Payload   map[string]interface{} `bson:"payload" json:"payload"`
+	Summary   string                 `bson:"summary" json:"summary"`
+	CreatedAt time.Time              `bson:"created_at" json:"created_at"`
+	ExpiresAt time.Time              `bson:"expires_at" json:"expires_at"`
+
+	Challenge string `bson:"challenge,omitempty" json:"challenge,omitempty"`
+	CodeHash  string `bson:"code_hash,omitempty" json:"-"`
+}
+
+// CreatePendingAction stores an action waiting for confirmation. codeHash is
+// the hash of the one-time code for ConfirmCode challenges.
+func (m *AccManager) CreatePendingAction(accountID primitive.ObjectID, kind string, payload map[string]interface{}, summary string, ttl time.Duration, challenge, codeHash string) (*PendingAction, error) {
+	_, err := m.pendingActions.DeleteMany(context.TODO(), bson.M{"account_id": accountID})
+	if err != nil {
+		return nil, err
+	}
+
+	action := PendingAction{
+		AccountID: accountID,
+		Kind:      kind,
+		Payload:   payload,
+		Summary:   summary,
+		CreatedAt: time.Now(),
+		ExpiresAt: time.Now().Add(ttl),
+		Challenge: challenge,
+		CodeHash:  codeHash,
+	}
+	insertResult, err := m.pendingActions.InsertOne(context.TODO(), action)
+	if err != nil {
+		return nil, err
+	}
+	action.ID = insertResult.InsertedID.(primitive.ObjectID)
+	return &action, nil
+}
+
+// TakePendingAction removes and returns the account's unexpired pending
+// action. Removing it atomically means a repeated "confirm" can't run the
+// same action twice.
+func (m *AccManager) TakePendingAction(accountID primitive.ObjectID) (*PendingAction, error) {
+	filter := bson.M{"account_id": accountID, "expires_at": bson.M{"$gt": time.Now()}}
+	opts := options.FindOneAndDelete().SetSort(bson.D{{Key: "created_at", Value: -1}})
+
+	var action PendingAction
+	err := m.pendingActions.FindOneAndDelete(context.TODO(), filter, opts).Decode(&action)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrNoPendingAction
+	} else if err != nil {
+		return nil, err
+	}
+	return &action, nil
+}
+
+// PeekPendingAction returns the account's unexpired pending action without
+// taking it, so its code can be checked first.
+func (m *AccManager) PeekPendingAction(accountID primitive.ObjectID) (*PendingAction, error) {
+	filter := bson.M{"account_id": accountID, "expires_at": bson.M{"$gt": time.Now()}}
+	opts := options.FindOne().SetSort(bson.D{{Key: "created_at", Value: -1}})
+
+	var action PendingAction
+	err := m.pendingActions.FindOne(context.TODO(), filter, opts).Decode(&action)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrNoPendingAction
+	} else if err != nil {
+		return nil, err
+	}
+	return &action, nil
+}
+
+// TakePendingActionByID removes and returns the pending action that was
+// checked, failing if it was taken or replaced meanwhile.
+func (m *AccManager) TakePendingActionByID(accountID, actionID primitive.ObjectID) (*PendingAction, error) {
+	filter := bson.M{"_id": actionID, "account_id": accountID, "expires_at": bson.M{"$gt": time.Now()}}
+
+	var action PendingAction
+	err := m.pendingActions.FindOneAndDelete(context.TODO(), filter).Decode(&action)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrNoPendingAction
+	} else if err != nil {
+		return nil, err
+	}
+	return &action, nil
+}
+
+// RecordConfirmFailure counts a wrong code against the account. Once it runs
+// out of attempts the action is dropped and the account's confirmations are
+// locked; it reports how many attempts are left.
+func (m *AccManager) RecordConfirmFailure(action *PendingAction) (int, error) {
+	var account BankAccount
+	err := m.accounts.FindOneAndUpdate(context.TODO(),
+		bson.M{"_id": action.AccountID},
+		bson.M{"$inc": bson.M{"confirm_failures": 1}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&account)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return 0, ErrAccountNotFound
+	} else if err != nil {
+		return 0, err
+	}
+	if left := MaxConfirmAttempts - account.ConfirmFailures; left > 0 {
+		return left, nil
+	}
+
+	if _, err := m.pendingActions.DeleteMany(context.TODO(), bson.M{"account_id": action.AccountID}); err != nil {
+		return 0, err
+	}
+	_, err = m.accounts.UpdateOne(context.TODO(),
+		bson.M{"_id": action.AccountID},
+		bson.M{
+			"$set":   bson.M{"confirm_locked_until": time.Now().Add(ConfirmLockout)},
+			"$unset": bson.M{"confirm_failures": ""},
+		})
+	return 0, err
+}
+
+// ClearConfirmFailures forgets the account's wrong codes once a right one is
+// given.
+func (m *AccManager) ClearConfirmFailures(accountID primitive.ObjectID) error {
+	_, err := m.accounts.UpdateOne(context.TODO(),
+		bson.M{"_id": accountID, "confirm_failures": bson.M{"$gt": 0}},
+		bson.M{"$unset": bson.M{"confirm_failures": ""}})
+	return err
+}
+
+// SetTransactionPIN stores the hash of the PIN chat actions are confirmed
+// with. An empty hash removes the PIN, and one-time codes are used again.
+func (m *AccManager) SetTransactionPIN(accountID primitive.ObjectID, pinHash string) error {
+	update := bson.M{"$set": bson.M{"transaction_pin": pinHash, "updated_at": time.Now()}}
+	if pinHash == "" {
+		update = bson.M{"$unset": bson.M{"transaction_pin": ""}, "$set": bson.M{"updated_at": time.Now()}}
+	}
+
+	result, err := m.accounts.UpdateOne(context.TODO(), bson.M{"_id": accountID}, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrAccountNotFound
+	}
+	return nil
+}
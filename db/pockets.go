@@ -0,0 +1,264 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrPocketExists   = errors.New("a pocket with this name already exists")
+	ErrPocketNotFound = errors.New("pocket not found")
+)
+
+// Pocket is a named sub-balance ring-fenced inside an account. Money in a
+// pocket is not part of the account's spendable Balance.
+type Pocket struct {
+	ID           primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	AccountID    primitive.ObjectID `bson:"account_id" json:"account_id"`
+	Name         string             `bson:"name" json:"name"`
+	NameKey      string             `bson:"name_key" json:"-"`
+	Balance      float64            `bson:"balance" json:"balance"`
+	TargetAmount float64            `bson:"target_amount,omitempty" json:"target_amount,omitempty"`
+	TargetDate   *time.Time         `bson:"target_date,omitempty" json:"target_date,omitempty"`
+	CreatedAt    time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt    time.Time          `bson:"updated_at" json:"updated_at"`
+}
+
+func pocketNameKey(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name), " "))
+}
+
+func (m *AccManager) CreatePocket(accountID primitive.ObjectID, name string, targetAmount float64, targetDate *time.Time) (*Pocket, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, errors.New("pocket name is required")
+	}
+	if targetAmount < 0 {
+		return nil, errors.New("target amount cannot be negative")
+	}
+
+	pocket := Pocket{
+		AccountID:    accountID,
+		Name:         name,
+		NameKey:      pocketNameKey(name),
+		TargetAmount: targetAmount,
+		TargetDate:   targetDate,
+		CreatedAt:    time.Now(),
+		UpdatedAt:    time.Now(),
+	}
+
+	insertResult, err := m.pockets.InsertOne(context.TODO(), pocket)
+	if mongo.IsDuplicateKeyError(err) {
+		return nil, ErrPocketExists
+	} else if err != nil {
+		return nil, err
+	}
+
+	pocket.ID = insertResult.InsertedID.(primitive.ObjectID)
+	return &pocket, nil
+}
+
+func (m *AccManager) GetPockets(accountID primitive.ObjectID) ([]Pocket, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "name_key", Value: 1}})
+	cursor, err := m.pockets.Find(context.TODO(), bson.M{"account_id": accountID}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+
+	pockets := []Pocket{}
+	if err := cursor.All(context.TODO(), &pockets); err != nil {
+		return nil, err
+	}
+	return pockets, nil
+}
+
+func (m *AccManager) GetPocketById(accountID, pocketID primitive.ObjectID) (*Pocket, error) {
+	var pocket Pocket
+	err := m.pockets.FindOne(context.TODO(), bson.M{"_id": pocketID, "account_id": accountID}).Decode(&pocket)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrPocketNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &pocket, nil
+}
+
+// FindPocketByName looks a pocket up by name, case-insensitively. If there is
+// no exact match a unique prefix match is accepted ("car" finds "Car fund").
+func (m *AccManager) FindPocketByName(accountID primitive.ObjectID, name string) (*Pocket, error) {
+	key := pocketNameKey(name)
+	if key == "" {
+		return nil, ErrPocketNotFound
+	}
+
+	var pocket Pocket
+	err := m.pockets.FindOne(context.TODO(), bson.M{"account_id": accountID, "name_key": key}).Decode(&pocket)
+	if err == nil {
+		return &pocket, nil
+	} else if !errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, err
+	}
+
+	filter := bson.M{"account_id": accountID, "name_key": primitive.Regex{Pattern: "^" + regexp.QuoteMeta(key)}}
+	cursor, err := m.pockets.Find(context.TODO(), filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+
+	var pockets []Pocket
+	if err := cursor.All(context.TODO(), &pockets); err != nil {
+		return nil, err
+	}
+	if len(pockets) != 1 {
+		return nil, ErrPocketNotFound
+	}
+	return &pockets[0], nil
+}
+
+func (m *AccManager) UpdatePocketGoal(accountID, pocketID primitive.ObjectID, targetAmount float64, targetDate *time.Time) (*Pocket, error) {
+	if targetAmount < 0 {
+		return nil, errors.New("target amount cannot be negative")
+	}
+
+	update := bson.M{"$set": bson.M{
+		"target_amount": targetAmount,
+		"target_date":   targetDate,
+		"updated_at":    time.Now(),
+	}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var pocket Pocket
+	err := m.pockets.FindOneAndUpdate(context.TODO(), bson.M{"_id": pocketID, "account_id": accountID}, update, opts).Decode(&pocket)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrPocketNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &pocket, nil
+}
+
+// MovePocketFunds moves amount between the account's main balance and one of
+// its pockets (into the pocket when toPocket is set) and records the move as
+// a transaction, all in one database transaction.
+func (m *AccManager) MovePocketFunds(accountID, pocketID primitive.ObjectID, amount float64, toPocket bool) (*Pocket, error) {
+	if amount <= 0 {
+		return nil, errors.New("amount must be greater than zero")
+	}
+
+	session, err := m.client.StartSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.EndSession(context.TODO())
+
+	result, err := session.WithTransaction(context.Background(), func(sessCtx mongo.SessionContext) (interface{}, error) {
+		return m.movePocketFundsInSession(sessCtx, accountID, pocketID, amount, toPocket)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.(*Pocket), nil
+}
+
+func (m *AccManager) movePocketFundsInSession(sessCtx mongo.SessionContext, accountID, pocketID primitive.ObjectID, amount float64, toPocket bool) (*Pocket, error) {
+	var account BankAccount
+	err := m.accounts.FindOne(sessCtx, bson.M{"_id": accountID}).Decode(&account)
+	if err != nil {
+		return nil, err
+	}
+
+	var pocket Pocket
+	err = m.pockets.FindOne(sessCtx, bson.M{"_id": pocketID, "account_id": accountID}).Decode(&pocket)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrPocketNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	delta := amount
+	transactionType := TransactionPocketIn
+	if toPocket {
+		if account.Balance < amount {
+			return nil, errors.New("insufficient funds")
+		}
+	} else {
+		if pocket.Balance < amount {
+			return nil, errors.New("insufficient funds in pocket")
+		}
+		delta = -amount
+		transactionType = TransactionPocketOut
+	}
+
+	_, err = m.accounts.UpdateOne(sessCtx,
+		bson.M{"_id": accountID},
+		bson.M{"$inc": bson.M{"balance": -delta}, "$set": bson.M{"updated_at": time.Now()}},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = m.pockets.UpdateOne(sessCtx,
+		bson.M{"_id": pocketID},
+		bson.M{"$inc": bson.M{"balance": delta}, "$set": bson.M{"updated_at": time.Now()}},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	transaction := Transaction{
+		FromAccount: accountID,
+		ToAccount:   accountID,
+		Amount:      amount,
+		Timestamp:   time.Now(),
+		Type:        transactionType,
+		PocketID:    pocketID,
+	}
+	_, err = m.transactions.InsertOne(sessCtx, transaction)
+	if err != nil {
+		return nil, err
+	}
+
+	pocket.Balance += delta
+	return &pocket, nil
+}
+
+// DeletePocket closes a pocket, returning whatever is left in it to the main
+// balance. Both happen in one database transaction, so the money can't be
+// returned without the pocket going, or the other way round.
+func (m *AccManager) DeletePocket(accountID, pocketID primitive.ObjectID) error {
+	session, err := m.client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(context.TODO())
+
+	_, err = session.WithTransaction(context.Background(), func(sessCtx mongo.SessionContext) (interface{}, error) {
+		var pocket Pocket
+		err := m.pockets.FindOne(sessCtx, bson.M{"_id": pocketID, "account_id": accountID}).Decode(&pocket)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrPocketNotFound
+		} else if err != nil {
+			return nil, err
+		}
+
+		if pocket.Balance > 0 {
+			if _, err := m.movePocketFundsInSession(sessCtx, accountID, pocketID, pocket.Balance, false); err != nil {
+				return nil, err
+			}
+		}
+
+		_, err = m.pockets.DeleteOne(sessCtx, bson.M{"_id": pocketID, "account_id": accountID})
+		return nil, err
+	})
+	return err
+}
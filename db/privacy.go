@@ -0,0 +1,407 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Kinds of personal data request.
+const (
+	DataRequestExport  = "export"
+	DataRequestErasure = "erasure"
+)
+
+// Data request states. A request waits for an admin, then runs as a job that
+// ends completed or failed.
+const (
+	DataRequestPendingApproval = "pending_approval"
+	DataRequestRunning         = "running"
+	DataRequestCompleted       = "completed"
+	DataRequestRejected        = "rejected"
+	DataRequestFailed          = "failed"
+)
+
+var (
+	ErrDataRequestNotFound = errors.New("data request not found")
+	ErrDataRequestOpen     = errors.New("a request of this kind is already open")
+	ErrDataRequestClosed   = errors.New("data request is no longer pending approval")
+	ErrErasureBalance      = errors.New("the account and its pockets must be empty before it can be erased")
+	ErrAccountErased       = errors.New("account has been erased")
+)
+
+// DataRequest tracks an export or erasure of an account's personal data.
+type DataRequest struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	AccountID   primitive.ObjectID `bson:"account_id" json:"account_id"`
+	Kind        string             `bson:"kind" json:"kind"`
+	Status      string             `bson:"status" json:"status"`
+	Source      string             `bson:"source" json:"source"`
+	ReviewedBy  primitive.ObjectID `bson:"reviewed_by,omitempty" json:"reviewed_by,omitempty"`
+	ReviewNote  string             `bson:"review_note,omitempty" json:"review_note,omitempty"`
+	ExportKey   string             `bson:"export_key,omitempty" json:"-"`
+	Error       string             `bson:"error,omitempty" json:"error,omitempty"`
+	CreatedAt   time.Time          `bson:"created_at" json:"created_at"`
+	ReviewedAt  *time.Time         `bson:"reviewed_at,omitempty" json:"reviewed_at,omitempty"`
+	CompletedAt *time.Time         `bson:"completed_at,omitempty" json:"completed_at,omitempty"`
+}
+
+// ChatMessage is one exchange with the chat bot, kept as the transcript.
+type ChatMessage struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	AccountID primitive.ObjectID `bson:"account_id" json:"account_id"`
+	Source    string             `bson:"source" json:"source"`
+	UserText  string             `bson:"user_text" json:"user_text"`
+	Reply     string             `bson:"reply" json:"reply"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+}
+
+func (m *AccManager) RecordChatMessage(accountID primitive.ObjectID, source, userText, reply string) error {
+	_, err := m.chatMessages.InsertOne(context.TODO(), ChatMessage{
+		AccountID: accountID,
+		Source:    source,
+		UserText:  userText,
+		Reply:     reply,
+		CreatedAt: time.Now(),
+	})
+	return err
+}
+
+func (m *AccManager) GetChatMessages(accountID primitive.ObjectID) ([]ChatMessage, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}})
+	cursor, err := m.chatMessages.Find(context.TODO(), bson.M{"account_id": accountID}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+
+	messages := []ChatMessage{}
+	if err := cursor.All(context.TODO(), &messages); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// checkErasable makes sure erasing the account won't strand any money.
+func (m *AccManager) checkErasable(ctx context.Context, account *BankAccount) error {
+	if account.ErasedAt != nil {
+		return ErrAccountErased
+	}
+	if account.Role == RoleBank {
+		return errors.New("the bank revenue account can't be erased")
+	}
+	if account.Balance != 0 {
+		return ErrErasureBalance
+	}
+	count, err := m.pockets.CountDocuments(ctx, bson.M{"account_id": account.ID, "balance": bson.M{"$ne": 0}})
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return ErrErasureBalance
+	}
+	return nil
+}
+
+// CreateDataRequest opens an export or erasure request for admin approval.
+// An account has at most one open request of each kind.
+func (m *AccManager) CreateDataRequest(accountID primitive.ObjectID, kind, source string) (*DataRequest, error) {
+	if kind != DataRequestExport && kind != DataRequestErasure {
+		return nil, fmt.Errorf("unknown data request kind %q", kind)
+	}
+
+	account, err := m.SearchAccountById(accountID)
+	if err != nil {
+		return nil, err
+	}
+	if account == nil {
+		return nil, errors.New("account not found")
+	}
+	if account.ErasedAt != nil {
+		return nil, ErrAccountErased
+	}
+	if kind == DataRequestErasure {
+		if err := m.checkErasable(context.TODO(), account); err != nil {
+			return nil, err
+		}
+	}
+
+	open := bson.M{
+		"account_id": accountID,
+		"kind":       kind,
+		"status":     bson.M{"$in": []string{DataRequestPendingApproval, DataRequestRunning}},
+	}
+	count, err := m.dataRequests.CountDocuments(context.TODO(), open)
+	if err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		return nil, ErrDataRequestOpen
+	}
+
+	request := DataRequest{
+		AccountID: accountID,
+		Kind:      kind,
+		Status:    DataRequestPendingApproval,
+		Source:    source,
+		CreatedAt: time.Now(),
+	}
+	insertResult, err := m.dataRequests.InsertOne(context.TODO(), request)
+	if err != nil {
+		return nil, err
+	}
+	request.ID = insertResult.InsertedID.(primitive.ObjectID)
+	return &request, nil
+}
+
+func (m *AccManager) GetDataRequestById(id primitive.ObjectID) (*DataRequest, error) {
+	var request DataRequest
+	err := m.dataRequests.FindOne(context.TODO(), bson.M{"_id": id}).Decode(&request)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrDataRequestNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &request, nil
+}
+
+// GetDataRequests lists requests, newest first. A zero accountID lists every
+// account's requests and an empty status lists every state.
+func (m *AccManager) GetDataRequests(accountID primitive.ObjectID, status string) ([]DataRequest, error) {
+	filter := bson.M{}
+	if !accountID.IsZero() {
+		filter["account_id"] = accountID
+	}
+	if status != "" {
+		filter["status"] = status
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}})
+
+	cursor, err := m.dataRequests.Find(context.TODO(), filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+
+	requests := []DataRequest{}
+	if err := cursor.All(context.TODO(), &requests); err != nil {
+		return nil, err
+	}
+	return requests, nil
+}
+
+// ReviewDataRequest approves or rejects a request that is pending approval.
+// Approving moves it to running; the caller then runs the job and reports
+// back with CompleteDataRequest.
+func (m *AccManager) ReviewDataRequest(id, reviewerID primitive.ObjectID, approve bool, note string) (*DataRequest, error) {
+	status := DataRequestRunning
+	if !approve {
+		status = DataRequestRejected
+	}
+	set := bson.M{
+		"status":      status,
+		"reviewed_by": reviewerID,
+		"reviewed_at": time.Now(),
+	}
+	if note != "" {
+		set["review_note"] = note
+	}
+
+	filter := bson.M{"_id": id, "status": DataRequestPendingApproval}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var request DataRequest
+	err := m.dataRequests.FindOneAndUpdate(context.TODO(), filter, bson.M{"$set": set}, opts).Decode(&request)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		if _, findErr := m.GetDataRequestById(id); findErr != nil {
+			return nil, findErr
+		}
+		return nil, ErrDataRequestClosed
+	} else if err != nil {
+		return nil, err
+	}
+	return &request, nil
+}
+
+// CompleteDataRequest records the outcome of a running job.
+func (m *AccManager) CompleteDataRequest(request *DataRequest, exportKey string, jobErr error) error {
+	now := time.Now()
+	set := bson.M{"status": DataRequestCompleted, "completed_at": now}
+	if exportKey != "" {
+		set["export_key"] = exportKey
+	}
+	if jobErr != nil {
+		set["status"] = DataRequestFailed
+		set["error"] = jobErr.Error()
+	}
+
+	_, err := m.dataRequests.UpdateOne(context.TODO(), bson.M{"_id": request.ID}, bson.M{"$set": set})
+	if err != nil {
+		return err
+	}
+	request.Status = set["status"].(string)
+	request.ExportKey = exportKey
+	request.CompletedAt = &now
+	if jobErr != nil {
+		request.Error = jobErr.Error()
+	}
+	return nil
+}
+
+// PersonalDataExport is everything held about an account, as handed to the
+// account holder. KYC document metadata is included; the files themselves
+// are not.
+type PersonalDataExport struct {
+	GeneratedAt      time.Time      `json:"generated_at"`
+	Account          BankAccount    `json:"account"`
+	KYC              KYCProfile     `json:"kyc"`
+	Transactions     []Transaction  `json:"transactions"`
+	Payees           []Payee        `json:"payees"`
+	IncomingRequests []MoneyRequest `json:"incoming_money_requests"`
+	OutgoingRequests []MoneyRequest `json:"outgoing_money_requests"`
+	Splits           []Split        `json:"splits"`
+	Pockets          []Pocket       `json:"pockets"`
+	Budgets          []Budget       `json:"budgets"`
+	ChatTranscript   []ChatMessage  `json:"chat_transcript"`
+	AuditEntries     []AuditEntry   `json:"audit_entries"`
+}
+
+func (m *AccManager) CollectPersonalData(accountID primitive.ObjectID) (*PersonalDataExport, error) {
+	account, err := m.SearchAccountById(accountID)
+	if err != nil {
+		return nil, err
+	}
+	if account == nil {
+		return nil, errors.New("account not found")
+	}
+	account.Password = ""
+
+	account.KYC.Status = account.KYC.State()
+	export := &PersonalDataExport{GeneratedAt: time.Now().UTC(), Account: *account, KYC: account.KYC}
+	if export.Transactions, err = m.GetTransactionsHistory(accountID); err != nil {
+		return nil, err
+	}
+	if export.Payees, err = m.GetPayees(accountID); err != nil {
+		return nil, err
+	}
+	if export.IncomingRequests, err = m.GetMoneyRequests(accountID, true, ""); err != nil {
+		return nil, err
+	}
+	if export.OutgoingRequests, err = m.GetMoneyRequests(accountID, false, ""); err != nil {
+		return nil, err
+	}
+	if export.Splits, err = m.GetSplits(accountID); err != nil {
+		return nil, err
+	}
+	if export.Pockets, err = m.GetPockets(accountID); err != nil {
+		return nil, err
+	}
+	if export.Budgets, err = m.GetBudgets(accountID); err != nil {
+		return nil, err
+	}
+	if export.ChatTranscript, err = m.GetChatMessages(accountID); err != nil {
+		return nil, err
+	}
+
+	// Everything the account did, and everything done to it
+	filter := bson.M{"$or": []bson.M{{"actor_id": accountID}, {"target": accountID.Hex()}}}
+	cursor, err := m.auditLog.Find(context.TODO(), filter, options.Find().SetSort(bson.D{{Key: "seq", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+	export.AuditEntries = []AuditEntry{}
+	if err := cursor.All(context.TODO(), &export.AuditEntries); err != nil {
+		return nil, err
+	}
+	return export, nil
+}
+
+// EraseAccount pseudonymizes an account instead of deleting it, so the
+// ledger still balances: transactions only reference account IDs and are
+// kept, as are AML cases and the append-only audit log, which we must retain.
+// Names, phone numbers, identity details, chat transcripts, payees and notes
+// are removed. It returns the blob keys of the KYC documents, which the
+// caller deletes from the blob store.
+func (m *AccManager) EraseAccount(accountID primitive.ObjectID) ([]string, error) {
+	session, err := m.client.StartSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.EndSession(context.TODO())
+
+	var blobKeys []string
+	_, err = session.WithTransaction(context.TODO(), func(sessCtx mongo.SessionContext) (interface{}, error) {
+		blobKeys = nil
+
+		var account BankAccount
+		err := m.accounts.FindOne(sessCtx, bson.M{"_id": accountID}).Decode(&account)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, errors.New("account not found")
+		} else if err != nil {
+			return nil, err
+		}
+		if err := m.checkErasable(sessCtx, &account); err != nil {
+			return nil, err
+		}
+		for _, document := range account.KYC.Documents {
+			blobKeys = append(blobKeys, document.BlobKey)
+		}
+
+		now := time.Now()
+		update := bson.M{
+			"$set": bson.M{
+				"account_holder": "erased-" + accountID.Hex()[16:],
+				"phone_number":   "",
+				"password":       "",
+				"kyc":            KYCProfile{Status: account.KYC.State()},
+				"erased_at":      now,
+				"updated_at":     now,
+			},
+			"$unset": bson.M{"two_factor": "", "transaction_pin": "", "password_reset": ""},
+		}
+		if _, err := m.accounts.UpdateOne(sessCtx, bson.M{"_id": accountID}, update); err != nil {
+			return nil, err
+		}
+
+		// Other people's address books hold this account's phone number too
+		payees := bson.M{"$or": []bson.M{{"owner_id": accountID}, {"account_id": accountID}}}
+		if _, err := m.payees.DeleteMany(sessCtx, payees); err != nil {
+			return nil, err
+		}
+		for _, collection := range []*mongo.Collection{m.chatMessages, m.pockets, m.budgets, m.pendingActions, m.sessions} {
+			if _, err := collection.DeleteMany(sessCtx, bson.M{"account_id": accountID}); err != nil {
+				return nil, err
+			}
+		}
+
+		if _, err := m.apiKeys.UpdateMany(sessCtx,
+			bson.M{"account_id": accountID, "revoked_at": nil},
+			bson.M{"$set": bson.M{"revoked_at": now}}); err != nil {
+			return nil, err
+		}
+
+		requests := bson.M{"$or": []bson.M{{"requester_id": accountID}, {"payer_id": accountID}}}
+		if _, err := m.moneyRequests.UpdateMany(sessCtx, requests, bson.M{"$set": bson.M{"note": ""}}); err != nil {
+			return nil, err
+		}
+		pending := bson.M{"$and": []bson.M{requests, {"status": MoneyRequestPending}}}
+		if _, err := m.moneyRequests.UpdateMany(sessCtx, pending, bson.M{"$set": bson.M{"status": MoneyRequestCancelled, "updated_at": now}}); err != nil {
+			return nil, err
+		}
+		if _, err := m.splits.UpdateMany(sessCtx, bson.M{"owner_id": accountID}, bson.M{"$set": bson.M{"description": ""}}); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return blobKeys, nil
+}
@@ -0,0 +1,183 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Roles an account can have. Everyone who signs up is a customer; the other
+// roles are staff roles that only an admin can grant. RoleBank is reserved
+// for the revenue account and can't be granted.
+const (
+	RoleCustomer = "customer"
+	RoleTeller   = "teller"
+	RoleSupport  = "support"
+	RoleAuditor  = "auditor"
+	RoleAdmin    = "admin"
+)
+
+// Permissions guard the staff endpoints and chat intents. What customers do
+// with their own accounts needs no permission.
+const (
+	PermAccountsRead    = "accounts:read"
+	PermAccountsImport  = "accounts:import"
+	PermAccountsDeposit = "accounts:deposit"
+	PermAccountsDelete  = "accounts:delete"
+	PermStatsRead       = "stats:read"
+	PermRolesManage     = "roles:manage"
+	PermSessionsRevoke  = "sessions:revoke"
+	PermTwoFactorReset  = "2fa:reset"
+	PermLoginsUnlock    = "logins:unlock"
+	PermAPIKeysManage   = "api_keys:manage"
+	PermFeesRead        = "fees:read"
+	PermFeesManage      = "fees:manage"
+	PermFraudRead       = "fraud:read"
+	PermFraudManage     = "fraud:manage"
+	PermFraudReview     = "fraud:review"
+	PermAMLRead         = "aml:read"
+	PermAMLManage       = "aml:manage"
+	PermKYCRead         = "kyc:read"
+	PermKYCReview       = "kyc:review"
+	PermAuditRead       = "audit:read"
+	PermPrivacyRead     = "privacy:read"
+	PermPrivacyReview   = "privacy:review"
+	PermAdjustmentsRead = "adjustments:read"
+	PermAdjustmentsMake = "adjustments:propose"
+	PermAdjustmentsSign = "adjustments:approve"
+)
+
+// RolePermissions maps every role to what it may do. Admins hold every
+// permission, so a new permission goes on the admin list and on whichever
+// other roles need it.
+var RolePermissions = map[string][]string{
+	RoleCustomer: {},
+	RoleTeller: {
+		PermAccountsRead, PermAccountsDeposit, PermKYCRead, PermKYCReview, PermAdjustmentsRead, PermAdjustmentsMake,
+	},
+	RoleSupport: {
+		PermAccountsRead, PermKYCRead, PermPrivacyRead, PermPrivacyReview, PermFraudRead,
+		PermAdjustmentsRead, PermAdjustmentsMake, PermSessionsRevoke, PermTwoFactorReset, PermLoginsUnlock,
+	},
+	RoleAuditor: {
+		PermAccountsRead, PermStatsRead, PermFeesRead, PermFraudRead, PermAMLRead, PermKYCRead,
+		PermAuditRead, PermPrivacyRead, PermAdjustmentsRead,
+	},
+	RoleAdmin: {
+		PermAccountsRead, PermAccountsImport, PermAccountsDeposit, PermAccountsDelete, PermStatsRead,
+		PermRolesManage, PermSessionsRevoke, PermTwoFactorReset, PermLoginsUnlock, PermAPIKeysManage, PermFeesRead,
+		PermFeesManage, PermFraudRead, PermFraudManage, PermFraudReview, PermAMLRead, PermAMLManage,
+		PermKYCRead, PermKYCReview, PermAuditRead, PermPrivacyRead, PermPrivacyReview,
+		PermAdjustmentsRead, PermAdjustmentsMake, PermAdjustmentsSign,
+	},
+}
+
+var (
+	ErrUnknownRole      = errors.New("unknown role")
+	ErrOwnRole          = errors.New("you can't change your own role")
+	ErrLastAdmin        = errors.New("the last admin can't lose the admin role")
+	ErrRoleNotGrantable = errors.New("this role can't be granted")
+)
+
+// ValidRole reports whether role is one of the named roles.
+func ValidRole(role string) bool {
+	_, ok := RolePermissions[role]
+	return ok
+}
+
+// HasPermission reports whether accounts with the role may use permission.
+// Accounts with an unknown role have no permissions.
+func HasPermission(role, permission string) bool {
+	for _, granted := range RolePermissions[role] {
+		if granted == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// Roles lists the named roles in alphabetical order.
+func Roles() []string {
+	roles := make([]string, 0, len(RolePermissions))
+	for role := range RolePermissions {
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+	return roles
+}
+
+// ensureRoles moves accounts from the free-form roles of before to the named
+// ones. The old default "user", a missing role and any role that isn't known
+// become customer; existing admins keep their role. Fee rules for "user"
+// follow their accounts.
+func (m *AccManager) ensureRoles() error {
+	known := []string{RoleBank}
+	for role := range RolePermissions {
+		known = append(known, role)
+	}
+
+	_, err := m.accounts.UpdateMany(context.TODO(),
+		bson.M{"role": bson.M{"$nin": known}},
+		bson.M{"$set": bson.M{"role": RoleCustomer}})
+	if err != nil {
+		return err
+	}
+
+	_, err = m.feeRules.UpdateMany(context.TODO(),
+		bson.M{"role": "user"},
+		bson.M{"$set": bson.M{"role": RoleCustomer}})
+	return err
+}
+
+// SetAccountRole grants role to an account, replacing its current role.
+// Nobody can change their own role, and the last admin can't be demoted, so
+// the bank can't lock itself out of administration.
+func (m *AccManager) SetAccountRole(actorID, accountID primitive.ObjectID, role string) (*BankAccount, error) {
+	if role == RoleBank {
+		return nil, ErrRoleNotGrantable
+	}
+	if !ValidRole(role) {
+		return nil, ErrUnknownRole
+	}
+	if actorID == accountID {
+		return nil, ErrOwnRole
+	}
+
+	account, err := m.SearchAccountById(accountID)
+	if err != nil || account == nil {
+		return nil, ErrAccountNotFound
+	}
+	if account.Role == RoleBank || account.ErasedAt != nil {
+		return nil, ErrRoleNotGrantable
+	}
+	if account.Role == role {
+		return account, nil
+	}
+
+	if account.Role == RoleAdmin {
+		admins, err := m.accounts.CountDocuments(context.TODO(), bson.M{"role": RoleAdmin})
+		if err != nil {
+			return nil, err
+		}
+		if admins <= 1 {
+			return nil, ErrLastAdmin
+		}
+	}
+
+	// Only change the role it had when it was checked
+	result, err := m.accounts.UpdateOne(context.TODO(),
+		bson.M{"_id": accountID, "role": account.Role},
+		bson.M{"$set": bson.M{"role": role, "updated_at": time.Now()}})
+	if err != nil {
+		return nil, err
+	}
+	if result.MatchedCount == 0 {
+		return nil, errors.New("the account's role changed meanwhile, try again")
+	}
+	account.Role = role
+	return account, nil
+}
@@ -0,0 +1,317 @@
+package db
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// RefreshTokenTTL is how long a session lasts. Refreshing rotates the token
+// but doesn't extend the session, so everyone signs in again at least this
+// often.
+const RefreshTokenTTL = 30 * 24 * time.Hour
+
+// Why a session ended.
+const (
+	SessionRevokedLogout = "logout"
+	SessionRevokedUser   = "revoked"
+	SessionRevokedAdmin  = "revoked_by_admin"
+	SessionRevokedReuse  = "refresh_token_reuse"
+
+	SessionRevokedPassword = "password_change"
+)
+
+var (
+	ErrSessionNotFound     = errors.New("session not found")
+	ErrSessionRevoked      = errors.New("session has been revoked, please log in again")
+	ErrSessionExpired      = errors.New("session has expired, please log in again")
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token was already used; the session has been revoked")
+	ErrTokenRevoked        = errors.New("token has been revoked")
+)
+
+// Session is one signed-in device. Only hashes of its refresh tokens are
+// kept: the current one, and the one it replaced so that replaying an old
+// token can be told apart from a made-up one.
+type Session struct {
+	ID           primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	AccountID    primitive.ObjectID `bson:"account_id" json:"account_id"`
+	RefreshHash  string             `bson:"refresh_hash" json:"-"`
+	PreviousHash string             `bson:"previous_hash,omitempty" json:"-"`
+	UserAgent    string             `bson:"user_agent" json:"user_agent"`
+	IP           string             `bson:"ip" json:"ip"`
+	CreatedAt    time.Time          `bson:"created_at" json:"created_at"`
+	LastUsedAt   time.Time          `bson:"last_used_at" json:"last_used_at"`
+	ExpiresAt    time.Time          `bson:"expires_at" json:"expires_at"`
+	RevokedAt    *time.Time         `bson:"revoked_at,omitempty" json:"revoked_at,omitempty"`
+	RevokeReason string             `bson:"revoke_reason,omitempty" json:"revoke_reason,omitempty"`
+
+	// SecondFactorAt is when the session last proved a second factor
+	SecondFactorAt *time.Time `bson:"second_factor_at,omitempty" json:"second_factor_at,omitempty"`
+}
+
+// revokedToken is an access token that was logged out before it expired.
+// The TTL index drops it once it would have expired anyway.
+type revokedToken struct {
+	TokenID   string    `bson:"jti"`
+	ExpiresAt time.Time `bson:"expires_at"`
+}
+
+// newRefreshSecret returns a refresh token for the session, which is the
+// session ID and a random secret, and the hash to store.
+func newRefreshSecret(sessionID primitive.ObjectID) (string, string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", err
+	}
+	encoded := hex.EncodeToString(secret)
+	return sessionID.Hex() + "." + encoded, hashRefreshSecret(encoded), nil
+}
+
+func hashRefreshSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func parseRefreshToken(token string) (primitive.ObjectID, string, error) {
+	sessionHex, secret, ok := strings.Cut(token, ".")
+	if !ok || secret == "" {
+		return primitive.NilObjectID, "", ErrInvalidRefreshToken
+	}
+	sessionID, err := primitive.ObjectIDFromHex(sessionHex)
+	if err != nil {
+		return primitive.NilObjectID, "", ErrInvalidRefreshToken
+	}
+	return sessionID, hashRefreshSecret(secret), nil
+}
+
+func sameHash(a, b string) bool {
+	return a != "" && subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// CreateSession starts a session for a login and returns it with its first
+// refresh token. secondFactor records that the login proved a second factor.
+func (m *AccManager) CreateSession(accountID primitive.ObjectID, userAgent, ip string, secondFactor bool) (*Session, string, error) {
+	now := time.Now()
+	session := Session{
+		ID:         primitive.NewObjectID(),
+		AccountID:  accountID,
+		UserAgent:  userAgent,
+		IP:         ip,
+		CreatedAt:  now,
+		LastUsedAt: now,
+		ExpiresAt:  now.Add(RefreshTokenTTL),
+	}
+	if secondFactor {
+		session.SecondFactorAt = &now
+	}
+
+	refreshToken, hash, err := newRefreshSecret(session.ID)
+	if err != nil {
+		return nil, "", err
+	}
+	session.RefreshHash = hash
+
+	if _, err := m.sessions.InsertOne(context.TODO(), session); err != nil {
+		return nil, "", err
+	}
+	return &session, refreshToken, nil
+}
+
+// RotateSession trades a refresh token for a new one. Each token works once:
+// presenting the one that was already traded in means it leaked, so the whole
+// session is revoked and ErrRefreshTokenReused returned along with it.
+func (m *AccManager) RotateSession(refreshToken, userAgent, ip string) (*Session, string, error) {
+	sessionID, hash, err := parseRefreshToken(refreshToken)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var session Session
+	err = m.sessions.FindOne(context.TODO(), bson.M{"_id": sessionID}).Decode(&session)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, "", ErrInvalidRefreshToken
+	} else if err != nil {
+		return nil, "", err
+	}
+
+	switch {
+	case sameHash(hash, session.PreviousHash):
+		if session.RevokedAt == nil {
+			if err := m.revokeSessions(bson.M{"_id": session.ID}, SessionRevokedReuse); err != nil {
+				return nil, "", err
+			}
+		}
+		return &session, "", ErrRefreshTokenReused
+	case !sameHash(hash, session.RefreshHash):
+		return nil, "", ErrInvalidRefreshToken
+	case session.RevokedAt != nil:
+		return nil, "", ErrSessionRevoked
+	case time.Now().After(session.ExpiresAt):
+		return nil, "", ErrSessionExpired
+	}
+
+	newToken, newHash, err := newRefreshSecret(session.ID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Only rotate the token that was checked; if two refreshes race with the
+	// same token, the loser is a reuse like any other.
+	now := time.Now()
+	result, err := m.sessions.UpdateOne(context.TODO(),
+		bson.M{"_id": session.ID, "refresh_hash": hash, "revoked_at": nil},
+		bson.M{"$set": bson.M{
+			"refresh_hash":  newHash,
+			"previous_hash": hash,
+			"last_used_at":  now,
+			"user_agent":    userAgent,
+			"ip":            ip,
+		}})
+	if err != nil {
+		return nil, "", err
+	}
+	if result.MatchedCount == 0 {
+		if err := m.revokeSessions(bson.M{"_id": session.ID}, SessionRevokedReuse); err != nil {
+			return nil, "", err
+		}
+		return &session, "", ErrRefreshTokenReused
+	}
+
+	session.RefreshHash = newHash
+	session.PreviousHash = hash
+	session.LastUsedAt = now
+	session.UserAgent = userAgent
+	session.IP = ip
+	return &session, newToken, nil
+}
+
+func (m *AccManager) revokeSessions(filter bson.M, reason string) error {
+	filter["revoked_at"] = nil
+	_, err := m.sessions.UpdateMany(context.TODO(), filter,
+		bson.M{"$set": bson.M{"revoked_at": time.Now(), "revoke_reason": reason}})
+	return err
+}
+
+// RevokeSession ends one of the account's sessions.
+func (m *AccManager) RevokeSession(accountID, sessionID primitive.ObjectID, reason string) error {
+	result, err := m.sessions.UpdateOne(context.TODO(),
+		bson.M{"_id": sessionID, "account_id": accountID, "revoked_at": nil},
+		bson.M{"$set": bson.M{"revoked_at": time.Now(), "revoke_reason": reason}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// RevokeAllSessions ends every session of the account and returns how many
+// were still open.
+func (m *AccManager) RevokeAllSessions(accountID primitive.ObjectID, reason string) (int64, error) {
+	result, err := m.sessions.UpdateMany(context.TODO(),
+		bson.M{"account_id": accountID, "revoked_at": nil, "expires_at": bson.M{"$gt": time.Now()}},
+		bson.M{"$set": bson.M{"revoked_at": time.Now(), "revoke_reason": reason}})
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
+
+// RevokeOtherSessions ends every session of the account except keepID, e.g.
+// after a password change on that device. keepID may be nil.
+func (m *AccManager) RevokeOtherSessions(accountID, keepID primitive.ObjectID, reason string) (int64, error) {
+	result, err := m.sessions.UpdateMany(context.TODO(),
+		bson.M{"account_id": accountID, "_id": bson.M{"$ne": keepID}, "revoked_at": nil, "expires_at": bson.M{"$gt": time.Now()}},
+		bson.M{"$set": bson.M{"revoked_at": time.Now(), "revoke_reason": reason}})
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
+
+// GetActiveSessions lists the account's open sessions, most recently used
+// first.
+func (m *AccManager) GetActiveSessions(accountID primitive.ObjectID) ([]*Session, error) {
+	filter := bson.M{"account_id": accountID, "revoked_at": nil, "expires_at": bson.M{"$gt": time.Now()}}
+	opts := options.Find().SetSort(bson.D{{Key: "last_used_at", Value: -1}})
+
+	cursor, err := m.sessions.Find(context.TODO(), filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+
+	sessions := []*Session{}
+	if err := cursor.All(context.TODO(), &sessions); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+func (m *AccManager) GetSession(sessionID primitive.ObjectID) (*Session, error) {
+	var session Session
+	err := m.sessions.FindOne(context.TODO(), bson.M{"_id": sessionID}).Decode(&session)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrSessionNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// MarkSecondFactor records that the session just proved a second factor.
+func (m *AccManager) MarkSecondFactor(sessionID primitive.ObjectID) error {
+	_, err := m.sessions.UpdateOne(context.TODO(),
+		bson.M{"_id": sessionID},
+		bson.M{"$set": bson.M{"second_factor_at": time.Now()}})
+	return err
+}
+
+// DenyToken puts an access token on the denylist until it expires.
+func (m *AccManager) DenyToken(tokenID string, expiresAt time.Time) error {
+	_, err := m.revokedTokens.InsertOne(context.TODO(), revokedToken{TokenID: tokenID, ExpiresAt: expiresAt})
+	if mongo.IsDuplicateKeyError(err) {
+		return nil
+	}
+	return err
+}
+
+// TokenRevoked is checked for every access token: it fails when the token
+// was logged out or its session has ended.
+func (m *AccManager) TokenRevoked(tokenID, sessionID string) error {
+	denied, err := m.revokedTokens.CountDocuments(context.TODO(), bson.M{"jti": tokenID})
+	if err != nil {
+		return err
+	}
+	if denied > 0 {
+		return ErrTokenRevoked
+	}
+
+	id, err := primitive.ObjectIDFromHex(sessionID)
+	if err != nil {
+		return ErrSessionNotFound
+	}
+	var session Session
+	err = m.sessions.FindOne(context.TODO(), bson.M{"_id": id}).Decode(&session)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return ErrSessionNotFound
+	} else if err != nil {
+		return err
+	}
+	if session.RevokedAt != nil {
+		return ErrSessionRevoked
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"math"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	SplitEqual  = "equal"
+	SplitCustom = "custom"
+)
+
+var ErrSplitNotFound = errors.New("split not found")
+
+// SplitShare is one participant's part of a split and the money request
+// that was sent to collect it.
+type SplitShare struct {
+	AccountID primitive.ObjectID `bson:"account_id" json:"account_id"`
+	Amount    float64            `bson:"amount" json:"amount"`
+	RequestID primitive.ObjectID `bson:"request_id" json:"request_id"`
+}
+
+// Split is an expense paid by OwnerID and shared with other users.
+type Split struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	OwnerID     primitive.ObjectID `bson:"owner_id" json:"owner_id"`
+	Description string             `bson:"description" json:"description"`
+	Total       float64            `bson:"total" json:"total"`
+	Method      string             `bson:"method" json:"method"`
+	OwnerShare  float64            `bson:"owner_share" json:"owner_share"`
+	Shares      []SplitShare       `bson:"shares" json:"shares"`
+	CreatedAt   time.Time          `bson:"created_at" json:"created_at"`
+}
+
+// EqualShares divides total into n shares rounded to cents. Leftover cents
+// go to the first shares so the parts always add up to the total.
+func EqualShares(total float64, n int) []float64 {
+	if n <= 0 {
+		return nil
+	}
+
+	cents := int64(math.Round(total * 100))
+	base := cents / int64(n)
+	remainder := cents % int64(n)
+
+	shares := make([]float64, n)
+	for i := range shares {
+		share := base
+		if int64(i) < remainder {
+			share++
+		}
+		shares[i] = float64(share) / 100
+	}
+	return shares
+}
+
+func (m *AccManager) CreateSplit(split Split) (*Split, error) {
+	if split.ID.IsZero() {
+		split.ID = primitive.NewObjectID()
+	}
+	split.CreatedAt = time.Now()
+
+	if _, err := m.splits.InsertOne(context.TODO(), split); err != nil {
+		return nil, err
+	}
+	return &split, nil
+}
+
+func (m *AccManager) GetSplitById(ownerID, splitID primitive.ObjectID) (*Split, error) {
+	var split Split
+	err := m.splits.FindOne(context.TODO(), bson.M{"_id": splitID, "owner_id": ownerID}).Decode(&split)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrSplitNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &split, nil
+}
+
+func (m *AccManager) GetSplits(ownerID primitive.ObjectID) ([]Split, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}})
+	cursor, err := m.splits.Find(context.TODO(), bson.M{"owner_id": ownerID}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+
+	splits := []Split{}
+	if err := cursor.All(context.TODO(), &splits); err != nil {
+		return nil, err
+	}
+	return splits, nil
+}
+
+// GetMoneyRequestsByIds returns the given money requests keyed by ID.
+func (m *AccManager) GetMoneyRequestsByIds(ids []primitive.ObjectID) (map[primitive.ObjectID]MoneyRequest, error) {
+	if err := m.expireMoneyRequests(); err != nil {
+		return nil, err
+	}
+
+	cursor, err := m.moneyRequests.Find(context.TODO(), bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+
+	var requests []MoneyRequest
+	if err := cursor.All(context.TODO(), &requests); err != nil {
+		return nil, err
+	}
+
+	byID := make(map[primitive.ObjectID]MoneyRequest, len(requests))
+	for _, request := range requests {
+		byID[request.ID] = request
+	}
+	return byID, nil
+}
@@ -0,0 +1,163 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// After MaxTwoFactorAttempts wrong codes in a row, second factor checks are
+// refused for TwoFactorLockout.
+const (
+	MaxTwoFactorAttempts = 5
+	TwoFactorLockout     = 15 * time.Minute
+)
+
+var (
+	ErrTwoFactorEnabled     = errors.New("two-factor authentication is already on")
+	ErrTwoFactorNotEnabled  = errors.New("two-factor authentication is not on")
+	ErrTwoFactorNotEnrolled = errors.New("start enrolling first")
+	ErrTwoFactorCodeUsed    = errors.New("this code was already used, wait for the next one")
+	ErrTwoFactorLocked      = errors.New("too many wrong codes, try again later")
+)
+
+// TwoFactor is an account's TOTP settings. Recovery codes are stored as
+// hashes and each works once. LastStep is the time step of the last code
+// accepted, so a code can't be replayed within its period.
+type TwoFactor struct {
+	Secret         string     `bson:"secret,omitempty"`
+	PendingSecret  string     `bson:"pending_secret,omitempty"`
+	EnabledAt      *time.Time `bson:"enabled_at,omitempty"`
+	RecoveryCodes  []string   `bson:"recovery_codes,omitempty"`
+	LastStep       int64      `bson:"last_step,omitempty"`
+	FailedAttempts int        `bson:"failed_attempts,omitempty"`
+	LockedUntil    *time.Time `bson:"locked_until,omitempty"`
+}
+
+func (t TwoFactor) Enabled() bool {
+	return t.EnabledAt != nil
+}
+
+func (t TwoFactor) Locked() bool {
+	return t.LockedUntil != nil && time.Now().Before(*t.LockedUntil)
+}
+
+// StartTwoFactorEnrollment keeps a new secret until the user proves their
+// authenticator has it. Enrolling again replaces a secret that was never
+// confirmed.
+func (m *AccManager) StartTwoFactorEnrollment(accountID primitive.ObjectID, secret string) error {
+	result, err := m.accounts.UpdateOne(context.TODO(),
+		bson.M{"_id": accountID, "two_factor.enabled_at": nil},
+		bson.M{"$set": bson.M{"two_factor.pending_secret": secret, "updated_at": time.Now()}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrTwoFactorEnabled
+	}
+	return nil
+}
+
+// EnableTwoFactor turns the pending secret into the account's secret, with
+// the step of the code that confirmed it and the recovery code hashes.
+func (m *AccManager) EnableTwoFactor(accountID primitive.ObjectID, secret string, step int64, recoveryHashes []string) error {
+	now := time.Now()
+	result, err := m.accounts.UpdateOne(context.TODO(),
+		bson.M{"_id": accountID, "two_factor.enabled_at": nil, "two_factor.pending_secret": secret},
+		bson.M{"$set": bson.M{
+			"two_factor": TwoFactor{
+				Secret:        secret,
+				EnabledAt:     &now,
+				RecoveryCodes: recoveryHashes,
+				LastStep:      step,
+			},
+			"updated_at": now,
+		}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrTwoFactorNotEnrolled
+	}
+	return nil
+}
+
+// DisableTwoFactor removes the account's authenticator and recovery codes.
+func (m *AccManager) DisableTwoFactor(accountID primitive.ObjectID) error {
+	result, err := m.accounts.UpdateOne(context.TODO(),
+		bson.M{"_id": accountID, "two_factor.enabled_at": bson.M{"$ne": nil}},
+		bson.M{"$unset": bson.M{"two_factor": ""}, "$set": bson.M{"updated_at": time.Now()}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrTwoFactorNotEnabled
+	}
+	return nil
+}
+
+// UseTwoFactorStep records that the code for step was used. It fails if that
+// step or a later one was already used.
+func (m *AccManager) UseTwoFactorStep(accountID primitive.ObjectID, step int64) error {
+	result, err := m.accounts.UpdateOne(context.TODO(),
+		bson.M{"_id": accountID, "two_factor.last_step": bson.M{"$lt": step}},
+		bson.M{"$set": bson.M{"two_factor.last_step": step, "two_factor.failed_attempts": 0}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrTwoFactorCodeUsed
+	}
+	return nil
+}
+
+// UseRecoveryCode spends a recovery code. It reports false when the account
+// has no unused code with that hash.
+func (m *AccManager) UseRecoveryCode(accountID primitive.ObjectID, hash string) (bool, error) {
+	result, err := m.accounts.UpdateOne(context.TODO(),
+		bson.M{"_id": accountID, "two_factor.recovery_codes": hash},
+		bson.M{"$pull": bson.M{"two_factor.recovery_codes": hash}, "$set": bson.M{"two_factor.failed_attempts": 0}})
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount > 0, nil
+}
+
+// ReplaceRecoveryCodes swaps the account's recovery codes for new ones.
+func (m *AccManager) ReplaceRecoveryCodes(accountID primitive.ObjectID, recoveryHashes []string) error {
+	result, err := m.accounts.UpdateOne(context.TODO(),
+		bson.M{"_id": accountID, "two_factor.enabled_at": bson.M{"$ne": nil}},
+		bson.M{"$set": bson.M{"two_factor.recovery_codes": recoveryHashes, "updated_at": time.Now()}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrTwoFactorNotEnabled
+	}
+	return nil
+}
+
+// RecordTwoFactorFailure counts a wrong code and locks second factor checks
+// once there were too many in a row. It reports whether it locked them.
+func (m *AccManager) RecordTwoFactorFailure(accountID primitive.ObjectID) (bool, error) {
+	var account BankAccount
+	err := m.accounts.FindOneAndUpdate(context.TODO(),
+		bson.M{"_id": accountID},
+		bson.M{"$inc": bson.M{"two_factor.failed_attempts": 1}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&account)
+	if err != nil {
+		return false, err
+	}
+	if account.TwoFactor.FailedAttempts < MaxTwoFactorAttempts {
+		return false, nil
+	}
+
+	_, err = m.accounts.UpdateOne(context.TODO(),
+		bson.M{"_id": accountID},
+		bson.M{"$set": bson.M{"two_factor.locked_until": time.Now().Add(TwoFactorLockout), "two_factor.failed_attempts": 0}})
+	return err == nil, err
+}
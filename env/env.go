@@ -13,13 +13,23 @@ type Specification struct {
 	TwilioAuth      string
 	TwilioAccSid    string
 	OpenaiApiKey    string
-	JwtSecret       string
 	TwilioPhoneNum  string
 	MongoSecret     string
 	TwilioSecret    string
 	TwilioApiKey    string	
 	TwilioApiSecret string
 	AppWebhookUrl   string
+	KycStorageDir   string
+	BankCode        string
+	JwtKeyDir       string
+	JwtAlgorithm    string
+	JwtKeyRotation  string
+	StepUpTransferAmount string
+	ChatConfirmActions   string
+	ChatConfirmAmount    string
+	PasswordMinLength    string
+	PasswordBreachedList string
+	TrustedProxies       string
 }
 
 func New() *Specification {
@@ -29,13 +39,23 @@ func New() *Specification {
 		TwilioAuth:     getEnvVar("TWILIO_AUTH"),
 		TwilioAccSid:   getEnvVar("TWILIO_ACC_SID"),
 		OpenaiApiKey:   getEnvVar("OPENAI_API_KEY"),
-		JwtSecret:      getEnvVar("JWT_SECRET"),
 		TwilioPhoneNum: getEnvVar("TWILIO_PHONE_NUM"),
 		MongoSecret:    getEnvVar("MONGODB_URI"),
 		TwilioSecret:   getEnvVar("TWILIO_SECRET"),
 		TwilioApiKey:   getEnvVar("TWILIO_API_KEY"),
 		TwilioApiSecret: getEnvVar("TWILIO_API_SECRET"),
 		AppWebhookUrl:  getEnvVar("APP_WEBHOOK_URL"),
+		KycStorageDir:  getEnvVarOrDefault("KYC_STORAGE_DIR", "data/kyc"),
+		BankCode:       getEnvVarOrDefault("BANK_CODE", "GOBK"),
+		JwtKeyDir:      getEnvVarOrDefault("JWT_KEY_DIR", "data/jwt-keys"),
+		JwtAlgorithm:   getEnvVarOrDefault("JWT_ALGORITHM", "EdDSA"),
+		JwtKeyRotation: getEnvVarOrDefault("JWT_KEY_ROTATION", "720h"),
+		StepUpTransferAmount: getEnvVarOrDefault("STEP_UP_TRANSFER_AMOUNT", "1000"),
+		ChatConfirmActions:   getEnvVarOrDefault("CHAT_CONFIRM_ACTIONS", "transfer,pay_request,erasure"),
+		ChatConfirmAmount:    getEnvVarOrDefault("CHAT_CONFIRM_AMOUNT", "0"),
+		PasswordMinLength:    getEnvVarOrDefault("PASSWORD_MIN_LENGTH", "10"),
+		PasswordBreachedList: getEnvVarOrDefault("PASSWORD_BREACHED_LIST", "data/breached-passwords.txt"),
+		TrustedProxies:       getEnvVarOrDefault("TRUSTED_PROXIES", ""),
 	}
 	return &spec
 }
@@ -48,3 +68,11 @@ func getEnvVar(varName string) string {
 
 	return envVar
 }
+
+// getEnvVarOrDefault is getEnvVar for optional settings.
+func getEnvVarOrDefault(varName, defaultValue string) string {
+	if envVar := os.Getenv(varName); envVar != "" {
+		return envVar
+	}
+	return defaultValue
+}
@@ -0,0 +1,65 @@
+package utils
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Account numbers are IBAN-style: the country code, two mod-97 check digits,
+// a four character bank code and a ten digit serial, e.g. IL34GOBK0000000001.
+const AccountNumberCountry = "IL"
+
+var (
+	accountNumberRegexp = regexp.MustCompile(`^[A-Z]{2}[0-9]{2}[A-Z0-9]{4}[0-9]{10}$`)
+	bankCodeRegexp      = regexp.MustCompile(`^[A-Z0-9]{4}$`)
+)
+
+// ValidBankCode reports whether code can be used in account numbers.
+func ValidBankCode(code string) bool {
+	return bankCodeRegexp.MatchString(code)
+}
+
+// NewAccountNumber builds the account number for a serial.
+func NewAccountNumber(bankCode string, serial int64) string {
+	bban := fmt.Sprintf("%s%010d", bankCode, serial)
+	check := 98 - mod97(bban+AccountNumberCountry+"00")
+	return fmt.Sprintf("%s%02d%s", AccountNumberCountry, check, bban)
+}
+
+// NormalizeAccountNumber drops the spaces and dashes people type into
+// account numbers and upper-cases the rest.
+func NormalizeAccountNumber(number string) string {
+	number = strings.NewReplacer(" ", "", "-", "").Replace(number)
+	return strings.ToUpper(number)
+}
+
+// LooksLikeAccountNumber reports whether the (normalized) input has the shape
+// of an account number, whether or not its check digits are right.
+func LooksLikeAccountNumber(number string) bool {
+	return accountNumberRegexp.MatchString(NormalizeAccountNumber(number))
+}
+
+// ValidAccountNumber checks the shape and the check digits, which catches any
+// single mistyped character and most swapped pairs.
+func ValidAccountNumber(number string) bool {
+	number = NormalizeAccountNumber(number)
+	if !accountNumberRegexp.MatchString(number) {
+		return false
+	}
+	return mod97(number[4:]+number[:4]) == 1
+}
+
+// mod97 computes the ISO 7064 remainder, reading letters as 10 to 35.
+func mod97(s string) int {
+	remainder := 0
+	for _, r := range s {
+		switch {
+		case r >= '0' && r <= '9':
+			remainder = (remainder*10 + int(r-'0')) % 97
+		case r >= 'A' && r <= 'Z':
+			remainder = (remainder*100 + int(r-'A') + 10) % 97
+		}
+	}
+	return remainder
+}
@@ -0,0 +1,36 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"math/big"
+	"strings"
+)
+
+// RandomDigits returns a random numeric code of n digits, such as a one-time
+// code sent over WhatsApp.
+func RandomDigits(n int) (string, error) {
+	var sb strings.Builder
+	for i := 0; i < n; i++ {
+		digit, err := rand.Int(rand.Reader, big.NewInt(10))
+		if err != nil {
+			return "", err
+		}
+		sb.WriteByte(byte('0' + digit.Int64()))
+	}
+	return sb.String(), nil
+}
+
+// HashCode hashes a short-lived code for storage. Codes only live for
+// minutes and allow a few attempts, so a fast hash is enough.
+func HashCode(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// CheckCodeHash reports whether code matches a hash from HashCode.
+func CheckCodeHash(code, hash string) bool {
+	return hash != "" && subtle.ConstantTimeCompare([]byte(HashCode(code)), []byte(hash)) == 1
+}
@@ -6,56 +6,186 @@ import (
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
-	"github.com/tamir-liebermann/gobank/env"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
-func GenerateToken(username string, userId primitive.ObjectID) (string, error) {
-	spec := env.New()
+// Access tokens are short-lived; a session stays signed in by trading its
+// refresh token for a new pair before the access token runs out.
+const AccessTokenTTL = 15 * time.Minute
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"username": username,
-		"userId":   userId.Hex(),
-		"exp":      time.Now().Add(time.Hour * 72).Unix(),
-	})
+// TokenIssuer is the iss claim of gobank tokens, for services that verify
+// them against the published key set.
+const TokenIssuer = "gobank"
 
-	return token.SignedString([]byte(spec.JwtSecret))
+// AccessClaims are what an access token carries besides its expiry.
+type AccessClaims struct {
+	UserID    string
+	SessionID string
+	TokenID   string
+	ExpiresAt time.Time
 }
 
-func VerifyToken(token string) (string, error) {
-	spec := env.New()
+// TokenRevocationCheck reports an error when the token or its session was
+// revoked. The database layer registers it at startup, since utils can't
+// depend on it.
+type TokenRevocationCheck func(tokenID, sessionID string) error
 
-	parsedToken, err := jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
-		_, ok := token.Method.(*jwt.SigningMethodHMAC)
+var revocationCheck TokenRevocationCheck
+
+func SetTokenRevocationCheck(check TokenRevocationCheck) {
+	revocationCheck = check
+}
+
+// signToken signs claims with the current signing key, naming it in the kid
+// header.
+func signToken(claims jwt.MapClaims) (string, error) {
+	keys, err := Keys()
+	if err != nil {
+		return "", err
+	}
+	key, err := keys.Signer()
+	if err != nil {
+		return "", err
+	}
+
+	claims["iss"] = TokenIssuer
+	claims["iat"] = time.Now().Unix()
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(key.Algorithm), claims)
+	token.Header["kid"] = key.ID
+
+	return token.SignedString(key.PrivateKey)
+}
 
-		if !ok {
+// parseSignedToken checks a token's signature and expiry. The kid header
+// picks the verification key, so tokens signed before a rotation stay valid
+// until they expire.
+func parseSignedToken(token string) (jwt.MapClaims, error) {
+	keys, err := Keys()
+	if err != nil {
+		return nil, err
+	}
+
+	parsedToken, err := jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key := keys.Key(kid)
+		if key == nil {
+			return nil, errors.New("unknown signing key")
+		}
+		if token.Method.Alg() != key.Algorithm {
 			return nil, errors.New("unexpected sigining method")
 		}
-		return []byte(spec.JwtSecret), nil
-	})
+		return key.PublicKey, nil
+	}, jwt.WithValidMethods([]string{AlgorithmEdDSA, AlgorithmRS256}), jwt.WithIssuer(TokenIssuer))
 
 	if err != nil {
-		return "", errors.New("could not parse token")
+		return nil, errors.New("could not parse token")
 	}
 
 	tokenIsValid := parsedToken.Valid
 
 	if !tokenIsValid {
-		return "", errors.New("invalid token")
+		return nil, errors.New("invalid token")
 	}
 
 	claims, ok := parsedToken.Claims.(jwt.MapClaims)
 
 	if !ok {
-		return "", errors.New("invalid token claims")
+		return nil, errors.New("invalid token claims")
+	}
+	return claims, nil
+}
+
+// GenerateAccessToken signs an access token for a session. The token ID
+// (jti) is what logout puts on the denylist.
+func GenerateAccessToken(username string, userId primitive.ObjectID, sessionID string) (string, *AccessClaims, error) {
+	claims := &AccessClaims{
+		UserID:    userId.Hex(),
+		SessionID: sessionID,
+		TokenID:   primitive.NewObjectID().Hex(),
+		ExpiresAt: time.Now().Add(AccessTokenTTL),
 	}
+	signed, err := signToken(jwt.MapClaims{
+		"username": username,
+		"userId":   claims.UserID,
+		"sid":      claims.SessionID,
+		"jti":      claims.TokenID,
+		"exp":      claims.ExpiresAt.Unix(),
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return signed, claims, nil
+}
+
+// ParseAccessToken checks the signature, expiry and revocation of an access
+// token. Tokens from before sessions existed have no session and are refused,
+// and so are challenge tokens.
+func ParseAccessToken(token string) (*AccessClaims, error) {
+	claims, err := parseSignedToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := claims["purpose"]; ok {
+		return nil, errors.New("not an access token")
+	}
+
 	userIdHex, ok := claims["userId"].(string)
 	if !ok {
-		return "", errors.New("invalid user ID in token claims")
+		return nil, errors.New("invalid user ID in token claims")
+	}
+	sessionID, _ := claims["sid"].(string)
+	tokenID, _ := claims["jti"].(string)
+	if sessionID == "" || tokenID == "" {
+		return nil, errors.New("token has no session, please log in again")
+	}
+	expiresAt, err := claims.GetExpirationTime()
+	if err != nil || expiresAt == nil {
+		return nil, errors.New("invalid token expiry")
+	}
+
+	if revocationCheck != nil {
+		if err := revocationCheck(tokenID, sessionID); err != nil {
+			return nil, err
+		}
 	}
 
+	return &AccessClaims{UserID: userIdHex, SessionID: sessionID, TokenID: tokenID, ExpiresAt: expiresAt.Time}, nil
+}
+
+// GenerateChallengeToken signs a short-lived token that proves the first step
+// of a multi-step flow, such as a login waiting for its second factor. It is
+// only good for the purpose it was made for and can't be used as an access
+// token.
+func GenerateChallengeToken(userId primitive.ObjectID, purpose string, ttl time.Duration) (string, error) {
+	return signToken(jwt.MapClaims{
+		"purpose": purpose,
+		"userId":  userId.Hex(),
+		"exp":     time.Now().Add(ttl).Unix(),
+	})
+}
+
+// ParseChallengeToken returns the account a challenge token was made for.
+func ParseChallengeToken(token, purpose string) (string, error) {
+	claims, err := parseSignedToken(token)
+	if err != nil {
+		return "", err
+	}
+	if got, _ := claims["purpose"].(string); got != purpose {
+		return "", errors.New("invalid challenge")
+	}
+	userIdHex, ok := claims["userId"].(string)
+	if !ok {
+		return "", errors.New("invalid user ID in token claims")
+	}
 	return userIdHex, nil
+}
 
+func VerifyToken(token string) (string, error) {
+	claims, err := ParseAccessToken(token)
+	if err != nil {
+		return "", err
+	}
+	return claims.UserID, nil
 }
 
 func ExtractStringTokenFromHeader(header string) (string, error) {
@@ -0,0 +1,371 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tamir-liebermann/gobank/env"
+)
+
+// Token signing algorithms. New keys use the configured one; keys already in
+// the key directory keep the algorithm of their type.
+const (
+	AlgorithmEdDSA = "EdDSA"
+	AlgorithmRS256 = "RS256"
+)
+
+const rsaKeyBits = 2048
+
+// keyReloadInterval limits how often signing or an unknown key ID makes the
+// ring re-read the key directory, so a flood of forged kids can't turn into
+// disk reads.
+const keyReloadInterval = 10 * time.Second
+
+// SigningKey is a key from the key directory. Keys with only a public part
+// were put there to verify tokens signed elsewhere and never sign.
+type SigningKey struct {
+	ID         string
+	Algorithm  string
+	PrivateKey crypto.Signer
+	PublicKey  crypto.PublicKey
+	CreatedAt  time.Time
+}
+
+// KeyRing holds the token keys in a directory of PEM files named after their
+// key ID. The newest private key signs; every key verifies until it has been
+// out of use for longer than an access token lives, after which rotation
+// deletes it. The directory may be shared by several instances: they all sign
+// with the newest private key in it, so whichever one prunes may delete keys
+// another generated.
+type KeyRing struct {
+	mu         sync.RWMutex
+	dir        string
+	algorithm  string
+	rotation   time.Duration
+	keys       []*SigningKey
+	reloadedAt time.Time
+}
+
+// JWK is a public key in JSON Web Key form.
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+var (
+	keyRing     *KeyRing
+	keyRingErr  error
+	keyRingOnce sync.Once
+)
+
+// Keys returns the process's key ring, loading it from JWT_KEY_DIR on first
+// use and generating a key if there is none yet.
+func Keys() (*KeyRing, error) {
+	keyRingOnce.Do(func() {
+		spec := env.New()
+		rotation, err := time.ParseDuration(spec.JwtKeyRotation)
+		if err != nil || rotation <= AccessTokenTTL {
+			keyRingErr = fmt.Errorf("JWT_KEY_ROTATION %q must be a duration longer than %s", spec.JwtKeyRotation, AccessTokenTTL)
+			return
+		}
+		keyRing, keyRingErr = NewKeyRing(spec.JwtKeyDir, spec.JwtAlgorithm, rotation)
+	})
+	return keyRing, keyRingErr
+}
+
+func NewKeyRing(dir, algorithm string, rotation time.Duration) (*KeyRing, error) {
+	if algorithm != AlgorithmEdDSA && algorithm != AlgorithmRS256 {
+		return nil, fmt.Errorf("unsupported token signing algorithm %q, use %s or %s", algorithm, AlgorithmEdDSA, AlgorithmRS256)
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	ring := &KeyRing{dir: dir, algorithm: algorithm, rotation: rotation}
+	if _, err := ring.RotateIfDue(); err != nil {
+		return nil, err
+	}
+	return ring, nil
+}
+
+// Signer returns the key new tokens are signed with. The directory is read
+// again at most once every keyReloadInterval, so a newer key generated by
+// another instance sharing it is picked up before the older one is pruned.
+func (k *KeyRing) Signer() (*SigningKey, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if err := k.reloadIfDueLocked(); err != nil {
+		log.Printf("Error reloading token keys: %v", err)
+	}
+	if key := k.signerLocked(); key != nil {
+		return key, nil
+	}
+	return nil, errors.New("no token signing key")
+}
+
+// Key finds a verification key by its ID. An ID the ring doesn't know may be
+// a key another instance sharing the directory has just generated, so the
+// directory is read again, at most once every keyReloadInterval.
+func (k *KeyRing) Key(id string) *SigningKey {
+	k.mu.RLock()
+	key := k.keyLocked(id)
+	k.mu.RUnlock()
+	if key != nil {
+		return key
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if err := k.reloadIfDueLocked(); err != nil {
+		log.Printf("Error reloading token keys: %v", err)
+	}
+	return k.keyLocked(id)
+}
+
+func (k *KeyRing) keyLocked(id string) *SigningKey {
+	for _, key := range k.keys {
+		if key.ID == id {
+			return key
+		}
+	}
+	return nil
+}
+
+// reloadIfDueLocked re-reads the key directory unless it was read within the
+// last keyReloadInterval.
+func (k *KeyRing) reloadIfDueLocked() error {
+	if time.Since(k.reloadedAt) < keyReloadInterval {
+		return nil
+	}
+	return k.reloadLocked()
+}
+
+func (k *KeyRing) reloadLocked() error {
+	keys, err := loadKeys(k.dir)
+	if err != nil {
+		return err
+	}
+	k.keys = keys
+	k.reloadedAt = time.Now()
+	return nil
+}
+
+// RotateIfDue reloads the directory, which picks up keys added by hand or by
+// other instances sharing it, generates a new signing key once the current
+// one is older than the rotation period, and deletes keys nobody can hold a
+// valid token for anymore. It reports whether a key was generated.
+func (k *KeyRing) RotateIfDue() (bool, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if err := k.reloadLocked(); err != nil {
+		return false, err
+	}
+
+	rotated := false
+	if signer := k.signerLocked(); signer == nil || time.Since(signer.CreatedAt) >= k.rotation {
+		key, err := k.generateLocked()
+		if err != nil {
+			return false, err
+		}
+		k.keys = append([]*SigningKey{key}, k.keys...)
+		rotated = true
+	}
+
+	return rotated, k.pruneLocked()
+}
+
+func (k *KeyRing) signerLocked() *SigningKey {
+	for _, key := range k.keys {
+		if key.PrivateKey != nil {
+			return key
+		}
+	}
+	return nil
+}
+
+func (k *KeyRing) generateLocked() (*SigningKey, error) {
+	var signer crypto.Signer
+	switch k.algorithm {
+	case AlgorithmEdDSA:
+		_, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		signer = private
+	default:
+		private, err := rsa.GenerateKey(rand.Reader, rsaKeyBits)
+		if err != nil {
+			return nil, err
+		}
+		signer = private
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(signer)
+	if err != nil {
+		return nil, err
+	}
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	id := now.Format("20060102T150405Z") + "-" + hex.EncodeToString(suffix)
+
+	block := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(filepath.Join(k.dir, id+".pem"), block, 0o600); err != nil {
+		return nil, err
+	}
+	return &SigningKey{ID: id, Algorithm: k.algorithm, PrivateKey: signer, PublicKey: signer.Public(), CreatedAt: now}, nil
+}
+
+// pruneLocked deletes private keys that were replaced by a newer one longer
+// ago than an access token lives, plus the time every instance sharing the
+// directory takes to start signing with the newer key. It doesn't matter
+// which instance generated them, so keys survive no restart. Public keys are
+// left for whoever put them there to remove.
+func (k *KeyRing) pruneLocked() error {
+	kept := k.keys[:0]
+	var replacedAt time.Time
+	for _, key := range k.keys {
+		if key.PrivateKey == nil {
+			kept = append(kept, key)
+			continue
+		}
+		if !replacedAt.IsZero() && time.Since(replacedAt) > AccessTokenTTL+keyReloadInterval+time.Minute {
+			if err := os.Remove(filepath.Join(k.dir, key.ID+".pem")); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+			continue
+		}
+		kept = append(kept, key)
+		replacedAt = key.CreatedAt
+	}
+	k.keys = kept
+	return nil
+}
+
+// loadKeys reads every .pem file in dir, newest first. A key's ID is its file
+// name and its age the file's modification time.
+func loadKeys(dir string) ([]*SigningKey, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []*SigningKey{}
+	for _, path := range paths {
+		key, err := loadKey(path)
+		if err != nil {
+			return nil, fmt.Errorf("loading token key %s: %w", path, err)
+		}
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].CreatedAt.Equal(keys[j].CreatedAt) {
+			return keys[i].ID > keys[j].ID
+		}
+		return keys[i].CreatedAt.After(keys[j].CreatedAt)
+	})
+	return keys, nil
+}
+
+func loadKey(path string) (*SigningKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("not a PEM file")
+	}
+
+	key := &SigningKey{ID: strings.TrimSuffix(filepath.Base(path), ".pem"), CreatedAt: info.ModTime()}
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := parsed.(crypto.Signer)
+		if !ok {
+			return nil, errors.New("unsupported private key")
+		}
+		key.PrivateKey = signer
+		key.PublicKey = signer.Public()
+	case "PUBLIC KEY":
+		if key.PublicKey, err = x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+
+	switch key.PublicKey.(type) {
+	case ed25519.PublicKey:
+		key.Algorithm = AlgorithmEdDSA
+	case *rsa.PublicKey:
+		key.Algorithm = AlgorithmRS256
+	default:
+		return nil, errors.New("only Ed25519 and RSA keys are supported")
+	}
+	return key, nil
+}
+
+// JWKS returns every verification key for publishing, including keys other
+// instances sharing the directory added since the last rotation check.
+func (k *KeyRing) JWKS() JWKSet {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if err := k.reloadIfDueLocked(); err != nil {
+		log.Printf("Error reloading token keys: %v", err)
+	}
+
+	set := JWKSet{Keys: []JWK{}}
+	for _, key := range k.keys {
+		jwk := JWK{KeyID: key.ID, Algorithm: key.Algorithm, Use: "sig"}
+		switch public := key.PublicKey.(type) {
+		case ed25519.PublicKey:
+			jwk.KeyType = "OKP"
+			jwk.Curve = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public)
+		case *rsa.PublicKey:
+			jwk.KeyType = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set
+}
@@ -0,0 +1,67 @@
+package utils
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// maxPasswordBytes is where bcrypt stops reading a password.
+const maxPasswordBytes = 72
+
+var ErrWeakPassword = errors.New("password is too weak")
+
+// PasswordPolicy is what new passwords must meet: a minimum length, and not
+// being on a list of passwords known from breaches.
+type PasswordPolicy struct {
+	MinLength int
+	breached  map[string]bool
+}
+
+// NewPasswordPolicy loads the breached password list, one password per line,
+// from breachedFile. An empty path means no list.
+func NewPasswordPolicy(minLength int, breachedFile string) (*PasswordPolicy, error) {
+	policy := &PasswordPolicy{MinLength: minLength, breached: map[string]bool{}}
+	if breachedFile == "" {
+		return policy, nil
+	}
+
+	f, err := os.Open(breachedFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if password := strings.TrimSpace(scanner.Text()); password != "" {
+			policy.breached[strings.ToLower(password)] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// BreachedCount is the number of passwords on the breached list.
+func (p *PasswordPolicy) BreachedCount() int {
+	return len(p.breached)
+}
+
+// Check returns an error wrapping ErrWeakPassword that says what is wrong
+// with password. The breached list is matched ignoring case.
+func (p *PasswordPolicy) Check(password string) error {
+	if len([]rune(password)) < p.MinLength {
+		return fmt.Errorf("%w: use at least %d characters", ErrWeakPassword, p.MinLength)
+	}
+	if len(password) > maxPasswordBytes {
+		return fmt.Errorf("%w: it is longer than %d bytes, use a shorter one", ErrWeakPassword, maxPasswordBytes)
+	}
+	if p.breached[strings.ToLower(password)] {
+		return fmt.Errorf("%w: it appears in a list of leaked passwords, pick another", ErrWeakPassword)
+	}
+	return nil
+}
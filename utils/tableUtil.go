@@ -45,6 +45,25 @@ func getSelectedRow(record map[string]interface{}, myAccountId string) ([]string
 		toAccount = "your account"
 		amount = fmt.Sprintf("%v", record["amount"])
 	}
+
+	// Moves between the main balance and a savings pocket
+	switch record["type"] {
+	case "pocket_in":
+		toAccount = "pocket"
+		amount = fmt.Sprintf("-%v", record["amount"])
+	case "pocket_out":
+		fromAccount = "pocket"
+	case "deposit":
+		fromAccount = "deposit"
+	case "fee":
+		toAccount = fmt.Sprintf("%v fee", record["category"])
+	case "adjustment":
+		if toAccount == "your account" {
+			fromAccount = "adjustment"
+		} else {
+			toAccount = "adjustment"
+		}
+	}
 	
 
 	return []string{fromAccount,amount,toAccount, timeAgoStr}, nil
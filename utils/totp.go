@@ -0,0 +1,93 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base32"
+	"strings"
+	"time"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	"github.com/skip2/go-qrcode"
+)
+
+// TOTPIssuer is the name authenticator apps show next to the code.
+const TOTPIssuer = "gobank"
+
+const (
+	totpPeriod        = 30
+	recoveryCodeCount = 10
+	qrCodeSize        = 256
+)
+
+var totpOpts = totp.ValidateOpts{Period: totpPeriod, Digits: otp.DigitsSix, Algorithm: otp.AlgorithmSHA1}
+
+// TOTPEnrollment is a new authenticator secret and the ways to hand it to an
+// authenticator app.
+type TOTPEnrollment struct {
+	Secret    string
+	URI       string
+	QRCodePNG []byte
+}
+
+// NewTOTPEnrollment generates a secret for accountName.
+func NewTOTPEnrollment(accountName string) (*TOTPEnrollment, error) {
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      TOTPIssuer,
+		AccountName: accountName,
+		Period:      totpPeriod,
+		Digits:      otp.DigitsSix,
+		Algorithm:   otp.AlgorithmSHA1,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	png, err := qrcode.Encode(key.URL(), qrcode.Medium, qrCodeSize)
+	if err != nil {
+		return nil, err
+	}
+	return &TOTPEnrollment{Secret: key.Secret(), URI: key.URL(), QRCodePNG: png}, nil
+}
+
+// MatchTOTP checks code against the secret, allowing one period of clock
+// drift either way. It returns the time step the code belongs to, so callers
+// can refuse a code that was already used.
+func MatchTOTP(secret, code string, now time.Time) (int64, bool) {
+	for _, skew := range []int64{0, -1, 1} {
+		at := now.Add(time.Duration(skew*totpPeriod) * time.Second)
+		expected, err := totp.GenerateCodeCustom(secret, at, totpOpts)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return at.Unix() / totpPeriod, true
+		}
+	}
+	return 0, false
+}
+
+// NewRecoveryCodes returns single-use codes to sign in with when the
+// authenticator is lost, and the hashes to store.
+func NewRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+		code = code[:4] + "-" + code[4:]
+		codes = append(codes, code)
+		hashes = append(hashes, HashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// HashRecoveryCode hashes a recovery code the way it is stored, ignoring case,
+// spaces and dashes.
+func HashRecoveryCode(code string) string {
+	return HashCode(strings.NewReplacer("-", "", " ", "").Replace(strings.ToLower(code)))
+}